@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,6 +20,51 @@ import (
 )
 
 var configfile = flag.String("config", "doproxy.toml", "Use this config file")
+var weight = flag.Int("weight", 0, "Weight of droplets added with 'add' or 'create'")
+var pool = flag.String("pool", "", "Create droplets with the parameters of this [do-provisioner.pools] entry")
+var region = flag.String("region", "", "Only show droplets in this region with 'list', for example 'nyc3'")
+var status = flag.String("status", "", "Only show droplets with this status with 'list', for example 'active'")
+var force = flag.Bool("force", false, "Destroy droplets with 'destroy', even if connections to them cannot be drained")
+
+var tags, labels listFlag
+
+func init() {
+	flag.Var(&tags, "tag", "Tag droplets added with 'add' or 'create'. Can be repeated")
+	flag.Var(&labels, "label", "Label droplets added with 'add' or 'create' as 'key=value'. Can be repeated")
+}
+
+// listFlag is a flag that can be given several times.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// dropletOptions returns the droplet options given as flags.
+func dropletOptions() server.DropletOptions {
+	l, err := server.ParseLabels(labels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *weight < 0 {
+		log.Fatal("-weight cannot be negative")
+	}
+	return server.DropletOptions{Weight: *weight, Tags: tags, Labels: l}
+}
+
+// readInventory reads the configured inventory.
+// Saving it keeps the configured number of snapshots.
+func readInventory(conf *server.Config) (*server.Inventory, error) {
+	inv, err := server.ReadInventory(conf.InventoryFile, conf.Backend)
+	if err != nil {
+		return nil, err
+	}
+	inv.SetSnapshots(conf.InventorySnapshots)
+	return inv, nil
+}
 
 func main() {
 	//
@@ -25,20 +75,36 @@ func main() {
 		fmt.Println("Commands: (if none is given the doproxy server is started)")
 		fmt.Println(`  add <id>`)
 		fmt.Println(`      Add a running droplet to your inventory.`)
+		fmt.Println(`      Use -weight, -tag and -label to set them on the droplet.`)
 		fmt.Println(`  create [new-droplet-name]`)
 		fmt.Println(`      Create a new backend and add it as a backend to the configuration.`)
 		fmt.Println(`      If no name is given a name is generated.`)
+		fmt.Println(`      Use -weight, -tag and -label to set them on the droplet.`)
 		fmt.Println(`  delete <id>`)
 		fmt.Println(`      Delete a backend with the given id.`)
 		fmt.Println(`  destroy <id>`)
 		fmt.Println(`      Destroy a running droplet with the given id.`)
+		fmt.Println(`      If connections to it cannot be drained, it is not destroyed unless -force is given.`)
+		fmt.Println(`  import-tag <tag>`)
+		fmt.Println(`      Add all running droplets with the given tag to your inventory.`)
 		fmt.Println(`  list`)
 		fmt.Println(`      List all currently running droplets.`)
+		fmt.Println(`      Use -region and -status to only list matching droplets.`)
+		fmt.Println(`  replay <file>`)
+		fmt.Println(`      Send the requests recorded in the file to the backends in the inventory.`)
+		fmt.Println(`      Request bodies are not recorded, so requests are sent without a body.`)
 		fmt.Println(`  reboot <id>`)
 		fmt.Println(`      Reboot the backend with the given id.`)
 		fmt.Println(`  sanitize [apply]`)
 		fmt.Println(`      Sanitize the inventory. All droplets that cannot be located on`)
 		fmt.Println(`      DigitalOcean will be listed, or removed if 'apply' is specified.`)
+		fmt.Println(`  sort-inventory [id|name|started]`)
+		fmt.Println(`      Save the inventory sorted by the given key. Default is 'id'.`)
+		fmt.Println(`      Round-robin uses the saved order. Other commands sort by id again.`)
+		fmt.Println(`  stats`)
+		fmt.Println(`      Show statistics of the backends in the running server.`)
+		fmt.Println(`  watch`)
+		fmt.Println(`      Stream backend health changes from the running server.`)
 	}
 	flag.Parse()
 	shutdown.Logger = log.New(os.Stdout, "", log.LstdFlags)
@@ -66,12 +132,18 @@ func main() {
 		if len(args) >= 2 {
 			name = args[1]
 		}
-		drop, err := server.CreateDroplet(*conf, name)
+		opts := dropletOptions()
+		spec, err := conf.DO.Spec(*pool)
+		if err != nil {
+			log.Fatal(err)
+		}
+		drop, err := server.CreateDropletSpec(*conf, name, spec)
 		if err != nil {
 			log.Fatal("Error creating droplet:", err)
 		}
+		drop.SetOptions(opts)
 		log.Println("Adding droplet to inventory")
-		inv, err := server.ReadInventory(conf.InventoryFile, conf.Backend)
+		inv, err := readInventory(conf)
 		if err != nil {
 			log.Fatal("Error loading inventory:", err)
 		}
@@ -86,13 +158,19 @@ func main() {
 		}
 		log.Println("New inventory saved.")
 	case "list":
-		drops, err := server.ListDroplets(*conf)
+		drops, err := server.ListDropletsFilter(*conf, server.DropletFilter{Region: *region, Status: *status})
 		if err != nil {
 			log.Fatal("Error listing droplets:", err)
 		}
 		fmt.Printf("%d Currently Running:\n", len(drops.Droplets))
 		for _, drop := range drops.Droplets {
 			fmt.Println("\n[[droplet]]\n" + drop.String())
+			if drop.PrivateIP == "" {
+				fmt.Println("# Warning: No private IP address. Cannot be used as backend.")
+			}
+		}
+		if n := len(drops.NoPrivateIP()); n > 0 {
+			fmt.Printf("\n%d droplet(s) have no private IP address. Enable private networking or a VPC to use them as backends.\n", n)
 		}
 	case "add":
 		if len(args) < 2 {
@@ -103,8 +181,9 @@ func main() {
 		if err != nil {
 			log.Fatalf("%q is not a valid ID. It must be a number ", sid)
 		}
+		opts := dropletOptions()
 
-		inv, err := server.ReadInventory(conf.InventoryFile, conf.Backend)
+		inv, err := readInventory(conf)
 		if err != nil {
 			log.Fatal("Error loading inventory:", err)
 		}
@@ -120,9 +199,13 @@ func main() {
 		if !ok {
 			log.Fatal("Unable to locate a running droplet with ID ", sid)
 		}
+		if drop.PrivateIP == "" {
+			log.Fatalf("Droplet %d has no private IP address. Enable private networking or a VPC on the droplet.", id)
+		}
+		drop.SetOptions(opts)
 		be, err := drop.ToBackend(conf.Backend)
 		if err != nil {
-			log.Fatal("Error listing droplets:", err)
+			log.Fatal("Error converting droplet to backend:", err)
 		}
 		err = inv.AddBackend(be)
 		if err != nil {
@@ -133,13 +216,36 @@ func main() {
 			log.Fatal("Error saving inventory:", err)
 		}
 		log.Printf("Backend %q added to inventory", sid)
+	case "import-tag":
+		if len(args) < 2 {
+			log.Fatal("import-tag: No tag supplied")
+		}
+		tag := args[1]
+
+		inv, err := readInventory(conf)
+		if err != nil {
+			log.Fatal("Error loading inventory:", err)
+		}
+		drops, err := server.ListDropletsByTag(*conf, tag)
+		if err != nil {
+			log.Fatal("Error listing droplets:", err)
+		}
+		n, err := inv.ImportDroplets(drops.Droplets, conf.Backend)
+		if err != nil {
+			log.Fatal("Error adding backends:", err)
+		}
+		err = inv.SaveDroplets(conf.InventoryFile)
+		if err != nil {
+			log.Fatal("Error saving inventory:", err)
+		}
+		log.Printf("%d of %d droplets with tag %q added to inventory", n, len(drops.Droplets), tag)
 	case "sanitize":
 		apply := false
 		if len(args) >= 2 {
 			apply = args[1] == "apply"
 		}
 
-		inv, err := server.ReadInventory(conf.InventoryFile, conf.Backend)
+		inv, err := readInventory(conf)
 		if err != nil {
 			log.Fatal("Error loading inventory:", err)
 		}
@@ -148,15 +254,18 @@ func main() {
 			log.Fatal("Error listing droplets:", err)
 		}
 		ids := inv.IDs()
-		var remove []string
+		var remove, noip []string
 		for _, id := range ids {
 			n, err := strconv.Atoi(id)
 			if err != nil {
 				log.Println("warning: unable to parse id", id)
 				continue
 			}
-			_, ok := drops.DropletID(n)
+			drop, ok := drops.DropletID(n)
 			if ok {
+				if drop.PrivateIP == "" {
+					noip = append(noip, id)
+				}
 				continue
 			}
 			be, ok := inv.BackendID(id)
@@ -202,6 +311,31 @@ func main() {
 				fmt.Println("ID", be)
 			}
 		}
+		// Droplets that lost their private IP are running, so they are not removed.
+		if len(noip) > 0 {
+			fmt.Println(len(noip), "inventory backends are running without a private IP address:")
+			for _, be := range noip {
+				fmt.Println("ID", be)
+			}
+		}
+	case "sort-inventory":
+		key := "id"
+		if len(args) >= 2 {
+			key = args[1]
+		}
+		inv, err := readInventory(conf)
+		if err != nil {
+			log.Fatal("Error loading inventory:", err)
+		}
+		err = inv.SortBy(key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = inv.SaveDroplets(conf.InventoryFile)
+		if err != nil {
+			log.Fatal("Error saving inventory:", err)
+		}
+		log.Printf("Inventory sorted by %s", key)
 	case "reboot":
 		if len(args) < 2 {
 			log.Fatal("No id supplied")
@@ -212,7 +346,7 @@ func main() {
 			log.Fatalf("warning: unable to parse id %q", name)
 		}
 
-		inv, err := server.ReadInventory(conf.InventoryFile, conf.Backend)
+		inv, err := readInventory(conf)
 		if err != nil {
 			log.Fatal("Error loading inventory:", err)
 		}
@@ -247,7 +381,14 @@ func main() {
 		}
 		// Re-add Backend
 		if hasBe {
-			time.Sleep(time.Second * 5)
+			timeout := time.Duration(conf.Backend.RebootTimeout)
+			if timeout == 0 {
+				timeout = 5 * time.Minute
+			}
+			log.Println("Waiting up to", timeout, "for backend to become healthy")
+			if err := server.WaitHealthy(be, timeout); err != nil {
+				log.Fatalf("Backend NOT re-added: %v. Use '%s add %s' to add it manually.", err, os.Args[0], name)
+			}
 			if err := inv.AddBackend(be); err != nil {
 				log.Fatal("Error re-adding backend to inventory:", err)
 			}
@@ -256,13 +397,41 @@ func main() {
 			}
 			log.Println("Re-added backend to inventory")
 		}
+	case "replay":
+		if len(args) < 2 {
+			log.Fatal("No file supplied")
+		}
+		// Health checks are not running, so send to all backends.
+		bec := conf.Backend
+		bec.AssumeHealthy = true
+		inv, err := server.ReadInventory(conf.InventoryFile, bec)
+		if err != nil {
+			log.Fatal("Error loading inventory:", err)
+		}
+		lb, err := server.NewLoadBalancer(conf.LoadBalancing, inv)
+		if err != nil {
+			log.Fatal("Error creating load balancer:", err)
+		}
+		st, err := server.Replay(args[1], lb)
+		if st != nil {
+			log.Printf("Replayed %d requests, %d failed, %d sent without their body.", st.Requests, st.Errors, st.NoBody)
+			for code, n := range st.Status {
+				log.Printf("Status %d: %d responses", code, n)
+			}
+			for host, n := range st.Backends {
+				log.Printf("Backend %s: %d requests", host, n)
+			}
+		}
+		if err != nil {
+			log.Fatal("Error replaying requests:", err)
+		}
 	case "delete":
 		if len(args) < 2 {
 			log.Fatal("No id supplied")
 		}
 		name := args[1]
 
-		inv, err := server.ReadInventory(conf.InventoryFile, conf.Backend)
+		inv, err := readInventory(conf)
 		if err != nil {
 			log.Fatal("Error loading inventory:", err)
 		}
@@ -300,7 +469,7 @@ func main() {
 			log.Fatalln("Cannot find any running droplet droplet with id", n)
 		}
 
-		inv, err := server.ReadInventory(conf.InventoryFile, conf.Backend)
+		inv, err := readInventory(conf)
 		if err != nil {
 			log.Fatal("Error loading inventory:", err)
 		}
@@ -319,7 +488,13 @@ func main() {
 			}
 			log.Printf("Backend %s deleted from inventory", name)
 
-			time.Sleep(time.Second * 5)
+			err = drain(conf, name)
+			if err != nil {
+				if !*force {
+					log.Fatalln("Backend not drained:", err, "- droplet NOT destroyed. Use -force to destroy it anyway.")
+				}
+				log.Println("Backend not drained:", err)
+			}
 		}
 		err = drop.Delete(*conf)
 		if err != nil {
@@ -328,6 +503,43 @@ func main() {
 
 		log.Printf("Droplet %d %q destroyed", drop.ID, drop.Name)
 
+	case "stats":
+		url, tr := adminURL(*conf, "/_doproxy/stats")
+		st, err := server.FetchStatus(url, conf.AdminToken, tr)
+		if err != nil {
+			log.Fatal("Error fetching stats:", err)
+		}
+		err = st.WriteTable(os.Stdout)
+		if err != nil {
+			log.Fatal("Error writing stats:", err)
+		}
+	case "watch":
+		url, tr := adminURL(*conf, "/_doproxy/events")
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			log.Fatal("Error creating request:", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+conf.AdminToken)
+		resp, err := (&http.Client{Transport: tr}).Do(req)
+		if err != nil {
+			log.Fatal("Error connecting to server:", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Fatal("Unexpected response from server:", resp.Status)
+		}
+		log.Println("Watching", url)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "data: ") {
+				fmt.Println(strings.TrimPrefix(line, "data: "))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatal("Error reading events:", err)
+		}
+
 	case "help":
 		flag.Usage()
 	default:
@@ -336,3 +548,69 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// drain waits for the connections of the running server
+// to the backend with the ID to finish, up to 'drain-timeout'.
+// An error is returned if the server cannot be asked.
+func drain(conf *server.Config, id string) error {
+	if conf.AdminToken == "" {
+		return fmt.Errorf("'admin-token' is not set, so connections to the backend cannot be checked")
+	}
+	// Give the server time to reload the inventory.
+	time.Sleep(time.Second * 5)
+
+	timeout := time.Duration(conf.Backend.DrainTimeout)
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	log.Println("Waiting up to", timeout, "for connections to backend to finish")
+	url, tr := adminURL(*conf, "/_doproxy/stats")
+	return server.WaitDrained(url, conf.AdminToken, id, timeout, tr)
+}
+
+// adminURL returns the URL of an admin endpoint
+// on the server running with the supplied configuration,
+// and the transport used to connect to it.
+// The first TCP listener that isn't redirecting is used.
+// If the server only listens on Unix sockets, the transport
+// connects to the first one. Otherwise the transport is nil.
+func adminURL(conf server.Config, path string) (string, http.RoundTripper) {
+	var socks []server.ListenerConfig
+	for _, l := range conf.Listeners() {
+		if l.RedirectHTTPS {
+			continue
+		}
+		if strings.HasPrefix(l.Bind, "unix:") {
+			socks = append(socks, l)
+			continue
+		}
+		host, port, err := net.SplitHostPort(l.Bind)
+		if err != nil {
+			log.Fatal("Unable to parse 'bind' address:", err)
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		return fmt.Sprintf("%s://%s%s", listenerScheme(l), net.JoinHostPort(host, port), path), nil
+	}
+	if len(socks) == 0 {
+		log.Fatal("No listener found to reach the server. Configure a 'listener' that isn't redirecting to https.")
+	}
+	sock := socks[0]
+	file := strings.TrimPrefix(sock.Bind, "unix:")
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", file)
+		},
+	}
+	return fmt.Sprintf("%s://localhost%s", listenerScheme(sock), path), tr
+}
+
+// listenerScheme returns the URL scheme of the listener.
+func listenerScheme(l server.ListenerConfig) string {
+	if l.Https {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/naoina/toml"
+)
+
+// redacted replaces secrets in configurations that are shown.
+const redacted = "REDACTED"
+
+// adminAuthorized returns true if the request has the admin token
+// as a bearer token. If no token is configured, false is returned.
+func (s *Server) adminAuthorized(r *http.Request) bool {
+	s.mu.RLock()
+	token := s.Config.AdminToken
+	s.mu.RUnlock()
+	if token == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// requireAdmin returns a handler that only calls h
+// if the request has the admin token.
+func (s *Server) requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.adminAuthorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ServeReloadConfig will read the configuration file again and apply it.
+// The request must be a POST with the admin token.
+func (s *Server) ServeReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.adminAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	err := s.ReadConfig(s.configFile, false)
+	if err != nil {
+		s.log.Errorf("Reloading configuration: %v. New configuration NOT applied", err)
+		http.Error(w, fmt.Sprintf("Configuration not applied: %v", err), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "Configuration reloaded")
+}
+
+// Redacted returns a copy of the configuration with
+// tokens and password hashes replaced by "REDACTED".
+func (c Config) Redacted() Config {
+	if c.DO.Token != "" {
+		c.DO.Token = redacted
+	}
+	if c.AdminToken != "" {
+		c.AdminToken = redacted
+	}
+	if len(c.BasicAuth.Users) > 0 {
+		users := make([]string, len(c.BasicAuth.Users))
+		for i, u := range c.BasicAuth.Users {
+			if n := strings.IndexByte(u, ':'); n >= 0 {
+				u = u[:n+1] + redacted
+			}
+			users[i] = u
+		}
+		c.BasicAuth.Users = users
+	}
+	return c
+}
+
+// effectiveConfig returns the current configuration as TOML,
+// including defaults, with secrets redacted.
+func (s *Server) effectiveConfig() ([]byte, error) {
+	s.mu.RLock()
+	conf := s.Config
+	s.mu.RUnlock()
+	return toml.Marshal(conf.Redacted())
+}
+
+// ServeConfig will return the current configuration as TOML,
+// with secrets redacted. The request must have the admin token.
+func (s *Server) ServeConfig(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	b, err := s.effectiveConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/toml")
+	w.Write(b)
+}
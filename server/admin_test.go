@@ -0,0 +1,206 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/naoina/toml"
+)
+
+// Test that the configuration can be reloaded through the admin endpoint.
+func TestServeReloadConfig(t *testing.T) {
+	orig, err := ioutil.ReadFile("testdata/validconfig.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "doproxy-test-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "doproxy.toml")
+	write := func(conf string) {
+		if err := ioutil.WriteFile(file, []byte(conf), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Keys must be before the first table.
+	conf := strings.Replace(string(orig), "watch-config = false", "watch-config = false\nadmin-token = \"secret\"", 1)
+	write(conf)
+
+	s, err := NewServer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(s.ServeReloadConfig))
+	defer ts.Close()
+
+	reload := func(method, token string) int {
+		req, err := http.NewRequest(method, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	addForwarded := func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.Config.AddForwarded
+	}
+
+	write(strings.Replace(conf, "add-x-forwarded-for = true", "add-x-forwarded-for = false", 1))
+	if code := reload("GET", "secret"); code != http.StatusMethodNotAllowed {
+		t.Error("expected GET to be rejected, got", code)
+	}
+	if code := reload("POST", ""); code != http.StatusUnauthorized {
+		t.Error("expected missing token to be rejected, got", code)
+	}
+	if code := reload("POST", "wrong"); code != http.StatusUnauthorized {
+		t.Error("expected wrong token to be rejected, got", code)
+	}
+	if !addForwarded() {
+		t.Fatal("configuration was applied without a valid token")
+	}
+	if code := reload("POST", "secret"); code != http.StatusOK {
+		t.Fatal("expected reload to succeed, got", code)
+	}
+	if addForwarded() {
+		t.Fatal("new configuration was not applied")
+	}
+
+	// Changes UpdateConfig refuses are reported and not applied.
+	write(strings.Replace(conf, "watch-config = false", "watch-config = true", 1))
+	if code := reload("POST", "secret"); code != http.StatusBadRequest {
+		t.Fatal("expected reload to fail, got", code)
+	}
+	s.mu.RLock()
+	watch := s.Config.WatchConfig
+	s.mu.RUnlock()
+	if watch {
+		t.Fatal("refused configuration was applied")
+	}
+
+	// Without a token the endpoint is disabled.
+	s.mu.Lock()
+	s.Config.AdminToken = ""
+	s.mu.Unlock()
+	if code := reload("POST", ""); code != http.StatusUnauthorized {
+		t.Fatal("expected endpoint to be disabled, got", code)
+	}
+}
+
+// Test that the effective configuration is returned with secrets redacted.
+func TestServeConfig(t *testing.T) {
+	s, err := NewServer("testdata/validconfig.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Config.AdminToken = "secret"
+	s.Config.BasicAuth.Users = []string{"user:0123abcd"}
+	ts := httptest.NewServer(http.HandlerFunc(s.ServeConfig))
+	defer ts.Close()
+
+	get := func(token string) (int, []byte) {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, b
+	}
+	if code, _ := get("wrong"); code != http.StatusUnauthorized {
+		t.Fatal("expected 401 with wrong token, got", code)
+	}
+	code, b := get("secret")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", code, b)
+	}
+	for _, secret := range []string{valid_config.DO.Token, "0123abcd", `"secret"`} {
+		if strings.Contains(string(b), secret) {
+			t.Fatalf("secret %q returned in\n%s", secret, b)
+		}
+	}
+	var got Config
+	if err := toml.Unmarshal(b, &got); err != nil {
+		t.Fatalf("returned configuration cannot be parsed: %v\n%s", err, b)
+	}
+	if got.DO.Token != "REDACTED" || got.AdminToken != "REDACTED" || got.BasicAuth.Users[0] != "user:REDACTED" {
+		t.Fatalf("secrets not redacted: %q %q %v", got.DO.Token, got.AdminToken, got.BasicAuth.Users)
+	}
+	// Defaults and other values are returned.
+	if !got.DO.PrivateNetworking || got.DO.Region != valid_config.DO.Region || got.Backend.DialTimeout != valid_config.Backend.DialTimeout {
+		t.Fatalf("unexpected configuration returned:\n%s", b)
+	}
+	// The server configuration is not modified.
+	if s.Config.DO.Token != valid_config.DO.Token || s.Config.BasicAuth.Users[0] != "user:0123abcd" {
+		t.Fatal("server configuration was modified")
+	}
+}
+
+// Test that the stats and events endpoints require the admin token.
+func TestServeStatsAuth(t *testing.T) {
+	s, err := NewServer("testdata/validconfig.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLoadBalancer(LBConfig{Type: "roundrobin"}, newMockInventory(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.handler = NewReverseProxyConfig(s.Config, lb)
+	ts := httptest.NewServer(s.mux())
+	defer ts.Close()
+	url := ts.URL + "/_doproxy/stats"
+
+	// No admin token disables the endpoint.
+	if _, err := FetchStatus(url, "", nil); err == nil {
+		t.Fatal("expected stats to be disabled without admin token")
+	}
+	s.mu.Lock()
+	s.Config.AdminToken = "secret"
+	s.mu.Unlock()
+	if _, err := FetchStatus(url, "wrong", nil); err == nil {
+		t.Fatal("expected stats to be rejected with wrong token")
+	}
+	st, err := FetchStatus(url, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Backends) != 2 {
+		t.Fatalf("expected 2 backends, got %+v", st.Backends)
+	}
+
+	// Events also require the token.
+	res, err := http.Get(ts.URL + "/_doproxy/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatal("expected events to require admin token, got", res.Status)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuthConfig contains settings for requiring
+// HTTP basic authentication at the proxy.
+type BasicAuthConfig struct {
+	Enable bool     `toml:"enable"`
+	Realm  string   `toml:"realm"` // Realm sent to clients.
+	Users  []string `toml:"users"` // "user:hash" pairs, where hash is a bcrypt hash or the hex encoded SHA-256 hash of the password.
+}
+
+// Validate basic auth configuration.
+func (c BasicAuthConfig) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if len(c.Users) == 0 {
+		return fmt.Errorf("basic-auth: 'users' must contain at least one user")
+	}
+	for _, u := range c.Users {
+		name, hash, err := splitUser(u)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			return fmt.Errorf("basic-auth: user name of %q cannot be empty", u)
+		}
+		if isBcrypt(hash) {
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return fmt.Errorf("basic-auth: password of %q is not a valid bcrypt hash: %v", name, err)
+			}
+			continue
+		}
+		if sum, err := hex.DecodeString(hash); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("basic-auth: password of %q must be a bcrypt hash or a hex encoded SHA-256 hash", name)
+		}
+	}
+	return nil
+}
+
+// splitUser splits a "user:hash" pair.
+func splitUser(u string) (name, hash string, err error) {
+	i := strings.LastIndex(u, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("basic-auth: user %q must be in the form \"user:hash\"", u)
+	}
+	return u[:i], u[i+1:], nil
+}
+
+// isBcrypt returns true if the hash is a bcrypt hash.
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// authorized returns true if the request has valid credentials.
+func (c BasicAuthConfig) authorized(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(pass))
+	for _, u := range c.Users {
+		name, hash, err := splitUser(u)
+		if err != nil || name != user {
+			continue
+		}
+		if isBcrypt(hash) {
+			if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil {
+				return true
+			}
+			continue
+		}
+		want, err := hex.DecodeString(hash)
+		if err == nil && subtle.ConstantTimeCompare(want, sum[:]) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge will ask the client for credentials.
+func (c BasicAuthConfig) challenge(w http.ResponseWriter) {
+	realm := c.Realm
+	if realm == "" {
+		realm = "doproxy"
+	}
+	w.Header().Set("WWW-Authenticate", "Basic realm="+strconv.Quote(realm))
+}
@@ -1,15 +1,25 @@
 package server
 
 import (
-	"log"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/VividCortex/ewma"
 	"github.com/klauspost/shutdown"
+	"golang.org/x/net/http2"
 )
 
 // A Backend is a single running backend instance.
@@ -20,8 +30,13 @@ type Backend interface {
 	Name() string                 // A name for this backend
 	Host() string                 // Returns the hostname of the backend
 	Healthy() bool                // Is the backend healthy?
+	Degraded() bool               // Is the backend healthy, but slow? Degraded backends are used if no other is healthy.
 	Statistics() *Stats           // Returns a copy of the latest statistics. Updated every second.
 	Connections() int             // Return the current number of connections
+	Weight() int                  // Relative weight of the backend. Always at least 1.
+	Backup() bool                 // Backup backends are only used if no primary backend is healthy.
+	Priority() int                // Backends with a higher priority are only used if no lower priority backend is healthy.
+	Labels() map[string]string    // Labels of the backend. Must not be modified.
 	Close()                       // Close the backend (before shutdown/reload).
 }
 
@@ -29,20 +44,69 @@ type Backend interface {
 // between different backend types, so implementing different
 // ones are easier.
 type backend struct {
-	rt           *statRT
-	healthClient *http.Client
-	closeMonitor chan chan struct{}
-	Stats        Stats
-	ServerHost   string
-	HealthURL    string
+	rt              *statRT
+	healthClient    *http.Client
+	closeMonitor    chan chan struct{}
+	closeMu         sync.Mutex    // Protects closeMonitor when closing.
+	events          *Events       // Health transitions are published here, if set.
+	maxFailureRate  float64       // Mark unhealthy if the failure rate is above this. 0 disables.
+	healthExpect    []byte        // Health check response body must contain this, if set.
+	healthMethod    string        // HTTP method used for health checks.
+	dialTimeout     time.Duration // Timeout for connecting to the backend.
+	degradedLatency time.Duration // Mark degraded if latency is above this. 0 disables.
+	graceUntil      time.Time     // Health check failures are not counted before this.
+	weight          int           // Relative weight used by weighted load balancers.
+	backup          bool          // Only used if no primary backend is healthy.
+	priority        int           // Only used if no backend with lower priority is healthy.
+	http2           bool          // Requests are sent with HTTP/2 without TLS.
+	https           bool          // Requests are sent with TLS.
+	deps            []*dependency // Unhealthy while one of these is failing. Protected by Stats.mu.
+	healthLimit     chan struct{} // Limits health checks running at once, if set. Shared by backends of the server.
+	labels          map[string]string
+	Stats           Stats
+	ServerHost      string
+	HealthURL       string
+
+	// Inventories told when the backend becomes available or unavailable,
+	// or its connections change, with the backend as stored in each.
+	// Holds a map[*Inventory]Backend, which is replaced, never modified,
+	// so it can be read without locking. Changed with Stats.mu locked.
+	watchers atomic.Value
+
+	// Log and 'statsd' client of the server the backend belongs to.
+	log     *serverLog
+	metrics *serverMetrics
 }
 
 // newBackend returns a new generic backend.
 // It will start monitoring the backend at once
 func newBackend(bec BackendConfig, serverHost, healthURL string) *backend {
+	b := initBackend(bec, serverHost, healthURL)
+	b.start(bec)
+	return b
+}
+
+// initBackend returns a new generic backend without monitoring it.
+// Settings must be applied before start is called, since
+// the monitor reads them without locking.
+func initBackend(bec BackendConfig, serverHost, healthURL string) *backend {
 	b := &backend{
-		ServerHost: serverHost,
-		HealthURL:  healthURL,
+		ServerHost:      serverHost,
+		HealthURL:       healthURL,
+		maxFailureRate:  bec.MaxFailureRate,
+		dialTimeout:     time.Duration(bec.DialTimeout),
+		degradedLatency: time.Duration(bec.DegradedLatency),
+		healthMethod:    bec.HealthMethod,
+		graceUntil:      time.Now().Add(time.Duration(bec.HealthGrace)),
+		healthLimit:     bec.healthLimits.semaphore(bec.HealthLimit),
+		log:             bec.log,
+		metrics:         bec.metrics,
+	}
+	if b.healthMethod == "" {
+		b.healthMethod = "GET"
+	}
+	if bec.HealthExpectBody != "" {
+		b.healthExpect = []byte(bec.HealthExpectBody)
 	}
 	// Create a transport that is used for health checks.
 	tr := &http.Transport{
@@ -53,31 +117,66 @@ func newBackend(bec BackendConfig, serverHost, healthURL string) *backend {
 		DisableKeepAlives:  true,
 		DisableCompression: true,
 	}
+	tc, err := bec.HealthTLSConfig()
+	if err != nil {
+		b.log.Errorf("%s: health check TLS settings not applied: %v", serverHost, err)
+	}
+	tr.TLSClientConfig = tc
 	b.healthClient = &http.Client{Transport: tr}
 
 	// Reset running stats.
+	failureAvg := bec.FailureAvg
+	if failureAvg == 0 {
+		failureAvg = defaultFailureAvg
+	}
 	b.Stats.Latency = ewma.NewMovingAverage(float64(bec.LatencyAvg))
-	b.Stats.FailureRate = ewma.NewMovingAverage(10)
+	b.Stats.FailureRate = ewma.NewMovingAverage(float64(failureAvg))
 
 	// Set up the backend transport.
-	tr = &http.Transport{
-		Dial: func(network, addr string) (net.Conn, error) {
-			return net.DialTimeout(network, addr, time.Duration(bec.DialTimeout))
-		},
-		Proxy: http.ProxyFromEnvironment,
+	if bec.Protocol == protocolH2C {
+		b.http2 = true
+		b.rt = newStatTP(&http2.Transport{
+			// Connect without TLS and speak HTTP/2 at once.
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, b.dialTimeout)
+			},
+			IdleConnTimeout:    time.Duration(bec.IdleTimeout),
+			DisableCompression: bec.PassCompression,
+		})
+	} else {
+		tr = &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.DialTimeout(network, addr, b.dialTimeout)
+			},
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: bec.MaxIdleConns,
+			IdleConnTimeout:     time.Duration(bec.IdleTimeout),
+			DisableCompression:  bec.PassCompression,
+		}
+		b.rt = newStatTP(tr)
 	}
-	b.rt = newStatTP(tr)
+	b.rt.loadHeader = bec.LoadHeader
+	b.rt.connsChanged = b.connsChanged
 
 	// If we have no health url, assume healthy
 	if healthURL == "" {
 		b.Stats.Healthy = true
+	} else if bec.AssumeHealthy {
+		// Send traffic until the first health check has completed.
+		b.Stats.Healthy = true
+		b.Stats.unverified = true
 	}
+	return b
+}
 
+// start will start monitoring the backend,
+// unless health checks are disabled.
+func (b *backend) start(bec BackendConfig) {
 	if !bec.DisableHealth {
 		b.closeMonitor = make(chan chan struct{}, 0)
 		go b.startMonitor()
 	}
-	return b
 }
 
 // startMonitor will monitor stats of the backend
@@ -85,44 +184,27 @@ func newBackend(bec BackendConfig, serverHost, healthURL string) *backend {
 // This means that no other goroutine should acquire
 // both at the same time.
 func (b *backend) startMonitor() {
-	s := b.rt
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
+	// Start at a random point in the interval, so backends
+	// created at the same time are not all checked at once.
+	first := time.NewTimer(time.Duration(rand.Int63n(int64(healthInterval))))
+	defer first.Stop()
+	tick := first.C
+	var ticker *time.Ticker
 	exit := shutdown.First()
 	end := b.closeMonitor
 	previous := time.Now()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-tick:
+			if ticker == nil {
+				ticker = time.NewTicker(healthInterval)
+				defer ticker.Stop()
+				tick = ticker.C
+			}
 			elapsed := time.Now().Sub(previous)
 			previous = time.Now()
-			s.mu.Lock()
-			b.Stats.mu.Lock()
-			if s.requests == 0 {
-				b.Stats.Latency.Add(0)
-				b.Stats.FailureRate.Add(0)
-			} else {
-				b.Stats.Latency.Add(float64(s.latencySum) / float64(elapsed) / float64(s.requests))
-				b.Stats.FailureRate.Add(float64(s.errors) / float64(s.requests))
-			}
-			s.requests = 0
-			s.errors = 0
-			s.latencySum = 0
-			s.mu.Unlock()
-
-			// Perform health check
-			b.healthCheck()
-
-			if b.Stats.Healthy && b.Stats.healthFailures > 5 {
-				log.Println("5 Consequtive health tests failed. Marking as unhealty.")
-				b.Stats.Healthy = false
-			}
-			if !b.Stats.Healthy && b.Stats.healthFailures == 0 {
-				log.Println("Health check succeeded. Marking as healty")
-				b.Stats.Healthy = true
-			}
-			b.Stats.mu.Unlock()
+			b.update(elapsed)
 		case n := <-end:
 			exit.Cancel()
 			close(n)
@@ -134,6 +216,82 @@ func (b *backend) startMonitor() {
 	}
 }
 
+// update will update the statistics of the backend
+// and perform a health check.
+// This is called by startMonitor every second.
+func (b *backend) update(elapsed time.Duration) {
+	s := b.rt
+	s.mu.Lock()
+	b.Stats.mu.Lock()
+	b.sampleConnections()
+	if s.requests == 0 {
+		b.Stats.Latency.Add(0)
+		b.Stats.FailureRate.Add(0)
+	} else {
+		// Average latency of the requests in this period.
+		b.Stats.Latency.Add(float64(s.latencySum) / float64(s.requests))
+		b.Stats.FailureRate.Add(float64(s.errors) / float64(s.requests))
+	}
+	s.requests = 0
+	s.errors = 0
+	s.latencySum = 0
+	s.mu.Unlock()
+
+	// Perform health check
+	b.healthCheck()
+
+	// Failures during the grace period of a new backend are not counted,
+	// but the backend is not marked healthy until a check succeeds.
+	if b.Stats.healthFailures > 0 && time.Now().Before(b.graceUntil) {
+		b.Stats.healthFailures = 1
+	}
+
+	// A backend that was assumed healthy is marked unhealthy
+	// if the first health check outside the grace period fails.
+	if b.Stats.unverified && (b.Stats.healthFailures == 0 || !time.Now().Before(b.graceUntil)) {
+		b.Stats.unverified = false
+		if b.Stats.Healthy && b.Stats.healthFailures > 0 {
+			b.log.Warnf("%s: first health check failed. Marking as unhealthy.", b.ServerHost)
+			b.setHealthy(false)
+		}
+	}
+
+	failing := b.maxFailureRate > 0 && b.Stats.FailureRate.Value() > b.maxFailureRate
+	dep := b.failingDependency()
+	if b.Stats.Healthy && dep != "" {
+		b.log.Warnf("%s: dependency %q is failing. Marking as unhealthy.", b.ServerHost, dep)
+		b.setHealthy(false)
+	}
+	if b.Stats.Healthy && b.Stats.healthFailures > unhealthyFailures {
+		b.log.Warnf("%s: %d consecutive health checks failed. Marking as unhealthy.", b.ServerHost, unhealthyFailures)
+		b.setHealthy(false)
+	}
+	if b.Stats.Healthy && failing {
+		b.log.Warnf("%s: failure rate %.2f above %.2f. Marking as unhealthy.", b.ServerHost, b.Stats.FailureRate.Value(), b.maxFailureRate)
+		b.setHealthy(false)
+	}
+	if !b.Stats.Healthy && b.Stats.healthFailures == 0 && !failing && dep == "" {
+		b.log.Infof("%s: health check succeeded. Marking as healthy.", b.ServerHost)
+		b.setHealthy(true)
+	}
+	degraded := b.degradedLatency > 0 && time.Duration(b.Stats.Latency.Value()) > b.degradedLatency
+	if degraded != b.Stats.Degraded {
+		if degraded {
+			b.log.Warnf("%s: latency %v above %v. Marking as degraded.", b.ServerHost, time.Duration(b.Stats.Latency.Value()), b.degradedLatency)
+		} else {
+			b.log.Infof("%s: latency %v below %v. No longer degraded.", b.ServerHost, time.Duration(b.Stats.Latency.Value()), b.degradedLatency)
+		}
+		b.Stats.Degraded = degraded
+		b.publishHealth()
+	}
+	latency, healthy, draining := time.Duration(b.Stats.Latency.Value()), b.Stats.Healthy, b.Stats.Draining
+	b.Stats.mu.Unlock()
+
+	if m := b.metrics.get(); m != nil {
+		m.backend(b.ServerHost, b.Connections(), latency, healthy, draining)
+	}
+}
+
 // healthCheck will check the health by connecting
 // to the healthURL of the backend.
 // This is called by healthCheck every second.
@@ -142,36 +300,244 @@ func (b *backend) startMonitor() {
 func (b *backend) healthCheck() {
 	// If no checkurl har been set, assume we are healthy
 	if b.HealthURL == "" {
-		b.Stats.Healthy = true
+		b.Stats.healthFailures = 0
 		return
 	}
 
-	req, err := http.NewRequest("GET", b.HealthURL, nil)
+	req, err := http.NewRequest(b.healthMethod, b.HealthURL, nil)
 	if err != nil {
-		log.Println("Error checking health of", b.HealthURL, "Error:", err)
+		b.log.Debugf("Error checking health of %s: %v", b.HealthURL, err)
 	}
 
 	req.Header.Set("User-Agent", "doproxy health checker")
 
 	b.Stats.mu.Unlock()
+	if b.healthLimit != nil {
+		b.healthLimit <- struct{}{}
+	}
 	// Perform the check
 	resp, err := b.healthClient.Do(req)
+	found := true
+	if err == nil {
+		if b.healthExpect != nil {
+			var body []byte
+			body, err = ioutil.ReadAll(io.LimitReader(resp.Body, healthBodyLimit))
+			found = bytes.Contains(body, b.healthExpect)
+		}
+		resp.Body.Close()
+	}
+	if b.healthLimit != nil {
+		<-b.healthLimit
+	}
 
 	b.Stats.mu.Lock()
 	// Check response
 	if err != nil {
 		b.Stats.healthFailures++
-		log.Println("Error checking health of", b.HealthURL, "Error:", err)
+		b.log.Debugf("Error checking health of %s: %v", b.HealthURL, err)
 		return
 	}
 	if resp.StatusCode >= 500 {
 		b.Stats.healthFailures++
-		log.Println("Error checking health of", b.HealthURL, "Status code:", resp.StatusCode)
+		b.log.Debugf("Error checking health of %s: status code %d", b.HealthURL, resp.StatusCode)
+	} else if !found {
+		b.Stats.healthFailures++
+		b.log.Debugf("Error checking health of %s: response did not contain %q", b.HealthURL, b.healthExpect)
 	} else {
 		// Reset failures
 		b.Stats.healthFailures = 0
 	}
-	resp.Body.Close()
+}
+
+// defaultFailureAvg is the number of seconds the failure rate
+// is averaged over, if 'failure-average-seconds' isn't set.
+const defaultFailureAvg = 10
+
+// healthInterval is the time between health checks of a backend.
+const healthInterval = time.Second
+
+// unhealthyFailures is the number of consecutive health checks
+// that can fail before a backend is marked unhealthy.
+const unhealthyFailures = 5
+
+// healthLimiter contains the semaphore limiting the number of
+// health checks of the backends of a server running at once.
+// It is passed to the monitor of each backend with the backend
+// configuration. A nil *healthLimiter doesn't limit health checks.
+type healthLimiter struct {
+	mu  sync.Mutex
+	n   int
+	sem chan struct{}
+}
+
+// semaphore returns a semaphore allowing n health checks
+// to run at once. Backends created with the same limit share it.
+// If n is 0, nil is returned.
+func (l *healthLimiter) semaphore(n int) chan struct{} {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n != n {
+		l.n = n
+		l.sem = make(chan struct{}, n)
+	}
+	return l.sem
+}
+
+// healthBodyLimit is the maximum number of bytes of a health check
+// response that is searched for the expected body.
+const healthBodyLimit = 64 << 10
+
+// checkHealth will perform a single health check and
+// return true if the backend is healthy.
+func (b *backend) checkHealth() bool {
+	b.Stats.mu.Lock()
+	defer b.Stats.mu.Unlock()
+	b.healthCheck()
+	return b.HealthURL == "" || b.Stats.healthFailures == 0
+}
+
+// WaitHealthy will check the health of the backend every second,
+// until a health check succeeds or the timeout expires.
+// This can be used when health monitoring of the backend is disabled.
+func WaitHealthy(be Backend, timeout time.Duration) error {
+	hc, ok := be.(interface {
+		checkHealth() bool
+	})
+	if !ok {
+		return fmt.Errorf("backend type %T does not support health checks", be)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if hc.checkHealth() {
+			return nil
+		}
+		if time.Now().Add(time.Second).After(deadline) {
+			return fmt.Errorf("backend %s was not healthy within %s", be.Host(), timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// publishHealth will publish the current health state
+// of the backend, if events have been set.
+// It assumes b.Stats.mu is locked.
+func (b *backend) publishHealth() {
+	if b.events == nil {
+		return
+	}
+	b.events.Publish(HealthEvent{
+		Time:     time.Now(),
+		Host:     b.ServerHost,
+		Healthy:  b.Stats.Healthy,
+		Degraded: b.Stats.Degraded,
+		Latency:  time.Duration(b.Stats.Latency.Value()),
+	})
+}
+
+// setHealthy will set the health of the backend, publish it and
+// tell inventories watching the backend. It assumes b.Stats.mu is locked.
+func (b *backend) setHealthy(healthy bool) {
+	b.Stats.Healthy = healthy
+	b.publishHealth()
+	b.availabilityChanged()
+}
+
+// watch will make the backend tell the inventory when it becomes
+// available or unavailable, or its connections change.
+// be is the backend as stored in the inventory.
+func (b *backend) watch(i *Inventory, be Backend) {
+	b.Stats.mu.Lock()
+	old := b.watching()
+	ws := make(map[*Inventory]Backend, len(old)+1)
+	for wi, wbe := range old {
+		ws[wi] = wbe
+	}
+	ws[i] = be
+	b.watchers.Store(ws)
+	b.Stats.mu.Unlock()
+}
+
+// unwatch will stop telling the inventory about changes.
+func (b *backend) unwatch(i *Inventory) {
+	b.Stats.mu.Lock()
+	old := b.watching()
+	ws := make(map[*Inventory]Backend, len(old))
+	for wi, wbe := range old {
+		if wi != i {
+			ws[wi] = wbe
+		}
+	}
+	b.watchers.Store(ws)
+	b.Stats.mu.Unlock()
+}
+
+// watching returns the inventories watching the backend.
+// The returned map must not be modified.
+func (b *backend) watching() map[*Inventory]Backend {
+	ws, _ := b.watchers.Load().(map[*Inventory]Backend)
+	return ws
+}
+
+// availabilityChanged tells the inventories watching the backend
+// that it became available or unavailable.
+func (b *backend) availabilityChanged() {
+	for i := range b.watching() {
+		i.changed()
+	}
+}
+
+// connsChanged tells the inventories watching the backend
+// that its number of connections changed.
+func (b *backend) connsChanged() {
+	for i, be := range b.watching() {
+		i.connsChanged(be)
+	}
+}
+
+// setEvents will make the backend publish health
+// transitions to the supplied events.
+func (b *backend) setEvents(e *Events) {
+	b.Stats.mu.Lock()
+	b.events = e
+	b.Stats.mu.Unlock()
+}
+
+// selected records that the backend was
+// selected by a load balancer.
+func (b *backend) selected() {
+	b.Stats.mu.Lock()
+	b.Stats.Selected++
+	b.Stats.mu.Unlock()
+}
+
+// setDraining will stop or resume sending new requests to the backend.
+// Draining is independent of the health of the backend.
+func (b *backend) setDraining(draining bool) {
+	b.Stats.mu.Lock()
+	if b.Stats.Draining != draining {
+		b.Stats.Draining = draining
+		b.availabilityChanged()
+	}
+	b.Stats.mu.Unlock()
+}
+
+// isDraining returns true if no new requests
+// should be sent to the backend.
+func (b *backend) isDraining() bool {
+	b.Stats.mu.RLock()
+	defer b.Stats.mu.RUnlock()
+	return b.Stats.Draining
+}
+
+// retried records that a failed request
+// to the backend was retried.
+func (b *backend) retried() {
+	b.Stats.mu.Lock()
+	b.Stats.Retries++
+	b.Stats.mu.Unlock()
 }
 
 // Transport returns a RoundTripper that will collect stats
@@ -188,14 +554,51 @@ func (b *backend) Healthy() bool {
 	return ok
 }
 
-// Healthy returns the healthy state of the backend
-func (b *backend) Statistics() *Stats {
+// Degraded returns true if the latency of the
+// backend is above 'degraded-latency'.
+func (b *backend) Degraded() bool {
+	b.Stats.mu.RLock()
+	d := b.Stats.Degraded
+	b.Stats.mu.RUnlock()
+	return d
+}
+
+// failures returns the number of consecutive failed health checks.
+func (b *backend) failures() int {
 	b.Stats.mu.RLock()
-	s := b.Stats
+	n := b.Stats.healthFailures
 	b.Stats.mu.RUnlock()
-	return &s
+	return n
+}
+
+// Statistics returns a copy of the statistics of the backend.
+// Moving averages are copied as their current value,
+// so the copy doesn't change when the backend is updated.
+func (b *backend) Statistics() *Stats {
+	b.Stats.mu.RLock()
+	defer b.Stats.mu.RUnlock()
+	return &Stats{
+		healthFailures:    b.Stats.healthFailures,
+		unverified:        b.Stats.unverified,
+		Healthy:           b.Stats.Healthy,
+		Degraded:          b.Stats.Degraded,
+		Latency:           fixedAverage(b.Stats.Latency.Value()),
+		FailureRate:       fixedAverage(b.Stats.FailureRate.Value()),
+		Selected:          b.Stats.Selected,
+		Retries:           b.Stats.Retries,
+		Draining:          b.Stats.Draining,
+		SmoothConnections: b.Stats.SmoothConnections,
+	}
 }
 
+// fixedAverage is a moving average that keeps its value.
+// Values that are added or set are ignored.
+type fixedAverage float64
+
+func (f fixedAverage) Add(float64)    {}
+func (f fixedAverage) Value() float64 { return float64(f) }
+func (f fixedAverage) Set(float64)    {}
+
 // Host returns the host address of the backend.
 func (b *backend) Host() string {
 	return b.ServerHost
@@ -204,6 +607,9 @@ func (b *backend) Host() string {
 // Close the backend, which will shut down monitoring
 // of the backend.
 func (b *backend) Close() {
+	b.closeMu.Lock()
+	defer b.closeMu.Unlock()
+	b.setDependencies(nil)
 	if b.closeMonitor == nil {
 		return
 	}
@@ -214,36 +620,210 @@ func (b *backend) Close() {
 	b.closeMonitor = nil
 }
 
-// Connections returns the number of currently running requests.
-// Does not include websocket connections.
-func (b *backend) Connections() int {
+// setDependencies will replace the dependencies of the backend
+// with the ones in deps that gate the labels of the backend.
+// The checkers of the previous dependencies are released.
+func (b *backend) setDependencies(deps []DependencyConfig) {
+	var gated []*dependency
+	for _, c := range deps {
+		if c.gates(b.labels) {
+			gated = append(gated, acquireDependency(c, b.log))
+		}
+	}
+	b.Stats.mu.Lock()
+	old := b.deps
+	b.deps = gated
+	b.Stats.mu.Unlock()
+	for _, d := range old {
+		d.release()
+	}
+}
+
+// failingDependency returns the name of the first failing
+// dependency of the backend, or "" if none are failing.
+// It assumes b.Stats.mu is locked.
+func (b *backend) failingDependency() string {
+	for _, d := range b.deps {
+		if d.failing() {
+			return d.conf.Name
+		}
+	}
+	return ""
+}
+
+// Weight returns the relative weight of the backend.
+// Backends with no weight set have a weight of 1.
+func (b *backend) Weight() int {
+	if b.weight < 1 {
+		return 1
+	}
+	return b.weight
+}
+
+// Backup returns true if the backend is only
+// used when no primary backend is healthy.
+func (b *backend) Backup() bool {
+	return b.backup
+}
+
+// load returns the smoothed load reported by the backend
+// in 'load-header', between 0 and 1. If no load has been reported 0 is returned.
+func (b *backend) load() float64 {
+	b.rt.mu.RLock()
+	defer b.rt.mu.RUnlock()
+	return b.rt.load
+}
+
+// latencyPercentile returns the latency that p (0-100) percent of the
+// most recent requests were faster than or equal to.
+// Returns 0 if no requests have been made within latencySampleAge.
+func (b *backend) latencyPercentile(p float64) time.Duration {
 	b.rt.mu.RLock()
-	n := b.rt.running
-	b.rt.mu.RUnlock()
+	defer b.rt.mu.RUnlock()
+	return b.rt.percentile(p, time.Now())
+}
+
+// p95 returns the 95th percentile latency of recent requests.
+// The value is calculated at most once every p95Refresh.
+func (b *backend) p95() time.Duration {
+	now := time.Now()
+	s := b.rt
+	s.mu.RLock()
+	p, at := s.p95, s.p95At
+	s.mu.RUnlock()
+	if now.Sub(at) < p95Refresh {
+		return p
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// It may have been updated while we were waiting for the lock.
+	if now.Sub(s.p95At) >= p95Refresh {
+		s.p95 = s.percentile(95, now)
+		s.p95At = now
+	}
+	return s.p95
+}
+
+// usesHTTP2 returns whether requests to the backend use HTTP/2.
+func (b *backend) usesHTTP2() bool {
+	return b.http2
+}
+
+// scheme returns the URL scheme of requests to the backend.
+func (b *backend) scheme() string {
+	if b.https {
+		return "https"
+	}
+	return "http"
+}
+
+// dial connects to the backend for requests that don't use
+// the transport, like websockets. HTTPS backends are connected
+// with TLS, verified like requests sent with the transport.
+// Connecting, including the TLS handshake, may take up to the dial timeout.
+func (b *backend) dial() (net.Conn, error) {
+	deadline := time.Now().Add(b.dialTimeout)
+	c, err := wsDial("tcp", b.ServerHost, b.dialTimeout)
+	if err != nil || !b.https {
+		return c, err
+	}
+	tc := &tls.Config{}
+	if tr, ok := b.rt.rt.(*http.Transport); ok && tr.TLSClientConfig != nil {
+		tc = tr.TLSClientConfig.Clone()
+	}
+	if tc.ServerName == "" {
+		host, _, err := net.SplitHostPort(b.ServerHost)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		tc.ServerName = host
+	}
+	if b.dialTimeout > 0 {
+		c.SetDeadline(deadline)
+	}
+	tlsConn := tls.Client(c, tc)
+	if err := tlsConn.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Priority returns the failover tier of the backend.
+// 0 is the highest priority.
+func (b *backend) Priority() int {
+	return b.priority
+}
+
+// Labels returns the labels of the backend.
+func (b *backend) Labels() map[string]string {
+	return b.labels
+}
+
+// Connections returns the number of currently running requests
+// and open websocket connections.
+func (b *backend) Connections() int {
+	return int(atomic.LoadInt64(&b.rt.running))
+}
+
+// connSmoothing is the weight of a new sample
+// in the moving average of connections.
+const connSmoothing = 0.2
+
+// sampleConnections adds the current number of connections
+// to the moving average. It assumes b.Stats.mu is locked.
+func (b *backend) sampleConnections() {
+	b.Stats.SmoothConnections += connSmoothing * (float64(b.Connections()) - b.Stats.SmoothConnections)
+}
+
+// smoothedConnections returns the moving average of
+// the number of connections.
+func (b *backend) smoothedConnections() float64 {
+	b.Stats.mu.RLock()
+	n := b.Stats.SmoothConnections
+	b.Stats.mu.RUnlock()
 	return n
 }
 
+// openConn records a connection that does not use the transport,
+// like a websocket, as running. The returned function must be
+// called when the connection is closed.
+func (b *backend) openConn() func() {
+	atomic.AddInt64(&b.rt.running, 1)
+	b.rt.notifyConns()
+	return func() {
+		atomic.AddInt64(&b.rt.running, -1)
+		b.rt.notifyConns()
+	}
+}
+
 func (s *statRT) RoundTrip(req *http.Request) (*http.Response, error) {
 	// Record this request as running
-	s.mu.Lock()
-	s.running++
-	s.mu.Unlock()
+	atomic.AddInt64(&s.running, 1)
+	s.notifyConns()
 
 	// Time the request roundtrip time
 	start := time.Now()
 	resp, err := s.rt.RoundTrip(req)
-	dur := start.Sub(time.Now())
+	dur := time.Since(start)
 
 	// Update stats
+	atomic.AddInt64(&s.running, -1)
+	s.notifyConns()
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.running--
 	s.requests++
 	s.latencySum += dur
+	s.recordLatency(dur)
 	if err != nil {
 		s.errors++
 		return nil, err
 	}
+	if s.loadHeader != "" {
+		s.recordLoad(resp)
+	}
 	// Any status code above or equal to 500 is recorded as an error.
 	if resp.StatusCode >= 500 {
 		s.errors++
@@ -256,10 +836,18 @@ func (s *statRT) RoundTrip(req *http.Request) (*http.Response, error) {
 // backend. To access be sure to hold the 'mu' mutex.
 type Stats struct {
 	mu             sync.RWMutex
-	healthFailures int // Number of total health check failures
+	healthFailures int  // Number of total health check failures
+	unverified     bool // Assumed healthy before the first health check.
 	Healthy        bool
+	Degraded       bool // Latency is above 'degraded-latency'.
 	Latency        ewma.MovingAverage
 	FailureRate    ewma.MovingAverage
+	Selected       int64 // Number of times a load balancer has selected the backend.
+	Retries        int64 // Number of failed requests to the backend that were retried.
+	Draining       bool  // No new requests are sent to the backend. Open connections may finish.
+
+	// Moving average of the number of connections, sampled every second.
+	SmoothConnections float64
 }
 
 // statRT wraps a http.RoundTripper around statistics that can
@@ -268,9 +856,106 @@ type statRT struct {
 	rt         http.RoundTripper
 	mu         sync.RWMutex
 	latencySum time.Duration
-	running    int
+	running    int64 // Accessed atomically, so load balancers don't need the lock.
 	requests   int
 	errors     int
+	loadHeader string  // Response header with the load reported by the backend.
+	load       float64 // Smoothed reported load between 0 and 1.
+	loadSet    bool    // A load has been reported.
+
+	// Latency of the most recent requests, used for percentiles.
+	// next is the position of the oldest sample when samples is full.
+	samples []latencySample
+	next    int
+	p95     time.Duration // Cached 95th percentile, calculated at p95At.
+	p95At   time.Time
+
+	// Called when running changes, if set.
+	connsChanged func()
+}
+
+// notifyConns tells the backend that running has changed.
+func (s *statRT) notifyConns() {
+	if s.connsChanged != nil {
+		s.connsChanged()
+	}
+}
+
+// latencySample is the latency of a request
+// and the time it completed.
+type latencySample struct {
+	at  time.Time
+	dur time.Duration
+}
+
+const (
+	// latencySamples is the number of request latencies
+	// kept for calculating percentiles.
+	latencySamples = 200
+
+	// latencySampleAge is how long request latencies are used for percentiles.
+	// Backends that are not selected because they were slow
+	// will have no samples after this and will be tried again.
+	latencySampleAge = time.Minute
+
+	// p95Refresh is how often the cached 95th percentile is updated.
+	p95Refresh = time.Second
+)
+
+// recordLatency will add a request latency to the samples,
+// replacing the oldest when full. It assumes s.mu is locked.
+func (s *statRT) recordLatency(dur time.Duration) {
+	sample := latencySample{at: time.Now(), dur: dur}
+	if len(s.samples) < latencySamples {
+		s.samples = append(s.samples, sample)
+		return
+	}
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % latencySamples
+}
+
+// percentile returns the latency that p (0-100) percent of the
+// samples newer than latencySampleAge were faster than or equal to.
+// Returns 0 if there are no samples. It assumes s.mu is locked.
+func (s *statRT) percentile(p float64, now time.Time) time.Duration {
+	sorted := make([]time.Duration, 0, len(s.samples))
+	for _, sample := range s.samples {
+		if now.Sub(sample.at) < latencySampleAge {
+			sorted = append(sorted, sample.dur)
+		}
+	}
+	if len(sorted) == 0 {
+		return 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// loadSmoothing is the weight of a newly reported load
+// in the smoothed load of a backend.
+const loadSmoothing = 0.3
+
+// recordLoad will add the load reported in the response to the smoothed load.
+// Invalid values are ignored. It assumes s.mu is locked.
+func (s *statRT) recordLoad(resp *http.Response) {
+	h := resp.Header.Get(s.loadHeader)
+	if h == "" {
+		return
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(h), 64)
+	if err != nil || math.IsNaN(v) {
+		return
+	}
+	v = math.Min(math.Max(v, 0), 1)
+	if !s.loadSet {
+		s.load, s.loadSet = v, true
+		return
+	}
+	s.load += (v - s.load) * loadSmoothing
 }
 
 // dropletBackend is a a backend instance with a DigitalOcean droplet
@@ -281,12 +966,26 @@ type DropletBackend struct {
 }
 
 // NewDropletBackend returns a Backend configured with the
-// Droplet information.
+// Droplet information. Droplet settings override the backend config.
 func NewDropletBackend(d Droplet, bec BackendConfig) Backend {
+	dbec := d.backendConfig(bec)
 	b := &DropletBackend{
-		backend: newBackend(bec, d.ServerHost, d.HealthURL),
+		backend: initBackend(dbec, d.ServerHost, d.HealthURL),
 		Droplet: d,
 	}
+	b.weight = d.Weight
+	b.backup = d.Backup
+	b.priority = d.Priority
+	b.labels = d.Labels
+	b.https = d.Scheme == "https"
+	if !bec.DisableHealth {
+		b.setDependencies(bec.Dependencies)
+	}
+	// The grace period starts when the droplet was started, if known.
+	if !d.Started.IsZero() {
+		b.graceUntil = d.Started.Add(time.Duration(bec.HealthGrace))
+	}
+	b.start(dbec)
 	return b
 }
 
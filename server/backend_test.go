@@ -0,0 +1,456 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/doproxy/server/httpmock"
+)
+
+// Test that the backend transport is configured from the backend config.
+func TestBackendTransportConfig(t *testing.T) {
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	bec.MaxIdleConns = 64
+	bec.IdleTimeout = Duration(90 * time.Second)
+
+	b := newBackend(bec, "127.0.0.1:8080", "")
+	defer b.Close()
+	tr, ok := b.rt.rt.(*http.Transport)
+	if !ok {
+		t.Fatalf("backend transport was not *http.Transport, it was %T", b.rt.rt)
+	}
+	if tr.MaxIdleConnsPerHost != 64 {
+		t.Fatal("expected MaxIdleConnsPerHost to be 64, got", tr.MaxIdleConnsPerHost)
+	}
+	if tr.IdleConnTimeout != 90*time.Second {
+		t.Fatal("expected IdleConnTimeout to be 90s, got", tr.IdleConnTimeout)
+	}
+}
+
+// Test that WaitHealthy waits for a backend to become healthy.
+func TestWaitHealthy(t *testing.T) {
+	var healthy int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	be := &mockBackend{backend: newBackend(bec, "127.0.0.1:8080", ts.URL)}
+
+	// Become healthy after a delay.
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		atomic.StoreInt32(&healthy, 1)
+	}()
+	start := time.Now()
+	err := WaitHealthy(be, 10*time.Second)
+	if err != nil {
+		t.Fatal("backend did not become healthy:", err)
+	}
+	if time.Since(start) < 1500*time.Millisecond {
+		t.Fatal("backend reported healthy before health endpoint was")
+	}
+
+	// Should time out.
+	atomic.StoreInt32(&healthy, 0)
+	err = WaitHealthy(be, 1500*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected timeout waiting for unhealthy backend")
+	}
+}
+
+// failingRT is a RoundTripper where all requests fail with status 500.
+type failingRT struct{}
+
+func (failingRT) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := httpmock.MockResponse(req)
+	res.StatusCode = http.StatusInternalServerError
+	return res, err
+}
+
+// Test that a backend with a high failure rate is marked unhealthy.
+func TestBackendFailureRate(t *testing.T) {
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	bec.MaxFailureRate = 0.5
+	b := newBackend(bec, "127.0.0.1:8080", "")
+	b.rt.rt = failingRT{}
+
+	for i := 0; b.Healthy(); i++ {
+		if i > 30 {
+			t.Fatal("backend still healthy after 30 seconds of failures")
+		}
+		for j := 0; j < 5; j++ {
+			req, err := http.NewRequest("GET", "http://127.0.0.1:8080/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := b.Transport().RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+		}
+		b.update(time.Second)
+	}
+
+	// Without failing requests it should recover.
+	for i := 0; !b.Healthy(); i++ {
+		if i > 30 {
+			t.Fatal("backend did not recover after 30 seconds without failures")
+		}
+		b.update(time.Second)
+	}
+}
+
+// Test that health checks fail if the body doesn't contain the expected value.
+func TestHealthExpectBody(t *testing.T) {
+	var ok int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if atomic.LoadInt32(&ok) == 0 {
+			w.Write([]byte(`{"status":"starting"}`))
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer ts.Close()
+
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	bec.HealthExpectBody = `"status":"ok"`
+	b := newBackend(bec, "127.0.0.1:8080", ts.URL)
+	defer b.Close()
+
+	if b.checkHealth() {
+		t.Fatal("health check passed with unexpected body")
+	}
+	b.Stats.mu.Lock()
+	b.setHealthy(true)
+	b.Stats.mu.Unlock()
+	for i := 0; i < 6; i++ {
+		b.update(time.Second)
+	}
+	if b.Healthy() {
+		t.Fatal("backend should be unhealthy after failing health checks")
+	}
+
+	atomic.StoreInt32(&ok, 1)
+	if !b.checkHealth() {
+		t.Fatal("health check failed with expected body")
+	}
+}
+
+// Test that the configured method is used for health checks.
+func TestHealthMethod(t *testing.T) {
+	var method = make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case method <- r.Method:
+		default:
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	for _, m := range []string{"", "HEAD", "OPTIONS"} {
+		bec := valid_config.Backend
+		bec.DisableHealth = true
+		bec.HealthMethod = m
+		b := newBackend(bec, "127.0.0.1:8080", ts.URL)
+		if !b.checkHealth() {
+			t.Fatal("health check failed with method", m)
+		}
+		b.Close()
+		expect := m
+		if expect == "" {
+			expect = "GET"
+		}
+		if got := <-method; got != expect {
+			t.Fatalf("expected health check method %q, got %q", expect, got)
+		}
+	}
+}
+
+// slowRT is a RoundTripper that responds after a delay.
+type slowRT time.Duration
+
+func (s slowRT) RoundTrip(req *http.Request) (*http.Response, error) {
+	time.Sleep(time.Duration(s))
+	return httpmock.MockResponse(req)
+}
+
+// Test that a backend with high latency is marked degraded.
+func TestBackendDegraded(t *testing.T) {
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	bec.DegradedLatency = Duration(10 * time.Millisecond)
+	b := newBackend(bec, "127.0.0.1:8080", "")
+	b.rt.rt = slowRT(20 * time.Millisecond)
+
+	for i := 0; !b.Degraded(); i++ {
+		if i > 30 {
+			t.Fatal("backend not degraded after 30 seconds of slow requests")
+		}
+		req, err := http.NewRequest("GET", "http://127.0.0.1:8080/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := b.Transport().RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		b.update(time.Second)
+	}
+	if !b.Healthy() {
+		t.Fatal("degraded backend should still be healthy")
+	}
+	if lat := time.Duration(b.Statistics().Latency.Value()); lat < 10*time.Millisecond {
+		t.Fatal("expected latency above threshold, got", lat)
+	}
+
+	// Without slow requests it should recover.
+	for i := 0; b.Degraded(); i++ {
+		if i > 100 {
+			t.Fatal("backend still degraded after 100 seconds without requests")
+		}
+		b.update(time.Second)
+	}
+}
+
+// Test that the first health checks of backends created
+// at the same time are spread over the health interval.
+func TestHealthCheckJitter(t *testing.T) {
+	const n = 50
+	var mu sync.Mutex
+	first := make(map[string]time.Duration)
+	start := time.Now()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if _, ok := first[r.URL.Path]; !ok {
+			first[r.URL.Path] = time.Since(start)
+		}
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	bec := valid_config.Backend
+	for i := 0; i < n; i++ {
+		b := newBackend(bec, "127.0.0.1:8080", fmt.Sprintf("%s/%d", srv.URL, i))
+		defer b.Close()
+	}
+
+	deadline := time.Now().Add(healthInterval + time.Second)
+	for {
+		mu.Lock()
+		got := len(first)
+		mu.Unlock()
+		if got == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d backends were checked within the interval", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	min, max := healthInterval, time.Duration(0)
+	for _, d := range first {
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	if max-min < healthInterval/2 {
+		t.Fatalf("first health checks were not spread over the interval: first %v, last %v", min, max)
+	}
+}
+
+// Test that failed health checks during the grace period
+// don't mark a backend unhealthy.
+func TestHealthGracePeriod(t *testing.T) {
+	var ok int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ok) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	bec.HealthGrace = Duration(time.Hour)
+	b := newBackend(bec, "127.0.0.1:8080", ts.URL)
+	defer b.Close()
+
+	// Failures should not make a new backend healthy.
+	for i := 0; i < 10; i++ {
+		b.update(time.Second)
+	}
+	if b.Healthy() {
+		t.Fatal("backend should not be healthy while health checks fail")
+	}
+	atomic.StoreInt32(&ok, 1)
+	b.update(time.Second)
+	if !b.Healthy() {
+		t.Fatal("backend should be healthy after a successful health check")
+	}
+
+	// Failures during the grace period should be ignored.
+	atomic.StoreInt32(&ok, 0)
+	for i := 0; i < 10; i++ {
+		b.update(time.Second)
+	}
+	if !b.Healthy() {
+		t.Fatal("backend was marked unhealthy during the grace period")
+	}
+
+	// After the grace period failures are counted.
+	b.Stats.mu.Lock()
+	b.graceUntil = time.Now()
+	b.Stats.mu.Unlock()
+	for i := 0; i < 6; i++ {
+		b.update(time.Second)
+	}
+	if b.Healthy() {
+		t.Fatal("backend should be unhealthy after failing health checks")
+	}
+
+	// The grace period of droplets starts when they were started.
+	d := Droplet{ID: 1, ServerHost: "127.0.0.1:8080", Started: time.Now().Add(-2 * time.Hour)}
+	db := NewDropletBackend(d, bec).(*DropletBackend)
+	defer db.Close()
+	if db.graceUntil.After(time.Now()) {
+		t.Fatal("grace period of droplet started 2 hours ago should be over, ends", db.graceUntil)
+	}
+	d.Started = time.Now()
+	db = NewDropletBackend(d, bec).(*DropletBackend)
+	defer db.Close()
+	if !db.graceUntil.After(time.Now()) {
+		t.Fatal("grace period of new droplet should not be over")
+	}
+}
+
+// Test that droplet settings are applied before
+// the backend is monitored. Run with -race.
+func TestDropletBackendMonitor(t *testing.T) {
+	var checks int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&checks, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	bec := valid_config.Backend
+	bec.DisableHealth = false
+	bec.HealthGrace = Duration(time.Hour)
+	d := Droplet{ID: 1, ServerHost: "127.0.0.1:8080", HealthURL: ts.URL, Started: time.Now(), Weight: 2}
+	b := NewDropletBackend(d, bec)
+	defer b.Close()
+
+	// The second check starts after the first has been counted.
+	deadline := time.Now().Add(2*healthInterval + time.Second)
+	for atomic.LoadInt32(&checks) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("backend not checked twice after", 2*healthInterval+time.Second)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b.Healthy() {
+		t.Fatal("backend with failing health checks should not be healthy")
+	}
+}
+
+// Test that backends can be assumed healthy until the first health check.
+func TestBackendAssumeHealthy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	b := newBackend(bec, "127.0.0.1:8080", ts.URL)
+	if b.Healthy() {
+		t.Fatal("backend should not be healthy before a health check")
+	}
+	b.Close()
+
+	bec.AssumeHealthy = true
+	b = newBackend(bec, "127.0.0.1:8080", ts.URL)
+	defer b.Close()
+	if !b.Healthy() {
+		t.Fatal("backend should be assumed healthy before a health check")
+	}
+	b.update(time.Second)
+	if b.Healthy() {
+		t.Fatal("backend should be unhealthy after the first health check failed")
+	}
+}
+
+// Test that no more than 'health-check-concurrency' health checks
+// run at once, even if all backends are checked together.
+func TestHealthCheckConcurrency(t *testing.T) {
+	const limit = 4
+	var running, most int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}))
+	defer srv.Close()
+
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	bec.HealthLimit = limit
+	bec.healthLimits = &healthLimiter{}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		b := newBackend(bec, srv.Listener.Addr().String(), srv.URL)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !b.checkHealth() {
+				t.Error("health check failed")
+			}
+		}()
+	}
+	wg.Wait()
+	if most > limit {
+		t.Fatalf("expected at most %d concurrent health checks, got %d", limit, most)
+	}
+	if most == 0 {
+		t.Fatal("no health checks were made")
+	}
+
+	// Backends of another server don't share the limit.
+	other := (&healthLimiter{}).semaphore(limit)
+	if other == nil || other == bec.healthLimits.semaphore(limit) {
+		t.Fatal("servers should not share the health check limit")
+	}
+}
@@ -2,11 +2,15 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"html/template"
-	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,17 +20,55 @@ import (
 // Config contains the main server configuration
 // This maps directly to the main config file.
 type Config struct {
-	Bind          string          `toml:"bind"`
-	Https         bool            `toml:"https"`
-	CertFile      string          `toml:"tls-cert-file"`
-	KeyFile       string          `toml:"tls-key-file"`
-	AddForwarded  bool            `toml:"add-x-forwarded-for"`
-	WatchConfig   bool            `toml:"watch-config"` // Watch the configuration file for changes
-	LoadBalancing LBConfig        `toml:"loadbalancing"`
-	InventoryFile string          `toml:"inventory-file"`
-	Backend       BackendConfig   `toml:"backend"`
-	Provision     ProvisionConfig `toml:"provisioning"`
-	DO            DOConfig        `toml:"do-provisioner"`
+	Bind                string           `toml:"bind"`
+	Https               bool             `toml:"https"`
+	CertFile            string           `toml:"tls-cert-file"`
+	KeyFile             string           `toml:"tls-key-file"`
+	H2C                 bool             `toml:"h2c"`                    // Accept HTTP/2 without TLS, for example from gRPC clients.
+	CertDir             string           `toml:"tls-cert-dir"`           // Directory with certificates selected by SNI.
+	ClientCAFile        string           `toml:"tls-client-ca-file"`     // CA used to verify client certificates.
+	ClientAuth          string           `toml:"tls-client-auth"`        // Client certificate policy.
+	ClientCertHdr       string           `toml:"tls-client-cert-header"` // Send client certificate subject to backends in this header.
+	AddForwarded        bool             `toml:"add-x-forwarded-for"`
+	AddRealIP           bool             `toml:"add-x-real-ip"`         // Add "X-Real-IP" header.
+	JSONErrors          bool             `toml:"json-errors"`           // Return errors as JSON to clients preferring it.
+	RewriteLocation     bool             `toml:"rewrite-location"`      // Replace the backend host in redirects.
+	RewriteCookieDomain bool             `toml:"rewrite-cookie-domain"` // Replace the backend host in cookie domains.
+	AddProto            bool             `toml:"add-x-forwarded-proto"` // Add "X-Forwarded-Proto" header.
+	AddPort             bool             `toml:"add-x-forwarded-port"`  // Add "X-Forwarded-Port" header.
+	AddHost             bool             `toml:"add-x-forwarded-host"`  // Add "X-Forwarded-Host" header.
+	AddServedBy         bool             `toml:"add-x-served-by"`       // Add "X-Served-By" response header with the backend ID.
+	AddServedByHost     bool             `toml:"add-x-served-by-host"`  // Add "X-Served-By-Host" response header with the backend host.
+	WatchConfig         bool             `toml:"watch-config"`          // Watch the configuration file for changes
+	LogLevel            string           `toml:"log-level"`             // Minimum level of logged messages.
+	AdminToken          string           `toml:"admin-token"`           // Bearer token required by admin endpoints. Empty disables them.
+	LogConfig           bool             `toml:"log-config"`            // Log the effective configuration at startup, with secrets redacted.
+	LoadBalancing       LBConfig         `toml:"loadbalancing"`
+	InventoryFile       string           `toml:"inventory-file"`       // Inventory file or http(s) URL.
+	InventoryPoll       Duration         `toml:"inventory-poll"`       // Poll interval if the inventory is a URL.
+	InventorySnapshots  int              `toml:"inventory-snapshots"`  // Number of inventory snapshots kept when it is saved. 0 disables.
+	InventoryRollback   bool             `toml:"inventory-rollback"`   // Restore the newest good snapshot if the inventory cannot be read.
+	RequireBackends     bool             `toml:"require-backends"`     // Refuse to start if the inventory has no backends.
+	MaxHeaderBytes      int              `toml:"max-header-bytes"`     // Maximum size of request headers. 0 uses the Go default.
+	MaxURLLength        int              `toml:"max-url-length"`       // Maximum length of the request path and query. 0 means no limit.
+	MaxClientRequests   int              `toml:"max-client-requests"`  // Maximum concurrent requests from a single client IP. 0 means no limit.
+	MaxBackendRequests  int              `toml:"max-backend-requests"` // Maximum concurrent requests to all backends. 0 means no limit.
+	ShutdownTimeout     Duration         `toml:"shutdown-timeout"`     // Time to let running requests finish when shutting down. 0 uses 1 second.
+	AllowMethods        []string         `toml:"allow-methods"`        // Only these request methods are proxied. Empty allows all.
+	DenyMethods         []string         `toml:"deny-methods"`         // Requests with these methods are rejected.
+	Backend             BackendConfig    `toml:"backend"`
+	Provision           ProvisionConfig  `toml:"provisioning"`
+	DO                  DOConfig         `toml:"do-provisioner"`
+	CORS                CORSConfig       `toml:"cors"`
+	BasicAuth           BasicAuthConfig  `toml:"basic-auth"`
+	WebSocket           WebSocketConfig  `toml:"websocket"`
+	Statsd              StatsdConfig     `toml:"statsd"`
+	Tracing             TracingConfig    `toml:"tracing"`
+	Listener            []ListenerConfig `toml:"listener"` // If set, 'bind', 'https' and the TLS files are ignored.
+	Routes              []RouteConfig    `toml:"route"`    // Send requests with a path prefix to other backends.
+	MethodPools         MethodPoolConfig `toml:"method-pools"`
+	Shadow              ShadowConfig     `toml:"shadow"`
+	Record              RecordConfig     `toml:"record"`
 }
 
 // ReadConfigFile will open the file with the supplied name
@@ -46,7 +88,8 @@ func ReadConfigFile(file string) (*Config, error) {
 		return nil, err
 	}
 
-	config := Config{}
+	// Defaults for values that are true if not set.
+	config := Config{DO: DOConfig{PrivateNetworking: true}}
 	err = toml.NewDecoder(&buf).Decode(&config)
 	if err != nil {
 		return nil, err
@@ -70,16 +113,19 @@ func (s *Server) ReadConfig(file string, init bool) error {
 		return err
 	}
 	if init {
+		config.Backend = s.withServer(config.Backend)
 		s.mu.Lock()
 		s.Config = *config
 		s.mu.Unlock()
-		return nil
+		s.log.setLevel(logLevels[config.LogLevel])
+		s.tracer.set(config.Tracing, s.log)
+		return s.metrics.set(config.Statsd)
 	}
 	err = s.UpdateConfig(*config)
 	if err != nil {
 		return err
 	}
-	log.Println("Loaded configuration", file)
+	s.log.Infof("Loaded configuration %s", file)
 
 	return nil
 }
@@ -87,6 +133,7 @@ func (s *Server) ReadConfig(file string, init bool) error {
 // UpdateConfig will check and apply a revised config.
 // If the new config results in an error, the old config will remain.
 func (s *Server) UpdateConfig(new Config) (err error) {
+	new.Backend = s.withServer(new.Backend)
 	s.mu.Lock()
 	old := s.Config
 
@@ -112,21 +159,109 @@ func (s *Server) UpdateConfig(new Config) (err error) {
 	if old.KeyFile != new.KeyFile {
 		return fmt.Errorf("cannot modify 'tls-keyfile' while server is running. restart to apply.")
 	}
-	// New inventory file.
+	if old.H2C != new.H2C {
+		return fmt.Errorf("cannot modify 'h2c' while server is running. restart to apply.")
+	}
+	if !reflect.DeepEqual(old.Listener, new.Listener) {
+		return fmt.Errorf("cannot modify 'listener' while server is running. restart to apply.")
+	}
+	if old.ClientCAFile != new.ClientCAFile {
+		return fmt.Errorf("cannot modify 'tls-client-ca-file' while server is running. restart to apply.")
+	}
+	if old.ClientAuth != new.ClientAuth {
+		return fmt.Errorf("cannot modify 'tls-client-auth' while server is running. restart to apply.")
+	}
+	if old.CertDir != new.CertDir {
+		return fmt.Errorf("cannot modify 'tls-cert-dir' while server is running. restart to apply.")
+	}
+	if old.MaxHeaderBytes != new.MaxHeaderBytes {
+		return fmt.Errorf("cannot modify 'max-header-bytes' while server is running. restart to apply.")
+	}
+	if old.ShutdownTimeout != new.ShutdownTimeout {
+		return fmt.Errorf("cannot modify 'shutdown-timeout' while server is running. restart to apply.")
+	}
+	// New inventory file or load balancer.
+	// If neither changed, the current load balancer is kept.
 	var newLB LoadBalancer
-	if old.InventoryFile != new.InventoryFile {
-		inv, err := ReadInventory(new.InventoryFile, new.Backend)
+	if old.InventoryFile != new.InventoryFile || old.LoadBalancing != new.LoadBalancing {
+		inv, err := s.readInventory(new.InventoryFile, new.Backend)
 		if err != nil {
 			return err
 		}
-		newLB, err = NewLoadBalancer(s.Config.LoadBalancing, inv)
+		inv.SetSnapshots(new.InventorySnapshots)
+		newLB, err = NewLoadBalancer(new.LoadBalancing, inv)
 		if err != nil {
+			inv.Close()
 			return err
 		}
 	}
-	s.handler.SetBackends(newLB)
+	// New routes.
+	var routes []route
+	routesChanged := !reflect.DeepEqual(old.Routes, new.Routes) || old.MethodPools != new.MethodPools
+	if routesChanged {
+		routes, err = s.loadRoutes(new)
+		if err != nil {
+			if newLB != nil {
+				newLB.Close()
+			}
+			return err
+		}
+	}
+	// New shadow pool.
+	var shadow LoadBalancer
+	shadowChanged := old.Shadow.InventoryFile != new.Shadow.InventoryFile || old.LoadBalancing != new.LoadBalancing
+	if shadowChanged {
+		shadow, err = s.loadShadow(new)
+		if err != nil {
+			if newLB != nil {
+				newLB.Close()
+			}
+			for _, r := range routes {
+				r.balancer.Close()
+			}
+			return err
+		}
+	}
+	// New recorder. It is opened before anything is changed,
+	// so the configuration is not partially applied if it fails.
+	var rec *recorder
+	recordChanged := old.Record != new.Record
+	if recordChanged {
+		rec, err = newRecorder(new.Record, s.log)
+		if err != nil {
+			if newLB != nil {
+				newLB.Close()
+			}
+			for _, r := range routes {
+				r.balancer.Close()
+			}
+			if shadow != nil {
+				shadow.Close()
+			}
+			return err
+		}
+	}
+	if newLB != nil {
+		s.handler.SetBackends(newLB)
+	}
+	if routesChanged {
+		s.handler.setRoutes(routes)
+	}
+	if shadowChanged {
+		s.handler.setShadow(shadow)
+	}
 	s.handler.SetConfig(new)
 	s.Config = new
+	s.log.setLevel(logLevels[new.LogLevel])
+	if old.Tracing != new.Tracing {
+		s.tracer.set(new.Tracing, s.log)
+	}
+	if recordChanged {
+		s.handler.setRecorder(rec)
+	}
+	if old.Statsd != new.Statsd {
+		err = s.metrics.set(new.Statsd)
+	}
 	return
 }
 
@@ -134,11 +269,71 @@ func (s *Server) UpdateConfig(new Config) (err error) {
 // The function will validate all subobjects as well.
 // Will return an error with the first problem found.
 func (c Config) Validate() error {
-	if c.Https && c.CertFile == "" {
-		return fmt.Errorf("HTTPS requested, but no 'tls-cert-file' specified")
+	for _, l := range c.Listeners() {
+		err := l.Validate()
+		if err != nil {
+			return err
+		}
+		if l.RedirectHTTPS {
+			if _, ok := c.httpsPort(); !ok {
+				return fmt.Errorf("listener %q: 'redirect-https' requires a HTTPS listener", l.Bind)
+			}
+		}
+	}
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		return fmt.Errorf("unknown 'log-level' = '%s'", c.LogLevel)
+	}
+	auth, ok := clientAuthTypes[c.ClientAuth]
+	if !ok {
+		return fmt.Errorf("unknown 'tls-client-auth' = '%s'", c.ClientAuth)
+	}
+	if auth >= tls.VerifyClientCertIfGiven && c.ClientCAFile == "" {
+		return fmt.Errorf("'tls-client-auth' = '%s' requires 'tls-client-ca-file'", c.ClientAuth)
+	}
+	if c.CertDir != "" {
+		if err := isDir(c.CertDir); err != nil {
+			return fmt.Errorf("invalid 'tls-cert-dir': %v", err)
+		}
+	}
+	prefixes := make(map[string]bool, len(c.Routes))
+	for _, r := range c.Routes {
+		err := r.Validate()
+		if err != nil {
+			return err
+		}
+		if prefixes[r.PathPrefix] {
+			return fmt.Errorf("route: 'path-prefix' = '%s' is used more than once", r.PathPrefix)
+		}
+		prefixes[r.PathPrefix] = true
+	}
+	if c.InventoryPoll < 0 {
+		return fmt.Errorf("'inventory-poll' = '%s' cannot be negative", c.InventoryPoll)
 	}
-	if c.Https && c.KeyFile == "" {
-		return fmt.Errorf("HTTPS requested, but no 'tls-key-file' specified")
+	if c.InventorySnapshots < 0 {
+		return fmt.Errorf("'inventory-snapshots' = '%d' cannot be negative", c.InventorySnapshots)
+	}
+	if c.InventoryRollback && c.InventorySnapshots == 0 {
+		return fmt.Errorf("'inventory-rollback' requires 'inventory-snapshots' to be set")
+	}
+	if c.MaxHeaderBytes < 0 {
+		return fmt.Errorf("'max-header-bytes' = %d cannot be negative", c.MaxHeaderBytes)
+	}
+	if c.MaxURLLength < 0 {
+		return fmt.Errorf("'max-url-length' = %d cannot be negative", c.MaxURLLength)
+	}
+	if c.MaxClientRequests < 0 {
+		return fmt.Errorf("'max-client-requests' = %d cannot be negative", c.MaxClientRequests)
+	}
+	if c.MaxBackendRequests < 0 {
+		return fmt.Errorf("'max-backend-requests' = %d cannot be negative", c.MaxBackendRequests)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("'shutdown-timeout' = %v cannot be negative", c.ShutdownTimeout)
+	}
+	for _, m := range append(append([]string{}, c.AllowMethods...), c.DenyMethods...) {
+		if m == "" || m != strings.ToUpper(m) || strings.ContainsAny(m, " \t") {
+			return fmt.Errorf("'%s' is not a valid method in 'allow-methods' or 'deny-methods'", m)
+		}
 	}
 	err := c.LoadBalancing.Validate()
 	if err != nil {
@@ -156,12 +351,56 @@ func (c Config) Validate() error {
 	if err != nil {
 		return err
 	}
+	if c.Provision.UnhealthyAction == "destroy" && !c.DO.Enable {
+		return fmt.Errorf("provisioning: 'unhealthy-action' = 'destroy' requires 'do-provisioner' to be enabled")
+	}
+	err = c.CORS.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.WebSocket.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.BasicAuth.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.Record.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.Statsd.Validate()
+	if err != nil {
+		return err
+	}
+	if (c.LoadBalancing.Type == "loadweighted" || c.LoadBalancing.WebSocketType == "loadweighted") && c.Backend.LoadHeader == "" {
+		return fmt.Errorf("loadbalancing: \"loadweighted\" requires 'load-header' in [backend]")
+	}
+	err = c.Shadow.Validate()
+	if err != nil {
+		return err
+	}
+	err = c.Tracing.Validate()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
 // LBConfig contains settings for the load balancer.
 type LBConfig struct {
-	Type string `toml:"type"`
+	Type          string   `toml:"type"`
+	RandomStart   bool     `toml:"random-start"`      // Start round-robin at a random backend.
+	RouteHeader   string   `toml:"route-header"`      // Select backends where the label matches the value of this request header.
+	RouteLabel    string   `toml:"route-label"`       // Label to match against 'route-header'.
+	WebSocketType string   `toml:"websocket-type"`    // Load balancer type for websocket upgrades. Empty uses 'type'.
+	StickyCookie  string   `toml:"sticky-cookie"`     // Send clients back to the same backend using this cookie. Empty disables.
+	StickyTTL     Duration `toml:"sticky-cookie-ttl"` // Lifetime of the sticky cookie. 0 uses a session cookie.
+
+	// Make "leastconn" compare a moving average of the connections,
+	// sampled every second, instead of the current number.
+	SmoothConnections bool `toml:"smooth-connections"`
 }
 
 // Validate if settings in the load balancer configuration
@@ -170,10 +409,30 @@ func (c LBConfig) Validate() error {
 	if c.Type == "" {
 		return fmt.Errorf("loadbalancing: No 'type' specified")
 	}
+	if (c.RouteHeader == "") != (c.RouteLabel == "") {
+		return fmt.Errorf("loadbalancing: 'route-header' and 'route-label' must be set together")
+	}
+	if c.StickyCookie != "" && !validCookieName(c.StickyCookie) {
+		return fmt.Errorf("loadbalancing: 'sticky-cookie' = '%s' is not a valid cookie name", c.StickyCookie)
+	}
+	if c.StickyTTL < 0 {
+		return fmt.Errorf("loadbalancing: 'sticky-cookie-ttl' cannot be negative")
+	}
+	if c.SmoothConnections && c.Type != "leastconn" && c.WebSocketType != "leastconn" {
+		return fmt.Errorf("loadbalancing: 'smooth-connections' requires \"leastconn\" in 'type' or 'websocket-type'")
+	}
 	_, err := NewLoadBalancer(c, nil)
 	if err != nil {
 		return err
 	}
+	if c.WebSocketType != "" {
+		wsc := c
+		wsc.Type = c.WebSocketType
+		_, err := NewLoadBalancer(wsc, nil)
+		if err != nil {
+			return fmt.Errorf("loadbalancing: 'websocket-type': %v", err)
+		}
+	}
 	return nil
 }
 
@@ -181,13 +440,58 @@ func (c LBConfig) Validate() error {
 // backends. This information is mainly used to
 // instantiate and destroy backends on demand.
 type BackendConfig struct {
-	DialTimeout   Duration `toml:"dial-timeout"`            // Timeout for connecting to a backend.
-	LatencyAvg    int      `toml:"latency-average-seconds"` // Measure latency over this many seconds
-	HealthTimeout Duration `toml:"health-check-timeout"`    // Timeout for a health check. Should be less than 1 second.
-	HostPort      int      `toml:"new-host-port"`           // Host port the proxy should connect to.
-	HealthPath    string   `toml:"new-host-health-path"`    // Health path to use.
-	HealthHTTPS   bool     `toml:"new-host-health-https"`   // Set to true if the health check on new backs is https.
-	DisableHealth bool     `toml:"disable-health-check"`    // Disable health checks.
+	DialTimeout      Duration `toml:"dial-timeout"`             // Timeout for connecting to a backend.
+	LatencyAvg       int      `toml:"latency-average-seconds"`  // Measure latency over this many seconds
+	FailureAvg       int      `toml:"failure-average-seconds"`  // Measure the failure rate over this many seconds. 0 uses 10.
+	HealthTimeout    Duration `toml:"health-check-timeout"`     // Timeout for a health check. Should be less than 1 second.
+	HostPort         int      `toml:"new-host-port"`            // Host port the proxy should connect to.
+	HealthPath       string   `toml:"new-host-health-path"`     // Health path to use.
+	HealthPort       int      `toml:"new-host-health-port"`     // Port for health checks. 0 uses 'new-host-port'.
+	HealthHTTPS      bool     `toml:"new-host-health-https"`    // Set to true if the health check on new backs is https.
+	DisableHealth    bool     `toml:"disable-health-check"`     // Disable health checks.
+	MaxIdleConns     int      `toml:"max-idle-conns-per-host"`  // Maximum idle connections kept per backend. 0 uses the default.
+	IdleTimeout      Duration `toml:"idle-conn-timeout"`        // Close idle backend connections after this time. 0 means no limit.
+	RebootTimeout    Duration `toml:"reboot-health-timeout"`    // How long to wait for a rebooted backend to become healthy. 0 uses 5 minutes.
+	MaxFailureRate   float64  `toml:"max-failure-rate"`         // Mark backend unhealthy if the failure rate of requests is above this. 0 disables.
+	RequestTimeout   Duration `toml:"request-timeout"`          // Maximum time for a request to a backend. 0 means no limit.
+	RetryAttempts    int      `toml:"retry-attempts"`           // Retry failed GET, HEAD and OPTIONS requests without a body this many times.
+	RequestBudget    Duration `toml:"request-budget"`           // Maximum time for a request including retries. 0 means no limit.
+	DegradedLatency  Duration `toml:"degraded-latency"`         // Prefer other backends if latency is above this. 0 disables.
+	LoadHeader       string   `toml:"load-header"`              // Response header where backends report their load from 0 to 1. Used by "loadweighted".
+	Protocol         string   `toml:"protocol"`                 // Protocol used for requests to backends. "http1" (default) or "h2c".
+	PassCompression  bool     `toml:"pass-compression"`         // Don't request and decompress gzip, so compressed responses pass through untouched.
+	HealthGrace      Duration `toml:"health-grace-period"`      // Health check failures of new backends are not counted for this long.
+	AssumeHealthy    bool     `toml:"assume-healthy"`           // Send traffic to new backends before the first health check.
+	HealthExpectBody string   `toml:"health-check-expect-body"` // Health checks fail if the response doesn't contain this.
+	DrainTimeout     Duration `toml:"drain-timeout"`            // How long 'destroy' waits for connections to a backend to finish. 0 uses 30 seconds.
+	HealthMethod     string   `toml:"health-check-method"`      // HTTP method used for health checks. Default is GET.
+	HealthInsecure   bool     `toml:"health-check-insecure"`    // Don't verify certificates of HTTPS health checks.
+	HealthCAFile     string   `toml:"health-check-ca-file"`     // Verify certificates of HTTPS health checks with these CAs.
+	HealthLimit      int      `toml:"health-check-concurrency"` // Maximum health checks running at once for all backends. 0 means no limit.
+
+	// Services backends depend on. Backends are unhealthy while one is failing.
+	Dependencies []DependencyConfig `toml:"dependency"`
+
+	// Log, 'statsd' client, span exporter and health check limit of
+	// the server using the configuration. They are set by the server
+	// and not read from the configuration file.
+	log          *serverLog
+	metrics      *serverMetrics
+	tracer       *serverTracer
+	healthLimits *healthLimiter
+}
+
+// protocolH2C is the backend 'protocol' for HTTP/2 without TLS,
+// for example for gRPC backends.
+const protocolH2C = "h2c"
+
+// validProtocol returns an error if p is not a known backend protocol.
+func validProtocol(p string) error {
+	switch p {
+	case "", "http1", protocolH2C:
+		return nil
+	}
+	return fmt.Errorf("unknown 'protocol' = '%s'", p)
 }
 
 // Validate backend configuration.
@@ -206,22 +510,126 @@ func (c BackendConfig) Validate() error {
 	if c.LatencyAvg <= 0 {
 		return fmt.Errorf("'latency-average-seconds' = '%d' cannot be 0 or negative", c.LatencyAvg)
 	}
+	if c.FailureAvg < 0 {
+		return fmt.Errorf("'failure-average-seconds' = '%d' cannot be negative", c.FailureAvg)
+	}
+	if c.HealthPath != "" && !strings.HasPrefix(c.HealthPath, "/") {
+		return fmt.Errorf("'new-host-health-path' = '%s' must start with '/'", c.HealthPath)
+	}
+	if c.HealthPort < 0 || c.HealthPort > 65535 {
+		return fmt.Errorf("'new-host-health-port' = '%d' is not a valid port", c.HealthPort)
+	}
+	if c.MaxIdleConns < 0 {
+		return fmt.Errorf("'max-idle-conns-per-host' = '%d' cannot be negative", c.MaxIdleConns)
+	}
+	if c.HealthLimit < 0 {
+		return fmt.Errorf("'health-check-concurrency' = '%d' cannot be negative", c.HealthLimit)
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("'idle-conn-timeout' = '%s' cannot be negative", c.IdleTimeout)
+	}
+	if c.RebootTimeout < 0 {
+		return fmt.Errorf("'reboot-health-timeout' = '%s' cannot be negative", c.RebootTimeout)
+	}
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("'request-timeout' = '%s' cannot be negative", c.RequestTimeout)
+	}
+	if c.RetryAttempts < 0 {
+		return fmt.Errorf("'retry-attempts' = '%d' cannot be negative", c.RetryAttempts)
+	}
+	if c.RequestBudget < 0 {
+		return fmt.Errorf("'request-budget' = '%s' cannot be negative", c.RequestBudget)
+	}
+	if c.DegradedLatency < 0 {
+		return fmt.Errorf("'degraded-latency' = '%s' cannot be negative", c.DegradedLatency)
+	}
+	if c.HealthGrace < 0 {
+		return fmt.Errorf("'health-grace-period' = '%s' cannot be negative", c.HealthGrace)
+	}
+	if err := validProtocol(c.Protocol); err != nil {
+		return err
+	}
+	for _, d := range c.Dependencies {
+		if err := d.Validate(); err != nil {
+			return err
+		}
+	}
+	switch c.HealthMethod {
+	case "", "GET", "POST", "OPTIONS":
+	case "HEAD":
+		if c.HealthExpectBody != "" {
+			return fmt.Errorf("'health-check-expect-body' cannot be used with 'health-check-method' = 'HEAD'")
+		}
+	default:
+		return fmt.Errorf("'health-check-method' = '%s' must be GET, HEAD, POST or OPTIONS", c.HealthMethod)
+	}
+	if c.DrainTimeout < 0 {
+		return fmt.Errorf("'drain-timeout' = '%s' cannot be negative", c.DrainTimeout)
+	}
+	if c.MaxFailureRate < 0 || c.MaxFailureRate >= 1 {
+		return fmt.Errorf("'max-failure-rate' = '%g' must be at least 0 and less than 1", c.MaxFailureRate)
+	}
+	if _, err := c.HealthTLSConfig(); err != nil {
+		return err
+	}
 	return nil
 }
 
 // DigitalOcean provisioning config
 type DOConfig struct {
-	Enable     bool   `toml:"enable"`
-	HostPrefix string `toml:"hostname-prefix"`
-	Region     string `toml:"region"`
-	Size       string `toml:"size"`
-	Image      string `toml:"image"`
-	UserData   string `toml:"user-data"`
-	Backups    bool   `toml:"backups"`
-	Token      string `toml:"token"`
-	SSHKeyID   []int  `toml:"ssh-key-ids"`
+	Enable            bool              `toml:"enable"`
+	HostPrefix        string            `toml:"hostname-prefix"`
+	Region            string            `toml:"region"`
+	Size              string            `toml:"size"`
+	Image             string            `toml:"image"`
+	UserData          string            `toml:"user-data"`
+	Backups           bool              `toml:"backups"`
+	Token             string            `toml:"token"`
+	SSHKeyID          []int             `toml:"ssh-key-ids"`
+	APIBaseURL        string            `toml:"api-base-url"`       // Optional. Use another DO compatible API endpoint.
+	PrivateNetworking bool              `toml:"private-networking"` // Enable private networking on new droplets. True if not set.
+	VPCUUID           string            `toml:"vpc-uuid"`           // Optional. Create droplets in this VPC.
+	Pools             map[string]DOSpec `toml:"pools"`              // Optional. Droplet parameters of named pools.
+}
+
+// DOSpec contains the droplet parameters that can be set per pool.
+// Empty values use the value of the [do-provisioner] section.
+type DOSpec struct {
+	Region   string `toml:"region"`
+	Size     string `toml:"size"`
+	Image    string `toml:"image"`
+	UserData string `toml:"user-data"`
+}
+
+// Spec returns the droplet parameters of the pool.
+// If pool is empty, the [do-provisioner] values are returned.
+func (c DOConfig) Spec(pool string) (DOSpec, error) {
+	spec := DOSpec{Region: c.Region, Size: c.Size, Image: c.Image, UserData: c.UserData}
+	if pool == "" {
+		return spec, nil
+	}
+	p, ok := c.Pools[pool]
+	if !ok {
+		return spec, fmt.Errorf("unknown droplet pool %q", pool)
+	}
+	if p.Region != "" {
+		spec.Region = p.Region
+	}
+	if p.Size != "" {
+		spec.Size = p.Size
+	}
+	if p.Image != "" {
+		spec.Image = p.Image
+	}
+	if p.UserData != "" {
+		spec.UserData = p.UserData
+	}
+	return spec, nil
 }
 
+// vpcUUID matches a VPC UUID.
+var vpcUUID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
 func (c DOConfig) Validate() error {
 	if !c.Enable {
 		return nil
@@ -229,6 +637,76 @@ func (c DOConfig) Validate() error {
 	if c.Token == "" {
 		return fmt.Errorf("No 'token' specified")
 	}
+	if c.APIBaseURL != "" {
+		u, err := url.Parse(c.APIBaseURL)
+		if err != nil {
+			return fmt.Errorf("'api-base-url' = '%s' is not a valid URL: %v", c.APIBaseURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("'api-base-url' = '%s' must be a http or https URL", c.APIBaseURL)
+		}
+	}
+	if c.VPCUUID != "" && !vpcUUID.MatchString(c.VPCUUID) {
+		return fmt.Errorf("'vpc-uuid' = '%s' is not a valid UUID", c.VPCUUID)
+	}
+	for name := range c.Pools {
+		if name == "" {
+			return fmt.Errorf("'pools' cannot have an empty pool name")
+		}
+	}
+	return nil
+}
+
+// CORSConfig contains settings for answering
+// CORS requests at the proxy.
+type CORSConfig struct {
+	Enable         bool     `toml:"enable"`
+	AllowedOrigins []string `toml:"allowed-origins"` // Origins allowed. Use "*" to allow all.
+	AllowedMethods []string `toml:"allowed-methods"` // Methods returned on preflight requests.
+	AllowedHeaders []string `toml:"allowed-headers"` // Headers returned on preflight requests.
+	MaxAge         Duration `toml:"max-age"`         // How long clients may cache preflight responses.
+}
+
+// Validate CORS configuration.
+func (c CORSConfig) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("cors: 'allowed-origins' must contain at least one origin")
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("cors: 'max-age' cannot be negative")
+	}
+	return nil
+}
+
+// WebSocketConfig contains limits for proxied websocket connections.
+type WebSocketConfig struct {
+	IdleTimeout  Duration `toml:"idle-timeout"`    // Close connections with no traffic for this long. 0 means no limit.
+	MaxBytes     int64    `toml:"max-bytes"`       // Close connections after this many bytes in either direction. 0 means no limit.
+	MaxConns     int      `toml:"max-connections"` // Maximum number of open websocket connections. 0 means no limit.
+	DialAttempts int      `toml:"dial-attempts"`   // Number of times to try connecting to the backend. 0 tries once.
+	DialBackoff  Duration `toml:"dial-backoff"`    // Wait before the first retry. Doubled after every attempt. 0 uses 100ms.
+}
+
+// Validate websocket configuration.
+func (c WebSocketConfig) Validate() error {
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("websocket: 'idle-timeout' cannot be negative")
+	}
+	if c.MaxBytes < 0 {
+		return fmt.Errorf("websocket: 'max-bytes' cannot be negative")
+	}
+	if c.MaxConns < 0 {
+		return fmt.Errorf("websocket: 'max-connections' cannot be negative")
+	}
+	if c.DialAttempts < 0 {
+		return fmt.Errorf("websocket: 'dial-attempts' cannot be negative")
+	}
+	if c.DialBackoff < 0 {
+		return fmt.Errorf("websocket: 'dial-backoff' cannot be negative")
+	}
 	return nil
 }
 
@@ -259,14 +737,48 @@ type ProvisionConfig struct {
 	// How long between a new server can be provisioned.
 	UpscaleEvery Duration `toml:"upscale-every"`
 
+	// Expected time from a backend is provisioned until it is healthy.
+	// Clients are asked to retry after this, if no backend is available.
+	BootTime Duration `toml:"boot-time"`
+
 	// If a server fails this many health consequtive health checks, it will be deprovisioned.
 	// Health checks is performed every second.
 	MaxHealthFailures int `toml:"max-health-failures"`
+	// What to do with a backend that has failed 'unhealthy-remove-after' health checks.
+	// Can be "keep", "remove" from the inventory or "destroy" the droplet. Default is "keep".
+	// It applies even if provisioning is disabled.
+	UnhealthyAction string `toml:"unhealthy-action"`
+	// Consecutive failed health checks before 'unhealthy-action' is applied.
+	// Must be more than the failures that mark a backend unhealthy.
+	UnhealthyRemoveAfter int `toml:"unhealthy-remove-after"`
+
+	// Daily time ranges in UTC where no backends will be provisioned or deprovisioned.
+	// Each range is specified as "15:04-15:04", and may cross midnight.
+	MaintenanceWindows []string `toml:"maintenance-windows"`
+
+	// Add up to this fraction of 'upscale-every' and 'downscale-every' at random,
+	// so proxies sharing backends don't scale at the same time.
+	CooldownJitter float64 `toml:"cooldown-jitter"`
+	// If set, proxies sharing this file will not scale while another proxy is cooling down.
+	LockFile string `toml:"lock-file"`
 }
 
 // Validate provisioning configuration.
 // Will return the first error found.
 func (c ProvisionConfig) Validate() error {
+	// 'unhealthy-action' is used without provisioning.
+	switch c.UnhealthyAction {
+	case "", "keep":
+	case "remove", "destroy":
+		if c.UnhealthyRemoveAfter <= unhealthyFailures {
+			return fmt.Errorf("provisioning: 'unhealthy-remove-after' = '%d' must be more than %d with 'unhealthy-action' = '%s'", c.UnhealthyRemoveAfter, unhealthyFailures, c.UnhealthyAction)
+		}
+	default:
+		return fmt.Errorf("provisioning: unknown 'unhealthy-action' = '%s'. Must be \"keep\", \"remove\" or \"destroy\"", c.UnhealthyAction)
+	}
+	if c.UnhealthyRemoveAfter < 0 {
+		return fmt.Errorf("provisioning: 'unhealthy-remove-after' cannot be negative")
+	}
 	// We skip more checks if not enabled.
 	if !c.Enable {
 		return nil
@@ -298,6 +810,18 @@ func (c ProvisionConfig) Validate() error {
 	if c.MaxHealthFailures < 1 {
 		return fmt.Errorf("provisioning: 'max-health-failures' must be bigger than 0")
 	}
+	if c.BootTime < 0 {
+		return fmt.Errorf("provisioning: 'boot-time' cannot be negative")
+	}
+	if c.CooldownJitter < 0 || c.CooldownJitter > 1 {
+		return fmt.Errorf("provisioning: 'cooldown-jitter' = '%g' must be between 0 and 1", c.CooldownJitter)
+	}
+	for _, w := range c.MaintenanceWindows {
+		_, err := parseMaintenanceWindow(w)
+		if err != nil {
+			return fmt.Errorf("provisioning: 'maintenance-windows': %v", err)
+		}
+	}
 	return nil
 }
 
@@ -314,6 +838,12 @@ func (d *Duration) UnmarshalTOML(data []byte) error {
 	return nil
 }
 
+// MarshalTOML writes the duration as a string,
+// so it can be read by UnmarshalTOML.
+func (d Duration) MarshalTOML() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
 func (d Duration) String() string {
 	return time.Duration(d).String()
 }
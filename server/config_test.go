@@ -1,7 +1,11 @@
 package server
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -36,6 +40,8 @@ var valid_config = Config{
 		Backups:    false,
 		Token:      "878a490235d53e34b44369b8e78",
 		SSHKeyID:   []int{163420},
+		// Not in the file, so it should be the default.
+		PrivateNetworking: true,
 	},
 	Provision: ProvisionConfig{
 		Enable:            true,
@@ -57,8 +63,10 @@ func TestReadConfig(t *testing.T) {
 		t.Fatal("error loading config:", err)
 	}
 
-	if !reflect.DeepEqual(s.Config, valid_config) {
-		t.Fatalf("config mismatch:\nGot: %#v\nExpected: %#v", s.Config, valid_config)
+	v := valid_config
+	v.Backend = s.withServer(v.Backend)
+	if !reflect.DeepEqual(s.Config, v) {
+		t.Fatalf("config mismatch:\nGot: %#v\nExpected: %#v", s.Config, v)
 	}
 }
 
@@ -226,7 +234,336 @@ func TestConfigValidate(t *testing.T) {
 			v.Provision.MaxHealthFailures = -1
 			e = false
 
-		case 36: // Done
+		case 36: // Must be a http(s) URL
+			v.DO.APIBaseURL = "ftp://example.com"
+
+		case 37: // Must be a valid URL
+			v.DO.APIBaseURL = "http://%zz"
+
+		case 38: // Should pass.
+			v.DO.APIBaseURL = "http://127.0.0.1:8080/"
+			e = false
+
+		case 39: // Cannot be negative
+			v.Backend.MaxIdleConns = -1
+
+		case 40: // Cannot be negative
+			v.Backend.IdleTimeout = -1
+
+		case 41: // Should pass.
+			v.Backend.MaxIdleConns = 100
+			v.Backend.IdleTimeout = Duration(time.Minute)
+			e = false
+
+		case 42: // Cannot be negative
+			v.Backend.RebootTimeout = -1
+
+		case 43: // Invalid window
+			v.Provision.MaintenanceWindows = []string{"09:00-17:00", "25:00-26:00"}
+
+		case 44: // Should pass.
+			v.Provision.MaintenanceWindows = []string{"09:00-17:00", "22:00-02:00"}
+			e = false
+
+		case 45: // Must have origins
+			v.CORS.Enable = true
+
+		case 46: // Cannot be negative
+			v.CORS.Enable = true
+			v.CORS.AllowedOrigins = []string{"*"}
+			v.CORS.MaxAge = -1
+
+		case 47: // Should pass.
+			v.CORS.Enable = true
+			v.CORS.AllowedOrigins = []string{"*"}
+			e = false
+
+		case 48: // Cannot be negative
+			v.Backend.MaxFailureRate = -0.1
+
+		case 49: // Must be less than 1
+			v.Backend.MaxFailureRate = 1
+
+		case 50: // Should pass.
+			v.Backend.MaxFailureRate = 0.5
+			e = false
+
+		case 51: // Must start with /
+			v.Backend.HealthPath = "health"
+
+		case 52: // Should pass.
+			v.Backend.HealthPath = "/health"
+			e = false
+
+		case 53: // Cannot be negative
+			v.Backend.RequestTimeout = -1
+
+		case 54: // Unknown policy
+			v.ClientAuth = "always"
+
+		case 55: // Verification requires a CA
+			v.ClientAuth = "require-and-verify"
+
+		case 56: // Should pass.
+			v.ClientAuth = "require"
+			e = false
+
+		case 57: // Must be set together
+			v.LoadBalancing.RouteHeader = "X-Backend-Group"
+
+		case 58: // Must be set together
+			v.LoadBalancing.RouteLabel = "group"
+
+		case 59: // Should pass.
+			v.LoadBalancing.RouteHeader = "X-Backend-Group"
+			v.LoadBalancing.RouteLabel = "group"
+			e = false
+
+		case 60: // Cannot be negative
+			v.MaxHeaderBytes = -1
+
+		case 61: // Should pass.
+			v.MaxHeaderBytes = 1 << 10
+			e = false
+
+		case 62: // Cannot be negative
+			v.Backend.DrainTimeout = -1
+
+		case 63: // Listener needs certificate
+			v.Listener = []ListenerConfig{{Bind: ":443", Https: true}}
+
+		case 64: // Redirect needs a HTTPS listener
+			v.Listener = []ListenerConfig{{Bind: ":80", RedirectHTTPS: true}}
+
+		case 65: // Cannot redirect on HTTPS listener
+			v.Listener = []ListenerConfig{{Bind: ":443", Https: true, CertFile: "cert", KeyFile: "key", RedirectHTTPS: true}}
+
+		case 66: // Should pass.
+			v.Listener = []ListenerConfig{
+				{Bind: ":80", RedirectHTTPS: true},
+				{Bind: ":443", Https: true, CertFile: "cert", KeyFile: "key"},
+			}
+			e = false
+
+		case 67: // Must be between 0 and 1
+			v.Provision.CooldownJitter = 1.5
+
+		case 68: // Should pass.
+			v.Provision.CooldownJitter = 0.2
+			e = false
+
+		case 69: // Cannot be negative
+			v.WebSocket.IdleTimeout = -1
+
+		case 70: // Cannot be negative
+			v.WebSocket.MaxBytes = -1
+
+		case 71: // Cannot be negative
+			v.Provision.BootTime = -1
+
+		case 72: // Unknown method
+			v.Backend.HealthMethod = "get"
+
+		case 73: // HEAD has no body
+			v.Backend.HealthMethod = "HEAD"
+			v.Backend.HealthExpectBody = "ok"
+
+		case 74: // Should pass.
+			v.Backend.HealthMethod = "HEAD"
+			e = false
+
+		case 75: // Cannot be negative
+			v.MaxClientRequests = -1
+
+		case 76: // Directory must exist
+			v.CertDir = "testdata/nonexistent"
+
+		case 77: // Unknown websocket balancer
+			v.LoadBalancing.WebSocketType = "random"
+
+		case 78: // Should pass.
+			v.LoadBalancing.WebSocketType = "leastconn"
+			e = false
+
+		case 79: // Unknown log level
+			v.LogLevel = "verbose"
+
+		case 80: // Invalid VPC UUID
+			v.DO.VPCUUID = "my-vpc"
+
+		case 81: // Should pass.
+			v.DO.VPCUUID = "5a4981aa-9653-4bd1-bef5-d6bff52042e4"
+			e = false
+
+		case 82: // Cannot be negative
+			v.Backend.HealthGrace = -1
+
+		case 83: // Prefix must start with '/'
+			v.Routes = []RouteConfig{{PathPrefix: "api/", InventoryFile: "api.toml"}}
+
+		case 84: // Route needs inventory
+			v.Routes = []RouteConfig{{PathPrefix: "/api/"}}
+
+		case 85: // Prefixes must be unique
+			v.Routes = []RouteConfig{{PathPrefix: "/api/", InventoryFile: "api.toml"}, {PathPrefix: "/api/", InventoryFile: "api2.toml"}}
+
+		case 86: // Should pass.
+			v.Routes = []RouteConfig{{PathPrefix: "/api/", InventoryFile: "api.toml"}, {PathPrefix: "/static/", InventoryFile: "static.toml"}}
+			e = false
+
+		case 87: // Statsd address needs a port
+			v.Statsd.Address = "localhost"
+
+		case 88: // Sample rate above 1
+			v.Statsd.SampleRate = 1.5
+
+		case 89: // Sample rate is negative
+			v.Statsd.SampleRate = -0.5
+
+		case 90: // Basic auth needs users
+			v.BasicAuth.Enable = true
+
+		case 91: // Password must be a bcrypt or SHA-256 hash
+			v.BasicAuth = BasicAuthConfig{Enable: true, Users: []string{"admin:password"}}
+
+		case 92: // User must have a name
+			v.BasicAuth = BasicAuthConfig{Enable: true, Users: []string{":5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"}}
+
+		case 93: // Should pass.
+			v.BasicAuth = BasicAuthConfig{Enable: true, Users: []string{"admin:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"}}
+			e = false
+
+		case 94: // Unknown unhealthy action
+			v.Provision.UnhealthyAction = "reboot"
+
+		case 95: // Destroy needs DO provisioner
+			v.Provision.UnhealthyAction = "destroy"
+			v.Provision.UnhealthyRemoveAfter = 60
+			v.DO.Enable = false
+
+		case 96: // Websocket max connections cannot be negative
+			v.WebSocket.MaxConns = -1
+
+		case 97: // Tracing endpoint must be a URL
+			v.Tracing.Endpoint = "localhost:4318"
+
+		case 98: // Sticky cookie
+			v.LoadBalancing.StickyCookie = "DOPROXY_BE"
+			v.LoadBalancing.StickyTTL = Duration(time.Hour)
+			e = false
+
+		case 99: // Invalid sticky cookie name
+			v.LoadBalancing.StickyCookie = "do proxy"
+
+		case 100: // Negative sticky cookie TTL
+			v.LoadBalancing.StickyCookie = "DOPROXY_BE"
+			v.LoadBalancing.StickyTTL = Duration(-time.Second)
+
+		case 101: // Websocket dial attempts cannot be negative
+			v.WebSocket.DialAttempts = -1
+
+		case 102: // Websocket dial backoff cannot be negative
+			v.WebSocket.DialBackoff = -1
+
+		case 103: // Shadow sample rate must be between 0 and 1
+			v.Shadow.SampleRate = 1.5
+
+		case 104: // Snapshots cannot be negative
+			v.InventorySnapshots = -1
+
+		case 105: // Rollback requires snapshots
+			v.InventoryRollback = true
+
+		case 106: // Should pass.
+			v.InventorySnapshots = 3
+			v.InventoryRollback = true
+			e = false
+
+		case 107: // Load weighted without a load header.
+			v.LoadBalancing.Type = "loadweighted"
+
+		case 108: // Should pass.
+			v.LoadBalancing.WebSocketType = "loadweighted"
+			v.Backend.LoadHeader = "X-Load"
+			e = false
+
+		case 109: // Unknown backend protocol.
+			v.Backend.Protocol = "h3"
+
+		case 110: // Unknown route protocol.
+			v.Routes = []RouteConfig{{PathPrefix: "/grpc/", InventoryFile: "grpc.toml", Protocol: "grpc"}}
+
+		case 111: // h2c on a HTTPS listener.
+			v.Listener = []ListenerConfig{{Bind: ":443", Https: true, CertFile: "cert", KeyFile: "key", H2C: true}}
+
+		case 112: // Should pass.
+			v.H2C = true
+			v.Backend.Protocol = "http1"
+			v.Routes = []RouteConfig{{PathPrefix: "/grpc/", InventoryFile: "grpc.toml", Protocol: "h2c"}}
+			e = false
+
+		case 113: // Negative backend request limit.
+			v.MaxBackendRequests = -1
+
+		case 114: // Record sample rate out of range.
+			v.Record.SampleRate = 2
+
+		case 115: // Smoothed connections without "leastconn".
+			v.LoadBalancing.SmoothConnections = true
+		case 116: // Smoothed connections for websockets.
+			v.LoadBalancing.SmoothConnections = true
+			v.LoadBalancing.WebSocketType = "leastconn"
+			e = false
+
+		case 117: // Negative health check concurrency.
+			v.Backend.HealthLimit = -1
+
+		case 118: // Negative failure rate window.
+			v.Backend.FailureAvg = -1
+
+		case 119: // Negative retry attempts.
+			v.Backend.RetryAttempts = -1
+		case 120: // Negative request budget.
+			v.Backend.RequestBudget = Duration(-time.Second)
+
+		case 121: // Negative URL length.
+			v.MaxURLLength = -1
+
+		case 122: // Negative shutdown timeout.
+			v.ShutdownTimeout = Duration(-time.Second)
+
+		case 123: // Invalid health port.
+			v.Backend.HealthPort = 70000
+
+		case 124: // Lowercase method.
+			v.DenyMethods = []string{"trace"}
+
+		case 125: // Remove needs a threshold, even without provisioning.
+			v.Provision.Enable = false
+			v.Provision.UnhealthyAction = "remove"
+
+		case 126: // Threshold must be above the unhealthy threshold.
+			v.Provision.UnhealthyAction = "remove"
+			v.Provision.UnhealthyRemoveAfter = unhealthyFailures
+
+		case 127: // Unknown action is rejected without provisioning.
+			v.Provision.Enable = false
+			v.Provision.UnhealthyAction = "reboot"
+
+		case 128: // Should pass.
+			v.Provision.Enable = false
+			v.Provision.UnhealthyAction = "remove"
+			v.Provision.UnhealthyRemoveAfter = 60
+			e = false
+
+		case 129: // bcrypt hash is too short
+			v.BasicAuth = BasicAuthConfig{Enable: true, Users: []string{"admin:$2a$04$7vDC7BCk9ByQJq"}}
+
+		case 130: // Should pass.
+			v.BasicAuth = BasicAuthConfig{Enable: true, Users: []string{"admin:$2a$04$7vDC7BCk9ByQJq.cGOgKEunVya5SW.Rw2H55mJ9ErrnZB6Cv86CmG"}}
+			e = false
+
+		case 131: // Done
 			return
 		default:
 			t.Fatalf("test #%d not found", n)
@@ -259,6 +596,7 @@ func TestReloadConfig(t *testing.T) {
 
 	v := valid_config
 	v.WatchConfig = true
+	v.Backend = s.withServer(v.Backend)
 	s.mu.RLock()
 	if !reflect.DeepEqual(s.Config, v) {
 		t.Fatalf("config mismatch:\nGot: %#v\nExpected: %#v", s.Config, v)
@@ -289,6 +627,134 @@ func TestReloadConfig(t *testing.T) {
 	os.Remove(tmp)
 }
 
+// Test that reloading a configuration keeps routing requests,
+// whether or not the inventory file is changed.
+func TestUpdateConfigInventory(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	dir, err := ioutil.TempDir("", "doproxy-test-update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeInv := func(name string) string {
+		file := filepath.Join(dir, name)
+		inv := fmt.Sprintf("[[droplet]]\nid = 1\nname = \"web\"\nserver-host = %q\n", backend.Listener.Addr().String())
+		if err := ioutil.WriteFile(file, []byte(inv), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	conf := valid_config
+	conf.InventoryFile = writeInv("inv1.toml")
+	s := &Server{Config: conf, events: NewEvents()}
+	inv, err := s.readInventory(conf.InventoryFile, conf.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLoadBalancer(conf.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.handler = NewReverseProxyConfig(conf, lb)
+	defer func() {
+		s.handler.mu.RLock()
+		s.handler.balancer.Close()
+		s.handler.mu.RUnlock()
+	}()
+	ts := httptest.NewServer(s.handler)
+	defer ts.Close()
+
+	get := func(step string) {
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != "ok" {
+			t.Fatalf("%s: unexpected response %d %q", step, res.StatusCode, body)
+		}
+	}
+	get("initial")
+
+	// Same inventory file, other settings changed.
+	conf.AddForwarded = !conf.AddForwarded
+	conf.JSONErrors = true
+	if err := s.UpdateConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	s.handler.mu.RLock()
+	same := s.handler.balancer == lb
+	s.handler.mu.RUnlock()
+	if !same {
+		t.Error("load balancer was replaced, but inventory was unchanged")
+	}
+	get("unchanged inventory")
+
+	// New inventory file and load balancer type.
+	conf.InventoryFile = writeInv("inv2.toml")
+	conf.LoadBalancing.Type = "leastconn"
+	if err := s.UpdateConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	s.handler.mu.RLock()
+	_, isLeastConn := s.handler.balancer.(*leastConn)
+	s.handler.mu.RUnlock()
+	if !isLeastConn {
+		t.Error("load balancer type from new configuration was not used")
+	}
+	get("new inventory")
+}
+
+// Test that the configuration is not applied if
+// the record file cannot be opened.
+func TestUpdateConfigRecordFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doproxy-test-update-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := valid_config
+	s := &Server{Config: conf, events: NewEvents()}
+	lb, err := NewLoadBalancer(conf.LoadBalancing, newMockInventory(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	s.handler = NewReverseProxyConfig(conf, lb)
+
+	bad := conf
+	bad.JSONErrors = !conf.JSONErrors
+	bad.Record.File = filepath.Join(dir, "missing", "requests.log")
+	if err := s.UpdateConfig(bad); err == nil {
+		t.Fatal("expected error opening record file")
+	}
+	if s.Config.JSONErrors != conf.JSONErrors || s.handler.GetConfig().JSONErrors != conf.JSONErrors {
+		t.Fatal("configuration was applied, although the record file failed")
+	}
+	if s.handler.getRecorder() != nil {
+		t.Fatal("recorder was set, although the record file failed")
+	}
+
+	// The recorder belongs to the proxy, not all servers.
+	good := conf
+	good.Record.File = filepath.Join(dir, "requests.log")
+	if err := s.UpdateConfig(good); err != nil {
+		t.Fatal(err)
+	}
+	defer s.handler.setRecorder(nil)
+	if s.handler.getRecorder() == nil {
+		t.Fatal("recorder was not set")
+	}
+	if other := NewReverseProxyConfig(conf, lb); other.getRecorder() != nil {
+		t.Fatal("recorder was shared with another proxy")
+	}
+}
+
 // From https://gist.github.com/elazarl/5507969
 func cp(dst, src string) error {
 	s, err := os.Open(src)
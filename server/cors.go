@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// allowedOrigin returns the value of "Access-Control-Allow-Origin"
+// for the request. An empty string is returned if the request
+// has no origin or the origin is not allowed.
+func (c CORSConfig) allowedOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return ""
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// preflight will answer CORS preflight requests.
+// If the request was answered true is returned.
+func (c CORSConfig) preflight(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	origin := c.allowedOrigin(r)
+	if origin == "" {
+		return false
+	}
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	if len(c.AllowedMethods) > 0 {
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+	}
+	if len(c.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(c.MaxAge).Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// addHeaders will add CORS headers to a response,
+// if the request origin is allowed.
+func (c CORSConfig) addHeaders(h http.Header, r *http.Request) {
+	origin := c.allowedOrigin(r)
+	if origin == "" {
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+}
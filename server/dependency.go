@@ -0,0 +1,160 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DependencyConfig is a service that backends depend on.
+// While its health check fails, the backends it gates
+// are marked unhealthy, regardless of their own health checks.
+type DependencyConfig struct {
+	Name      string `toml:"name"`
+	HealthURL string `toml:"health-url"` // Health check URL of the service. Status codes below 500 are healthy.
+	Label     string `toml:"label"`      // Only backends with this "key=value" label depend on the service. Empty gates all backends.
+}
+
+// Validate the dependency configuration.
+func (c DependencyConfig) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("dependency: no 'name' specified")
+	}
+	u, err := url.Parse(c.HealthURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("dependency %q: 'health-url' = '%s' must be a http(s) URL", c.Name, c.HealthURL)
+	}
+	if c.Label != "" && strings.Index(c.Label, "=") <= 0 {
+		return fmt.Errorf("dependency %q: 'label' = '%s' must be in the form \"key=value\"", c.Name, c.Label)
+	}
+	return nil
+}
+
+// gates returns true if backends with the labels depend on the service.
+func (c DependencyConfig) gates(labels map[string]string) bool {
+	if c.Label == "" {
+		return true
+	}
+	kv := strings.SplitN(c.Label, "=", 2)
+	v, ok := labels[kv[0]]
+	return ok && v == kv[1]
+}
+
+const (
+	// dependencyFailures is the number of consecutive failed
+	// health checks before a dependency is considered failing.
+	dependencyFailures = 3
+
+	// dependencyTimeout is the timeout of a dependency health check.
+	dependencyTimeout = time.Second
+)
+
+// dependency checks the health of a service shared by backends.
+// Backends of a server with the same dependency share a single checker.
+type dependency struct {
+	conf     DependencyConfig
+	log      *serverLog // Log of the server using the checker.
+	client   *http.Client
+	refs     int // Number of backends using the checker. Protected by dependencies.mu.
+	stop     chan struct{}
+	mu       sync.RWMutex
+	failures int // Consecutive failed health checks.
+}
+
+// dependencyKey identifies a checker. Checkers are not shared
+// between servers, so they log to the server using them.
+type dependencyKey struct {
+	conf DependencyConfig
+	log  *serverLog
+}
+
+// dependencies contains the running dependency checkers.
+var dependencies = struct {
+	mu sync.Mutex
+	m  map[dependencyKey]*dependency
+}{m: make(map[dependencyKey]*dependency)}
+
+// acquireDependency returns the checker of the dependency.
+// The checker is started if it isn't running.
+// release must be called when the checker is no longer used.
+func acquireDependency(c DependencyConfig, log *serverLog) *dependency {
+	dependencies.mu.Lock()
+	defer dependencies.mu.Unlock()
+	key := dependencyKey{conf: c, log: log}
+	d, ok := dependencies.m[key]
+	if !ok {
+		d = &dependency{
+			conf:   c,
+			log:    log,
+			client: &http.Client{Timeout: dependencyTimeout},
+			stop:   make(chan struct{}),
+		}
+		dependencies.m[key] = d
+		go d.monitor()
+	}
+	d.refs++
+	return d
+}
+
+// release will stop the checker when no backends use it.
+func (d *dependency) release() {
+	dependencies.mu.Lock()
+	defer dependencies.mu.Unlock()
+	d.refs--
+	if d.refs == 0 {
+		delete(dependencies.m, dependencyKey{conf: d.conf, log: d.log})
+		close(d.stop)
+	}
+}
+
+// monitor will check the health of the dependency every second,
+// until the checker is released.
+func (d *dependency) monitor() {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	d.check()
+	for {
+		select {
+		case <-ticker.C:
+			d.check()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// check will perform a single health check of the dependency.
+func (d *dependency) check() {
+	resp, err := d.client.Get(d.conf.HealthURL)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			err = fmt.Errorf("status code %d", resp.StatusCode)
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		if d.failures >= dependencyFailures {
+			d.log.Infof("Dependency %q: health check succeeded.", d.conf.Name)
+		}
+		d.failures = 0
+		return
+	}
+	d.failures++
+	d.log.Debugf("Error checking health of dependency %q: %v", d.conf.Name, err)
+	if d.failures == dependencyFailures {
+		d.log.Warnf("Dependency %q: %d consecutive health checks failed.", d.conf.Name, d.failures)
+	}
+}
+
+// failing returns true if the dependency has failed
+// too many consecutive health checks.
+func (d *dependency) failing() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.failures >= dependencyFailures
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test that backends gated by a failing dependency are marked unhealthy.
+func TestDependencyGatesBackends(t *testing.T) {
+	var status int32 = http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	dep := DependencyConfig{Name: "database", HealthURL: srv.URL, Label: "db=main"}
+	if err := dep.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	gated := newBackend(bec, "10.0.0.1:8080", "")
+	gated.labels = map[string]string{"db": "main"}
+	gated.setDependencies([]DependencyConfig{dep})
+	other := newBackend(bec, "10.0.0.2:8080", "")
+	other.labels = map[string]string{"db": "replica"}
+	other.setDependencies([]DependencyConfig{dep})
+
+	d := gated.deps[0]
+	if len(other.deps) != 0 {
+		t.Fatal("expected backend with another label not to be gated")
+	}
+
+	// Fail the dependency.
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	for i := 0; i < dependencyFailures; i++ {
+		d.check()
+	}
+	gated.update(time.Second)
+	other.update(time.Second)
+	if gated.Healthy() {
+		t.Fatal("expected gated backend to be unhealthy")
+	}
+	if !other.Healthy() {
+		t.Fatal("expected backend that is not gated to stay healthy")
+	}
+
+	// The backend is healthy again when the dependency recovers.
+	atomic.StoreInt32(&status, http.StatusOK)
+	d.check()
+	gated.update(time.Second)
+	if !gated.Healthy() {
+		t.Fatal("expected gated backend to be healthy after the dependency recovered")
+	}
+
+	// The checker stops when no backend uses it.
+	gated.Close()
+	other.Close()
+	dependencies.mu.Lock()
+	n := len(dependencies.m)
+	dependencies.mu.Unlock()
+	if n != 0 {
+		t.Fatal("expected no running dependency checkers, got", n)
+	}
+
+	for _, c := range []DependencyConfig{
+		{HealthURL: srv.URL},
+		{Name: "x", HealthURL: "ftp://host"},
+		{Name: "x", HealthURL: srv.URL, Label: "nolabel"},
+	} {
+		if c.Validate() == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+}
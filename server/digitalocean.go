@@ -3,17 +3,36 @@ package server
 import (
 	"fmt"
 	"log"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/digitalocean/godo"
 	"golang.org/x/oauth2"
 )
 
+// DoClient returns a DigitalOcean API client.
+// If an API base URL is configured, the client will use that
+// instead of the default DigitalOcean API endpoint.
 func DoClient(conf DOConfig) *godo.Client {
 	token := &oauth2.Token{AccessToken: conf.Token}
 	t := oauth2.StaticTokenSource(token)
 	oauthClient := oauth2.NewClient(oauth2.NoContext, t)
-	return godo.NewClient(oauthClient)
+	client := godo.NewClient(oauthClient)
+	if conf.APIBaseURL != "" {
+		base := conf.APIBaseURL
+		// Relative API paths are resolved against the base URL.
+		if !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+		u, err := url.Parse(base)
+		if err != nil {
+			log.Println("Ignoring invalid 'api-base-url':", err)
+		} else {
+			client.BaseURL = u
+		}
+	}
+	return client
 }
 
 type ErrUnableToDelete struct {
@@ -42,12 +61,56 @@ func RemoveDroplet(conf Config, drop Droplet) error {
 
 // ListDroplets list all droplets currently running.
 func ListDroplets(conf Config) (*Droplets, error) {
+	return ListDropletsFilter(conf, DropletFilter{})
+}
+
+// DropletFilter selects droplets by region and status.
+// Empty fields match all droplets.
+type DropletFilter struct {
+	Region string // Region slug, for example "nyc3".
+	Status string // Droplet status, for example "active" or "off".
+}
+
+// match returns true if the droplet matches the filter.
+func (f DropletFilter) match(d *godo.Droplet) bool {
+	if f.Region != "" && (d.Region == nil || d.Region.Slug != f.Region) {
+		return false
+	}
+	return f.Status == "" || d.Status == f.Status
+}
+
+// ListDropletsFilter will list the droplets matching the filter.
+func ListDropletsFilter(conf Config, f DropletFilter) (*Droplets, error) {
 	client := DoClient(conf.DO)
 
 	d, _, err := client.Droplets.List(nil)
 	if err != nil {
 		return nil, err
 	}
+	var match []godo.Droplet
+	for _, drop := range d {
+		if f.match(&drop) {
+			match = append(match, drop)
+		}
+	}
+	return godoToDroplets(match)
+}
+
+// ListDropletsByTag will list all droplets
+// with the supplied tag.
+func ListDropletsByTag(conf Config, tag string) (*Droplets, error) {
+	client := DoClient(conf.DO)
+
+	d, _, err := client.Droplets.ListByTag(tag, nil)
+	if err != nil {
+		return nil, err
+	}
+	return godoToDroplets(d)
+}
+
+// godoToDroplets transfers a list of DO API objects
+// to an internal representation.
+func godoToDroplets(d []godo.Droplet) (*Droplets, error) {
 	var drops []Droplet
 	for _, drop := range d {
 		d, err := godoToDroplet(&drop)
@@ -75,6 +138,7 @@ func godoToDroplet(do *godo.Droplet) (*Droplet, error) {
 		ID:      do.ID,
 		Name:    do.Name,
 		Started: started,
+		Tags:    do.Tags,
 	}
 	if pub != nil {
 		drop.PublicIP = pub.IPAddress
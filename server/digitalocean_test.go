@@ -0,0 +1,140 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Test that a configured API base URL is used.
+func TestDoClientBaseURL(t *testing.T) {
+	var hit = make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case hit <- r.URL.Path:
+		default:
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"droplets":[]}`))
+	}))
+	defer ts.Close()
+
+	conf := valid_config
+	conf.DO.APIBaseURL = ts.URL
+
+	_, err := ListDroplets(conf)
+	if err != nil {
+		t.Fatal("error listing droplets:", err)
+	}
+	select {
+	case path := <-hit:
+		if !strings.HasSuffix(path, "/droplets") {
+			t.Fatalf("unexpected path requested: %q", path)
+		}
+	default:
+		t.Fatal("test server was not contacted")
+	}
+}
+
+// Test that listed droplets can be filtered by region and status.
+func TestListDropletsFilter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"droplets":[
+{"id":1,"name":"nyc-active","status":"active","region":{"slug":"nyc3"},"networks":{"v4":[{"ip_address":"10.0.0.1","type":"private"}]}},
+{"id":2,"name":"nyc-off","status":"off","region":{"slug":"nyc3"},"networks":{"v4":[{"ip_address":"10.0.0.2","type":"private"}]}},
+{"id":3,"name":"ams-active","status":"active","region":{"slug":"ams3"},"networks":{"v4":[{"ip_address":"10.0.0.3","type":"private"}]}},
+{"id":4,"name":"no-region","status":"active","networks":{"v4":[{"ip_address":"10.0.0.4","type":"private"}]}}
+]}`))
+	}))
+	defer ts.Close()
+
+	conf := valid_config
+	conf.DO.APIBaseURL = ts.URL
+	for _, test := range []struct {
+		filter DropletFilter
+		expect []int
+	}{
+		{DropletFilter{}, []int{1, 2, 3, 4}},
+		{DropletFilter{Region: "nyc3"}, []int{1, 2}},
+		{DropletFilter{Status: "active"}, []int{1, 3, 4}},
+		{DropletFilter{Region: "nyc3", Status: "active"}, []int{1}},
+		{DropletFilter{Region: "sfo2"}, nil},
+	} {
+		drops, err := ListDropletsFilter(conf, test.filter)
+		if err != nil {
+			t.Fatal("error listing droplets:", err)
+		}
+		var got []int
+		for _, d := range drops.Droplets {
+			got = append(got, d.ID)
+		}
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Fatalf("filter %+v: expected droplets %v, got %v", test.filter, test.expect, got)
+		}
+	}
+}
+
+// Test that droplets with a tag are imported into the inventory.
+func TestImportDropletsByTag(t *testing.T) {
+	var tag = make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case tag <- r.URL.Query().Get("tag_name"):
+		default:
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"droplets":[
+{"id":1,"name":"web-1","created_at":"2015-10-01T14:02:42Z","networks":{"v4":[{"ip_address":"10.0.0.1","type":"private"}]}},
+{"id":2,"name":"web-2","created_at":"2015-10-01T14:02:42Z","networks":{"v4":[{"ip_address":"10.0.0.2","type":"private"}]}},
+{"id":3,"name":"web-3","created_at":"2015-10-01T14:02:42Z","networks":{"v4":[{"ip_address":"10.0.0.3","type":"private"}]}},
+{"id":4,"name":"public-only","created_at":"2015-10-01T14:02:42Z","networks":{"v4":[{"ip_address":"45.55.0.4","type":"public"}]}}
+]}`))
+	}))
+	defer ts.Close()
+
+	conf := valid_config
+	conf.DO.APIBaseURL = ts.URL
+	conf.Backend.DisableHealth = true
+	drops, err := ListDropletsByTag(conf, "web")
+	if err != nil {
+		t.Fatal("error listing droplets:", err)
+	}
+	if got := <-tag; got != "web" {
+		t.Fatalf("expected tag %q to be requested, got %q", "web", got)
+	}
+	if len(drops.Droplets) != 4 {
+		t.Fatal("expected 4 droplets, got", len(drops.Droplets))
+	}
+	noip := drops.NoPrivateIP()
+	if len(noip) != 1 || noip[0].ID != 4 {
+		t.Fatalf("expected droplet 4 to have no private ip, got %v", noip)
+	}
+	if _, err := noip[0].ToBackend(conf.Backend); err == nil {
+		t.Fatal("droplet without private ip converted to backend")
+	}
+
+	// Droplet 2 is already in the inventory.
+	existing := Droplet{ID: 2, Name: "web-2", PrivateIP: "10.0.0.2"}
+	be, err := existing.ToBackend(conf.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := NewInventory([]Backend{be}, conf.Backend)
+	defer inv.Close()
+
+	n, err := inv.ImportDroplets(drops.Droplets, conf.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatal("expected 2 droplets to be added, got", n)
+	}
+	ids := inv.IDs()
+	expect := []string{"2", "1", "3"}
+	if !reflect.DeepEqual(ids, expect) {
+		t.Fatalf("expected inventory %v, got %v", expect, ids)
+	}
+}
@@ -5,7 +5,11 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/digitalocean/godo"
@@ -14,13 +18,28 @@ import (
 
 // A Droplet as defined in the inventory file.
 type Droplet struct {
-	ID         int       `toml:"id"`
-	Name       string    `toml:"name"`
-	PublicIP   string    `toml:"public-ip"`
-	PrivateIP  string    `toml:"private-ip"`
-	ServerHost string    `toml:"server-host"`
-	HealthURL  string    `toml:"health-url"`
-	Started    time.Time `toml:"started-time"`
+	ID          int               `toml:"id"`
+	Type        string            `toml:"type,omitempty"` // Backend type. Empty is "digitalocean".
+	Name        string            `toml:"name"`
+	PublicIP    string            `toml:"public-ip"`
+	PrivateIP   string            `toml:"private-ip"`
+	ServerHost  string            `toml:"server-host"`
+	HealthURL   string            `toml:"health-url"`
+	Started     time.Time         `toml:"started-time"`
+	Weight      int               `toml:"weight,omitempty"`       // Relative weight for weighted load balancing.
+	Backup      bool              `toml:"backup,omitempty"`       // Only use the backend if no primary backend is healthy.
+	Priority    int               `toml:"priority,omitempty"`     // Failover tier. 0 is used first, then 1 and so on.
+	Labels      map[string]string `toml:"labels,omitempty"`       // Arbitrary labels, usable for routing.
+	Tags        []string          `toml:"tags,omitempty"`         // Tags used to organize backends.
+	HealthPath  string            `toml:"health-path,omitempty"`  // Overrides the configured health path.
+	HealthPort  int               `toml:"health-port,omitempty"`  // Overrides the configured health port.
+	DialTimeout Duration          `toml:"dial-timeout,omitempty"` // Overrides the configured dial timeout.
+	Scheme      string            `toml:"scheme,omitempty"`       // "https" sends requests to the backend with TLS. Empty is "http".
+
+	// Override 'latency-average-seconds' and 'failure-average-seconds',
+	// for example to react faster to latency-sensitive backends.
+	LatencyAvg int `toml:"latency-average-seconds,omitempty"`
+	FailureAvg int `toml:"failure-average-seconds,omitempty"`
 }
 
 // Droplets contains all backend droplets.
@@ -28,25 +47,38 @@ type Droplets struct {
 	Droplets []Droplet `toml:"droplet"`
 }
 
+// dropletsByID sorts droplets by ID.
+type dropletsByID []Droplet
+
+func (d dropletsByID) Len() int           { return len(d) }
+func (d dropletsByID) Less(i, j int) bool { return d[i].ID < d[j].ID }
+func (d dropletsByID) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
 // CreateDroplet will provision a new droplet as backend
 // with the parameters given in the main configuration file.
 // If no name is given, a random name with the configured prefix and
 // 10 random characters will be generated.
 func CreateDroplet(conf Config, name string) (*Droplet, error) {
-	client := DoClient(conf.DO)
-
-	keys := make([]godo.DropletCreateSSHKey, len(conf.DO.SSHKeyID))
-	for i, key := range conf.DO.SSHKeyID {
-		keys[i] = godo.DropletCreateSSHKey{ID: key}
+	spec, err := conf.DO.Spec("")
+	if err != nil {
+		return nil, err
 	}
+	return CreateDropletSpec(conf, name, spec)
+}
+
+// CreateDropletSpec will provision a new droplet like CreateDroplet,
+// but with the region, size, image and user data of spec.
+// Use DOConfig.Spec to get the parameters of a pool.
+func CreateDropletSpec(conf Config, name string, spec DOSpec) (*Droplet, error) {
+	client := DoClient(conf.DO)
 
 	if name == "" {
 		name = conf.DO.HostPrefix + randStringRunes(10)
 	}
 
 	userdata := ""
-	if conf.DO.UserData != "" {
-		f, err := os.Open(conf.DO.UserData)
+	if spec.UserData != "" {
+		f, err := os.Open(spec.UserData)
 		if err != nil {
 			return nil, err
 		}
@@ -57,20 +89,7 @@ func CreateDroplet(conf Config, name string) (*Droplet, error) {
 		}
 		userdata = string(buf)
 	}
-	createRequest := &godo.DropletCreateRequest{
-		Name:   name,
-		Region: conf.DO.Region,
-		Size:   conf.DO.Size,
-		Image: godo.DropletCreateImage{
-			Slug: conf.DO.Image,
-		},
-		Backups:           conf.DO.Backups,
-		SSHKeys:           keys,
-		PrivateNetworking: true,
-		UserData:          userdata,
-	}
-
-	newDroplet, _, err := client.Droplets.Create(createRequest)
+	newDroplet, _, err := client.Droplets.Create(createRequest(conf.DO, spec, name, userdata))
 	if err != nil {
 		return nil, err
 	}
@@ -96,24 +115,210 @@ func CreateDroplet(conf Config, name string) (*Droplet, error) {
 		return nil, err
 	}
 	// Transfer proxy specific values
-	d.ServerHost = fmt.Sprintf("%s:%d", d.PrivateIP, conf.Backend.HostPort)
-	if conf.Backend.HealthHTTPS {
-		d.HealthURL = fmt.Sprintf("https://%s%s", d.ServerHost, conf.Backend.HealthPath)
-	} else {
-		d.HealthURL = fmt.Sprintf("http://%s%s", d.ServerHost, conf.Backend.HealthPath)
+	err = d.setHost(conf.Backend)
+	if err != nil {
+		return nil, err
 	}
 	return d, nil
 }
 
+// setHost will set the server host and health URL of
+// the droplet based on the backend configuration.
+// An error is returned if no valid health URL can be created.
+// If the droplet has a health path or port, it is used instead of
+// the configured one.
+func (d *Droplet) setHost(bec BackendConfig) error {
+	path := bec.HealthPath
+	if d.HealthPath != "" {
+		path = d.HealthPath
+	}
+	port := bec.HealthPort
+	if d.HealthPort != 0 {
+		port = d.HealthPort
+	}
+	if port == 0 {
+		port = bec.HostPort
+	}
+	host := fmt.Sprintf("%s:%d", d.PrivateIP, bec.HostPort)
+	scheme := "http"
+	if bec.HealthHTTPS {
+		scheme = "https"
+	}
+	health, err := d.healthURL(scheme, fmt.Sprintf("%s:%d", d.PrivateIP, port), path)
+	if err != nil {
+		return err
+	}
+	d.ServerHost = host
+	d.HealthURL = health
+	return nil
+}
+
+// healthURL returns a health URL for the host with the supplied path.
+// An error is returned if the path doesn't create a valid URL
+// pointing to the host.
+func (d *Droplet) healthURL(scheme, host, path string) (string, error) {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("droplet %d: health path %q must start with '/'", d.ID, path)
+	}
+	health := fmt.Sprintf("%s://%s%s", scheme, host, path)
+	u, err := url.Parse(health)
+	if err != nil {
+		return "", fmt.Errorf("droplet %d: invalid health url %q: %v", d.ID, health, err)
+	}
+	if u.Host != host {
+		return "", fmt.Errorf("droplet %d: health url %q does not point to %s", d.ID, health, host)
+	}
+	return health, nil
+}
+
+// validate the droplet specific settings.
+func (d *Droplet) validate() error {
+	if d.Weight < 0 {
+		return fmt.Errorf("droplet %d: 'weight' = '%d' cannot be negative", d.ID, d.Weight)
+	}
+	if d.DialTimeout < 0 {
+		return fmt.Errorf("droplet %d: 'dial-timeout' = '%s' cannot be negative", d.ID, d.DialTimeout)
+	}
+	if d.Priority < 0 {
+		return fmt.Errorf("droplet %d: 'priority' = '%d' cannot be negative", d.ID, d.Priority)
+	}
+	if d.LatencyAvg < 0 {
+		return fmt.Errorf("droplet %d: 'latency-average-seconds' = '%d' cannot be negative", d.ID, d.LatencyAvg)
+	}
+	if d.FailureAvg < 0 {
+		return fmt.Errorf("droplet %d: 'failure-average-seconds' = '%d' cannot be negative", d.ID, d.FailureAvg)
+	}
+	if d.HealthPort < 0 || d.HealthPort > 65535 {
+		return fmt.Errorf("droplet %d: 'health-port' = '%d' is not a valid port", d.ID, d.HealthPort)
+	}
+	switch d.Scheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("droplet %d: 'scheme' = '%s' must be \"http\" or \"https\"", d.ID, d.Scheme)
+	}
+	return nil
+}
+
+// checkProtocol returns an error if the scheme of the
+// droplet cannot be used with the backend protocol.
+func (d *Droplet) checkProtocol(bec BackendConfig) error {
+	if d.Scheme == "https" && bec.Protocol == protocolH2C {
+		return fmt.Errorf("droplet %d: 'scheme' = 'https' cannot be used with protocol %q", d.ID, protocolH2C)
+	}
+	return nil
+}
+
+// DropletOptions contains proxy settings that
+// can be given when a droplet is added to the inventory.
+type DropletOptions struct {
+	Weight int               // If not 0, replaces the weight of the droplet.
+	Tags   []string          // Added to the tags of the droplet.
+	Labels map[string]string // Added to the labels of the droplet.
+}
+
+// SetOptions applies the options to the droplet.
+// Tags that are already set are not added again.
+func (d *Droplet) SetOptions(o DropletOptions) {
+	if o.Weight != 0 {
+		d.Weight = o.Weight
+	}
+	for _, tag := range o.Tags {
+		found := false
+		for _, t := range d.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			d.Tags = append(d.Tags, tag)
+		}
+	}
+	if len(o.Labels) > 0 && d.Labels == nil {
+		d.Labels = make(map[string]string, len(o.Labels))
+	}
+	for k, v := range o.Labels {
+		d.Labels[k] = v
+	}
+}
+
+// ParseLabels parses labels given as "key=value".
+func ParseLabels(kv []string) (map[string]string, error) {
+	labels := make(map[string]string, len(kv))
+	for _, l := range kv {
+		i := strings.Index(l, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("label %q must be in the form \"key=value\"", l)
+		}
+		labels[l[:i]] = l[i+1:]
+	}
+	return labels, nil
+}
+
+// backendConfig returns the backend configuration with
+// droplet specific overrides applied.
+func (d *Droplet) backendConfig(bec BackendConfig) BackendConfig {
+	if d.DialTimeout > 0 {
+		bec.DialTimeout = d.DialTimeout
+	}
+	if d.LatencyAvg > 0 {
+		bec.LatencyAvg = d.LatencyAvg
+	}
+	if d.FailureAvg > 0 {
+		bec.FailureAvg = d.FailureAvg
+	}
+	return bec
+}
+
+// applyHealthPath will replace the path and port of the stored
+// health URL with the health path and port of the droplet, if set.
+// If no health URL is stored, the server host is used.
+func (d *Droplet) applyHealthPath() error {
+	if d.HealthPath == "" && d.HealthPort == 0 {
+		return nil
+	}
+	scheme, host, path := "http", d.ServerHost, d.HealthPath
+	if d.HealthURL != "" {
+		u, err := url.Parse(d.HealthURL)
+		if err != nil {
+			return fmt.Errorf("droplet %d: invalid health url %q: %v", d.ID, d.HealthURL, err)
+		}
+		scheme, host = u.Scheme, u.Host
+		if path == "" {
+			path = u.RequestURI()
+		}
+	}
+	if d.HealthPort != 0 {
+		h, _, err := net.SplitHostPort(host)
+		if err != nil {
+			return fmt.Errorf("droplet %d: cannot set health port on %q: %v", d.ID, host, err)
+		}
+		host = net.JoinHostPort(h, strconv.Itoa(d.HealthPort))
+	}
+	health, err := d.healthURL(scheme, host, path)
+	if err != nil {
+		return err
+	}
+	d.HealthURL = health
+	return nil
+}
+
+// ToBackend will return the droplet as a backend.
+// The server host and health URL are set from the backend configuration.
 func (d *Droplet) ToBackend(bec BackendConfig) (Backend, error) {
 	if d.PrivateIP == "" {
 		return nil, fmt.Errorf("cannot convert droplet %d to backend: no private ip v4 address", d.ID)
 	}
-	d.ServerHost = fmt.Sprintf("%s:%d", d.PrivateIP, bec.HostPort)
-	if bec.HealthHTTPS {
-		d.HealthURL = fmt.Sprintf("https://%s%s", d.ServerHost, bec.HealthPath)
-	} else {
-		d.HealthURL = fmt.Sprintf("http://%s%s", d.ServerHost, bec.HealthPath)
+	err := d.validate()
+	if err == nil {
+		err = d.checkProtocol(bec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = d.setHost(bec)
+	if err != nil {
+		return nil, err
 	}
 	return NewDropletBackend(*d, bec), nil
 }
@@ -181,6 +386,40 @@ func (d Droplets) DropletID(id int) (drop *Droplet, ok bool) {
 	return nil, false
 }
 
+// NoPrivateIP returns the droplets that have no private IPv4 address.
+// They cannot be used as backends.
+func (d Droplets) NoPrivateIP() []Droplet {
+	var res []Droplet
+	for _, drop := range d.Droplets {
+		if drop.PrivateIP == "" {
+			res = append(res, drop)
+		}
+	}
+	return res
+}
+
+// createRequest returns the request for creating a droplet
+// with the supplied parameters, name and user data.
+func createRequest(conf DOConfig, spec DOSpec, name, userdata string) *godo.DropletCreateRequest {
+	keys := make([]godo.DropletCreateSSHKey, len(conf.SSHKeyID))
+	for i, key := range conf.SSHKeyID {
+		keys[i] = godo.DropletCreateSSHKey{ID: key}
+	}
+	return &godo.DropletCreateRequest{
+		Name:   name,
+		Region: spec.Region,
+		Size:   spec.Size,
+		Image: godo.DropletCreateImage{
+			Slug: spec.Image,
+		},
+		Backups:           conf.Backups,
+		SSHKeys:           keys,
+		PrivateNetworking: conf.PrivateNetworking,
+		VPCUUID:           conf.VPCUUID,
+		UserData:          userdata,
+	}
+}
+
 // Generate a random string of n characters.
 func randStringRunes(n int) string {
 	rand.Seed(time.Now().UnixNano())
@@ -0,0 +1,377 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/naoina/toml"
+)
+
+// Test that malformed health paths are reported when creating backends.
+func TestDropletToBackendHealthPath(t *testing.T) {
+	invalid := []string{"health", "?query", "#frag", "/%zz", "@evil.com/"}
+	for _, path := range invalid {
+		bec := BackendConfig{DisableHealth: true, HostPort: 8080, HealthPath: path}
+		d := Droplet{ID: 1, PrivateIP: "10.0.0.1"}
+		_, err := d.ToBackend(bec)
+		if err == nil {
+			t.Fatalf("health path %q should return an error", path)
+		}
+	}
+
+	bec := BackendConfig{DisableHealth: true, HostPort: 8080, HealthPath: "/health?full=1", HealthHTTPS: true}
+	d := Droplet{ID: 1, PrivateIP: "10.0.0.1"}
+	be, err := d.ToBackend(bec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	if d.HealthURL != "https://10.0.0.1:8080/health?full=1" {
+		t.Fatalf("unexpected health url %q", d.HealthURL)
+	}
+	if be.Host() != "10.0.0.1:8080" {
+		t.Fatalf("unexpected host %q", be.Host())
+	}
+}
+
+// Test that a droplet health path overrides the configured health path.
+func TestDropletHealthPathOverride(t *testing.T) {
+	bec := BackendConfig{DisableHealth: true, HostPort: 8080, HealthPath: "/health"}
+	d := Droplet{ID: 1, PrivateIP: "10.0.0.1", HealthPath: "/status"}
+	be, err := d.ToBackend(bec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+	if d.HealthURL != "http://10.0.0.1:8080/status" {
+		t.Fatalf("unexpected health url %q", d.HealthURL)
+	}
+
+	inv, err := parseInventory([]byte(`
+[[droplet]]
+id = 1
+server-host = "192.168.0.1:8080"
+health-url = "https://192.168.0.1:8000/index.html"
+health-path = "/status"
+
+[[droplet]]
+id = 2
+server-host = "192.168.0.2:8080"
+health-url = "http://192.168.0.2:8000/index.html"
+`), bec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inv.Close()
+	expect := []string{"https://192.168.0.1:8000/status", "http://192.168.0.2:8000/index.html"}
+	for i, be := range inv.backends {
+		got := be.(*DropletBackend).HealthURL
+		if got != expect[i] {
+			t.Fatalf("droplet %d: expected health url %q, got %q", i, expect[i], got)
+		}
+	}
+
+	_, err = parseInventory([]byte(`
+[[droplet]]
+id = 1
+server-host = "192.168.0.1:8080"
+health-path = "status"
+`), bec)
+	if err == nil {
+		t.Fatal("expected error for invalid health path")
+	}
+}
+
+// Test that health checks use the configured health port,
+// and that droplets can override it.
+func TestDropletHealthPort(t *testing.T) {
+	bec := BackendConfig{DisableHealth: true, HostPort: 8080, HealthPort: 9090, HealthPath: "/health"}
+	d := Droplet{ID: 1, PrivateIP: "10.0.0.1"}
+	be, err := d.ToBackend(bec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+	if d.HealthURL != "http://10.0.0.1:9090/health" {
+		t.Fatalf("unexpected health url %q", d.HealthURL)
+	}
+	if be.Host() != "10.0.0.1:8080" {
+		t.Fatalf("unexpected host %q", be.Host())
+	}
+
+	d = Droplet{ID: 1, PrivateIP: "10.0.0.1", HealthPort: 9999}
+	be, err = d.ToBackend(bec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+	if d.HealthURL != "http://10.0.0.1:9999/health" {
+		t.Fatalf("unexpected health url %q", d.HealthURL)
+	}
+
+	inv, err := parseInventory([]byte(`
+[[droplet]]
+id = 1
+server-host = "192.168.0.1:8080"
+health-url = "https://192.168.0.1:8080/status?full=1"
+health-port = 9090
+
+[[droplet]]
+id = 2
+server-host = "192.168.0.2:8080"
+health-port = 9090
+health-path = "/ping"
+`), bec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inv.Close()
+	expect := []string{"https://192.168.0.1:9090/status?full=1", "http://192.168.0.2:9090/ping"}
+	for i, be := range inv.backends {
+		got := be.(*DropletBackend).HealthURL
+		if got != expect[i] {
+			t.Fatalf("droplet %d: expected health url %q, got %q", i, expect[i], got)
+		}
+	}
+
+	d = Droplet{ID: 1, PrivateIP: "10.0.0.1", HealthPort: -1}
+	if _, err := d.ToBackend(bec); err == nil {
+		t.Fatal("expected error for invalid health port")
+	}
+}
+
+// Test that a droplet dial timeout overrides the configured dial timeout.
+func TestDropletDialTimeoutOverride(t *testing.T) {
+	bec := BackendConfig{DisableHealth: true, HostPort: 8080, DialTimeout: Duration(time.Second)}
+	local := Droplet{ID: 1, PrivateIP: "10.0.0.1"}
+	far := Droplet{ID: 2, PrivateIP: "10.0.0.2", DialTimeout: Duration(10 * time.Second)}
+	for _, d := range []Droplet{local, far} {
+		be, err := d.ToBackend(bec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		be.Close()
+		expect := time.Second
+		if d.DialTimeout > 0 {
+			expect = time.Duration(d.DialTimeout)
+		}
+		if got := be.(*DropletBackend).dialTimeout; got != expect {
+			t.Fatalf("droplet %d: expected dial timeout %s, got %s", d.ID, expect, got)
+		}
+	}
+
+	invalid := Droplet{ID: 3, PrivateIP: "10.0.0.3", DialTimeout: -1}
+	if _, err := invalid.ToBackend(bec); err == nil {
+		t.Fatal("expected error for negative dial timeout")
+	}
+
+	// The override must survive saving and reading the inventory.
+	inv := NewInventory([]Backend{NewDropletBackend(far, bec), NewDropletBackend(local, bec)}, bec)
+	defer inv.Close()
+	tmp := filepath.Join(os.TempDir(), "doproxy-test-dial-inventory.toml")
+	defer os.Remove(tmp)
+	err := inv.SaveDroplets(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ReadInventory(tmp, bec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saved.Close()
+	for _, be := range saved.backends {
+		d := be.(*DropletBackend)
+		expect := time.Second
+		if d.Droplet.ID == far.ID {
+			expect = 10 * time.Second
+		}
+		if d.dialTimeout != expect {
+			t.Fatalf("droplet %d: expected dial timeout %s after reload, got %s", d.Droplet.ID, expect, d.dialTimeout)
+		}
+	}
+}
+
+// Test that the averaging windows can be configured and overridden
+// by droplets, so averages react faster with a shorter window.
+func TestDropletAverageOverride(t *testing.T) {
+	bec := BackendConfig{DisableHealth: true, HostPort: 8080, LatencyAvg: 30}
+	bulk := Droplet{ID: 1, PrivateIP: "10.0.0.1"}
+	fast := Droplet{ID: 2, PrivateIP: "10.0.0.2", LatencyAvg: 2, FailureAvg: 2}
+	averages := func(d Droplet, bec BackendConfig) (latency, failures float64) {
+		be, err := d.ToBackend(bec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		be.Close()
+		st := &be.(*DropletBackend).Stats
+		// A quiet period followed by 3 seconds of slow, failing requests.
+		// Averages start at the first value that isn't 0.
+		for i := 0; i < 20; i++ {
+			st.Latency.Add(0.01)
+			st.FailureRate.Add(0.01)
+		}
+		for i := 0; i < 3; i++ {
+			st.Latency.Add(1)
+			st.FailureRate.Add(1)
+		}
+		return st.Latency.Value(), st.FailureRate.Value()
+	}
+	latency, failures := averages(bulk, bec)
+	if latency > 0.5 || failures > 0.5 {
+		t.Fatalf("expected default windows to react slowly, got latency %.2f and failure rate %.2f", latency, failures)
+	}
+	latency, failures = averages(fast, bec)
+	if latency < 0.9 || failures < 0.9 {
+		t.Fatalf("expected short windows to react fast, got latency %.2f and failure rate %.2f", latency, failures)
+	}
+	bec.FailureAvg = 2
+	if _, failures = averages(bulk, bec); failures < 0.9 {
+		t.Fatalf("expected configured failure window to react fast, got %.2f", failures)
+	}
+
+	invalid := Droplet{ID: 3, PrivateIP: "10.0.0.3", FailureAvg: -1}
+	if _, err := invalid.ToBackend(bec); err == nil {
+		t.Fatal("expected error for negative failure window")
+	}
+}
+
+// Test that the create request reflects the configuration.
+func TestDropletCreateRequest(t *testing.T) {
+	conf, err := ReadConfigFile("testdata/validconfig.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conf.DO.PrivateNetworking {
+		t.Fatal("private networking should be enabled if not configured")
+	}
+	spec, err := conf.DO.Spec("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := createRequest(conf.DO, spec, "name", "userdata")
+	if !req.PrivateNetworking || req.VPCUUID != "" {
+		t.Fatalf("unexpected networking: private %t, vpc %q", req.PrivateNetworking, req.VPCUUID)
+	}
+
+	conf.DO.PrivateNetworking = false
+	conf.DO.VPCUUID = "5a4981aa-9653-4bd1-bef5-d6bff52042e4"
+	req = createRequest(conf.DO, spec, "name", "userdata")
+	if req.PrivateNetworking {
+		t.Fatal("private networking should be disabled")
+	}
+	if req.VPCUUID != conf.DO.VPCUUID {
+		t.Fatalf("expected VPC %q, got %q", conf.DO.VPCUUID, req.VPCUUID)
+	}
+	if req.Name != "name" || req.UserData != "userdata" || req.Region != conf.DO.Region || req.Size != conf.DO.Size || req.Image.Slug != conf.DO.Image {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	if len(req.SSHKeys) != len(conf.DO.SSHKeyID) {
+		t.Fatalf("expected %d SSH keys, got %d", len(conf.DO.SSHKeyID), len(req.SSHKeys))
+	}
+}
+
+// Test that droplets created in a pool use the parameters of the pool.
+func TestDropletCreateRequestPool(t *testing.T) {
+	conf, err := ReadConfigFile("testdata/validconfig.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = toml.Unmarshal([]byte(`
+[pools.ams]
+region = "ams3"
+size = "4gb"
+
+[pools.sfo]
+region = "sfo2"
+image = "ubuntu-16-04-x64"
+`), &conf.DO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.DO.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pool                string
+		region, size, image string
+	}{
+		{"", conf.DO.Region, conf.DO.Size, conf.DO.Image},
+		{"ams", "ams3", "4gb", conf.DO.Image},
+		{"sfo", "sfo2", conf.DO.Size, "ubuntu-16-04-x64"},
+	}
+	for _, test := range tests {
+		spec, err := conf.DO.Spec(test.pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := createRequest(conf.DO, spec, "name", "")
+		if req.Region != test.region || req.Size != test.size || req.Image.Slug != test.image {
+			t.Fatalf("pool %q: expected %s/%s/%s, got %s/%s/%s", test.pool, test.region, test.size, test.image, req.Region, req.Size, req.Image.Slug)
+		}
+		if req.PrivateNetworking != conf.DO.PrivateNetworking || len(req.SSHKeys) != len(conf.DO.SSHKeyID) {
+			t.Fatalf("pool %q: shared parameters not applied: %+v", test.pool, req)
+		}
+	}
+	if _, err := conf.DO.Spec("lon"); err == nil {
+		t.Fatal("expected error for unknown pool")
+	}
+}
+
+// Test that weight, tags and labels given when adding
+// a droplet are saved in the inventory.
+func TestDropletOptionsSaved(t *testing.T) {
+	labels, err := ParseLabels([]string{"group=a", "zone=nyc3=x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseLabels([]string{"=a"}); err == nil {
+		t.Fatal("expected error on label without key")
+	}
+	if _, err := ParseLabels([]string{"group"}); err == nil {
+		t.Fatal("expected error on label without value")
+	}
+
+	bec := BackendConfig{DisableHealth: true, HostPort: 8080}
+	d := Droplet{ID: 1, PrivateIP: "10.0.0.1", Tags: []string{"web"}, Labels: map[string]string{"group": "b", "tier": "1"}}
+	d.SetOptions(DropletOptions{Weight: 3, Tags: []string{"web", "canary"}, Labels: labels})
+	be, err := d.ToBackend(bec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := NewInventory([]Backend{be}, bec)
+	defer inv.Close()
+	tmp := filepath.Join(os.TempDir(), "doproxy-test-options-inventory.toml")
+	defer os.Remove(tmp)
+	if err := inv.SaveDroplets(tmp); err != nil {
+		t.Fatal("error writing inventory:", err)
+	}
+	saved, err := ReadInventory(tmp, bec)
+	if err != nil {
+		t.Fatal("error re-loading inventory:", err)
+	}
+	defer saved.Close()
+	got := saved.backends[0].(*DropletBackend).Droplet
+	if got.Weight != 3 {
+		t.Error("expected weight 3, got", got.Weight)
+	}
+	if !reflect.DeepEqual(got.Tags, []string{"web", "canary"}) {
+		t.Errorf("unexpected tags %q", got.Tags)
+	}
+	expect := map[string]string{"group": "a", "tier": "1", "zone": "nyc3=x"}
+	if !reflect.DeepEqual(got.Labels, expect) {
+		t.Errorf("unexpected labels %v", got.Labels)
+	}
+	if saved.backends[0].Weight() != 3 {
+		t.Error("backend weight was not set, got", saved.backends[0].Weight())
+	}
+
+	// Negative weights are not allowed.
+	d = Droplet{ID: 2, PrivateIP: "10.0.0.2", Weight: -1}
+	if _, err := d.ToBackend(bec); err == nil {
+		t.Fatal("expected error on negative weight")
+	}
+}
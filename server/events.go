@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthEvent is published when a backend changes
+// health state, or when it is marked degraded because
+// latency is above 'degraded-latency', or recovers.
+type HealthEvent struct {
+	Time     time.Time     `json:"time"`
+	Host     string        `json:"host"`
+	Healthy  bool          `json:"healthy"`
+	Degraded bool          `json:"degraded,omitempty"`
+	Latency  time.Duration `json:"latency"`
+}
+
+// Events distributes health events to all subscribers.
+// Events can be served as a Server-Sent Events stream,
+// by using it as a http.Handler.
+type Events struct {
+	mu   sync.Mutex
+	subs map[chan HealthEvent]struct{}
+}
+
+// NewEvents returns a new event publisher
+// with no subscribers.
+func NewEvents() *Events {
+	return &Events{subs: make(map[chan HealthEvent]struct{})}
+}
+
+// Subscribe returns a channel that will receive all
+// events published until Unsubscribe is called.
+func (e *Events) Subscribe() chan HealthEvent {
+	c := make(chan HealthEvent, 16)
+	e.mu.Lock()
+	e.subs[c] = struct{}{}
+	e.mu.Unlock()
+	return c
+}
+
+// Unsubscribe will stop sending events on the channel
+// and close it.
+func (e *Events) Unsubscribe(c chan HealthEvent) {
+	e.mu.Lock()
+	if _, ok := e.subs[c]; ok {
+		delete(e.subs, c)
+		close(c)
+	}
+	e.mu.Unlock()
+}
+
+// Publish an event to all subscribers.
+// Subscribers that are not keeping up will not
+// receive the event, so publishing never blocks.
+func (e *Events) Publish(ev HealthEvent) {
+	e.mu.Lock()
+	for c := range e.subs {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+	e.mu.Unlock()
+}
+
+// ServeHTTP will stream events to the client
+// as Server-Sent Events until the client disconnects.
+func (e *Events) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	c := e.Subscribe()
+	defer e.Unsubscribe(c)
+	for {
+		select {
+		case ev := <-c:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "event: health\ndata: %s\n\n", b)
+			if err != nil {
+				return
+			}
+			f.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that a backend becoming healthy publishes an event.
+func TestHealthEventPublished(t *testing.T) {
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer health.Close()
+
+	bec := BackendConfig{
+		DialTimeout:   Duration(time.Second),
+		LatencyAvg:    30,
+		HealthTimeout: Duration(250 * time.Millisecond),
+	}
+	events := NewEvents()
+	sub := events.Subscribe()
+	defer events.Unsubscribe(sub)
+
+	// Backends with a health URL start out unhealthy.
+	be := &mockBackend{backend: newBackend(bec, "mockhost:80", health.URL)}
+	defer be.Close()
+	inv := NewInventory([]Backend{be}, bec)
+	inv.SetEvents(events)
+
+	select {
+	case ev := <-sub:
+		if !ev.Healthy {
+			t.Fatal("expected healthy event, got unhealthy")
+		}
+		if ev.Host != "mockhost:80" {
+			t.Fatalf("expected host %q, got %q", "mockhost:80", ev.Host)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no health event published after 3 seconds")
+	}
+}
+
+// Test that a backend marked degraded publishes an event.
+func TestLatencyEventPublished(t *testing.T) {
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	bec.DegradedLatency = Duration(10 * time.Millisecond)
+	b := newBackend(bec, "127.0.0.1:8080", "")
+	defer b.Close()
+	b.rt.rt = slowRT(20 * time.Millisecond)
+	events := NewEvents()
+	sub := events.Subscribe()
+	defer events.Unsubscribe(sub)
+	b.setEvents(events)
+
+	for i := 0; !b.Degraded(); i++ {
+		if i > 30 {
+			t.Fatal("backend not degraded after 30 seconds of slow requests")
+		}
+		req, err := http.NewRequest("GET", "http://127.0.0.1:8080/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := b.Transport().RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		b.update(time.Second)
+	}
+	select {
+	case ev := <-sub:
+		if !ev.Degraded || !ev.Healthy {
+			t.Fatalf("expected healthy, degraded event, got %+v", ev)
+		}
+		if ev.Latency < 10*time.Millisecond {
+			t.Fatal("expected latency above threshold, got", ev.Latency)
+		}
+	default:
+		t.Fatal("no event published when backend was degraded")
+	}
+}
+
+// Test that events are streamed as Server-Sent Events.
+func TestEventsStream(t *testing.T) {
+	events := NewEvents()
+	ts := httptest.NewServer(events)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	// Wait for the handler to subscribe.
+	for i := 0; ; i++ {
+		events.mu.Lock()
+		n := len(events.subs)
+		events.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if i > 30 {
+			t.Fatal("handler did not subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	events.Publish(HealthEvent{Host: "somehost:80", Healthy: false})
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		if !strings.Contains(line, `"host":"somehost:80"`) || !strings.Contains(line, `"healthy":false`) {
+			t.Fatalf("unexpected event %q", line)
+		}
+		return
+	}
+	t.Fatal("no event received:", scanner.Err())
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+)
+
+// BackendFactory creates a backend from an inventory entry.
+// Settings in the entry should override the backend configuration.
+type BackendFactory func(d Droplet, bec BackendConfig) (Backend, error)
+
+// InventoryEntry can be implemented by backends created by a
+// BackendFactory, so they are kept when the inventory is saved.
+type InventoryEntry interface {
+	InventoryEntry() Droplet
+}
+
+// backendFactories contains the registered backend types.
+var backendFactories = struct {
+	mu sync.RWMutex
+	m  map[string]BackendFactory
+}{m: map[string]BackendFactory{
+	"digitalocean": newDropletFactory,
+}}
+
+// defaultBackendType is used for inventory entries without a type.
+const defaultBackendType = "digitalocean"
+
+// RegisterBackend will register a factory for inventory
+// entries with 'type' set to the name.
+// A factory already registered with the name is replaced.
+func RegisterBackend(name string, f BackendFactory) {
+	backendFactories.mu.Lock()
+	backendFactories.m[name] = f
+	backendFactories.mu.Unlock()
+}
+
+// newInventoryBackend creates a backend with the
+// factory registered for the type of the entry.
+func newInventoryBackend(d Droplet, bec BackendConfig) (Backend, error) {
+	typ := d.Type
+	if typ == "" {
+		typ = defaultBackendType
+	}
+	backendFactories.mu.RLock()
+	f, ok := backendFactories.m[typ]
+	backendFactories.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("droplet %d: unknown backend type %q", d.ID, d.Type)
+	}
+	return f(d, bec)
+}
+
+// newDropletFactory creates a DigitalOcean droplet backend.
+func newDropletFactory(d Droplet, bec BackendConfig) (Backend, error) {
+	err := d.validate()
+	if err == nil {
+		err = d.checkProtocol(bec)
+	}
+	if err == nil {
+		err = d.applyHealthPath()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewDropletBackend(d, bec), nil
+}
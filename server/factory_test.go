@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// staticBackend is a backend created by a custom factory.
+type staticBackend struct {
+	*backend
+	entry Droplet
+}
+
+func (s *staticBackend) ID() string              { return fmt.Sprintf("static-%d", s.entry.ID) }
+func (s *staticBackend) Name() string            { return s.entry.Name }
+func (s *staticBackend) InventoryEntry() Droplet { return s.entry }
+
+// Test that inventory entries use the factory registered for their type.
+func TestRegisterBackend(t *testing.T) {
+	RegisterBackend("static", func(d Droplet, bec BackendConfig) (Backend, error) {
+		if d.ServerHost == "" {
+			return nil, fmt.Errorf("static backend %d has no server-host", d.ID)
+		}
+		return &staticBackend{backend: newBackend(bec, d.ServerHost, d.HealthURL), entry: d}, nil
+	})
+	defer func() {
+		backendFactories.mu.Lock()
+		delete(backendFactories.m, "static")
+		backendFactories.mu.Unlock()
+	}()
+
+	const inventory = `
+[[droplet]]
+id = 1
+type = "static"
+name = "static-1"
+server-host = "10.0.0.1:8080"
+
+[[droplet]]
+id = 2
+name = "droplet-2"
+server-host = "10.0.0.2:8080"
+`
+	bec := BackendConfig{DisableHealth: true}
+	inv, err := parseInventory([]byte(inventory), bec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inv.Close()
+	static, ok := inv.BackendID("static-1")
+	if !ok {
+		t.Fatal("static backend not found, got", inv.IDs())
+	}
+	if _, ok := static.(*staticBackend); !ok {
+		t.Fatalf("expected *staticBackend, got %T", static)
+	}
+	if static.Host() != "10.0.0.1:8080" {
+		t.Fatal("unexpected host", static.Host())
+	}
+	drop, ok := inv.BackendID("2")
+	if !ok {
+		t.Fatal("droplet backend not found, got", inv.IDs())
+	}
+	if _, ok := drop.(*DropletBackend); !ok {
+		t.Fatalf("expected *DropletBackend, got %T", drop)
+	}
+
+	// Both types are kept when the inventory is saved.
+	tmp := filepath.Join(os.TempDir(), "doproxy-test-factory-inventory.toml")
+	defer os.Remove(tmp)
+	if err := inv.SaveDroplets(tmp); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ReadInventory(tmp, bec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saved.Close()
+	if _, ok := saved.BackendID("static-1"); !ok {
+		t.Fatal("static backend was not saved, got", saved.IDs())
+	}
+
+	// Errors from the factory and unknown types are returned.
+	_, err = parseInventory([]byte("[[droplet]]\nid = 3\ntype = \"static\"\n"), bec)
+	if err == nil {
+		t.Fatal("expected error from factory")
+	}
+	_, err = parseInventory([]byte("[[droplet]]\nid = 4\ntype = \"unknown\"\n"), bec)
+	if err == nil {
+		t.Fatal("expected error on unknown type")
+	}
+}
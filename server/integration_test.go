@@ -0,0 +1,297 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newTestInventory starts n real http servers and returns an inventory
+// of droplet backends using them. Requests and health checks go through
+// the network, so the real transports are used.
+// handler returns the handler of server i. Health checks are sent to "/health"
+// and are answered by the helper. The backends are healthy when it returns.
+// The returned function closes the inventory and the servers.
+func newTestInventory(t *testing.T, bec BackendConfig, n int, handler func(i int) http.Handler) (*Inventory, func()) {
+	var servers []*httptest.Server
+	var backends []Backend
+	closeAll := func() {
+		for _, be := range backends {
+			be.Close()
+		}
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}
+	for i := 0; i < n; i++ {
+		mux := http.NewServeMux()
+		mux.Handle("/", handler(i))
+		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		srv := httptest.NewServer(mux)
+		servers = append(servers, srv)
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			closeAll()
+			t.Fatal(err)
+		}
+		d := Droplet{
+			ID:         i + 1,
+			Name:       fmt.Sprintf("test-%d", i),
+			PrivateIP:  u.Hostname(),
+			ServerHost: u.Host,
+			HealthURL:  srv.URL + "/health",
+		}
+		backends = append(backends, NewDropletBackend(d, bec))
+	}
+	// Wait for the health monitors to mark the backends healthy.
+	deadline := time.Now().Add(5 * time.Second)
+	for _, be := range backends {
+		for !be.Healthy() {
+			if time.Now().After(deadline) {
+				closeAll()
+				t.Fatalf("backend %s did not become healthy", be.Host())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	inv := NewInventory(backends, bec)
+	return inv, closeAll
+}
+
+// Test a roundtrip through the proxy to real backends.
+func TestIntegrationRoundtrip(t *testing.T) {
+	inv, closeInv := newTestInventory(t, valid_config.Backend, 2, func(i int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Backend", fmt.Sprint(i))
+			fmt.Fprintf(w, "%s %s %s %s", r.Method, r.URL.Path, r.Header.Get("X-Forwarded-For"), b)
+		})
+	})
+	defer closeInv()
+	lb, err := NewLoadBalancer(valid_config.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(NewReverseProxyConfig(valid_config, lb))
+	defer ts.Close()
+
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		res, err := http.Post(ts.URL+"/path", "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatal("unexpected status", res.Status)
+		}
+		if want := "POST /path 127.0.0.1 body"; string(b) != want {
+			t.Fatalf("expected %q, got %q", want, b)
+		}
+		seen[res.Header.Get("X-Backend")] = true
+	}
+	if len(seen) != 2 {
+		t.Fatal("expected both backends to be used, got", seen)
+	}
+}
+
+// Test an inventory with both HTTP and HTTPS backends.
+func TestIntegrationMixedScheme(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS != nil)
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	var backends []Backend
+	for i, srv := range []*httptest.Server{plain, secure} {
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := Droplet{ID: i + 1, PrivateIP: u.Hostname(), ServerHost: u.Host, Scheme: u.Scheme}
+		be, err := newInventoryBackend(d, bec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer be.Close()
+		// Trust the certificate of the test server.
+		tr := be.(*DropletBackend).rt.rt.(*http.Transport)
+		tr.TLSClientConfig = secure.Client().Transport.(*http.Transport).TLSClientConfig
+		backends = append(backends, be)
+	}
+	lb, err := NewLoadBalancer(valid_config.LoadBalancing, NewInventory(backends, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(NewReverseProxyConfig(valid_config, lb))
+	defer ts.Close()
+
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %s: %q", res.Status, b)
+		}
+		seen[string(b)] = true
+	}
+	if !seen["true"] || !seen["false"] {
+		t.Fatal("expected requests with and without TLS, got", seen)
+	}
+
+	// Invalid schemes and HTTPS with h2c are rejected.
+	if _, err := newInventoryBackend(Droplet{ID: 3, Scheme: "ftp"}, bec); err == nil {
+		t.Fatal("expected scheme \"ftp\" to be rejected")
+	}
+	bec.Protocol = protocolH2C
+	if _, err := newInventoryBackend(Droplet{ID: 3, Scheme: "https"}, bec); err == nil {
+		t.Fatal("expected scheme \"https\" with h2c to be rejected")
+	}
+}
+
+// Test a websocket upgrade through the proxy to a real backend.
+func TestIntegrationWebSocket(t *testing.T) {
+	inv, closeInv := newTestInventory(t, valid_config.Backend, 1, func(i int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Upgrade") != "websocket" {
+				http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+				return
+			}
+			c, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			fmt.Fprint(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			brw.Flush()
+			io.Copy(c, brw)
+		})
+	})
+	defer closeInv()
+	lb, err := NewLoadBalancer(valid_config.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(NewReverseProxyConfig(valid_config, lb))
+	defer ts.Close()
+
+	c, br := dialWS(t, strings.TrimPrefix(ts.URL, "http://"))
+	defer c.Close()
+	for _, msg := range []string{"hello\n", "world\n"} {
+		fmt.Fprint(c, msg)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := br.ReadString('\n')
+		if err != nil || got != msg {
+			t.Fatalf("expected echo %q, got %q, %v", msg, got, err)
+		}
+	}
+	if n := inv.backends[0].Connections(); n != 1 {
+		t.Fatal("expected the websocket to be counted as a connection, got", n)
+	}
+}
+
+// Test a streaming gRPC style call over HTTP/2 without TLS,
+// from the client through the proxy to the backend.
+func TestIntegrationH2C(t *testing.T) {
+	// The backend answers with two messages and a trailer.
+	// The second message is only sent when the client has received the first.
+	received := make(chan struct{})
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "HTTP/2 required, got "+r.Proto, http.StatusHTTPVersionNotSupported)
+			return
+		}
+		req, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "%s-1\n", req)
+		w.(http.Flusher).Flush()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			return
+		}
+		fmt.Fprintf(w, "%s-2\n", req)
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := valid_config
+	conf.H2C = true
+	conf.Backend.Protocol = "h2c"
+	bec := conf.Backend
+	bec.DisableHealth = true
+	be := &mockBackend{backend: newBackend(bec, u.Host, "")}
+	lb, err := NewLoadBalancer(conf.LoadBalancing, NewInventory([]Backend{be}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := &Server{Config: conf}
+	go s.serve(conf.Listeners()[0], NewReverseProxyConfig(conf, lb), ln)
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	res, err := client.Post("http://"+ln.Addr().String()+"/svc/Method", "application/grpc", strings.NewReader("call"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+		b, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("unexpected response %s %s: %q", res.Proto, res.Status, b)
+	}
+	buf := make([]byte, len("call-1\n"))
+	if _, err := io.ReadFull(res.Body, buf); err != nil || string(buf) != "call-1\n" {
+		t.Fatalf("expected first message, got %q, %v", buf, err)
+	}
+	close(received)
+	rest, err := ioutil.ReadAll(res.Body)
+	if err != nil || string(rest) != "call-2\n" {
+		t.Fatalf("expected second message, got %q, %v", rest, err)
+	}
+	if got := res.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Fatalf("expected trailer Grpc-Status 0, got %q", got)
+	}
+}
@@ -3,8 +3,15 @@ package server
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/klauspost/shutdown"
 	"github.com/naoina/toml"
@@ -14,31 +21,186 @@ import (
 // inventory. This is used by the load balancer to
 // select a backend to send incoming requests to.
 type Inventory struct {
-	backends []Backend
-	bec      BackendConfig
-	mu       sync.RWMutex
+	gen       uint64    // Incremented when backends change or change availability. Accessed atomically.
+	backends  []Backend // Replaced, never modified, when backends change. Protected by mu.
+	bec       BackendConfig
+	mu        sync.RWMutex
+	snapshots int          // Number of snapshots kept by SaveDroplets.
+	order     string       // Key SaveDroplets sorts by. Empty sorts by ID.
+	untracked int          // Backends that don't report availability changes. Protected by mu.
+	tier      atomic.Value // Cached *tierCache of all backends.
+	conns     *connHeap    // Backends by connections, built when first used. Protected by mu.
 }
 
 // NewInventory will a return a new Inventory
 // with the supplied backends and config.
 func NewInventory(b []Backend, bec BackendConfig) *Inventory {
-	return &Inventory{backends: b, bec: bec}
+	i := &Inventory{backends: b, bec: bec}
+	for _, be := range b {
+		i.track(be)
+	}
+	return i
 }
 
-// ReadInventory will read an inventory file and return the found items.
-// TODO: Make sure Id is unique
-func ReadInventory(file string, bec BackendConfig) (*Inventory, error) {
-	f, err := os.Open(file)
+// track will make the backend tell the inventory when it becomes
+// available or unavailable, or its connections change.
+// It assumes i.mu is locked or that the inventory isn't in use yet.
+func (i *Inventory) track(be Backend) {
+	i.conns = nil
+	if w, ok := be.(interface {
+		watch(*Inventory, Backend)
+	}); ok {
+		w.watch(i, be)
+		return
+	}
+	i.untracked++
+}
+
+// untrack will stop tracking a backend that has been
+// removed from the inventory. It assumes i.mu is locked.
+func (i *Inventory) untrack(be Backend) {
+	i.conns = nil
+	if w, ok := be.(interface {
+		unwatch(*Inventory)
+	}); ok {
+		w.unwatch(i)
+		return
+	}
+	i.untracked--
+}
+
+// changed invalidates the cached tier, since a backend
+// has been added, removed or changed availability.
+func (i *Inventory) changed() {
+	atomic.AddUint64(&i.gen, 1)
+}
+
+// byConns returns the backends ordered by connections. The order is
+// built when first used, and rebuilt when backends are added or removed.
+// nil is returned if some backends don't report connection changes,
+// since the order could not be kept up to date.
+func (i *Inventory) byConns() *connHeap {
+	i.mu.RLock()
+	h, untracked := i.conns, i.untracked
+	i.mu.RUnlock()
+	if h != nil || untracked > 0 {
+		return h
+	}
+	i.mu.Lock()
+	if i.conns == nil && i.untracked == 0 {
+		i.conns = newConnHeap(i.backends)
+	}
+	h = i.conns
+	i.mu.Unlock()
+	return h
+}
+
+// connsChanged updates the position of a backend
+// ordered by connections, if the order is in use.
+func (i *Inventory) connsChanged(be Backend) {
+	i.mu.RLock()
+	h := i.conns
+	i.mu.RUnlock()
+	if h != nil {
+		h.update(be)
+	}
+}
+
+// tierCache is the best tier of the backends
+// in an inventory, when the generation was gen.
+type tierCache struct {
+	gen    uint64
+	backup bool
+	prio   int
+	ok     bool
+}
+
+// bestTier returns the best tier of all backends.
+// The tier is cached until backends are added or removed, or a backend
+// changes availability, so backends are not checked on every request.
+func (i *Inventory) bestTier() (backup bool, prio int, ok bool) {
+	// Read the generation first, so changes while
+	// the tier is found invalidate the result.
+	gen := atomic.LoadUint64(&i.gen)
+	i.mu.RLock()
+	backends, cache := i.backends, i.untracked == 0
+	i.mu.RUnlock()
+	if !cache {
+		return bestTier(backends, nil)
+	}
+	if c, _ := i.tier.Load().(*tierCache); c != nil && c.gen == gen {
+		return c.backup, c.prio, c.ok
+	}
+	backup, prio, ok = bestTier(backends, nil)
+	i.tier.Store(&tierCache{gen: gen, backup: backup, prio: prio, ok: ok})
+	return backup, prio, ok
+}
+
+// An InventorySource provides the content of an inventory.
+type InventorySource interface {
+	// Read the current inventory.
+	Read() ([]byte, error)
+}
+
+// defaultInventoryPoll is the poll interval for
+// remote inventories if none is configured.
+const defaultInventoryPoll = 30 * time.Second
+
+// fileSource is an inventory stored in a local file.
+type fileSource string
+
+// Read the content of the file.
+func (f fileSource) Read() ([]byte, error) {
+	return ioutil.ReadFile(string(f))
+}
+
+// urlSource is an inventory that is fetched from a http(s) URL.
+type urlSource string
+
+// Read the content of the URL.
+func (u urlSource) Read() ([]byte, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(string(u))
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	conf, err := ioutil.ReadAll(f)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching inventory from %s returned status %s", string(u), resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// isURL returns true if the inventory name is a http(s) URL.
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// newInventorySource returns a source for the supplied
+// file name or URL.
+func newInventorySource(name string) InventorySource {
+	if isURL(name) {
+		return urlSource(name)
+	}
+	return fileSource(name)
+}
+
+// ReadInventory will read an inventory file and return the found items.
+// If the file is a http(s) URL, the inventory is fetched from that.
+// TODO: Make sure Id is unique
+func ReadInventory(file string, bec BackendConfig) (*Inventory, error) {
+	conf, err := newInventorySource(file).Read()
 	if err != nil {
 		return nil, err
 	}
+	return parseInventory(conf, bec)
+}
+
+// parseInventory will parse the content of an inventory
+// and return the found items.
+func parseInventory(conf []byte, bec BackendConfig) (*Inventory, error) {
 	drops := Droplets{}
-	err = toml.Unmarshal(conf, &drops)
+	err := toml.Unmarshal(conf, &drops)
 	if err != nil {
 		return nil, err
 	}
@@ -49,7 +211,13 @@ func ReadInventory(file string, bec BackendConfig) (*Inventory, error) {
 	}
 
 	for _, v := range drops.Droplets {
-		inv.backends = append(inv.backends, NewDropletBackend(v, bec))
+		be, err := newInventoryBackend(v, bec)
+		if err != nil {
+			inv.Close()
+			return nil, err
+		}
+		inv.backends = append(inv.backends, be)
+		inv.track(be)
 	}
 
 	return inv, nil
@@ -58,7 +226,11 @@ func ReadInventory(file string, bec BackendConfig) (*Inventory, error) {
 // SaveDroplets will save all Doplets in the current
 // inventory to a specified file.
 // If the file exists it will be overwritten.
+// If snapshots are enabled, the saved inventory is also kept as a snapshot.
 func (i *Inventory) SaveDroplets(file string) error {
+	if isURL(file) {
+		return fmt.Errorf("cannot save inventory to %s: only files can be saved", file)
+	}
 	// We do not want to get interrupted while saving the inventory
 	if shutdown.Lock() {
 		defer shutdown.Unlock()
@@ -68,12 +240,25 @@ func (i *Inventory) SaveDroplets(file string) error {
 
 	// Put into object
 	drops := Droplets{}
-	for _, be := range i.backends {
-		drop, ok := be.(*DropletBackend)
-		if ok {
+	for _, be := range i.list() {
+		switch drop := be.(type) {
+		case *DropletBackend:
 			drops.Droplets = append(drops.Droplets, drop.Droplet)
+		case InventoryEntry:
+			drops.Droplets = append(drops.Droplets, drop.InventoryEntry())
 		}
 	}
+	// Sort by ID, so the saved file doesn't change with backend order.
+	// Droplets with the same value of another key stay sorted by ID.
+	sort.Sort(dropletsByID(drops.Droplets))
+	i.mu.RLock()
+	less := inventoryOrders[i.order]
+	i.mu.RUnlock()
+	if less != nil {
+		sort.SliceStable(drops.Droplets, func(a, b int) bool {
+			return less(drops.Droplets[a], drops.Droplets[b])
+		})
+	}
 
 	// Marshall the inventory.
 	b, err := toml.Marshal(drops)
@@ -93,9 +278,66 @@ func (i *Inventory) SaveDroplets(file string) error {
 		return err
 	}
 
+	i.mu.RLock()
+	n := i.snapshots
+	i.mu.RUnlock()
+	return saveSnapshot(file, b, n)
+}
+
+// SetSnapshots sets the number of snapshots SaveDroplets keeps
+// of the saved inventory. Snapshot 1 is the newest and is saved
+// as "<file>.1". If n is 0, no snapshots are saved.
+func (i *Inventory) SetSnapshots(n int) {
+	i.mu.Lock()
+	i.snapshots = n
+	i.mu.Unlock()
+}
+
+// inventoryOrders contains the keys an inventory can be saved in order of.
+var inventoryOrders = map[string]func(a, b Droplet) bool{
+	"id":      func(a, b Droplet) bool { return a.ID < b.ID },
+	"name":    func(a, b Droplet) bool { return a.Name < b.Name },
+	"started": func(a, b Droplet) bool { return a.Started.Before(b.Started) },
+}
+
+// SortBy sets the order droplets are saved in by SaveDroplets.
+// The key can be "id", "name" or "started".
+// Backends are read in the order they are saved,
+// so this changes where round-robin starts.
+func (i *Inventory) SortBy(key string) error {
+	if _, ok := inventoryOrders[key]; !ok {
+		return fmt.Errorf("cannot sort inventory by %q: must be \"id\", \"name\" or \"started\"", key)
+	}
+	i.mu.Lock()
+	i.order = key
+	i.mu.Unlock()
 	return nil
 }
 
+// snapshotFile returns the name of snapshot n of the inventory file.
+func snapshotFile(file string, n int) string {
+	return fmt.Sprintf("%s.%d", file, n)
+}
+
+// saveSnapshot will save b as the newest snapshot of the inventory file.
+// Older snapshots are rotated, so at most n are kept.
+func saveSnapshot(file string, b []byte, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	err := os.Remove(snapshotFile(file, n))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for k := n - 1; k >= 1; k-- {
+		err := os.Rename(snapshotFile(file, k), snapshotFile(file, k+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return ioutil.WriteFile(snapshotFile(file, 1), b, 0644)
+}
+
 // Close all backends associated with this inventory.
 // This will stop all stats and monitoring of the backends.
 func (i *Inventory) Close() {
@@ -106,28 +348,163 @@ func (i *Inventory) Close() {
 	i.mu.RUnlock()
 }
 
+// Reuse will replace backends in the inventory with backends
+// from the old inventory that have the same ID and droplet definition,
+// so their statistics and health history are kept.
+// Reused backends are removed from the old inventory, so closing
+// it will not close them. The replaced backends are closed.
+// If the backend configuration has changed, nothing is reused.
+// The number of reused backends is returned.
+func (i *Inventory) Reuse(old *Inventory) int {
+	if old == nil || old == i || !reflect.DeepEqual(i.bec, old.bec) {
+		return 0
+	}
+	i.mu.Lock()
+	old.mu.Lock()
+	// Create new slices, since the old ones may be in use.
+	backends := make([]Backend, len(i.backends))
+	copy(backends, i.backends)
+	moved := make(map[Backend]struct{})
+	var replaced []Backend
+	for j, be := range backends {
+		for _, obe := range old.backends {
+			if _, ok := moved[obe]; ok || !sameBackend(be, obe) {
+				continue
+			}
+			replaced = append(replaced, be)
+			i.untrack(be)
+			old.untrack(obe)
+			i.track(obe)
+			backends[j] = obe
+			moved[obe] = struct{}{}
+			break
+		}
+	}
+	if len(moved) > 0 {
+		i.backends = backends
+		i.changed()
+		keep := make([]Backend, 0, len(old.backends)-len(moved))
+		for _, obe := range old.backends {
+			if _, ok := moved[obe]; !ok {
+				keep = append(keep, obe)
+			}
+		}
+		old.backends = keep
+		old.changed()
+	}
+	old.mu.Unlock()
+	i.mu.Unlock()
+
+	// Closing waits for health checks, so it is done
+	// without blocking load balancers using the inventories.
+	for _, be := range replaced {
+		be.Close()
+	}
+	return len(moved)
+}
+
+// sameBackend returns true if the backends have the same
+// ID and host, and droplet backends have the same definition.
+func sameBackend(a, b Backend) bool {
+	if a.ID() != b.ID() || a.Host() != b.Host() {
+		return false
+	}
+	da, aok := a.(*DropletBackend)
+	db, bok := b.(*DropletBackend)
+	if aok != bok {
+		return false
+	}
+	return !aok || reflect.DeepEqual(da.Droplet, db.Droplet)
+}
+
+// SetEvents will make all backends in the inventory
+// publish health transitions to the supplied events.
+func (i *Inventory) SetEvents(e *Events) {
+	i.mu.RLock()
+	for _, be := range i.backends {
+		if ev, ok := be.(interface {
+			setEvents(*Events)
+		}); ok {
+			ev.setEvents(e)
+		}
+	}
+	i.mu.RUnlock()
+}
+
+// list returns the backends of the inventory.
+// The slice must not be modified. Since changes to the inventory
+// replace the slice, it can be used without holding the lock.
+func (i *Inventory) list() []Backend {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.backends
+}
+
 // AddBackend will add a backend to the inventory
 // At the moment no checks are performed, but that could
 // happen in the future.
 func (i *Inventory) AddBackend(be Backend) error {
 	i.mu.Lock()
-	i.backends = append(i.backends, be)
+	// Create a new slice, since the old one may be in use.
+	backends := make([]Backend, 0, len(i.backends)+1)
+	i.backends = append(append(backends, i.backends...), be)
+	i.track(be)
+	i.changed()
 	i.mu.Unlock()
 	return nil
 }
 
-// Remove will remove a backend from the inventory
+// ImportDroplets will add the droplets to the inventory as backends.
+// Droplets already in the inventory are skipped, as are droplets
+// that cannot be converted to a backend.
+// The number of droplets added is returned.
+func (i *Inventory) ImportDroplets(drops []Droplet, bec BackendConfig) (int, error) {
+	added := 0
+	for _, drop := range drops {
+		id := strconv.Itoa(drop.ID)
+		if _, ok := i.BackendID(id); ok {
+			i.bec.log.Infof("Droplet %d %q already in inventory, skipping", drop.ID, drop.Name)
+			continue
+		}
+		be, err := drop.ToBackend(bec)
+		if err != nil {
+			i.bec.log.Warnf("Skipping droplet %d %q: %v", drop.ID, drop.Name, err)
+			continue
+		}
+		err = i.AddBackend(be)
+		if err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
+
+// Remove will remove a backend from the inventory and close it.
 // If the backend cannot be found an error will be returned.
+// Load balancers using the inventory will no longer select the
+// backend, but requests already sent to it will complete.
 func (i *Inventory) Remove(id string) error {
 	i.mu.Lock()
-	defer i.mu.Unlock()
+	var removed Backend
 	for j, be := range i.backends {
 		if be.ID() == id {
-			i.backends = append(i.backends[:j], i.backends[j+1:]...)
-			return nil
+			// Create a new slice, since the old one may be in use.
+			keep := make([]Backend, 0, len(i.backends)-1)
+			keep = append(keep, i.backends[:j]...)
+			i.backends = append(keep, i.backends[j+1:]...)
+			i.untrack(be)
+			i.changed()
+			removed = be
+			break
 		}
 	}
-	return fmt.Errorf("backend %q could not be found in inventory", id)
+	i.mu.Unlock()
+	if removed == nil {
+		return fmt.Errorf("backend %q could not be found in inventory", id)
+	}
+	removed.Close()
+	return nil
 }
 
 // BackendID will return a backend with the specified ID,
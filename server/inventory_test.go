@@ -1,11 +1,18 @@
 package server
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/klauspost/doproxy/server/httpmock"
 )
 
 // Test that config is read and parsed correctly
@@ -86,14 +93,15 @@ func TestSaveInventory(t *testing.T) {
 		}
 		drop := *d
 
+		// Droplets are saved sorted by ID.
 		var expect Droplet
 		switch i {
 		case 0:
-			expect = Droplet{ID: 1, Name: "auto-nginx 1", PrivateIP: "192.168.0.1", ServerHost: "192.168.0.1:8080", HealthURL: "http://192.168.0.1:8000/index.html"}
+			expect = Droplet{ID: -73, Name: "auto-nginx 3", PrivateIP: "192.168.0.3", ServerHost: "192.168.0.3:8080", HealthURL: "http://192.168.0.3:8000/index.html"}
 		case 1:
-			expect = Droplet{ID: 2, Name: "auto-nginx 2", PrivateIP: "192.168.0.2", ServerHost: "192.168.0.2:8080", HealthURL: "http://192.168.0.2:8000/index.html"}
+			expect = Droplet{ID: 1, Name: "auto-nginx 1", PrivateIP: "192.168.0.1", ServerHost: "192.168.0.1:8080", HealthURL: "http://192.168.0.1:8000/index.html"}
 		case 2:
-			expect = Droplet{ID: -73, Name: "auto-nginx 3", PrivateIP: "192.168.0.3", ServerHost: "192.168.0.3:8080", HealthURL: "http://192.168.0.3:8000/index.html"}
+			expect = Droplet{ID: 2, Name: "auto-nginx 2", PrivateIP: "192.168.0.2", ServerHost: "192.168.0.2:8080", HealthURL: "http://192.168.0.2:8000/index.html"}
 		default:
 			t.Fatalf("unexpected droplet\n%#v", drop.Droplet)
 		}
@@ -112,3 +120,279 @@ func TestSaveInventory(t *testing.T) {
 		t.Fatal("error removing temporary inventory file", err)
 	}
 }
+
+// Test that saving keeps a rotating set of snapshots.
+func TestSaveInventorySnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doproxy-test-snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "inventory.toml")
+
+	inv, err := ReadInventory("testdata/validinventory.toml", BackendConfig{DisableHealth: true})
+	if err != nil {
+		t.Fatal("error loading inventory:", err)
+	}
+	defer inv.Close()
+	inv.SetSnapshots(2)
+
+	// Save with 3, 2 and 1 backends.
+	for _, id := range []string{"", "1", "2"} {
+		if id != "" {
+			if err := inv.Remove(id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := inv.SaveDroplets(file); err != nil {
+			t.Fatal("error writing inventory:", err)
+		}
+	}
+	for n, want := range map[int]int{1: 1, 2: 2} {
+		snap, err := ReadInventory(snapshotFile(file, n), BackendConfig{DisableHealth: true})
+		if err != nil {
+			t.Fatalf("error reading snapshot %d: %v", n, err)
+		}
+		if got := len(snap.IDs()); got != want {
+			t.Fatalf("snapshot %d: expected %d backends, got %d", n, want, got)
+		}
+		snap.Close()
+	}
+	if _, err := os.Stat(snapshotFile(file, 3)); !os.IsNotExist(err) {
+		t.Fatal("expected only 2 snapshots, got error", err)
+	}
+}
+
+// Test that droplets are saved sorted by ID, regardless
+// of the order they were added in.
+func TestSaveInventorySorted(t *testing.T) {
+	inv := NewInventory(nil, BackendConfig{})
+	defer inv.Close()
+	for _, id := range []int{5, 3, 9, 1} {
+		d := Droplet{ID: id, Name: fmt.Sprintf("droplet %d", id), ServerHost: fmt.Sprintf("192.168.0.%d:8080", id)}
+		err := inv.AddBackend(NewDropletBackend(d, BackendConfig{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmp := filepath.Join(os.TempDir(), "doproxy-test-sorted-inventory.toml")
+	defer os.Remove(tmp)
+	err := inv.SaveDroplets(tmp)
+	if err != nil {
+		t.Fatal("error writing inventory:", err)
+	}
+	saved, err := ReadInventory(tmp, BackendConfig{})
+	if err != nil {
+		t.Fatal("error re-loading inventory:", err)
+	}
+	defer saved.Close()
+	var got []int
+	for _, be := range saved.backends {
+		got = append(got, be.(*DropletBackend).Droplet.ID)
+	}
+	expect := []int{1, 3, 5, 9}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("droplets not sorted, got %v, expected %v", got, expect)
+	}
+}
+
+// Test that droplets are saved in the order set with SortBy.
+func TestSaveInventorySortBy(t *testing.T) {
+	inv := NewInventory(nil, BackendConfig{DisableHealth: true})
+	defer inv.Close()
+	start := time.Now().Round(time.Millisecond)
+	for n, d := range []Droplet{
+		{ID: 5, Name: "b", Started: start.Add(2 * time.Hour)},
+		{ID: 3, Name: "c", Started: start},
+		{ID: 9, Name: "a", Started: start.Add(time.Hour)},
+		{ID: 1, Name: "a", Started: start.Add(3 * time.Hour)},
+	} {
+		d.ServerHost = fmt.Sprintf("192.168.0.%d:8080", n)
+		err := inv.AddBackend(NewDropletBackend(d, BackendConfig{DisableHealth: true}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if inv.SortBy("size") == nil {
+		t.Fatal("expected error sorting by unknown key")
+	}
+	tmp := filepath.Join(os.TempDir(), "doproxy-test-sortby-inventory.toml")
+	defer os.Remove(tmp)
+	for key, expect := range map[string][]int{
+		"id":      {1, 3, 5, 9},
+		"name":    {1, 9, 5, 3}, // Same names are sorted by ID.
+		"started": {3, 9, 5, 1},
+	} {
+		if err := inv.SortBy(key); err != nil {
+			t.Fatal(err)
+		}
+		if err := inv.SaveDroplets(tmp); err != nil {
+			t.Fatal("error writing inventory:", err)
+		}
+		saved, err := ReadInventory(tmp, BackendConfig{DisableHealth: true})
+		if err != nil {
+			t.Fatal("error re-loading inventory:", err)
+		}
+		var got []int
+		for _, be := range saved.backends {
+			got = append(got, be.(*DropletBackend).Droplet.ID)
+		}
+		saved.Close()
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("sorted by %s: got %v, expected %v", key, got, expect)
+		}
+	}
+}
+
+// Test that an inventory can be read from a URL.
+func TestReadInventoryURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/validinventory.toml")
+	}))
+	defer ts.Close()
+
+	inv, err := ReadInventory(ts.URL+"/inventory.toml", BackendConfig{DisableHealth: true})
+	if err != nil {
+		t.Fatal("error loading inventory:", err)
+	}
+	ids := inv.IDs()
+	if !reflect.DeepEqual(ids, []string{"1", "2", "-73"}) {
+		t.Fatalf("unexpected backends loaded: %v", ids)
+	}
+
+	// Saving to a URL is not possible.
+	err = inv.SaveDroplets(ts.URL + "/inventory.toml")
+	if err == nil {
+		t.Fatal("expected error saving inventory to URL")
+	}
+
+	// Status codes other than 200 are reported as errors.
+	nf := httptest.NewServer(http.NotFoundHandler())
+	defer nf.Close()
+	_, err = ReadInventory(nf.URL+"/inventory.toml", BackendConfig{DisableHealth: true})
+	if err == nil {
+		t.Fatal("expected error loading inventory from missing URL")
+	}
+}
+
+// Test that weights and labels are read from the inventory.
+func TestReadInventoryLabels(t *testing.T) {
+	inv, err := ReadInventory("testdata/labelinventory.toml", BackendConfig{DisableHealth: true})
+	if err != nil {
+		t.Fatal("error loading inventory:", err)
+	}
+	if len(inv.backends) != 2 {
+		t.Fatal("expected 2 backends, got", len(inv.backends))
+	}
+	be := inv.backends[0]
+	if be.Weight() != 3 {
+		t.Fatal("expected weight 3, got", be.Weight())
+	}
+	if !reflect.DeepEqual(be.Labels(), map[string]string{"group": "eu"}) {
+		t.Fatalf("unexpected labels %v", be.Labels())
+	}
+	be = inv.backends[1]
+	if be.Weight() != 1 {
+		t.Fatal("expected default weight 1, got", be.Weight())
+	}
+	if len(be.Labels()) != 0 {
+		t.Fatalf("expected no labels, got %v", be.Labels())
+	}
+}
+
+// Test that removed backends are closed and no longer selected.
+func TestInventoryRemoveCloses(t *testing.T) {
+	inv, err := ReadInventory("testdata/validinventory.toml", valid_config.Backend)
+	if err != nil {
+		t.Fatal("error loading inventory:", err)
+	}
+	defer inv.Close()
+	lb, err := NewLoadBalancer(valid_config.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := lb.Backends()
+	be, ok := inv.BackendID("1")
+	if !ok {
+		t.Fatal("backend 1 not found")
+	}
+	db := be.(*DropletBackend)
+	if db.closeMonitor == nil {
+		t.Fatal("monitor was not started")
+	}
+
+	err = inv.Remove("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Close returns when the monitor goroutine has exited.
+	db.closeMu.Lock()
+	running := db.closeMonitor != nil
+	db.closeMu.Unlock()
+	if running {
+		t.Fatal("monitor of removed backend is still running")
+	}
+	for _, b := range lb.Backends() {
+		if b == be {
+			t.Fatal("removed backend is still used by the load balancer")
+		}
+	}
+	if len(before) != 3 || before[0] != be {
+		t.Fatal("slice returned before removal was modified")
+	}
+	err = inv.Remove("1")
+	if err == nil {
+		t.Fatal("expected error removing backend twice")
+	}
+}
+
+// Test that backends can be removed and added while requests
+// are served. Run with -race to detect unsynchronized access.
+func TestInventoryRemoveWhileServing(t *testing.T) {
+	httpmock.RegisterResponder("GET", httpmock.MockResponse)
+	for _, typ := range []string{"roundrobin", "leastconn", "weightedrandom", "lowestp95"} {
+		inv := newMockInventory(t, 10)
+		lb, err := NewLoadBalancer(LBConfig{Type: typ}, inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(NewReverseProxyConfig(*defaultConfig, lb))
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for c := 0; c < 4; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					res, err := http.Get(ts.URL)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					res.Body.Close()
+				}
+			}()
+		}
+		for n := 0; n < 9; n++ {
+			if err := inv.Remove(fmt.Sprintf("id%d", n)); err != nil {
+				t.Fatal(err)
+			}
+			inv.AddBackend(newMockBackend(t, 10+n))
+			lb.Stats()
+			time.Sleep(time.Millisecond)
+		}
+		close(stop)
+		wg.Wait()
+		ts.Close()
+		if n := len(lb.Backends()); n != 10 {
+			t.Fatalf("%s: expected 10 backends, got %d", typ, n)
+		}
+		lb.Close()
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/shutdown"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// unixPrefix is the prefix of 'bind' addresses that are
+// Unix domain sockets, for example "unix:/run/doproxy.sock".
+const unixPrefix = "unix:"
+
+// ListenerConfig contains the configuration of a single
+// address the frontend listens on.
+type ListenerConfig struct {
+	Bind          string `toml:"bind"` // Address to listen on, or "unix:/path/to.sock" for a Unix domain socket.
+	Https         bool   `toml:"https"`
+	CertFile      string `toml:"tls-cert-file"`
+	KeyFile       string `toml:"tls-key-file"`
+	RedirectHTTPS bool   `toml:"redirect-https"` // Redirect all requests to the first HTTPS listener.
+	H2C           bool   `toml:"h2c"`            // Accept HTTP/2 without TLS. HTTPS listeners always accept HTTP/2.
+}
+
+// Validate the listener configuration.
+// Will return the first error found.
+func (l ListenerConfig) Validate() error {
+	if l.Https && l.CertFile == "" {
+		return fmt.Errorf("HTTPS requested, but no 'tls-cert-file' specified")
+	}
+	if l.Https && l.KeyFile == "" {
+		return fmt.Errorf("HTTPS requested, but no 'tls-key-file' specified")
+	}
+	if l.Https && l.RedirectHTTPS {
+		return fmt.Errorf("listener %q: 'redirect-https' cannot be used on a HTTPS listener", l.Bind)
+	}
+	if l.Https && l.H2C {
+		return fmt.Errorf("listener %q: 'h2c' cannot be used on a HTTPS listener", l.Bind)
+	}
+	if network, addr := l.address(); network == "unix" && addr == "" {
+		return fmt.Errorf("listener %q: no socket path given", l.Bind)
+	}
+	return nil
+}
+
+// address returns the network and address the listener binds to.
+func (l ListenerConfig) address() (network, addr string) {
+	if strings.HasPrefix(l.Bind, unixPrefix) {
+		return "unix", strings.TrimPrefix(l.Bind, unixPrefix)
+	}
+	if l.Bind == "" {
+		if l.Https {
+			return "tcp", ":https"
+		}
+		return "tcp", ":http"
+	}
+	return "tcp", l.Bind
+}
+
+// listenOn will open the listener.
+// A socket file left by a previous run is removed before
+// listening on a Unix socket. The socket file is removed
+// when the listener is closed.
+func listenOn(l ListenerConfig) (net.Listener, error) {
+	network, addr := l.address()
+	if network == "unix" {
+		if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// Listeners returns the listeners of the configuration.
+// If no listeners are configured, a single listener is
+// created from 'bind', 'https', 'tls-cert-file' and 'tls-key-file'.
+func (c Config) Listeners() []ListenerConfig {
+	if len(c.Listener) > 0 {
+		return c.Listener
+	}
+	return []ListenerConfig{{
+		Bind:     c.Bind,
+		Https:    c.Https,
+		CertFile: c.CertFile,
+		KeyFile:  c.KeyFile,
+		H2C:      c.H2C,
+	}}
+}
+
+// httpsPort returns the port of the first HTTPS listener.
+// If there is no HTTPS listener, false is returned.
+func (c Config) httpsPort() (string, bool) {
+	for _, l := range c.Listeners() {
+		if !l.Https {
+			continue
+		}
+		_, port, err := net.SplitHostPort(l.Bind)
+		if err != nil || port == "" {
+			return "443", true
+		}
+		return port, true
+	}
+	return "", false
+}
+
+// redirectHTTPS returns a handler that will redirect
+// all requests to HTTPS on the supplied port.
+func redirectHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+// serve the handler on the listener until an error occurs.
+// Listeners with 'redirect-https' will redirect all requests instead.
+func (s *Server) serve(l ListenerConfig, h http.Handler, ln net.Listener) error {
+	if l.RedirectHTTPS {
+		port, _ := s.Config.httpsPort()
+		h = redirectHTTPS(port)
+	}
+	if l.H2C {
+		h = h2c.NewHandler(h, &http2.Server{})
+	}
+	srv := s.httpServer(l, h)
+	s.mu.Lock()
+	s.servers = append(s.servers, srv)
+	s.mu.Unlock()
+	if !l.Https {
+		return srv.Serve(ln)
+	}
+	tc, err := s.Config.TLSConfig()
+	if err != nil {
+		return fmt.Errorf("invalid TLS configuration: %v", err)
+	}
+	srv.TLSConfig = tc
+	return srv.ServeTLS(ln, l.CertFile, l.KeyFile)
+}
+
+// defaultShutdownTimeout is used if 'shutdown-timeout' isn't set.
+const defaultShutdownTimeout = time.Second
+
+// shutdownTimeout returns the time running requests
+// have to finish when shutting down.
+func (c Config) shutdownTimeout() time.Duration {
+	if c.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return time.Duration(c.ShutdownTimeout)
+}
+
+// drain will stop all listeners and wait for running requests
+// to finish, up to 'shutdown-timeout'. Connections still active
+// after that are closed. Hijacked connections, like websockets,
+// are not waited for.
+// Returns false if connections had to be closed.
+func (s *Server) drain() bool {
+	s.mu.RLock()
+	servers := s.servers
+	timeout := s.Config.shutdownTimeout()
+	s.mu.RUnlock()
+
+	s.log.Infof("Shutting down. Waiting up to %v for running requests", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	clean := true
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if srv.Shutdown(ctx) == nil {
+				return
+			}
+			srv.Close()
+			mu.Lock()
+			clean = false
+			mu.Unlock()
+		}(srv)
+	}
+	wg.Wait()
+	if !clean {
+		s.log.Warnf("Requests still running after %v. Connections closed.", timeout)
+	}
+	return clean
+}
+
+// listen will serve the handler on all listeners.
+// It returns when a listener fails.
+func (s *Server) listen(h http.Handler) error {
+	ls := s.Config.Listeners()
+	errc := make(chan error, len(ls))
+	for _, l := range ls {
+		ln, err := listenOn(l)
+		if err != nil {
+			return err
+		}
+		s.log.Infof("Listening on %s (https: %t)", ln.Addr(), l.Https)
+		if _, ok := ln.(*net.UnixListener); ok {
+			// Closing the listener removes the socket file.
+			shutdown.FirstFunc(func(ln interface{}) {
+				ln.(net.Listener).Close()
+			}, ln)
+		}
+		go func(l ListenerConfig, ln net.Listener) {
+			err := s.serve(l, h, ln)
+			errc <- fmt.Errorf("listener %s: %v", ln.Addr(), err)
+		}(l, ln)
+	}
+	return <-errc
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test that all listeners serve and that HTTP can be redirected to HTTPS.
+func TestServerListeners(t *testing.T) {
+	cert := newTestCert(t, "127.0.0.1", nil)
+	certFile := filepath.Join(os.TempDir(), "doproxy-test-listener-cert.pem")
+	keyFile := filepath.Join(os.TempDir(), "doproxy-test-listener-key.pem")
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(certFile)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile)
+
+	var lns []net.Listener
+	for i := 0; i < 3; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		lns = append(lns, ln)
+	}
+	s := &Server{Config: Config{Listener: []ListenerConfig{
+		{Bind: lns[0].Addr().String()},
+		{Bind: lns[1].Addr().String(), Https: true, CertFile: certFile, KeyFile: keyFile},
+		{Bind: lns[2].Addr().String(), RedirectHTTPS: true},
+	}}}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	for i, l := range s.Config.Listener {
+		go s.serve(l, h, lns[i])
+	}
+
+	// The test certificate has no SANs, so it cannot be verified.
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for _, u := range []string{"http://" + lns[0].Addr().String(), "https://" + lns[1].Addr().String()} {
+		res, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || string(body) != "ok" {
+			t.Fatalf("%s: unexpected response %d %q", u, res.StatusCode, body)
+		}
+	}
+
+	res, err := client.Get("http://" + lns[2].Addr().String() + "/path?q=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMovedPermanently {
+		t.Fatal("expected redirect, got status", res.StatusCode)
+	}
+	expect := "https://" + lns[1].Addr().String() + "/path?q=1"
+	if loc := res.Header.Get("Location"); loc != expect {
+		t.Fatalf("expected redirect to %q, got %q", expect, loc)
+	}
+}
+
+// Test that the top level settings are used if no listeners are configured.
+func TestConfigListenersDefault(t *testing.T) {
+	c := Config{Bind: ":8000", Https: true, CertFile: "cert", KeyFile: "key"}
+	ls := c.Listeners()
+	if len(ls) != 1 {
+		t.Fatal("expected 1 listener, got", len(ls))
+	}
+	expect := ListenerConfig{Bind: ":8000", Https: true, CertFile: "cert", KeyFile: "key"}
+	if ls[0] != expect {
+		t.Fatalf("unexpected listener %+v", ls[0])
+	}
+	if port, ok := c.httpsPort(); !ok || port != "8000" {
+		t.Fatalf("unexpected https port %q, %t", port, ok)
+	}
+}
+
+// Test serving the proxy on a Unix domain socket.
+func TestServerUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doproxy-test-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "doproxy.sock")
+
+	// A socket left by a previous run is replaced.
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l := ListenerConfig{Bind: "unix:" + sock}
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := listenOn(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := valid_config
+	conf.AddForwarded = true
+	conf.AddRealIP = true
+	inv, closeInv := newTestInventory(t, conf.Backend, 1, func(i int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Header.Get("X-Forwarded-For") + "|" + r.Header.Get("X-Real-IP")))
+		})
+	})
+	defer closeInv()
+	lb, err := NewLoadBalancer(conf.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: conf}
+	go s.serve(l, NewReverseProxyConfig(conf, lb), ln)
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+	req, err := http.NewRequest("GET", "http://doproxy/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// There is no client IP to add.
+	if res.StatusCode != http.StatusOK || string(body) != "10.0.0.1|" {
+		t.Fatalf("unexpected response %d %q", res.StatusCode, body)
+	}
+
+	// Closing the listener removes the socket.
+	ln.Close()
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Fatal("expected socket to be removed, got", err)
+	}
+
+	if err := (ListenerConfig{Bind: "unix:"}).Validate(); err == nil {
+		t.Fatal("expected error for empty socket path")
+	}
+}
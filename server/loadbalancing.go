@@ -1,10 +1,13 @@
 package server
 
 import (
+	"container/heap"
 	"fmt"
-	"log"
 	"math"
+	"math/rand"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,8 +18,19 @@ type LoadBalancer interface {
 	// If none can be found nil will be returned.
 	Backend() Backend
 
+	// Return a single backend instance for which match returns true.
+	// If match is nil all backends can be returned.
+	// If none can be found nil will be returned.
+	BackendFilter(match func(Backend) bool) Backend
+
 	// Close all backends and stop monitoring them
 	Close()
+
+	// Backends returns all backends of the load balancer.
+	Backends() []Backend
+
+	// Stats returns combined statistics of all backends.
+	Stats() LBStats
 }
 
 // NewLoadBalancer returns a new load balancer described by the
@@ -24,9 +38,15 @@ type LoadBalancer interface {
 func NewLoadBalancer(conf LBConfig, i *Inventory) (LoadBalancer, error) {
 	switch conf.Type {
 	case "roundrobin":
-		return newRoundRobin(i), nil
+		return newRoundRobin(i, conf), nil
 	case "leastconn":
-		return newLeastConn(i), nil
+		return newLeastConn(i, conf), nil
+	case "lowestp95":
+		return newLowestP95(i), nil
+	case "weightedrandom":
+		return newWeightedRandom(i), nil
+	case "loadweighted":
+		return newLoadWeighted(i), nil
 	default:
 		return nil, fmt.Errorf("Unknown load balancer type %s", conf.Type)
 	}
@@ -34,8 +54,118 @@ func NewLoadBalancer(conf LBConfig, i *Inventory) (LoadBalancer, error) {
 
 // lbBase is common functionality for all load balancers
 type lbBase struct {
-	mu  sync.RWMutex
-	inv *Inventory
+	mu        sync.RWMutex
+	inv       *Inventory
+	noHealthy int64 // Accessed atomically.
+	log       rateLogger
+}
+
+// newLBBase returns the common functionality for a load balancer
+// of the inventory. It logs to the log of the inventory backends.
+// The inventory is nil when the configuration is validated.
+func newLBBase(inv *Inventory) lbBase {
+	var log *serverLog
+	if inv != nil {
+		log = inv.bec.log
+	}
+	return lbBase{inv: inv, log: rateLogger{log: log}}
+}
+
+// noHealthyLogInterval is the minimum interval between
+// logging that no healthy backend could be found.
+const noHealthyLogInterval = 10 * time.Second
+
+// noBackend records that no healthy backend could be found.
+func (r *lbBase) noBackend() {
+	atomic.AddInt64(&r.noHealthy, 1)
+	r.log.Println("Unable to find a healthy backend")
+}
+
+// pickTier will select a matching backend using pick, among the
+// healthy backends with the lowest priority. Backup backends are
+// only selected if no other backend is healthy.
+func (r *lbBase) pickTier(pick func(match func(Backend) bool) Backend, match func(Backend) bool) Backend {
+	be := r.tryTier(pick, match)
+	if be == nil {
+		r.noBackend()
+	}
+	return be
+}
+
+// tryTier is pickTier, but doesn't record it if no backend is found.
+// It is used when another backend can be selected instead.
+func (r *lbBase) tryTier(pick func(match func(Backend) bool) Backend, match func(Backend) bool) Backend {
+	backup, prio, ok := r.bestTier(match)
+	if !ok {
+		return nil
+	}
+	return pick(func(be Backend) bool {
+		return be.Backup() == backup && be.Priority() == prio && matches(match, be)
+	})
+}
+
+// bestTier returns the tier that should be used for the matching backends.
+// Tiers are ordered by backup and then priority, so backups are only used
+// if no primary backend is healthy. If no matching backend is healthy,
+// ok is false. Without a match function the tier is cached by the inventory.
+func (r *lbBase) bestTier(match func(Backend) bool) (backup bool, prio int, ok bool) {
+	if match == nil {
+		return r.inv.bestTier()
+	}
+	return bestTier(r.inv.list(), match)
+}
+
+// bestTier returns the tier that should be used for the matching backends.
+func bestTier(backends []Backend, match func(Backend) bool) (backup bool, prio int, ok bool) {
+	for _, be := range backends {
+		if !available(be) || !matches(match, be) {
+			continue
+		}
+		b, p := be.Backup(), be.Priority()
+		if !ok || (backup && !b) || (backup == b && p < prio) {
+			backup, prio, ok = b, p, true
+		}
+	}
+	return backup, prio, ok
+}
+
+// rateLogger will log at most one message per interval.
+// Messages logged within the interval are counted and the
+// count is added to the next message that is logged.
+type rateLogger struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	last       time.Time
+	suppressed int
+	// output is used for logging if set, otherwise messages are logged as warnings to log.
+	output func(v ...interface{})
+	log    *serverLog
+}
+
+// Println will log the values, unless a message has been
+// logged within the interval.
+func (l *rateLogger) Println(v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	interval := l.interval
+	if interval == 0 {
+		interval = noHealthyLogInterval
+	}
+	now := time.Now()
+	if !l.last.IsZero() && now.Sub(l.last) < interval {
+		l.suppressed++
+		return
+	}
+	if l.suppressed > 0 {
+		v = append(v, fmt.Sprintf("(%d similar messages suppressed)", l.suppressed))
+	}
+	l.last = now
+	l.suppressed = 0
+	if l.output != nil {
+		l.output(v...)
+		return
+	}
+	l.log.Warnf("%s", strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
 }
 
 // roundRobin is a load balancer that
@@ -52,28 +182,30 @@ func (r *lbBase) Close() {
 	r.mu.Unlock()
 }
 
+// inventory returns the inventory of the load balancer.
+func (r *lbBase) inventory() *Inventory {
+	return r.inv
+}
+
+// LBStats contains combined statistics of all backends
+// of a load balancer.
 type LBStats struct {
-	HealtyBackends   int
-	UnhealtyBackends int
-	AvgLatency       time.Duration
-	Connections      int
+	HealtyBackends   int           `json:"healthy_backends"`
+	UnhealtyBackends int           `json:"unhealthy_backends"`
+	AvgLatency       time.Duration `json:"avg_latency"`
+	Connections      int           `json:"connections"`
+	// NoHealthy is the number of times no healthy
+	// backend could be found.
+	NoHealthy int `json:"no_healthy"`
 }
 
 func (r *lbBase) Backends() []Backend {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	r.inv.mu.RLock()
-	defer r.inv.mu.RUnlock()
-	return r.inv.backends
+	return r.inv.list()
 }
 
 func (r *lbBase) Stats() LBStats {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	r.inv.mu.RLock()
-	defer r.inv.mu.RUnlock()
-	var stats LBStats
-	for _, be := range r.inv.backends {
+	stats := LBStats{NoHealthy: int(atomic.LoadInt64(&r.noHealthy))}
+	for _, be := range r.inv.list() {
 		bes := be.Statistics()
 		if bes.Healthy {
 			stats.HealtyBackends++
@@ -90,64 +222,491 @@ func (r *lbBase) Stats() LBStats {
 	return stats
 }
 
+// available returns true if the backend is healthy
+// and not draining, so it can receive new requests.
+func available(be Backend) bool {
+	if !be.Healthy() {
+		return false
+	}
+	d, ok := be.(interface {
+		isDraining() bool
+	})
+	return !ok || !d.isDraining()
+}
+
+// matches returns true if match is nil or
+// returns true for the backend.
+func matches(match func(Backend) bool, be Backend) bool {
+	return match == nil || match(be)
+}
+
+// LabelMatch returns a match function for BackendFilter,
+// that matches backends where the label has the supplied value.
+func LabelMatch(label, value string) func(Backend) bool {
+	return func(be Backend) bool {
+		v, ok := be.Labels()[label]
+		return ok && v == value
+	}
+}
+
+// tryBackend returns a backend for which match returns true.
+// Load balancers that support it will not count it as failing
+// if none is found, since the caller will select another backend.
+func tryBackend(lb LoadBalancer, match func(Backend) bool) Backend {
+	if t, ok := lb.(interface {
+		tryFilter(match func(Backend) bool) Backend
+	}); ok {
+		return t.tryFilter(match)
+	}
+	return lb.BackendFilter(match)
+}
+
+// IDMatch returns a match function for BackendFilter,
+// that matches the backend with the supplied ID.
+func IDMatch(id string) func(Backend) bool {
+	return func(be Backend) bool {
+		return be.ID() == id
+	}
+}
+
+// recordSelection will count that a backend was selected,
+// and return the backend.
+func recordSelection(be Backend) Backend {
+	if s, ok := be.(interface {
+		selected()
+	}); ok {
+		s.selected()
+	}
+	return be
+}
+
+// lbRand is the source of randomness used by load balancers.
+// Tests can replace it with setRandSource to get
+// deterministic selections.
+var lbRand = struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// setRandSource will make load balancers use the supplied source.
+// If nil is supplied, a source seeded with the current time is used.
+func setRandSource(src rand.Source) {
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+	lbRand.mu.Lock()
+	lbRand.r = rand.New(src)
+	lbRand.mu.Unlock()
+}
+
+// randIntn returns a random number in [0,n) from lbRand.
+func randIntn(n int) int {
+	lbRand.mu.Lock()
+	v := lbRand.r.Intn(n)
+	lbRand.mu.Unlock()
+	return v
+}
+
 // NewRoundRobin Returns a new round-robin loadbalancer
-func newRoundRobin(b *Inventory) LoadBalancer {
-	return &roundRobin{lbBase: lbBase{inv: b}}
+// If random start is enabled, the first backend is selected at random.
+func newRoundRobin(b *Inventory, conf LBConfig) LoadBalancer {
+	r := &roundRobin{lbBase: newLBBase(b)}
+	if conf.RandomStart && b != nil {
+		b.mu.RLock()
+		if len(b.backends) > 0 {
+			r.next = randIntn(len(b.backends))
+		}
+		b.mu.RUnlock()
+	}
+	return r
 }
 
 // Backend will return next server in a round-robin.
 // Will return nil if no healthy backend can be found.
 func (r *roundRobin) Backend() Backend {
+	return r.BackendFilter(nil)
+}
+
+// BackendFilter will return next matching server in a round-robin.
+// Will return nil if no healthy backend can be found.
+func (r *roundRobin) BackendFilter(match func(Backend) bool) Backend {
+	return r.pickTier(r.pick, match)
+}
+
+// tryFilter will return next matching server in a round-robin,
+// without recording it if none is found.
+func (r *roundRobin) tryFilter(match func(Backend) bool) Backend {
+	return r.tryTier(r.pick, match)
+}
+
+// pick will return next matching server in a round-robin,
+// or nil if none is healthy.
+func (r *roundRobin) pick(match func(Backend) bool) Backend {
+	backends := r.inv.list()
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	first := r.next
-	for {
-		ni := r.next % len(r.inv.backends)
-		be := r.inv.backends[ni]
-		r.next = ni + 1
-		if be.Healthy() {
-			return be
+	n := len(backends)
+	// The first degraded backend is used if no other is healthy.
+	var degraded Backend
+	degradedNext := 0
+	for i := 0; i < n; i++ {
+		ni := (r.next + i) % n
+		be := backends[ni]
+		if !available(be) || !matches(match, be) {
+			continue
 		}
-		if r.next == first {
-			log.Println("Unable to find a healthy backend")
-			return nil
+		if be.Degraded() {
+			if degraded == nil {
+				degraded, degradedNext = be, ni+1
+			}
+			continue
 		}
+		r.next = ni + 1
+		return recordSelection(be)
+	}
+	if degraded != nil {
+		r.next = degradedNext
+		return recordSelection(degraded)
 	}
+	return nil
 }
 
 // leastConn is a load balancer that
 // returns the backend with the fewest connections.
 type leastConn struct {
 	lbBase
+	conns func(Backend) float64 // Number of connections compared. The lowest is selected.
+	heap  bool                  // Backends are picked from the inventory ordered by current connections.
 }
 
 // NewRoundRobin Returns a new least-connections loadbalancer
-func newLeastConn(b *Inventory) LoadBalancer {
-	return &leastConn{lbBase: lbBase{inv: b}}
+func newLeastConn(b *Inventory, conf LBConfig) LoadBalancer {
+	r := &leastConn{lbBase: newLBBase(b), conns: currentConns, heap: true}
+	if conf.SmoothConnections {
+		// The average changes when sampled, not when connections
+		// are opened or closed, so backends are scanned.
+		r.conns = smoothedConns
+		r.heap = false
+	}
+	return r
+}
+
+// newLowestP95 returns a load balancer that selects the backend
+// with the lowest 95th percentile latency of recent requests.
+// Backends without recent requests are preferred, so they get sampled.
+func newLowestP95(b *Inventory) LoadBalancer {
+	return &leastConn{lbBase: newLBBase(b), conns: p95Latency}
+}
+
+// p95Latency returns the 95th percentile latency of the backend.
+// Backends without recent latency samples return 0.
+func p95Latency(be Backend) float64 {
+	if l, ok := be.(interface {
+		p95() time.Duration
+	}); ok {
+		return float64(l.p95())
+	}
+	return 0
+}
+
+// currentConns returns the current number of connections of the backend.
+func currentConns(be Backend) float64 {
+	return float64(be.Connections())
+}
+
+// smoothedConns returns the moving average of the connections of the backend.
+// Backends without an average use the current number.
+func smoothedConns(be Backend) float64 {
+	if s, ok := be.(interface {
+		smoothedConnections() float64
+	}); ok {
+		return s.smoothedConnections()
+	}
+	return currentConns(be)
 }
 
 // Backend will return the backend with the least connections
 // Will return nil if no healthy backend can be found
 func (r *leastConn) Backend() Backend {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	return r.BackendFilter(nil)
+}
+
+// BackendFilter will return the matching backend with the least connections
+// Will return nil if no healthy backend can be found
+func (r *leastConn) BackendFilter(match func(Backend) bool) Backend {
+	return r.pickTier(r.pick, match)
+}
+
+// tryFilter will return the matching backend with the least connections,
+// without recording it if none is found.
+func (r *leastConn) tryFilter(match func(Backend) bool) Backend {
+	return r.tryTier(r.pick, match)
+}
+
+// pick will return the matching backend with the least connections,
+// or nil if none is healthy.
+// If possible, backends are visited in order of connections, so
+// usually only the first is checked. Otherwise all backends are scanned.
+// The connection count is checked first, since it is cheaper
+// than checking health, so health is only checked for backends
+// that would be selected.
+func (r *leastConn) pick(match func(Backend) bool) Backend {
+	if r.heap {
+		if h := r.inv.byConns(); h != nil {
+			best := h.first(match)
+			if best == nil {
+				return nil
+			}
+			return recordSelection(best)
+		}
+	}
 	var best Backend
-	lowest := math.MaxInt32
-	for _, be := range r.inv.backends {
-		if !be.Healthy() {
+	bestDegraded := false
+	lowest := math.MaxFloat64
+	for _, be := range r.inv.list() {
+		conn := r.conns(be)
+		// Only a backend that isn't degraded can beat a degraded one
+		// with fewer connections.
+		if (conn >= lowest && !bestDegraded) || !available(be) || !matches(match, be) {
+			continue
+		}
+		degraded := be.Degraded()
+		if best != nil && degraded && (!bestDegraded || conn >= lowest) {
+			continue
+		}
+		best = be
+		bestDegraded = degraded
+		lowest = conn
+		// We cannot do better.
+		if conn == 0 && !degraded {
+			break
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return recordSelection(best)
+}
+
+// connHeap is a min-heap of the backends of an inventory, ordered
+// by connections, then by position in the inventory.
+// The backends update it when connections are opened or closed.
+type connHeap struct {
+	mu      sync.Mutex
+	entries []*connEntry
+	pos     map[Backend]*connEntry
+}
+
+// connEntry is a backend in a connHeap.
+type connEntry struct {
+	be    Backend
+	conns int // Connections when last updated.
+	order int // Position in the inventory.
+	index int // Position in the heap.
+}
+
+// newConnHeap returns the backends ordered by connections.
+func newConnHeap(backends []Backend) *connHeap {
+	h := &connHeap{
+		entries: make([]*connEntry, len(backends)),
+		pos:     make(map[Backend]*connEntry, len(backends)),
+	}
+	for j, be := range backends {
+		e := &connEntry{be: be, conns: be.Connections(), order: j, index: j}
+		h.entries[j] = e
+		h.pos[be] = e
+	}
+	heap.Init(h)
+	return h
+}
+
+func (h *connHeap) Len() int { return len(h.entries) }
+
+func (h *connHeap) Less(a, b int) bool {
+	ea, eb := h.entries[a], h.entries[b]
+	if ea.conns != eb.conns {
+		return ea.conns < eb.conns
+	}
+	return ea.order < eb.order
+}
+
+func (h *connHeap) Swap(a, b int) {
+	h.entries[a], h.entries[b] = h.entries[b], h.entries[a]
+	h.entries[a].index = a
+	h.entries[b].index = b
+}
+
+// Push and Pop are required by heap.Interface, but the
+// heap is rebuilt when backends are added or removed.
+func (h *connHeap) Push(x interface{}) { panic("connHeap: Push not supported") }
+func (h *connHeap) Pop() interface{}   { panic("connHeap: Pop not supported") }
+
+// update moves the backend to the position
+// of its current number of connections.
+func (h *connHeap) update(be Backend) {
+	h.mu.Lock()
+	// The count is read with the lock held, so the last
+	// update after a change always leaves the right count.
+	if e, ok := h.pos[be]; ok {
+		e.conns = be.Connections()
+		heap.Fix(h, e.index)
+	}
+	h.mu.Unlock()
+}
+
+// first returns the available matching backend with the fewest
+// connections that isn't degraded. If all of them are degraded,
+// the degraded backend with the fewest connections is returned.
+// Ties go to the backend first in the inventory.
+func (h *connHeap) first(match func(Backend) bool) Backend {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) == 0 {
+		return nil
+	}
+	// Usually the backend with the fewest connections can be used.
+	if be := h.entries[0].be; available(be) && matches(match, be) && !be.Degraded() {
+		return be
+	}
+	// The heap is visited best first. Children of a visited
+	// entry are ordered after it, so they are the next candidates.
+	var degraded Backend
+	next := &connCandidates{h: h, index: []int{0}}
+	for next.Len() > 0 {
+		j := heap.Pop(next).(int)
+		be := h.entries[j].be
+		if available(be) && matches(match, be) {
+			if !be.Degraded() {
+				return be
+			}
+			if degraded == nil {
+				degraded = be
+			}
+		}
+		for _, c := range []int{2*j + 1, 2*j + 2} {
+			if c < len(h.entries) {
+				heap.Push(next, c)
+			}
+		}
+	}
+	return degraded
+}
+
+// connCandidates are positions in a connHeap,
+// ordered like the entries at them.
+type connCandidates struct {
+	h     *connHeap
+	index []int
+}
+
+func (c *connCandidates) Len() int           { return len(c.index) }
+func (c *connCandidates) Less(a, b int) bool { return c.h.Less(c.index[a], c.index[b]) }
+func (c *connCandidates) Swap(a, b int)      { c.index[a], c.index[b] = c.index[b], c.index[a] }
+func (c *connCandidates) Push(x interface{}) { c.index = append(c.index, x.(int)) }
+
+func (c *connCandidates) Pop() interface{} {
+	n := len(c.index) - 1
+	j := c.index[n]
+	c.index = c.index[:n]
+	return j
+}
+
+// weightedRandom is a load balancer that selects a random
+// healthy backend with a probability proportional to its weight.
+type weightedRandom struct {
+	lbBase
+	weight func(Backend) int // Weight of a backend. Must be at least 1.
+}
+
+// newWeightedRandom returns a new weighted random loadbalancer
+func newWeightedRandom(b *Inventory) LoadBalancer {
+	return &weightedRandom{lbBase: newLBBase(b), weight: Backend.Weight}
+}
+
+// newLoadWeighted returns a weighted random loadbalancer, where the
+// weight of backends is reduced by the load they report in 'load-header'.
+func newLoadWeighted(b *Inventory) LoadBalancer {
+	return &weightedRandom{lbBase: newLBBase(b), weight: loadWeight}
+}
+
+// minLoadWeight is the fraction of the weight fully loaded backends keep,
+// so they still receive requests and can report a lower load.
+const minLoadWeight = 0.05
+
+// loadWeight returns the weight of the backend scaled by
+// the load it has reported. Backends that have not reported
+// a load use their full weight.
+func loadWeight(be Backend) int {
+	w := float64(be.Weight()) * 1000
+	if l, ok := be.(interface {
+		load() float64
+	}); ok {
+		w *= math.Max(1-l.load(), minLoadWeight)
+	}
+	return int(w)
+}
+
+// Backend will return a random healthy backend based on weight.
+// Will return nil if no healthy backend can be found.
+func (r *weightedRandom) Backend() Backend {
+	return r.BackendFilter(nil)
+}
+
+// BackendFilter will return a random matching backend based on weight.
+// Will return nil if no healthy backend can be found.
+func (r *weightedRandom) BackendFilter(match func(Backend) bool) Backend {
+	return r.pickTier(r.pick, match)
+}
+
+// tryFilter will return a random matching backend based on weight,
+// without recording it if none is found.
+func (r *weightedRandom) tryFilter(match func(Backend) bool) Backend {
+	return r.tryTier(r.pick, match)
+}
+
+// pick will return a random matching backend based on weight,
+// or nil if none is healthy.
+func (r *weightedRandom) pick(match func(Backend) bool) Backend {
+	backends := r.inv.list()
+	// Weights are evaluated once, since they may change between
+	// summing and selecting when they are based on load.
+	healthy := make([]weighted, 0, len(backends))
+	var degraded []weighted
+	total, degradedTotal := 0, 0
+	for _, be := range backends {
+		if !available(be) || !matches(match, be) {
 			continue
 		}
-		conn := be.Connections()
-		if conn < lowest {
-			best = be
-			lowest = conn
+		w := weighted{be: be, weight: r.weight(be)}
+		if be.Degraded() {
+			degraded = append(degraded, w)
+			degradedTotal += w.weight
+			continue
 		}
+		healthy = append(healthy, w)
+		total += w.weight
 	}
-	if lowest == math.MaxInt32 {
-		log.Println("Unable to find a healthy backend")
+	// Use degraded backends if no other is healthy.
+	if total == 0 {
+		healthy, total = degraded, degradedTotal
+	}
+	if total == 0 {
 		return nil
 	}
-	return best
+	n := randIntn(total)
+	for _, w := range healthy {
+		n -= w.weight
+		if n < 0 {
+			return recordSelection(w.be)
+		}
+	}
+	return nil
+}
+
+// weighted is a backend with the weight it had when selection began.
+type weighted struct {
+	be     Backend
+	weight int
 }
 
 // TODO: Implement
@@ -1,7 +1,13 @@
 package server
 
 import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRoundRobin(t *testing.T) {
@@ -27,7 +33,7 @@ func TestRoundRobin(t *testing.T) {
 	// Mark one as unhealthy
 	mark := inv.backends[2].(*mockBackend)
 	mark.Stats.mu.Lock()
-	mark.Stats.Healthy = false
+	mark.setHealthy(false)
 	mark.Stats.mu.Unlock()
 	for i := 0; i < len(inv.backends)*5; i++ {
 		be := lb.Backend()
@@ -49,7 +55,7 @@ func TestRoundRobin(t *testing.T) {
 	for i := 0; i < len(inv.backends); i++ {
 		mark := inv.backends[i].(*mockBackend)
 		mark.Stats.mu.Lock()
-		mark.Stats.Healthy = false
+		mark.setHealthy(false)
 		mark.Stats.mu.Unlock()
 	}
 	be := lb.Backend()
@@ -100,7 +106,7 @@ func TestLeastConn(t *testing.T) {
 			mark := inv.backends[n].(*mockBackend)
 			mark.backend.Close() // Close the monitor, so it doesn't interfere.
 			mark.Stats.mu.Lock()
-			mark.Stats.Healthy = false
+			mark.setHealthy(false)
 			mark.Stats.mu.Unlock()
 			healthy := inv.backends[n].Healthy()
 			if healthy {
@@ -109,9 +115,7 @@ func TestLeastConn(t *testing.T) {
 		}
 		for n, num := range test.conns {
 			mark := inv.backends[n].(*mockBackend)
-			mark.rt.mu.Lock()
-			mark.rt.running = num
-			mark.rt.mu.Unlock()
+			atomic.StoreInt64(&mark.rt.running, int64(num))
 			connections := inv.backends[n].Connections()
 			if connections != num {
 				t.Fatal("test", i, "Connections was not set to", num, "got", connections)
@@ -137,3 +141,769 @@ func TestLeastConn(t *testing.T) {
 		inv.Close()
 	}
 }
+
+// Test that round-robin selections are distributed evenly.
+func TestRoundRobinSelections(t *testing.T) {
+	conf := LBConfig{Type: "roundrobin"}
+	inv := newMockInventory(t, 5)
+	defer inv.Close()
+
+	lb, err := NewLoadBalancer(conf, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1003; i++ {
+		if lb.Backend() == nil {
+			t.Fatal("got no backend on iteration", i)
+		}
+	}
+	min, max := int64(-1), int64(0)
+	for _, be := range lb.Backends() {
+		n := be.Statistics().Selected
+		if min < 0 || n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+	}
+	if max-min > 1 {
+		t.Fatalf("selections not evenly distributed. min: %d, max: %d", min, max)
+	}
+	st := lb.Stats()
+	if st.HealtyBackends != 5 {
+		t.Fatal("expected 5 healthy backends, got", st.HealtyBackends)
+	}
+}
+
+// Test that round-robin balancers can start at random offsets.
+func TestRoundRobinRandomStart(t *testing.T) {
+	conf := LBConfig{Type: "roundrobin", RandomStart: true}
+	inv := newMockInventory(t, 10)
+	defer inv.Close()
+
+	starts := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		lb, err := NewLoadBalancer(conf, inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		be := lb.Backend()
+		if be == nil {
+			t.Fatal("got no backend on iteration", i)
+		}
+		starts[be.(*mockBackend).n] = true
+	}
+	if len(starts) < 2 {
+		t.Fatal("all balancers started at the same backend:", starts)
+	}
+
+	// Without random start, the first backend is always selected first.
+	conf.RandomStart = false
+	lb, err := NewLoadBalancer(conf, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := lb.Backend().(*mockBackend).n; n != 0 {
+		t.Fatal("expected first backend, got", n)
+	}
+
+	// Empty inventories should not fail.
+	conf.RandomStart = true
+	empty := newMockInventory(t, 0)
+	_, err = NewLoadBalancer(conf, empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that weighted random selection follows the backend weights.
+func TestWeightedRandom(t *testing.T) {
+	conf := LBConfig{Type: "weightedrandom"}
+	inv := newMockInventory(t, 5)
+	defer inv.Close()
+	weights := []int{1, 2, 3, 4, 0}
+	total := 0
+	for i, w := range weights {
+		inv.backends[i].(*mockBackend).weight = w
+		total += inv.backends[i].Weight()
+	}
+
+	lb, err := NewLoadBalancer(conf, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20000
+	counts := make([]int, len(weights))
+	for i := 0; i < n; i++ {
+		be := lb.Backend()
+		if be == nil {
+			t.Fatal("got no backend on iteration", i)
+		}
+		counts[be.(*mockBackend).n]++
+	}
+	for i, c := range counts {
+		expect := float64(n) * float64(inv.backends[i].Weight()) / float64(total)
+		if math.Abs(float64(c)-expect) > expect*0.15 {
+			t.Fatalf("backend %d selected %d times, expected about %.0f", i, c, expect)
+		}
+	}
+
+	// Unhealthy backends are never selected.
+	for i := range inv.backends {
+		mark := inv.backends[i].(*mockBackend)
+		mark.backend.Close()
+		mark.Stats.mu.Lock()
+		mark.setHealthy(i == 3)
+		mark.Stats.mu.Unlock()
+	}
+	for i := 0; i < 100; i++ {
+		if n := lb.Backend().(*mockBackend).n; n != 3 {
+			t.Fatal("expected only healthy backend 3, got", n)
+		}
+	}
+	inv.backends[3].(*mockBackend).Stats.mu.Lock()
+	inv.backends[3].(*mockBackend).setHealthy(false)
+	inv.backends[3].(*mockBackend).Stats.mu.Unlock()
+	if be := lb.Backend(); be != nil {
+		t.Fatal("all backends should be unhealthy, but got one anyway")
+	}
+}
+
+// Test that backends reporting a high load receive less traffic.
+func TestLoadWeighted(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	defer inv.Close()
+	for i, load := range []string{"0.9", "0.1", ""} {
+		m := inv.backends[i].(*mockBackend)
+		m.weight = 1
+		m.rt.loadHeader = "X-Load"
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("X-Load", load)
+		m.rt.mu.Lock()
+		m.rt.recordLoad(resp)
+		m.rt.mu.Unlock()
+	}
+	lb, err := NewLoadBalancer(LBConfig{Type: "loadweighted"}, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20000
+	counts := make([]int, 3)
+	for i := 0; i < n; i++ {
+		counts[lb.Backend().(*mockBackend).n]++
+	}
+	// Weights are 0.1, 0.9 and 1.
+	for i, w := range []float64{0.1, 0.9, 1} {
+		expect := n * w / 2
+		if math.Abs(float64(counts[i])-expect) > expect*0.15 {
+			t.Fatalf("backend %d selected %d times, expected about %.0f", i, counts[i], expect)
+		}
+	}
+
+	// The reported load is smoothed and limited to 0-1.
+	m := inv.backends[0].(*mockBackend)
+	resp := &http.Response{Header: http.Header{"X-Load": []string{"7"}}}
+	m.rt.mu.Lock()
+	m.rt.recordLoad(resp)
+	m.rt.mu.Unlock()
+	if l := m.load(); math.Abs(l-0.93) > 1e-9 {
+		t.Fatal("expected smoothed load 0.93, got", l)
+	}
+}
+
+// Test that a weight changing during selection never fails the pick.
+func TestWeightedRandomChangingWeight(t *testing.T) {
+	inv := newMockInventory(t, 2)
+	defer inv.Close()
+	calls := 0
+	lb := &weightedRandom{lbBase: lbBase{inv: inv}, weight: func(Backend) int {
+		// The load rises after the weights have been summed.
+		calls++
+		if calls > 2 {
+			return 1
+		}
+		return 1000
+	}}
+	for i := 0; i < 100; i++ {
+		calls = 0
+		if be := lb.pick(nil); be == nil {
+			t.Fatal("no backend selected")
+		}
+	}
+}
+
+// setConnections sets the number of connections of a backend
+// and tells its inventories, like opening a connection does.
+func setConnections(b *backend, n int) {
+	atomic.StoreInt64(&b.rt.running, int64(n))
+	b.connsChanged()
+}
+
+// Test that "leastconn" follows connections as they are
+// opened and closed, and as backends are added.
+func TestLeastConnFollowsConnections(t *testing.T) {
+	inv := newMockInventory(t, 4)
+	defer inv.Close()
+	for _, be := range inv.backends {
+		be.Close() // Close the monitor, so it doesn't interfere.
+	}
+	lb, err := NewLoadBalancer(LBConfig{Type: "leastconn"}, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(n int) {
+		t.Helper()
+		be := lb.Backend()
+		if be == nil || be.(*mockBackend).n != n {
+			t.Fatalf("expected backend %d, got %v", n, be)
+		}
+	}
+	open := func(n int) func() {
+		return inv.backends[n].(*mockBackend).openConn()
+	}
+	expect(0)
+	if inv.byConns() == nil {
+		t.Fatal("backends were not ordered by connections")
+	}
+	done0 := open(0)
+	expect(1)
+	done1 := open(1)
+	done2 := open(2)
+	expect(3)
+	done3 := open(3)
+	expect(0)
+	done2()
+	expect(2)
+	done0()
+	expect(0)
+	done0 = open(0)
+	done2 = open(2)
+
+	// An added backend has no connections.
+	added := newMockBackend(t, 4)
+	defer added.Close()
+	if err := inv.AddBackend(added); err != nil {
+		t.Fatal(err)
+	}
+	expect(4)
+	setConnections(added.(*mockBackend).backend, 1)
+	expect(0)
+	done0()
+	done1()
+	done2()
+	done3()
+}
+
+// Test that smoothed connections make "leastconn"
+// switch backends less often under bursty load.
+func TestLeastConnSmoothed(t *testing.T) {
+	inv := newMockInventory(t, 2)
+	defer inv.Close()
+	bursty := inv.backends[0].(*mockBackend)
+	steady := inv.backends[1].(*mockBackend)
+	// Close the monitors, so samples are only taken by the test.
+	bursty.backend.Close()
+	steady.backend.Close()
+
+	raw, err := NewLoadBalancer(LBConfig{Type: "leastconn"}, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smooth, err := NewLoadBalancer(LBConfig{Type: "leastconn", SmoothConnections: true}, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lastRaw, lastSmooth Backend
+	var switchRaw, switchSmooth int
+	for i := 0; i < 60; i++ {
+		// The bursty backend alternates between 0 and 10 connections,
+		// the steady one always has 4.
+		setConnections(bursty.backend, 10*(i%2))
+		setConnections(steady.backend, 4)
+		for _, m := range []*mockBackend{bursty, steady} {
+			m.Stats.mu.Lock()
+			m.sampleConnections()
+			m.Stats.mu.Unlock()
+		}
+		be := raw.Backend()
+		if lastRaw != nil && be != lastRaw {
+			switchRaw++
+		}
+		lastRaw = be
+		be = smooth.Backend()
+		if lastSmooth != nil && be != lastSmooth {
+			switchSmooth++
+		}
+		lastSmooth = be
+	}
+	if switchRaw < 50 {
+		t.Fatal("expected raw connections to switch on every burst, switched", switchRaw)
+	}
+	if switchSmooth > 5 {
+		t.Fatal("expected smoothed connections to be stable, switched", switchSmooth)
+	}
+	if lastSmooth != steady {
+		t.Fatal("expected the steady backend to be selected, got", lastSmooth.Name())
+	}
+	if n := bursty.Statistics().SmoothConnections; math.Abs(n-5) > 1 {
+		t.Fatal("expected average of about 5 connections, got", n)
+	}
+}
+
+// Test that "lowestp95" avoids a backend with a low
+// average latency but slow tail requests.
+func TestLowestP95(t *testing.T) {
+	inv := newMockInventory(t, 2)
+	defer inv.Close()
+	tail := inv.backends[0].(*mockBackend)
+	steady := inv.backends[1].(*mockBackend)
+
+	lb, err := NewLoadBalancer(LBConfig{Type: "lowestp95"}, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Backends without samples are preferred, so they get sampled.
+	tail.rt.mu.Lock()
+	tail.rt.recordLatency(time.Second)
+	tail.rt.mu.Unlock()
+	if be := lb.Backend(); be != steady {
+		t.Fatal("expected the backend without samples to be selected, got", be.Name())
+	}
+
+	// The tail backend averages about 100ms, but 10% of requests take a second.
+	// The steady backend always takes 150ms.
+	var tailSum, steadySum time.Duration
+	tail.rt.mu.Lock()
+	steady.rt.mu.Lock()
+	for i := 0; i < latencySamples*2; i++ {
+		d := time.Millisecond
+		if i%10 == 0 {
+			d = time.Second
+		}
+		tail.rt.recordLatency(d)
+		tailSum += d
+		steady.rt.recordLatency(150 * time.Millisecond)
+		steadySum += 150 * time.Millisecond
+	}
+	// Make the cached percentiles expire.
+	tail.rt.p95At = time.Time{}
+	steady.rt.p95At = time.Time{}
+	steady.rt.mu.Unlock()
+	tail.rt.mu.Unlock()
+	if tailSum >= steadySum {
+		t.Fatal("expected the tail backend to have the lowest average")
+	}
+	if l := len(tail.rt.samples); l != latencySamples {
+		t.Fatal("expected", latencySamples, "samples, got", l)
+	}
+	if p := tail.latencyPercentile(95); p != time.Second {
+		t.Fatal("expected p95 of 1s, got", p)
+	}
+	if p := steady.latencyPercentile(95); p != 150*time.Millisecond {
+		t.Fatal("expected p95 of 150ms, got", p)
+	}
+	for i := 0; i < 10; i++ {
+		if be := lb.Backend(); be != steady {
+			t.Fatal("expected the steady backend to be selected, got", be.Name())
+		}
+	}
+
+	// The percentile is cached, so new samples are not used at once.
+	steady.rt.mu.Lock()
+	for i := 0; i < latencySamples; i++ {
+		steady.rt.recordLatency(2 * time.Second)
+	}
+	steady.rt.mu.Unlock()
+	if be := lb.Backend(); be != steady {
+		t.Fatal("expected the cached percentile to be used, got", be.Name())
+	}
+
+	// When the samples of the tail backend are too old,
+	// it has no samples, so it is tried again.
+	tail.rt.mu.Lock()
+	for i := range tail.rt.samples {
+		tail.rt.samples[i].at = time.Now().Add(-latencySampleAge)
+	}
+	tail.rt.p95At = time.Time{}
+	tail.rt.mu.Unlock()
+	if p := tail.latencyPercentile(95); p != 0 {
+		t.Fatal("expected no percentile from old samples, got", p)
+	}
+	if be := lb.Backend(); be != tail {
+		t.Fatal("expected the backend with old samples to be selected, got", be.Name())
+	}
+}
+
+// Test that failing selections are counted and
+// only logged once per interval.
+func TestNoHealthyRateLimited(t *testing.T) {
+	for _, typ := range []string{"roundrobin", "leastconn", "weightedrandom"} {
+		inv := newMockInventory(t, 3)
+		for _, be := range inv.backends {
+			mark := be.(*mockBackend)
+			mark.Stats.mu.Lock()
+			mark.setHealthy(false)
+			mark.Stats.mu.Unlock()
+		}
+		lb, err := NewLoadBalancer(LBConfig{Type: typ}, inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var logged int
+		base := lbBaseOf(lb)
+		base.log.interval = time.Hour
+		base.log.output = func(v ...interface{}) { logged++ }
+
+		for i := 0; i < 100; i++ {
+			if be := lb.Backend(); be != nil {
+				t.Fatal(typ, "all backends should be unhealthy, but got one anyway")
+			}
+		}
+		if logged != 1 {
+			t.Fatal(typ, "expected 1 log line, got", logged)
+		}
+		if got := lb.Stats().NoHealthy; got != 100 {
+			t.Fatal(typ, "expected 100 failed selections, got", got)
+		}
+		inv.Close()
+	}
+}
+
+// lbBaseOf returns the common load balancer fields.
+func lbBaseOf(lb LoadBalancer) *lbBase {
+	switch v := lb.(type) {
+	case *roundRobin:
+		return &v.lbBase
+	case *leastConn:
+		return &v.lbBase
+	case *weightedRandom:
+		return &v.lbBase
+	}
+	panic("unknown load balancer type")
+}
+
+func TestRateLoggerInterval(t *testing.T) {
+	var lines [][]interface{}
+	l := rateLogger{interval: 50 * time.Millisecond, output: func(v ...interface{}) { lines = append(lines, v) }}
+	l.Println("a")
+	l.Println("b")
+	l.Println("c")
+	if len(lines) != 1 {
+		t.Fatal("expected 1 line, got", len(lines))
+	}
+	time.Sleep(60 * time.Millisecond)
+	l.Println("d")
+	if len(lines) != 2 {
+		t.Fatal("expected 2 lines, got", len(lines))
+	}
+	if got := fmt.Sprint(lines[1]...); !strings.Contains(got, "2 similar messages suppressed") {
+		t.Fatal("unexpected line:", got)
+	}
+}
+
+// BenchmarkLeastConn selects backends from a large inventory
+// with a spread of connection counts.
+func BenchmarkLeastConn(b *testing.B) {
+	const n = 500
+	loadOnce.Do(func() {
+		var err error
+		defaultConfig, err = ReadConfigFile("testdata/validconfig.toml")
+		if err != nil {
+			b.Fatal("Unable to read config:", err)
+		}
+	})
+	be := make([]Backend, n)
+	for i := range be {
+		mb := &mockBackend{backend: newBackend(defaultConfig.Backend, "", ""), n: i}
+		mb.rt.running = int64(1 + (n-i)%7)
+		be[i] = mb
+	}
+	inv := NewInventory(be, defaultConfig.Backend)
+	defer inv.Close()
+	lb := newLeastConn(inv, LBConfig{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if lb.Backend() == nil {
+				b.Fatal("no backend returned")
+			}
+		}
+	})
+}
+
+// countingBackend counts the health checks of a backend.
+type countingBackend struct {
+	*mockBackend
+	calls *int64
+}
+
+func (c countingBackend) Healthy() bool {
+	atomic.AddInt64(c.calls, 1)
+	return c.mockBackend.Healthy()
+}
+
+// Test that the best tier is cached, so backends are not all checked
+// on every selection, and that it changes with backend availability.
+func TestBestTierCached(t *testing.T) {
+	var calls int64
+	be := make([]Backend, 10)
+	var primary []*mockBackend
+	for i := range be {
+		m := newMockBackend(t, i).(*mockBackend)
+		m.backend.Close() // Close the monitor, so it doesn't interfere.
+		m.backup = i >= 5
+		if !m.backup {
+			primary = append(primary, m)
+		}
+		be[i] = countingBackend{mockBackend: m, calls: &calls}
+	}
+	inv := NewInventory(be, defaultConfig.Backend)
+	defer inv.Close()
+	lb := newLeastConn(inv, LBConfig{})
+	lb.Backend()
+
+	atomic.StoreInt64(&calls, 0)
+	for i := 0; i < 100; i++ {
+		if lb.Backend().Backup() {
+			t.Fatal("expected a primary backend")
+		}
+	}
+	if n := atomic.LoadInt64(&calls); n > 100 {
+		t.Fatal("expected at most one health check per selection, got", n)
+	}
+
+	for _, m := range primary {
+		m.Stats.mu.Lock()
+		m.setHealthy(false)
+		m.Stats.mu.Unlock()
+	}
+	if !lb.Backend().Backup() {
+		t.Fatal("expected a backup backend when no primary is healthy")
+	}
+	primary[2].Stats.mu.Lock()
+	primary[2].setHealthy(true)
+	primary[2].Stats.mu.Unlock()
+	if got := lb.Backend(); got.ID() != primary[2].ID() {
+		t.Fatal("expected the healthy primary backend, got", got.ID())
+	}
+	if err := inv.Remove(primary[2].ID()); err != nil {
+		t.Fatal(err)
+	}
+	if !lb.Backend().Backup() {
+		t.Fatal("expected a backup backend after the primary was removed")
+	}
+}
+
+// Test that degraded backends are only selected if no other backend is healthy.
+func TestDegradedDeprioritized(t *testing.T) {
+	setDegraded := func(be Backend, degraded bool) {
+		m := be.(*mockBackend)
+		m.Stats.mu.Lock()
+		m.Stats.Degraded = degraded
+		m.Stats.mu.Unlock()
+	}
+	for _, typ := range []string{"roundrobin", "leastconn", "weightedrandom"} {
+		inv := newMockInventory(t, 3)
+		for _, be := range inv.backends {
+			be.Close() // Close the monitor, so it doesn't interfere.
+		}
+		lb, err := NewLoadBalancer(LBConfig{Type: typ}, inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setDegraded(inv.backends[0], true)
+		setDegraded(inv.backends[1], true)
+		for i := 0; i < 20; i++ {
+			be := lb.Backend()
+			if be == nil || be.(*mockBackend).n != 2 {
+				t.Fatalf("%s: expected the backend that isn't degraded, got %v", typ, be)
+			}
+		}
+
+		// The healthy backend being busy should not matter.
+		setConnections(inv.backends[2].(*mockBackend).backend, 10)
+		if be := lb.Backend(); be == nil || be.(*mockBackend).n != 2 {
+			t.Fatalf("%s: expected the busy backend that isn't degraded, got %v", typ, be)
+		}
+		setConnections(inv.backends[2].(*mockBackend).backend, 0)
+
+		// With only degraded backends healthy, they should be used.
+		m := inv.backends[2].(*mockBackend)
+		m.Stats.mu.Lock()
+		m.setHealthy(false)
+		m.Stats.mu.Unlock()
+		for i := 0; i < 20; i++ {
+			be := lb.Backend()
+			if be == nil || be.(*mockBackend).n == 2 {
+				t.Fatalf("%s: expected a degraded backend, got %v", typ, be)
+			}
+		}
+		lb.Close()
+	}
+}
+
+// Test that backup backends are only used if no primary backend is healthy.
+func TestBackupLastResort(t *testing.T) {
+	setHealthy := func(be Backend, healthy bool) {
+		m := be.(*mockBackend)
+		m.Stats.mu.Lock()
+		m.setHealthy(healthy)
+		m.Stats.mu.Unlock()
+	}
+	for _, typ := range []string{"roundrobin", "leastconn", "weightedrandom"} {
+		inv := newMockInventory(t, 4)
+		for _, be := range inv.backends {
+			be.Close() // Close the monitor, so it doesn't interfere.
+		}
+		inv.backends[2].(*mockBackend).backup = true
+		inv.backends[3].(*mockBackend).backup = true
+		lb, err := NewLoadBalancer(LBConfig{Type: typ}, inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			be := lb.Backend()
+			if be == nil || be.Backup() {
+				t.Fatalf("%s: expected a primary backend, got %v", typ, be)
+			}
+		}
+
+		// A busy primary should still be preferred.
+		setHealthy(inv.backends[0], false)
+		setConnections(inv.backends[1].(*mockBackend).backend, 10)
+		if be := lb.Backend(); be == nil || be.(*mockBackend).n != 1 {
+			t.Fatalf("%s: expected the remaining primary, got %v", typ, be)
+		}
+		setConnections(inv.backends[1].(*mockBackend).backend, 0)
+
+		// With no healthy primary, backups are used.
+		setHealthy(inv.backends[1], false)
+		seen := make(map[int]bool)
+		for i := 0; i < 20; i++ {
+			be := lb.Backend()
+			if be == nil || !be.Backup() {
+				t.Fatalf("%s: expected a backup backend, got %v", typ, be)
+			}
+			seen[be.(*mockBackend).n] = true
+		}
+		if typ == "roundrobin" && len(seen) != 2 {
+			t.Fatalf("%s: expected both backups to be used, got %v", typ, seen)
+		}
+
+		// Backups are skipped as soon as a primary is healthy again.
+		setHealthy(inv.backends[0], true)
+		if be := lb.Backend(); be == nil || be.(*mockBackend).n != 0 {
+			t.Fatalf("%s: expected the recovered primary, got %v", typ, be)
+		}
+		lb.Close()
+	}
+}
+
+// Test that higher priority tiers are only used
+// when all backends of lower tiers are unhealthy.
+func TestPriorityTiers(t *testing.T) {
+	setHealthy := func(be Backend, healthy bool) {
+		m := be.(*mockBackend)
+		m.Stats.mu.Lock()
+		m.setHealthy(healthy)
+		m.Stats.mu.Unlock()
+	}
+	for _, typ := range []string{"roundrobin", "leastconn", "weightedrandom"} {
+		// Two backends in each of tier 0, 1 and 2.
+		inv := newMockInventory(t, 6)
+		for i, be := range inv.backends {
+			be.Close() // Close the monitor, so it doesn't interfere.
+			be.(*mockBackend).priority = i / 2
+		}
+		lb, err := NewLoadBalancer(LBConfig{Type: typ}, inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectTier := func(tier int) {
+			t.Helper()
+			for i := 0; i < 20; i++ {
+				be := lb.Backend()
+				if be == nil || be.Priority() != tier {
+					t.Fatalf("%s: expected backend in tier %d, got %v", typ, tier, be)
+				}
+			}
+		}
+		expectTier(0)
+
+		// One healthy backend is enough to stay in a tier.
+		setHealthy(inv.backends[0], false)
+		expectTier(0)
+		setHealthy(inv.backends[1], false)
+		expectTier(1)
+
+		// Tier 1 exhausted, so tier 2 is used.
+		setHealthy(inv.backends[2], false)
+		setHealthy(inv.backends[3], false)
+		expectTier(2)
+
+		// A backup is only used when all tiers are exhausted.
+		inv.backends[4].(*mockBackend).backup = true
+		expectTier(2)
+		setHealthy(inv.backends[5], false)
+		if be := lb.Backend(); be == nil || !be.Backup() {
+			t.Fatalf("%s: expected the backup, got %v", typ, be)
+		}
+
+		// Recovery of a lower tier moves traffic back.
+		setHealthy(inv.backends[1], true)
+		expectTier(0)
+		lb.Close()
+	}
+}
+
+// sequenceSource is a rand.Source returning values from a fixed sequence.
+// Each value v makes rand.Intn(n) return v%n for small values.
+type sequenceSource struct {
+	values []int64
+	i      int
+}
+
+func (s *sequenceSource) Int63() int64 {
+	v := s.values[s.i%len(s.values)]
+	s.i++
+	return v << 32
+}
+
+func (s *sequenceSource) Seed(int64) { s.i = 0 }
+
+// Test that an injected random source gives deterministic selections.
+func TestInjectedRandSource(t *testing.T) {
+	defer setRandSource(nil)
+	inv := newMockInventory(t, 4)
+	defer inv.Close()
+	for i, be := range inv.backends {
+		mark := be.(*mockBackend)
+		mark.backend.Close() // Close the monitor, so it doesn't interfere.
+		mark.weight = i + 1
+	}
+
+	// Weights 1, 2, 3 and 4 cover the values 0, 1-2, 3-5 and 6-9.
+	setRandSource(&sequenceSource{values: []int64{9, 0, 3, 1, 6, 5}})
+	lb, err := NewLoadBalancer(LBConfig{Type: "weightedrandom"}, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []int{3, 0, 2, 1, 3, 2}
+	for i, want := range expect {
+		if got := lb.Backend().(*mockBackend).n; got != want {
+			t.Fatalf("selection %d: expected backend %d, got %d", i, want, got)
+		}
+	}
+
+	// Round robin with a random start uses the same source.
+	setRandSource(&sequenceSource{values: []int64{2}})
+	lb, err = NewLoadBalancer(LBConfig{Type: "roundrobin", RandomStart: true}, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lb.Backend().(*mockBackend).n; got != 2 {
+		t.Fatal("expected round robin to start at backend 2, got", got)
+	}
+}
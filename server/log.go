@@ -0,0 +1,108 @@
+package server
+
+import (
+	"log"
+	"sync"
+)
+
+// Logger is used for all logging of the server.
+// Use (*Server).SetLogger to send the log to another destination.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// logLevel is the minimum level of messages that are logged.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevels maps 'log-level' values to log levels.
+var logLevels = map[string]logLevel{
+	"":      levelInfo,
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// stdLogger logs to the standard logger.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, v ...interface{}) { log.Printf("DEBUG: "+format, v...) }
+func (stdLogger) Infof(format string, v ...interface{})  { log.Printf(format, v...) }
+func (stdLogger) Warnf(format string, v ...interface{})  { log.Printf("WARNING: "+format, v...) }
+func (stdLogger) Errorf(format string, v ...interface{}) { log.Printf("ERROR: "+format, v...) }
+
+// serverLog is the destination and level of the log of a server.
+// It is passed to the proxy, load balancers and backends of the server.
+// A nil *serverLog logs to the standard logger at the info level,
+// so backends and load balancers can be used without a server.
+type serverLog struct {
+	mu    sync.RWMutex
+	out   Logger
+	level logLevel
+}
+
+// newServerLog returns a log to the standard logger at the info level.
+func newServerLog() *serverLog {
+	return &serverLog{out: stdLogger{}, level: levelInfo}
+}
+
+// SetLogger will send all log messages of the server to the supplied logger.
+// If nil is supplied, the standard logger is used.
+func (s *Server) SetLogger(l Logger) {
+	if l == nil {
+		l = stdLogger{}
+	}
+	s.log.mu.Lock()
+	s.log.out = l
+	s.log.mu.Unlock()
+}
+
+// setLevel sets the minimum level of messages that are logged.
+func (l *serverLog) setLevel(level logLevel) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.level = level
+	l.mu.Unlock()
+}
+
+// logf will send the message to the logger,
+// if the level is at least the configured level.
+func (l *serverLog) logf(level logLevel, format string, v ...interface{}) {
+	var out Logger = stdLogger{}
+	min := levelInfo
+	if l != nil {
+		l.mu.RLock()
+		out, min = l.out, l.level
+		l.mu.RUnlock()
+	}
+	if level < min {
+		return
+	}
+	switch level {
+	case levelDebug:
+		out.Debugf(format, v...)
+	case levelInfo:
+		out.Infof(format, v...)
+	case levelWarn:
+		out.Warnf(format, v...)
+	default:
+		out.Errorf(format, v...)
+	}
+}
+
+func (l *serverLog) Debugf(format string, v ...interface{}) { l.logf(levelDebug, format, v...) }
+func (l *serverLog) Infof(format string, v ...interface{})  { l.logf(levelInfo, format, v...) }
+func (l *serverLog) Warnf(format string, v ...interface{})  { l.logf(levelWarn, format, v...) }
+func (l *serverLog) Errorf(format string, v ...interface{}) { l.logf(levelError, format, v...) }
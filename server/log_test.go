@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// captureLogger records all messages with their level.
+type captureLogger struct {
+	lines []string
+}
+
+func (c *captureLogger) Debugf(format string, v ...interface{}) { c.add("debug", format, v) }
+func (c *captureLogger) Infof(format string, v ...interface{})  { c.add("info", format, v) }
+func (c *captureLogger) Warnf(format string, v ...interface{})  { c.add("warn", format, v) }
+func (c *captureLogger) Errorf(format string, v ...interface{}) { c.add("error", format, v) }
+
+func (c *captureLogger) add(level, format string, v []interface{}) {
+	c.lines = append(c.lines, level+": "+fmt.Sprintf(format, v...))
+}
+
+// Test that messages are sent to the logger and filtered by level.
+func TestLoggerLevel(t *testing.T) {
+	s := &Server{log: newServerLog()}
+	c := &captureLogger{}
+	s.SetLogger(c)
+
+	logAll := func() {
+		s.log.Debugf("debug %d", 1)
+		s.log.Infof("info %d", 2)
+		s.log.Warnf("warn %d", 3)
+		s.log.Errorf("error %d", 4)
+	}
+	tests := []struct {
+		level  string
+		expect []string
+	}{
+		{level: "", expect: []string{"info: info 2", "warn: warn 3", "error: error 4"}},
+		{level: "debug", expect: []string{"debug: debug 1", "info: info 2", "warn: warn 3", "error: error 4"}},
+		{level: "warn", expect: []string{"warn: warn 3", "error: error 4"}},
+		{level: "error", expect: []string{"error: error 4"}},
+	}
+	for _, test := range tests {
+		c.lines = nil
+		conf := valid_config
+		conf.LogLevel = test.level
+		if err := conf.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		s.log.setLevel(logLevels[conf.LogLevel])
+		logAll()
+		if !reflect.DeepEqual(c.lines, test.expect) {
+			t.Errorf("level %q: expected %q, got %q", test.level, test.expect, c.lines)
+		}
+	}
+
+	// Rate limited messages are logged as warnings.
+	c.lines = nil
+	s.log.setLevel(levelWarn)
+	l := rateLogger{log: s.log}
+	l.Println("Unable to find a healthy backend")
+	expect := []string{"warn: Unable to find a healthy backend"}
+	if !reflect.DeepEqual(c.lines, expect) {
+		t.Errorf("expected %q, got %q", expect, c.lines)
+	}
+}
+
+// Test that servers send messages of their backends
+// and load balancers to their own logger.
+func TestLoggerPerServer(t *testing.T) {
+	var logs [2]*captureLogger
+	var lbs [2]LoadBalancer
+	for i := range logs {
+		s := &Server{log: newServerLog()}
+		logs[i] = &captureLogger{}
+		s.SetLogger(logs[i])
+		inv := NewInventory(nil, BackendConfig{log: s.log})
+		defer inv.Close()
+		lb, err := NewLoadBalancer(LBConfig{Type: "roundrobin"}, inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lbs[i] = lb
+	}
+	if be := lbs[0].Backend(); be != nil {
+		t.Fatal("expected no backend, got", be)
+	}
+	expect := []string{"warn: Unable to find a healthy backend"}
+	if !reflect.DeepEqual(logs[0].lines, expect) {
+		t.Errorf("expected %q, got %q", expect, logs[0].lines)
+	}
+	if len(logs[1].lines) != 0 {
+		t.Errorf("expected nothing logged by the other server, got %q", logs[1].lines)
+	}
+}
@@ -1,15 +1,253 @@
 package server
 
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
 type Provisioner interface {
 	Add() error
 	Remove() error
 }
 
+// ErrMaintenanceWindow is returned when provisioning is
+// suppressed by a maintenance window.
+var ErrMaintenanceWindow = fmt.Errorf("provisioning suppressed by maintenance window")
+
+// ErrCooldown is returned when provisioning is suppressed,
+// because the cooldown after the last change hasn't expired.
+var ErrCooldown = fmt.Errorf("provisioning suppressed by cooldown")
+
+// ErrScaleLocked is returned when provisioning is suppressed,
+// because another proxy holds the shared lock.
+var ErrScaleLocked = fmt.Errorf("provisioning suppressed by another proxy")
+
+// errProvisionerClosed is returned when the provisioner has been closed.
+var errProvisionerClosed = fmt.Errorf("provisioner has been closed")
+
 type provisioner struct {
-	Config ProvisionConfig
+	Config   ProvisionConfig
+	windows  []maintenanceWindow
+	now      func() time.Time // Returns current time. Replaceable for tests.
+	lock     scaleLock
+	mu       sync.Mutex
+	closed   bool
+	nextAdd  time.Time    // No backends are added before this.
+	nextDrop time.Time    // No backends are removed before this.
+	save     func() error // Saves the inventory after backends are added or removed, if set.
+	log      *serverLog   // Log of the backends provisioned.
 }
 
 func newProvisioner(c ProvisionConfig, lb LoadBalancer) (*provisioner, error) {
-	p := provisioner{Config: c}
+	p := provisioner{Config: c, now: time.Now, lock: scaleLock(c.LockFile), log: balancerLog(lb)}
+	for _, w := range c.MaintenanceWindows {
+		mw, err := parseMaintenanceWindow(w)
+		if err != nil {
+			return nil, err
+		}
+		p.windows = append(p.windows, mw)
+	}
 	return &p, nil
 }
+
+// Add will provision a new backend.
+// If we are inside a maintenance window ErrMaintenanceWindow
+// is returned, and nothing is provisioned.
+// ErrCooldown or ErrScaleLocked is returned if a backend
+// has been added recently by this or another proxy.
+func (p *provisioner) Add() error {
+	if p.isClosed() {
+		return errProvisionerClosed
+	}
+	if w, ok := p.inMaintenance(); ok {
+		p.log.Infof("Not adding backend, maintenance window %v is active", w)
+		return ErrMaintenanceWindow
+	}
+	if err := p.cooldown(&p.nextAdd, p.Config.UpscaleEvery); err != nil {
+		return err
+	}
+	// TODO: Provision droplet.
+	p.persist()
+	return nil
+}
+
+// Remove will deprovision a backend.
+// If we are inside a maintenance window ErrMaintenanceWindow
+// is returned, and nothing is deprovisioned.
+// ErrCooldown or ErrScaleLocked is returned if a backend
+// has been removed recently by this or another proxy.
+func (p *provisioner) Remove() error {
+	if p.isClosed() {
+		return errProvisionerClosed
+	}
+	if w, ok := p.inMaintenance(); ok {
+		p.log.Infof("Not removing backend, maintenance window %v is active", w)
+		return ErrMaintenanceWindow
+	}
+	if err := p.cooldown(&p.nextDrop, p.Config.DownscaleEvery); err != nil {
+		return err
+	}
+	// TODO: Deprovision droplet.
+	p.persist()
+	return nil
+}
+
+// persist will save the inventory after it has changed,
+// so a restart doesn't lose the provisioned backends.
+func (p *provisioner) persist() {
+	if p.save == nil {
+		return
+	}
+	if err := p.save(); err != nil {
+		p.log.Errorf("Saving inventory after provisioning: %v", err)
+	}
+}
+
+// Close the provisioner.
+// No backends will be added or removed after this.
+func (p *provisioner) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+}
+
+// isClosed returns true if the provisioner has been closed.
+func (p *provisioner) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// cooldown will check if the cooldown stored in next has expired,
+// and the shared lock can be acquired.
+// If so, next cooldown is set to a jittered 'every' from now.
+func (p *provisioner) cooldown(next *time.Time, every Duration) error {
+	now := p.now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !next.IsZero() && now.Before(*next) {
+		return ErrCooldown
+	}
+	until := now.Add(jitter(time.Duration(every), p.Config.CooldownJitter))
+	if p.lock != "" {
+		ok, err := p.lock.acquire(now, until)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			p.log.Infof("Not scaling, another proxy has scaled recently")
+			return ErrScaleLocked
+		}
+	}
+	*next = until
+	return nil
+}
+
+// jitter returns d with up to the fraction f of d added at random.
+func jitter(d time.Duration, f float64) time.Duration {
+	if f <= 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Float64()*f*float64(d))
+}
+
+// scaleLock is a lock shared between proxies, stored in a file.
+// The file contains the time the lock expires.
+type scaleLock string
+
+// acquire the lock until the supplied time.
+// If the lock is held by someone else, false is returned.
+// Expired locks are taken over.
+func (l scaleLock) acquire(now, until time.Time) (bool, error) {
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(string(l), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			b, err := ioutil.ReadFile(string(l))
+			if err != nil && !os.IsNotExist(err) {
+				return false, err
+			}
+			exp, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(b)))
+			if err == nil && now.Before(exp) {
+				return false, nil
+			}
+			// Expired or invalid, remove and try again.
+			err = os.Remove(string(l))
+			if err != nil && !os.IsNotExist(err) {
+				return false, err
+			}
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		_, err = f.WriteString(until.UTC().Format(time.RFC3339Nano))
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		return err == nil, err
+	}
+	return false, nil
+}
+
+// inMaintenance returns the active maintenance window if there is one.
+func (p *provisioner) inMaintenance() (maintenanceWindow, bool) {
+	now := p.now()
+	for _, w := range p.windows {
+		if w.contains(now) {
+			return w, true
+		}
+	}
+	return maintenanceWindow{}, false
+}
+
+// maintenanceWindow is a daily time range in UTC.
+// If start is after end, the window crosses midnight.
+type maintenanceWindow struct {
+	start time.Duration // Time since midnight
+	end   time.Duration // Time since midnight
+}
+
+// parseMaintenanceWindow will parse a window
+// specified as "15:04-15:04".
+func parseMaintenanceWindow(s string) (maintenanceWindow, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return maintenanceWindow{}, fmt.Errorf("window %q must be specified as 'hh:mm-hh:mm'", s)
+	}
+	var w maintenanceWindow
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return maintenanceWindow{}, fmt.Errorf("window %q: %v", s, err)
+		}
+		d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			w.start = d
+		} else {
+			w.end = d
+		}
+	}
+	if w.start == w.end {
+		return maintenanceWindow{}, fmt.Errorf("window %q cannot start and end at the same time", s)
+	}
+	return w, nil
+}
+
+// contains returns true if the time is within the window.
+func (w maintenanceWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start < w.end {
+		return d >= w.start && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+func (w maintenanceWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", int(w.start.Hours()), int(w.start.Minutes())%60, int(w.end.Hours()), int(w.end.Minutes())%60)
+}
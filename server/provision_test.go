@@ -0,0 +1,133 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type maintenanceTest struct {
+	windows  []string
+	at       string // Time of day in UTC
+	suppress bool
+}
+
+var maintenanceTests = []maintenanceTest{
+	maintenanceTest{windows: nil, at: "12:00", suppress: false},
+	maintenanceTest{windows: []string{"09:00-17:00"}, at: "12:00", suppress: true},
+	maintenanceTest{windows: []string{"09:00-17:00"}, at: "09:00", suppress: true},
+	maintenanceTest{windows: []string{"09:00-17:00"}, at: "17:00", suppress: false},
+	maintenanceTest{windows: []string{"09:00-17:00"}, at: "08:59", suppress: false},
+	maintenanceTest{windows: []string{"22:00-06:00"}, at: "23:30", suppress: true},
+	maintenanceTest{windows: []string{"22:00-06:00"}, at: "03:00", suppress: true},
+	maintenanceTest{windows: []string{"22:00-06:00"}, at: "12:00", suppress: false},
+	maintenanceTest{windows: []string{"01:00-02:00", "13:00-14:00"}, at: "13:15", suppress: true},
+	maintenanceTest{windows: []string{"01:00-02:00", "13:00-14:00"}, at: "12:15", suppress: false},
+}
+
+// Test that provisioning is suppressed only inside maintenance windows.
+func TestProvisionMaintenanceWindow(t *testing.T) {
+	for i, test := range maintenanceTests {
+		conf := valid_config.Provision
+		conf.MaintenanceWindows = test.windows
+		p, err := newProvisioner(conf, nil)
+		if err != nil {
+			t.Fatal("test", i, "error creating provisioner:", err)
+		}
+		at, err := time.Parse("15:04", test.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.now = func() time.Time { return at }
+
+		for _, fn := range []func() error{p.Add, p.Remove} {
+			err = fn()
+			if test.suppress && err != ErrMaintenanceWindow {
+				t.Fatal("test", i, "expected provisioning to be suppressed, got", err)
+			}
+			if !test.suppress && err != nil {
+				t.Fatal("test", i, "expected provisioning not to be suppressed, got", err)
+			}
+		}
+	}
+}
+
+// Test that invalid windows are rejected.
+func TestParseMaintenanceWindow(t *testing.T) {
+	invalid := []string{"", "09:00", "09:00-", "9-17", "25:00-26:00", "10:00-10:00", "09:00-12:00-15:00"}
+	for _, w := range invalid {
+		_, err := parseMaintenanceWindow(w)
+		if err == nil {
+			t.Fatalf("window %q should not be valid", w)
+		}
+	}
+	w, err := parseMaintenanceWindow("22:30 - 06:15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != "22:30-06:15" {
+		t.Fatalf("unexpected window %q", w.String())
+	}
+}
+
+// Test that jitter adds at most the configured fraction.
+func TestProvisionJitter(t *testing.T) {
+	d := time.Minute
+	if got := jitter(d, 0); got != d {
+		t.Fatal("expected no jitter, got", got)
+	}
+	var varied bool
+	for i := 0; i < 1000; i++ {
+		got := jitter(d, 0.25)
+		if got < d || got > d+d/4 {
+			t.Fatalf("jitter %s out of range [%s, %s]", got, d, d+d/4)
+		}
+		varied = varied || got != d
+	}
+	if !varied {
+		t.Fatal("jitter was never added")
+	}
+}
+
+// Test that only one provisioner can scale while the shared lock is held,
+// and that a provisioner waits for its own cooldown.
+func TestProvisionSharedLock(t *testing.T) {
+	lock := filepath.Join(os.TempDir(), "doproxy-test-scale.lock")
+	os.Remove(lock)
+	defer os.Remove(lock)
+
+	conf := valid_config.Provision
+	conf.UpscaleEvery = Duration(time.Minute)
+	conf.CooldownJitter = 0.5
+	conf.LockFile = lock
+	now := time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)
+	var ps []*provisioner
+	for i := 0; i < 2; i++ {
+		p, err := newProvisioner(conf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.now = func() time.Time { return now }
+		ps = append(ps, p)
+	}
+
+	if err := ps[0].Add(); err != nil {
+		t.Fatal("first provisioner should add, got", err)
+	}
+	if err := ps[1].Add(); err != ErrScaleLocked {
+		t.Fatal("second provisioner should be locked, got", err)
+	}
+	if err := ps[0].Add(); err != ErrCooldown {
+		t.Fatal("first provisioner should be cooling down, got", err)
+	}
+
+	// After the maximum jittered cooldown, the lock has expired.
+	now = now.Add(90 * time.Second)
+	if err := ps[1].Add(); err != nil {
+		t.Fatal("second provisioner should add after lock expired, got", err)
+	}
+	if err := ps[0].Add(); err != ErrScaleLocked {
+		t.Fatal("first provisioner should be locked, got", err)
+	}
+}
@@ -1,19 +1,77 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ReverseProxy struct {
 	mu       sync.RWMutex
 	balancer LoadBalancer
 	conf     Config
+	draining []Backend // Removed backends that still had connections.
+	// wsBalancer is used for websocket upgrades if 'websocket-type' is set.
+	// It shares the inventory of balancer and must not be closed.
+	wsBalancer LoadBalancer
+	wsType     string
+	wsConns    int64   // Open websocket connections. Accessed atomically.
+	routes     []route // Path prefix routes and method pools, longest prefix first.
+	clients    clientLimiter
+	// shadow receives a copy of requests if 'shadow' is configured.
+	shadow         LoadBalancer
+	shadowInflight int64 // Mirrored requests in flight. Accessed atomically.
+	shadowMissed   int64 // Requests not mirrored, since no shadow backend was healthy. Accessed atomically.
+	inflight       int64 // Requests sent to backends. Accessed atomically.
+	retries        int64 // Retried requests. Accessed atomically.
+	failovers      int64 // Requests retried on another backend. Accessed atomically.
+
+	// rec records a sample of requests if 'record' is configured.
+	rec *recorder
+}
+
+// clientLimiter keeps track of the number of
+// requests in flight from each client IP.
+type clientLimiter struct {
+	mu       sync.Mutex
+	inflight map[string]int
+}
+
+// acquire will register a request from the client IP.
+// If the client already has max requests in flight,
+// false is returned and nothing is registered.
+func (c *clientLimiter) acquire(ip string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight[ip] >= max {
+		return false
+	}
+	if c.inflight == nil {
+		c.inflight = make(map[string]int)
+	}
+	c.inflight[ip]++
+	return true
+}
+
+// release will unregister a request from the client IP.
+func (c *clientLimiter) release(ip string) {
+	c.mu.Lock()
+	c.inflight[ip]--
+	if c.inflight[ip] <= 0 {
+		delete(c.inflight, ip)
+	}
+	c.mu.Unlock()
 }
 
 // NewReverseProxy will create a new reverse
@@ -39,35 +97,142 @@ func (h *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.URL.Scheme = "http"
 	conf := h.GetConfig()
 
-	if conf.AddForwarded {
-		// Get IP, and add it to "X-Forwarded-For".
-		// This allows proxy chaining.
+	// Record a sample of requests as the client sent them.
+	if rec := h.getRecorder(); rec != nil {
+		if done := rec.start(r); done != nil {
+			defer done()
+		}
+	}
+
+	// Send the duration and status of the request to statsd,
+	// and trace the request if enabled.
+	var span *Span
+	if m, tr := conf.Backend.metrics.get(), conf.Backend.tracer.get(); m != nil || tr != nil {
+		sw := &statusWriter{ResponseWriter: w}
+		w = sw
+		if tr != nil {
+			span = startSpan(r)
+		}
+		defer func(start time.Time) {
+			if m != nil {
+				m.request(start, sw.status)
+			}
+			if span != nil {
+				span.finish(tr, sw.status)
+			}
+		}(time.Now())
+	}
+
+	// Recover from panics, so a single request cannot take the server down.
+	defer func() {
+		if v := recover(); v != nil {
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			conf.Backend.log.Errorf("Panic serving %s %s from %s (request id %q): %v\n%s", r.Method, r.URL.Path, r.RemoteAddr, r.Header.Get("X-Request-Id"), v, debug.Stack())
+			writeError(w, r, conf, "Internal server error.", http.StatusInternalServerError)
+		}
+	}()
+
+	// Reject methods that are not allowed.
+	if !methodAllowed(conf, r.Method) {
+		w.Header().Set("Allow", strings.Join(allowedMethods(conf), ", "))
+		writeError(w, r, conf, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Reject long URLs before anything is done with them.
+	if conf.MaxURLLength > 0 && len(r.URL.RequestURI()) > conf.MaxURLLength {
+		writeError(w, r, conf, "URL too long.", http.StatusRequestURITooLong)
+		return
+	}
+
+	// Limit the number of concurrent requests from a single client.
+	if conf.MaxClientRequests > 0 {
+		if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if !h.clients.acquire(ip, conf.MaxClientRequests) {
+				writeError(w, r, conf, "Too many concurrent requests.", http.StatusTooManyRequests)
+				return
+			}
+			defer h.clients.release(ip)
+		}
+	}
+
+	// Clients connected to a Unix socket have no IP,
+	// so the headers are passed on as they are.
+	if conf.AddForwarded || conf.AddRealIP {
 		if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-			// If we aren't the first proxy retain prior
-			// X-Forwarded-For information as a comma+space
-			// separated list and fold multiple headers into one.
-			if prior, ok := r.Header["X-Forwarded-For"]; ok {
-				clientIP = strings.Join(prior, ", ") + ", " + clientIP
+			// Set "X-Real-IP" to the immediate client.
+			if conf.AddRealIP {
+				r.Header.Set("X-Real-IP", clientIP)
+			}
+			// Add IP to "X-Forwarded-For".
+			// This allows proxy chaining.
+			if conf.AddForwarded {
+				// If we aren't the first proxy retain prior
+				// X-Forwarded-For information as a comma+space
+				// separated list and fold multiple headers into one.
+				if prior, ok := r.Header["X-Forwarded-For"]; ok {
+					clientIP = strings.Join(prior, ", ") + ", " + clientIP
+				}
+				r.Header.Set("X-Forwarded-For", clientIP)
 			}
-			r.Header.Set("X-Forwarded-For", clientIP)
 		}
 	}
 
-	// Override protocol, we are talking to a backend now.
-	r.Proto = "HTTP/1.1"
-	r.ProtoMajor = 1
-	r.ProtoMinor = 1
+	// Tell the backend how the client connected to us.
+	if conf.AddProto {
+		if r.TLS != nil {
+			r.Header.Set("X-Forwarded-Proto", "https")
+		} else {
+			r.Header.Set("X-Forwarded-Proto", "http")
+		}
+	}
+	if conf.AddPort {
+		if port := frontendPort(r); port != "" {
+			r.Header.Set("X-Forwarded-Port", port)
+		}
+	}
+	// The Host header is forwarded unchanged, but backends behind
+	// other proxies often only trust "X-Forwarded-Host".
+	if conf.AddHost && r.Host != "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+
+	// Pass the verified client certificate subject to the backend.
+	// Any value sent by the client is removed.
+	if conf.ClientCertHdr != "" {
+		r.Header.Del(conf.ClientCertHdr)
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			r.Header.Set(conf.ClientCertHdr, r.TLS.PeerCertificates[0].Subject.String())
+		}
+	}
+
+	// Keep the connection to the backend open.
 	r.Close = false
 
-	// Get a backend
-	backend := h.GetBackend()
-	if backend == nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		// TODO: Add custom error message!
-		fmt.Fprintf(w, "No healthy backend available :(")
+	// Keep chunked uploads chunked. The length of the body is unknown,
+	// so it must be sent with chunked encoding to the backend.
+	if r.ContentLength < 0 || isChunked(r.TransferEncoding) {
+		r.ContentLength = -1
+		r.TransferEncoding = []string{"chunked"}
+	}
+
+	// Answer CORS preflight requests ourself.
+	if conf.CORS.Enable && conf.CORS.preflight(w, r) {
 		return
 	}
-	r.URL.Host = backend.Host()
+
+	// Require credentials before the request is sent to a backend.
+	if conf.BasicAuth.Enable {
+		if !conf.BasicAuth.authorized(r) {
+			conf.BasicAuth.challenge(w)
+			writeError(w, r, conf, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		// Credentials are for the proxy, not the backend.
+		r.Header.Del("Authorization")
+	}
 
 	webSock := false
 	ch := r.Header["Connection"]
@@ -79,16 +244,74 @@ func (h *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+
+	// Get a backend
+	backend := h.selectBackend(r, conf.LoadBalancing, webSock)
+	if backend == nil {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter(conf)))
+		// TODO: Add custom error message!
+		writeError(w, r, conf, "No healthy backend available :(", http.StatusServiceUnavailable)
+		return
+	}
+	// Tell the client which backend handled the request.
+	// This is set before the backend is contacted, so errors have it too.
+	// It is replaced if the request is sent to another backend.
+	useBackend(w, r, conf, backend)
+
+	// Override protocol, we are talking to a backend now.
+	// HTTP/2 backends keep the protocol, so gRPC streams work.
+	h2 := usesHTTP2(backend)
+	if !h2 {
+		r.Proto = "HTTP/1.1"
+		r.ProtoMajor = 1
+		r.ProtoMinor = 1
+	}
+	if span != nil {
+		span.Attributes["backend.id"] = backend.ID()
+		span.Attributes["backend.host"] = backend.Host()
+	}
+
 	// Handle websocket upgrades
 	// See https://groups.google.com/forum/#!topic/golang-nuts/KBx9pDlvFOc
 	if webSock {
+		// Limit the number of open websocket connections.
+		if max := conf.WebSocket.MaxConns; max > 0 {
+			if atomic.AddInt64(&h.wsConns, 1) > int64(max) {
+				atomic.AddInt64(&h.wsConns, -1)
+				writeError(w, r, conf, "Too many websocket connections.", http.StatusServiceUnavailable)
+				return
+			}
+			defer atomic.AddInt64(&h.wsConns, -1)
+		}
+
 		hj, ok := w.(http.Hijacker)
 
 		if !ok {
-			http.Error(w, "cannot hijack writer", http.StatusInternalServerError)
+			writeError(w, r, conf, "cannot hijack writer", http.StatusInternalServerError)
 			return
 		}
 
+		// Connect before hijacking, so the client can be told if it fails.
+		// Failed attempts are retried on another backend, if one is available.
+		b, be, err := dialWebSocket(r.Context(), conf.WebSocket, conf.Backend.log, backend, func(failed Backend) Backend {
+			next := h.selectOther(r, conf.LoadBalancing, true, failed)
+			if next == nil {
+				next = failed
+			}
+			h.recordRetry(failed, next)
+			return next
+		})
+		if be != backend {
+			backend = be
+			useBackend(w, r, conf, backend)
+		}
+		if err != nil {
+			conf.Backend.log.Warnf("Websocket connection to %s failed: %v", r.URL.Host, err)
+			writeError(w, r, conf, "couldn't connect to backend server", http.StatusServiceUnavailable)
+			return
+		}
+		defer b.Close()
+
 		a, _, err := hj.Hijack()
 		if err != nil {
 			http.Error(w, "error hijacking websocket", http.StatusInternalServerError)
@@ -96,24 +319,25 @@ func (h *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		defer a.Close()
 
-		b, err := net.Dial("tcp", r.URL.Host)
-		if err != nil {
-			http.Error(w, "couldn't connect to backend server", http.StatusServiceUnavailable)
-			return
+		// Count the websocket as a connection to the backend while it is open.
+		if c, ok := backend.(interface {
+			openConn() func()
+		}); ok {
+			defer c.openConn()()
 		}
-		defer b.Close()
 
 		err = r.Write(b)
 		if err != nil {
-			log.Printf("writing websocket request to backend server failed: %v", err)
+			conf.Backend.log.Warnf("Writing websocket request to backend server failed: %v", err)
 			http.Error(w, "writing to websocket backend failed", http.StatusInternalServerError)
 			return
 		}
 
 		// Do two-way copying
+		ws := newWSLimits(conf.WebSocket, a, b)
 		errc := make(chan error, 2)
-		cp := func(dst io.Writer, src io.Reader) {
-			_, err := io.Copy(dst, src)
+		cp := func(dst io.Writer, src net.Conn) {
+			_, err := io.Copy(dst, ws.reader(src))
 			errc <- err
 		}
 		go cp(a, b)
@@ -122,30 +346,426 @@ func (h *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// We return as soon as ONE direction encounter an error.
 		<-errc
 	} else {
+		// Set a deadline for the entire request, shared by all attempts.
+		if conf.Backend.RequestBudget > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), time.Duration(conf.Backend.RequestBudget))
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		// Limit the number of requests in flight to all backends.
+		if max := conf.MaxBackendRequests; max > 0 {
+			if atomic.AddInt64(&h.inflight, 1) > int64(max) {
+				atomic.AddInt64(&h.inflight, -1)
+				writeError(w, r, conf, "Too many requests.", http.StatusServiceUnavailable)
+				return
+			}
+			defer atomic.AddInt64(&h.inflight, -1)
+		}
+
+		// Send a copy to the shadow pool before the body is read.
+		// Rejected requests are not mirrored.
+		h.mirror(r, conf.Shadow)
 
-		resp, err := backend.Transport().RoundTrip(r)
+		resp, be, err := h.roundTrip(w, r, conf, backend)
+		backend = be
 		if err != nil {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			log.Printf("Error: %v", err)
-			// TODO: Add RETRY logic here!
-			fmt.Fprintf(w, "Error processing request.")
+			if err == context.DeadlineExceeded || r.Context().Err() == context.DeadlineExceeded {
+				conf.Backend.log.Warnf("Request to %s timed out", backend.Host())
+				writeError(w, r, conf, "Backend did not respond in time.", http.StatusGatewayTimeout)
+				return
+			}
+			conf.Backend.log.Warnf("Request to %s failed: %v", backend.Host(), err)
+			writeError(w, r, conf, "Error processing request.", http.StatusServiceUnavailable)
 			return
 		}
 
+		// Point redirects and cookies for the backend at the proxy.
+		if conf.RewriteLocation && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+			rewriteLocation(resp.Header, backend.Host(), r)
+		}
+		if conf.RewriteCookieDomain {
+			rewriteCookieDomain(resp.Header, backend.Host(), r.Host)
+		}
+
 		for k, v := range resp.Header {
 			for _, vv := range v {
 				w.Header().Add(k, vv)
 			}
 		}
+		if conf.CORS.Enable {
+			conf.CORS.addHeaders(w.Header(), r)
+		}
+
+		// Trailers must be announced before the header is written.
+		announced := len(resp.Trailer)
+		if announced > 0 {
+			keys := make([]string, 0, announced)
+			for k := range resp.Trailer {
+				keys = append(keys, k)
+			}
+			w.Header().Add("Trailer", strings.Join(keys, ", "))
+		}
 
 		w.WriteHeader(resp.StatusCode)
 
-		io.Copy(w, resp.Body)
+		if bodyAllowed(r.Method, resp.StatusCode) {
+			if h2 {
+				copyFlush(w, resp.Body)
+			} else {
+				io.Copy(w, resp.Body)
+			}
+		}
 		resp.Body.Close()
-		copyHeader(w.Header(), resp.Trailer)
+
+		// Trailers that were not announced can be sent using http.TrailerPrefix.
+		if len(resp.Trailer) == announced {
+			copyHeader(w.Header(), resp.Trailer)
+		} else {
+			for k, vv := range resp.Trailer {
+				k = http.TrailerPrefix + k
+				for _, v := range vv {
+					w.Header().Add(k, v)
+				}
+			}
+		}
+	}
+}
+
+// roundTrip sends the request to the backend.
+// Each attempt may take up to 'request-timeout'.
+// If an attempt fails and the request can be retried, it is sent to
+// the next backend, up to 'retry-attempts' times, until the deadline
+// of the request is exceeded. The backend that was used last is returned.
+// If an attempt timed out, context.DeadlineExceeded is returned.
+func (h *ReverseProxy) roundTrip(w http.ResponseWriter, r *http.Request, conf Config, be Backend) (*http.Response, Backend, error) {
+	for attempt := 0; ; attempt++ {
+		req, cancel := r, context.CancelFunc(nil)
+		if conf.Backend.RequestTimeout > 0 {
+			var ctx context.Context
+			ctx, cancel = context.WithTimeout(r.Context(), time.Duration(conf.Backend.RequestTimeout))
+			req = r.WithContext(ctx)
+		}
+		resp, err := be.Transport().RoundTrip(req)
+		if err == nil {
+			if cancel != nil {
+				// The timeout must cover reading the body.
+				resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			}
+			return resp, be, nil
+		}
+		if req.Context().Err() == context.DeadlineExceeded {
+			err = context.DeadlineExceeded
+		}
+		if cancel != nil {
+			cancel()
+		}
+		if attempt >= conf.Backend.RetryAttempts || !canRetry(r) || r.Context().Err() != nil {
+			return nil, be, err
+		}
+		next := h.selectOther(r, conf.LoadBalancing, false, be)
+		if next == nil {
+			return nil, be, err
+		}
+		conf.Backend.log.Debugf("Request to %s failed, retrying on %s: %v", be.Host(), next.Host(), err)
+		h.recordRetry(be, next)
+		be = next
+		useBackend(w, r, conf, be)
+	}
+}
+
+// useBackend will send the request to the backend and
+// update the headers telling the client which backend is used.
+func useBackend(w http.ResponseWriter, r *http.Request, conf Config, be Backend) {
+	r.URL.Host = be.Host()
+	r.URL.Scheme = backendScheme(be)
+	setStickyCookie(w, r, conf.LoadBalancing, be)
+	if conf.AddServedBy {
+		w.Header().Set("X-Served-By", be.ID())
+	}
+	if conf.AddServedByHost {
+		w.Header().Set("X-Served-By-Host", be.Host())
+	}
+}
+
+// canRetry returns true if the request can be sent again.
+// Only requests without a body and side effects are retried.
+func canRetry(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return r.Body == nil || r.Body == http.NoBody
+	}
+	return false
+}
+
+// cancelBody cancels the context of a request when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// rewriteLocation will replace the backend host in the
+// 'Location' header with the host the client requested.
+// Relative locations and locations on other hosts are not changed.
+func rewriteLocation(h http.Header, backendHost string, r *http.Request) {
+	loc := h.Get("Location")
+	if loc == "" || r.Host == "" {
+		return
+	}
+	u, err := url.Parse(loc)
+	if err != nil || !sameHost(u.Host, backendHost) {
+		return
+	}
+	u.Host = r.Host
+	if r.TLS != nil {
+		u.Scheme = "https"
+	} else {
+		u.Scheme = "http"
+	}
+	h.Set("Location", u.String())
+}
+
+// rewriteCookieDomain will replace a 'Domain' attribute matching the
+// backend host in 'Set-Cookie' headers with the host the client requested.
+func rewriteCookieDomain(h http.Header, backendHost, host string) {
+	cookies := h["Set-Cookie"]
+	if len(cookies) == 0 || host == "" {
+		return
+	}
+	if hn, _, err := net.SplitHostPort(host); err == nil {
+		host = hn
+	}
+	for i, c := range cookies {
+		parts := strings.Split(c, ";")
+		for j, p := range parts {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) != 2 || !strings.EqualFold(kv[0], "domain") {
+				continue
+			}
+			if sameHost(strings.TrimPrefix(kv[1], "."), backendHost) {
+				parts[j] = " Domain=" + host
+			}
+		}
+		cookies[i] = strings.Join(parts, ";")
 	}
 }
 
+// sameHost returns whether host refers to the backend host.
+// If host has no port, only the host names are compared.
+func sameHost(host, backendHost string) bool {
+	if host == "" {
+		return false
+	}
+	if strings.EqualFold(host, backendHost) {
+		return true
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return false
+	}
+	bh, _, err := net.SplitHostPort(backendHost)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(host, bh)
+}
+
+// writeError will write an error response to the client.
+// If 'json-errors' is enabled and the client prefers JSON,
+// the error is written as a JSON object.
+func writeError(w http.ResponseWriter, r *http.Request, conf Config, msg string, code int) {
+	if !conf.JSONErrors || !prefersJSON(r.Header.Get("Accept")) {
+		w.WriteHeader(code)
+		fmt.Fprint(w, msg)
+		return
+	}
+	b, err := json.Marshal(struct {
+		Error string `json:"error"`
+		Code  int    `json:"code"`
+	}{Error: msg, Code: code})
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// prefersJSON returns true if the Accept header value
+// prefers JSON at least as much as any other type.
+func prefersJSON(accept string) bool {
+	jsonQ, otherQ := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mt := strings.ToLower(strings.TrimSpace(params[0]))
+		if mt == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if mt == "application/json" || strings.HasSuffix(mt, "+json") {
+			jsonQ = math.Max(jsonQ, q)
+		} else {
+			otherQ = math.Max(otherQ, q)
+		}
+	}
+	return jsonQ > 0 && jsonQ >= otherQ
+}
+
+// noBackendRetry is how long clients are asked to wait
+// for a backend to become healthy if provisioning is disabled.
+const noBackendRetry = 5 * time.Second
+
+// defaultBootTime is the expected time for a new backend
+// to become available if 'boot-time' isn't set.
+const defaultBootTime = 60 * time.Second
+
+// retryAfter returns the number of seconds clients should
+// wait before retrying, when no backend is available.
+// If provisioning is enabled, this is the time it takes to
+// boot a new backend.
+func retryAfter(conf Config) int {
+	d := noBackendRetry
+	if conf.Provision.Enable {
+		d = time.Duration(conf.Provision.BootTime)
+		if d <= 0 {
+			d = defaultBootTime
+		}
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// standardMethods are listed in the 'Allow' header
+// when only 'deny-methods' is set.
+var standardMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "TRACE", "CONNECT"}
+
+// methodAllowed returns true if requests with the method
+// are allowed by 'allow-methods' and 'deny-methods'.
+func methodAllowed(conf Config, method string) bool {
+	if len(conf.AllowMethods) > 0 && !hasMethod(conf.AllowMethods, method) {
+		return false
+	}
+	return !hasMethod(conf.DenyMethods, method)
+}
+
+// allowedMethods returns the methods that are allowed,
+// to be sent to the client in the 'Allow' header.
+func allowedMethods(conf Config) []string {
+	list := conf.AllowMethods
+	if len(list) == 0 {
+		list = standardMethods
+	}
+	var allowed []string
+	for _, m := range list {
+		if methodAllowed(conf, m) {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed
+}
+
+// hasMethod returns true if the method is in the list.
+func hasMethod(list []string, method string) bool {
+	for _, m := range list {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyAllowed returns true if a response to a request
+// with the method and status code may contain a body.
+// See RFC 7230, section 3.3.
+func bodyAllowed(method string, status int) bool {
+	switch {
+	case method == "HEAD":
+		return false
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// backendScheme returns the URL scheme of requests to the backend.
+// Backends that don't report one use "http".
+func backendScheme(be Backend) string {
+	if s, ok := be.(interface {
+		scheme() string
+	}); ok {
+		return s.scheme()
+	}
+	return "http"
+}
+
+// usesHTTP2 returns whether requests to the backend use HTTP/2.
+func usesHTTP2(be Backend) bool {
+	h, ok := be.(interface {
+		usesHTTP2() bool
+	})
+	return ok && h.usesHTTP2()
+}
+
+// copyFlush copies the response body to the client and flushes
+// after every read, so streamed messages are sent at once.
+func copyFlush(w http.ResponseWriter, body io.Reader) error {
+	f, _ := w.(http.Flusher)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if f != nil {
+				f.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isChunked returns true if chunked is the final transfer encoding.
+func isChunked(te []string) bool {
+	return len(te) > 0 && strings.EqualFold(te[len(te)-1], "chunked")
+}
+
+// frontendPort returns the port the client connected to.
+func frontendPort(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		return port
+	}
+	if r.TLS != nil {
+		return "443"
+	}
+	return "80"
+}
+
 // Copied from
 // https://github.com/golang/go/blob/release-branch.go1.5/src/net/http/httputil/reverseproxy.go#L82
 func copyHeader(dst, src http.Header) {
@@ -167,15 +787,91 @@ func (h *ReverseProxy) SetConfig(conf Config) {
 // with the new ones. Requests currently being served will
 // still go to the old backends, but new ones will go to
 // a new one.
+// Backends that are unchanged are kept, so their
+// statistics and health history carry over.
 func (h *ReverseProxy) SetBackends(balancer LoadBalancer) {
 	h.mu.Lock()
 	if h.balancer != nil {
+		if n := reuseBackends(h.balancer, balancer); n > 0 {
+			h.conf.Backend.log.Debugf("Kept %d unchanged backend(s)", n)
+		}
+		removed := removedBackends(h.balancer.Backends(), balancer.Backends())
+		for _, be := range removed {
+			if d, ok := be.(interface {
+				setDraining(bool)
+			}); ok {
+				d.setDraining(true)
+			}
+		}
+		h.draining = append(h.draining, removed...)
 		h.balancer.Close()
 	}
 	h.balancer = balancer
+	h.wsBalancer = nil
 	h.mu.Unlock()
 }
 
+// inventoried is implemented by load balancers
+// that can return their inventory.
+type inventoried interface {
+	inventory() *Inventory
+}
+
+// balancerLog returns the log of the backends of the load balancer.
+// If it has no inventory, nil is returned, which logs to the standard logger.
+func balancerLog(lb LoadBalancer) *serverLog {
+	if i, ok := lb.(inventoried); ok {
+		return i.inventory().bec.log
+	}
+	return nil
+}
+
+// reuseBackends will move unchanged backends from
+// the old to the new load balancer inventory.
+// The number of backends moved is returned.
+func reuseBackends(old, new LoadBalancer) int {
+	o, ok := old.(inventoried)
+	if !ok {
+		return 0
+	}
+	n, ok := new.(inventoried)
+	if !ok {
+		return 0
+	}
+	return n.inventory().Reuse(o.inventory())
+}
+
+// removedBackends returns the backends in old with connections,
+// that have no backend with the same ID in new.
+func removedBackends(old, new []Backend) []Backend {
+	ids := make(map[string]struct{}, len(new))
+	for _, be := range new {
+		ids[be.ID()] = struct{}{}
+	}
+	var removed []Backend
+	for _, be := range old {
+		if _, ok := ids[be.ID()]; !ok && be.Connections() > 0 {
+			removed = append(removed, be)
+		}
+	}
+	return removed
+}
+
+// drainingBackends returns removed backends that still have connections.
+// Backends without connections are forgotten.
+func (h *ReverseProxy) drainingBackends() []Backend {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	active := h.draining[:0]
+	for _, be := range h.draining {
+		if be.Connections() > 0 {
+			active = append(active, be)
+		}
+	}
+	h.draining = active
+	return append([]Backend(nil), active...)
+}
+
 // GetConfig will return a copy of the latest configuration.
 func (h *ReverseProxy) GetConfig() Config {
 	h.mu.RLock()
@@ -183,6 +879,96 @@ func (h *ReverseProxy) GetConfig() Config {
 	return h.conf
 }
 
+// selectBackend will return a backend for the request.
+// If label routing is configured and the request has the
+// route header, a backend with a matching label is preferred.
+// Requests matching a route use the backends of the route.
+// Other websocket upgrades use the 'websocket-type' balancer, if set.
+func (h *ReverseProxy) selectBackend(r *http.Request, lbc LBConfig, webSock bool) Backend {
+	return h.selectOther(r, lbc, webSock, nil)
+}
+
+// selectOther is selectBackend for retries, where a backend
+// other than the failed one is preferred. If no other backend
+// is healthy, the failed backend may be returned.
+func (h *ReverseProxy) selectOther(r *http.Request, lbc LBConfig, webSock bool, failed Backend) Backend {
+	h.mu.RLock()
+	if rb := h.routeBalancer(r.URL.Path, r.Method); rb != nil {
+		defer h.mu.RUnlock()
+		return pickBackend(r, lbc, rb, failed)
+	}
+	h.mu.RUnlock()
+
+	if webSock && lbc.WebSocketType != "" && lbc.WebSocketType != lbc.Type {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return pickBackend(r, lbc, h.websocketBalancer(lbc), failed)
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return pickBackend(r, lbc, h.balancer, failed)
+}
+
+// pickBackend will return a backend from the load balancer.
+// If the request has a sticky cookie and the backend in it is
+// healthy, that backend is used.
+// If label routing is configured and the request has the
+// route header, a backend with a matching label is preferred.
+// If failed is set, other backends are preferred.
+func pickBackend(r *http.Request, lbc LBConfig, lb LoadBalancer, failed Backend) Backend {
+	other := func(match func(Backend) bool) func(Backend) bool {
+		if failed == nil {
+			return match
+		}
+		return func(be Backend) bool {
+			return be != failed && matches(match, be)
+		}
+	}
+	if lbc.StickyCookie != "" {
+		if c, err := r.Cookie(lbc.StickyCookie); err == nil && c.Value != "" {
+			if be := tryBackend(lb, other(IDMatch(c.Value))); be != nil {
+				return be
+			}
+		}
+	}
+	if lbc.RouteHeader != "" {
+		if v := r.Header.Get(lbc.RouteHeader); v != "" {
+			if be := tryBackend(lb, other(LabelMatch(lbc.RouteLabel, v))); be != nil {
+				return be
+			}
+		}
+	}
+	if failed != nil {
+		if be := tryBackend(lb, other(nil)); be != nil {
+			return be
+		}
+	}
+	return lb.Backend()
+}
+
+// websocketBalancer returns a load balancer of the 'websocket-type'
+// sharing the inventory of the current load balancer.
+// If it cannot be created, the current load balancer is returned.
+// h.mu must be held for writing.
+func (h *ReverseProxy) websocketBalancer(lbc LBConfig) LoadBalancer {
+	if h.wsBalancer != nil && h.wsType == lbc.WebSocketType {
+		return h.wsBalancer
+	}
+	inv, ok := h.balancer.(inventoried)
+	if !ok {
+		return h.balancer
+	}
+	wsc := lbc
+	wsc.Type = lbc.WebSocketType
+	lb, err := NewLoadBalancer(wsc, inv.inventory())
+	if err != nil {
+		h.conf.Backend.log.Errorf("Creating websocket load balancer: %v", err)
+		return h.balancer
+	}
+	h.wsBalancer, h.wsType = lb, lbc.WebSocketType
+	return lb
+}
+
 // GetBackend will return a backend from
 // the current load balancer.
 func (h *ReverseProxy) GetBackend() Backend {
@@ -190,3 +976,48 @@ func (h *ReverseProxy) GetBackend() Backend {
 	defer h.mu.RUnlock()
 	return h.balancer.Backend()
 }
+
+// setStickyCookie will send the sticky cookie to the client,
+// if it doesn't already point to the backend.
+func setStickyCookie(w http.ResponseWriter, r *http.Request, lbc LBConfig, be Backend) {
+	if lbc.StickyCookie == "" {
+		return
+	}
+	// Replace the cookie set for a backend that failed.
+	removeSetCookie(w.Header(), lbc.StickyCookie)
+	if c, err := r.Cookie(lbc.StickyCookie); err == nil && c.Value == be.ID() {
+		return
+	}
+	c := &http.Cookie{
+		Name:     lbc.StickyCookie,
+		Value:    be.ID(),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	}
+	if lbc.StickyTTL > 0 {
+		c.MaxAge = int(time.Duration(lbc.StickyTTL) / time.Second)
+	}
+	http.SetCookie(w, c)
+}
+
+// removeSetCookie removes the cookie with the name from the
+// 'Set-Cookie' headers of the response.
+func removeSetCookie(h http.Header, name string) {
+	var kept []string
+	for _, c := range h["Set-Cookie"] {
+		if !strings.HasPrefix(c, name+"=") {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == 0 {
+		h.Del("Set-Cookie")
+		return
+	}
+	h["Set-Cookie"] = kept
+}
+
+// validCookieName returns true if name can be used as a cookie name.
+func validCookieName(name string) bool {
+	return (&http.Cookie{Name: name}).String() != ""
+}
@@ -2,14 +2,22 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/klauspost/doproxy/server/httpmock"
 )
@@ -143,6 +151,45 @@ func TestProxyAddForward(t *testing.T) {
 	}
 }
 
+// Test that X-Real-IP is set to the client IP.
+func TestProxyAddRealIP(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	var realIP = make(chan string, 1)
+	responder := func(req *http.Request) (*http.Response, error) {
+		realIP <- req.Header.Get("X-Real-IP")
+		return httpmock.MockResponse(req)
+	}
+	httpmock.RegisterResponder("GET", responder)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := *defaultConfig
+	conf.AddRealIP = true
+	proxy := NewReverseProxyConfig(conf, lb)
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A value sent by the client must be replaced.
+	req.Header.Set("X-Real-IP", "10.0.0.1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatal("Unexpected status code", res.StatusCode)
+	}
+	if got := <-realIP; got != "127.0.0.1" {
+		t.Fatalf("expected X-Real-IP %q, got %q", "127.0.0.1", got)
+	}
+}
+
 // Test that Status code is returned.
 func TestProxyStatusCode(t *testing.T) {
 	inv := newMockInventory(t, 3)
@@ -241,4 +288,1630 @@ func TestProxyMethods(t *testing.T) {
 	}
 }
 
+// Test that a body sent by a backend in a response to HEAD
+// is not sent to the client, but Content-Length is kept.
+func TestProxyHeadBody(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	var closed = make(chan bool, 2)
+	responder := func(req *http.Request) (*http.Response, error) {
+		const body = "not allowed"
+		resp, err := httpmock.MockResponse(req)
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		resp.ContentLength = int64(len(body))
+		resp.Body = &closeNotifier{Reader: strings.NewReader(body), closed: closed}
+		return resp, err
+	}
+	httpmock.RegisterResponder("HEAD", responder)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxyConfig(*defaultConfig, lb)
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, mustRequest(t, "HEAD", "http://example.com/"))
+	if rec.Body.Len() != 0 {
+		t.Fatalf("expected no body, got %q", rec.Body.String())
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != "11" {
+		t.Fatalf("expected Content-Length 11, got %q", cl)
+	}
+	if !<-closed {
+		t.Fatal("backend response body was not closed")
+	}
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	res, err := http.DefaultClient.Do(mustRequest(t, "HEAD", ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.ContentLength != 11 {
+		t.Fatalf("expected status 200 with length 11, got %d with length %d", res.StatusCode, res.ContentLength)
+	}
+}
+
+// closeNotifier sends true on closed when it is closed.
+type closeNotifier struct {
+	io.Reader
+	closed chan bool
+}
+
+func (c *closeNotifier) Close() error {
+	c.closed <- true
+	return nil
+}
+
 //TODO: Add Websocket tests.
+
+// Test that CORS preflight requests are answered by the proxy.
+func TestProxyCORS(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	var reached = make(chan string, 2)
+	responder := func(req *http.Request) (*http.Response, error) {
+		reached <- req.Method
+		return httpmock.MockResponse(req)
+	}
+	httpmock.RegisterResponder("OPTIONS", responder)
+	httpmock.RegisterResponder("GET", responder)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := *defaultConfig
+	conf.CORS = CORSConfig{
+		Enable:         true,
+		AllowedOrigins: []string{"http://example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"X-Custom"},
+		MaxAge:         Duration(10 * time.Minute),
+	}
+	proxy := NewReverseProxyConfig(conf, lb)
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	req, err := http.NewRequest("OPTIONS", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatal("Unexpected status code", res.StatusCode)
+	}
+	expect := map[string]string{
+		"Access-Control-Allow-Origin":  "http://example.com",
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "X-Custom",
+		"Access-Control-Max-Age":       "600",
+	}
+	for k, v := range expect {
+		if got := res.Header.Get(k); got != v {
+			t.Fatalf("header %s: expected %q, got %q", k, v, got)
+		}
+	}
+	select {
+	case m := <-reached:
+		t.Fatal("preflight request was forwarded to backend:", m)
+	default:
+	}
+
+	// Actual requests are forwarded with CORS headers added.
+	req, err = http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "http://example.com")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected status code", res.StatusCode)
+	}
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "http://example.com" {
+		t.Fatalf("expected allowed origin on response, got %q", got)
+	}
+	if m := <-reached; m != "GET" {
+		t.Fatal("unexpected method reached backend:", m)
+	}
+
+	// Disallowed origins are forwarded untouched.
+	req, err = http.NewRequest("OPTIONS", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "http://evil.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("disallowed origin was allowed")
+	}
+	if m := <-reached; m != "OPTIONS" {
+		t.Fatal("unexpected method reached backend:", m)
+	}
+}
+
+// Test that the stats endpoint reports backend selections.
+func TestProxyStats(t *testing.T) {
+	inv := newMockInventory(t, 2)
+	httpmock.RegisterResponder("GET", httpmock.MockResponse)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxyConfig(*defaultConfig, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	for i := 0; i < 4; i++ {
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	stats := httptest.NewServer(http.HandlerFunc(proxy.ServeStats))
+	defer stats.Close()
+	res, err := http.Get(stats.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var st Status
+	err = json.NewDecoder(res.Body).Decode(&st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Backends) != 2 {
+		t.Fatal("expected 2 backends, got", len(st.Backends))
+	}
+	for _, be := range st.Backends {
+		if be.Selected != 2 {
+			t.Fatalf("backend %s: expected 2 selections, got %d", be.ID, be.Selected)
+		}
+	}
+}
+
+// Test that trailers from the backend are sent to the client.
+func TestProxyTrailers(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	responder := func(req *http.Request) (*http.Response, error) {
+		res, err := httpmock.MockResponse(req)
+		res.Trailer = http.Header{"Grpc-Status": []string{"0"}, "Grpc-Message": []string{"fine"}}
+		return res, err
+	}
+	httpmock.RegisterResponder("GET", responder)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxyConfig(*defaultConfig, lb)
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "ok" {
+		t.Fatalf("expected response %q got %q", "ok", response)
+	}
+	if got := res.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Fatalf("expected trailer Grpc-Status %q, got %q", "0", got)
+	}
+	if got := res.Trailer.Get("Grpc-Message"); got != "fine" {
+		t.Fatalf("expected trailer Grpc-Message %q, got %q", "fine", got)
+	}
+}
+
+// Test that requests exceeding the request timeout return 504.
+func TestProxyRequestTimeout(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	responder := func(req *http.Request) (*http.Response, error) {
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(5 * time.Second):
+			return httpmock.MockResponse(req)
+		}
+	}
+	httpmock.RegisterResponder("GET", responder)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := *defaultConfig
+	conf.Backend.RequestTimeout = Duration(100 * time.Millisecond)
+	proxy := NewReverseProxyConfig(conf, lb)
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	start := time.Now()
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Fatal("Unexpected status code", res.StatusCode)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("request was not cancelled at deadline")
+	}
+}
+
+// refusingRT is a RoundTripper where all connections are refused.
+type refusingRT struct{}
+
+func (refusingRT) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("connection refused")
+}
+
+// Test that failed requests are not retried on the backend that failed,
+// even if it is selected by the sticky cookie.
+func TestProxyRetryOtherBackend(t *testing.T) {
+	inv := newMockInventory(t, 2)
+	failed := inv.backends[0].(*mockBackend)
+	failed.rt.mu.Lock()
+	failed.rt.rt = refusingRT{}
+	failed.rt.mu.Unlock()
+	httpmock.RegisterResponder("GET", httpmock.MockResponse)
+
+	conf := *defaultConfig
+	conf.LoadBalancing.StickyCookie = "DOPROXY_BE"
+	conf.Backend.RetryAttempts = 1
+	conf.AddServedBy = true
+	lb, err := NewLoadBalancer(conf.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxyConfig(conf, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	for i := 0; i < 4; i++ {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(&http.Cookie{Name: "DOPROXY_BE", Value: failed.ID()})
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal("expected retry to succeed, got", res.Status)
+		}
+		if id := res.Header.Get("X-Served-By"); id != inv.backends[1].ID() {
+			t.Fatal("expected request to be served by", inv.backends[1].ID(), "got", id)
+		}
+		// The sticky cookie names the backend that served the request.
+		cookies := res.Cookies()
+		if len(cookies) != 1 || cookies[0].Value != inv.backends[1].ID() {
+			t.Fatal("expected one sticky cookie for", inv.backends[1].ID(), "got", cookies)
+		}
+	}
+	if st := proxy.Status(); st.Failovers != 4 {
+		t.Fatal("expected 4 failovers, got", st.Failovers)
+	}
+}
+
+// Test that failed requests are retried on other backends,
+// and that all attempts share the request budget.
+func TestProxyRetryBudget(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	var attempts int32
+	var hang int32
+	responder := func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 && atomic.LoadInt32(&hang) == 0 {
+			return nil, fmt.Errorf("connection refused")
+		}
+		if atomic.LoadInt32(&hang) == 0 {
+			return httpmock.MockResponse(req)
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(5 * time.Second):
+			return httpmock.MockResponse(req)
+		}
+	}
+	httpmock.RegisterResponder("GET", responder)
+	httpmock.RegisterResponder("POST", responder)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := *defaultConfig
+	conf.Backend.RetryAttempts = 5
+	conf.Backend.RequestTimeout = Duration(200 * time.Millisecond)
+	conf.Backend.RequestBudget = Duration(500 * time.Millisecond)
+	proxy := NewReverseProxyConfig(conf, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	// The first attempt fails and the retry succeeds.
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || atomic.LoadInt32(&attempts) != 2 {
+		t.Fatalf("expected status 200 after 2 attempts, got %d after %d", res.StatusCode, attempts)
+	}
+	if n := atomic.LoadInt64(&proxy.retries); n != 1 {
+		t.Fatal("expected 1 retry, got", n)
+	}
+
+	// Requests with a body are not retried.
+	atomic.StoreInt32(&attempts, 0)
+	res, err = http.Post(ts.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || atomic.LoadInt32(&attempts) != 1 {
+		t.Fatalf("expected status 503 after 1 attempt, got %d after %d", res.StatusCode, attempts)
+	}
+
+	// All backends hang. Without a budget, 6 attempts would take 1.2 seconds.
+	atomic.StoreInt32(&hang, 1)
+	atomic.StoreInt32(&attempts, 0)
+	start := time.Now()
+	res, err = http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	elapsed := time.Since(start)
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Fatal("expected status 504, got", res.StatusCode)
+	}
+	if elapsed > 900*time.Millisecond {
+		t.Fatal("request took longer than the budget:", elapsed)
+	}
+	if n := atomic.LoadInt32(&attempts); n < 2 || n > 3 {
+		t.Fatal("expected 2 or 3 attempts within the budget, got", n)
+	}
+}
+
+// Test that requests with a URL above 'max-url-length' are rejected
+// without reaching a backend.
+func TestProxyMaxURLLength(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	var reached = make(chan string, 2)
+	responder := func(req *http.Request) (*http.Response, error) {
+		reached <- req.URL.RequestURI()
+		return httpmock.MockResponse(req)
+	}
+	httpmock.RegisterResponder("GET", responder)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := *defaultConfig
+	conf.MaxURLLength = 64
+	ts := httptest.NewServer(NewReverseProxyConfig(conf, lb))
+	defer ts.Close()
+
+	long := "/" + strings.Repeat("a", 50) + "?q=" + strings.Repeat("b", 20)
+	for _, test := range []struct {
+		uri    string
+		status int
+	}{
+		{"/" + strings.Repeat("a", 63), http.StatusOK},
+		{long, http.StatusRequestURITooLong},
+	} {
+		res, err := http.Get(ts.URL + test.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Fatalf("%d bytes: expected status %d, got %d", len(test.uri), test.status, res.StatusCode)
+		}
+		if test.status == http.StatusOK {
+			if got := <-reached; got != test.uri {
+				t.Fatalf("expected %q to reach the backend, got %q", test.uri, got)
+			}
+		}
+	}
+	select {
+	case uri := <-reached:
+		t.Fatal("long URL reached the backend:", uri)
+	default:
+	}
+}
+
+// Test that requests with methods that aren't allowed get 405.
+func TestProxyDisallowedMethods(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	var reached = make(chan string, 2)
+	responder := func(req *http.Request) (*http.Response, error) {
+		reached <- req.Method
+		return httpmock.MockResponse(req)
+	}
+	httpmock.RegisterResponder("GET", responder)
+	httpmock.RegisterResponder("TRACE", responder)
+	httpmock.RegisterResponder("POST", responder)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny := *defaultConfig
+	deny.DenyMethods = []string{"TRACE", "CONNECT"}
+	allow := *defaultConfig
+	allow.AllowMethods = []string{"GET", "HEAD"}
+	for _, test := range []struct {
+		conf   Config
+		method string
+		status int
+		allow  string
+	}{
+		{*defaultConfig, "TRACE", http.StatusOK, ""},
+		{deny, "GET", http.StatusOK, ""},
+		{deny, "TRACE", http.StatusMethodNotAllowed, "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"},
+		{allow, "GET", http.StatusOK, ""},
+		{allow, "POST", http.StatusMethodNotAllowed, "GET, HEAD"},
+	} {
+		ts := httptest.NewServer(NewReverseProxyConfig(test.conf, lb))
+		req := mustRequest(t, test.method, ts.URL+"/path")
+		res, err := http.DefaultClient.Do(req)
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Fatalf("%s: expected status %d, got %d", test.method, test.status, res.StatusCode)
+		}
+		if got := res.Header.Get("Allow"); got != test.allow {
+			t.Fatalf("%s: expected Allow %q, got %q", test.method, test.allow, got)
+		}
+		if test.status == http.StatusOK {
+			if got := <-reached; got != test.method {
+				t.Fatalf("expected %s to reach the backend, got %s", test.method, got)
+			}
+		}
+	}
+	select {
+	case m := <-reached:
+		t.Fatal("denied method reached the backend:", m)
+	default:
+	}
+}
+
+// Test that X-Forwarded-Proto and X-Forwarded-Port reflect the frontend.
+func TestProxyForwardedProto(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	var got = make(chan [2]string, 1)
+	responder := func(req *http.Request) (*http.Response, error) {
+		got <- [2]string{req.Header.Get("X-Forwarded-Proto"), req.Header.Get("X-Forwarded-Port")}
+		return httpmock.MockResponse(req)
+	}
+	httpmock.RegisterResponder("GET", responder)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := *defaultConfig
+	conf.AddProto = true
+	conf.AddPort = true
+	proxy := NewReverseProxyConfig(conf, lb)
+
+	for _, useTLS := range []bool{false, true} {
+		ts := httptest.NewUnstartedServer(proxy)
+		proto := "http"
+		if useTLS {
+			ts.StartTLS()
+			proto = "https"
+		} else {
+			ts.Start()
+		}
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Client supplied values must be replaced.
+		req.Header.Set("X-Forwarded-Proto", "gopher")
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		h := <-got
+		if h[0] != proto {
+			t.Fatalf("expected X-Forwarded-Proto %q, got %q", proto, h[0])
+		}
+		if h[1] != u.Port() {
+			t.Fatalf("expected X-Forwarded-Port %q, got %q", u.Port(), h[1])
+		}
+		ts.Close()
+	}
+}
+
+// Test that X-Forwarded-Host carries the host requested by the client
+// and X-Forwarded-Port the port of the listener.
+func TestProxyForwardedHost(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	var got = make(chan [3]string, 1)
+	responder := func(req *http.Request) (*http.Response, error) {
+		got <- [3]string{req.Host, req.Header.Get("X-Forwarded-Host"), req.Header.Get("X-Forwarded-Port")}
+		return httpmock.MockResponse(req)
+	}
+	httpmock.RegisterResponder("GET", responder)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := *defaultConfig
+	conf.AddHost = true
+	conf.AddPort = true
+	ts := httptest.NewServer(NewReverseProxyConfig(conf, lb))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := mustRequest(t, "GET", ts.URL)
+	req.Host = "example.com:8443"
+	// Client supplied values must be replaced.
+	req.Header.Set("X-Forwarded-Host", "gopher.example.com")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	h := <-got
+	if h[0] != "example.com:8443" {
+		t.Fatalf("expected Host to be preserved, got %q", h[0])
+	}
+	if h[1] != "example.com:8443" {
+		t.Fatalf("expected X-Forwarded-Host %q, got %q", "example.com:8443", h[1])
+	}
+	if h[2] != u.Port() {
+		t.Fatalf("expected X-Forwarded-Port %q, got %q", u.Port(), h[2])
+	}
+}
+
+// Test that responses tell which backend served them, only if enabled.
+func TestProxyServedBy(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	for i, be := range inv.backends {
+		be.(*mockBackend).ServerHost = fmt.Sprintf("10.0.0.%d:8080", i)
+	}
+	var got = make(chan string, 1)
+	responder := func(req *http.Request) (*http.Response, error) {
+		got <- req.URL.Host
+		return httpmock.MockResponse(req)
+	}
+	httpmock.RegisterResponder("GET", responder)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, enable := range []bool{false, true} {
+		conf := *defaultConfig
+		conf.AddServedBy = enable
+		conf.AddServedByHost = enable
+		proxy := NewReverseProxyConfig(conf, lb)
+		for i := 0; i < 3; i++ {
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, mustRequest(t, "GET", "http://example.com/"))
+			host := <-got
+			id, servedHost := rec.Header().Get("X-Served-By"), rec.Header().Get("X-Served-By-Host")
+			if !enable {
+				if id != "" || servedHost != "" {
+					t.Fatalf("expected no backend headers, got %q and %q", id, servedHost)
+				}
+				continue
+			}
+			be, ok := inv.BackendID(id)
+			if !ok {
+				t.Fatalf("X-Served-By %q is not a backend ID", id)
+			}
+			if be.Host() != host || servedHost != host {
+				t.Fatalf("request was sent to %q, but X-Served-By-Host is %q", host, servedHost)
+			}
+		}
+	}
+}
+
+// Test that requests with a route header only hit backends with a matching label.
+func TestProxyLabelRouting(t *testing.T) {
+	inv := newMockInventory(t, 4)
+	for _, n := range []int{1, 3} {
+		inv.backends[n].(*mockBackend).labels = map[string]string{"group": "eu"}
+	}
+	inv.backends[0].(*mockBackend).labels = map[string]string{"group": "us"}
+	httpmock.RegisterResponder("GET", httpmock.MockResponse)
+
+	conf := *defaultConfig
+	conf.LoadBalancing.RouteHeader = "X-Backend-Group"
+	conf.LoadBalancing.RouteLabel = "group"
+	lb, err := NewLoadBalancer(conf.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxyConfig(conf, lb)
+
+	get := func(group string) *mockBackend {
+		req, err := http.NewRequest("GET", "http://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group != "" {
+			req.Header.Set("X-Backend-Group", group)
+		}
+		be := proxy.selectBackend(req, conf.LoadBalancing, false)
+		if be == nil {
+			t.Fatal("no backend selected")
+		}
+		return be.(*mockBackend)
+	}
+	for i := 0; i < 20; i++ {
+		be := get("eu")
+		if be.n != 1 && be.n != 3 {
+			t.Fatal("eu request was sent to backend", be.n)
+		}
+	}
+	// Unknown groups use all backends.
+	seen := make(map[int]bool)
+	for i := 0; i < 8; i++ {
+		seen[get("asia").n] = true
+	}
+	if len(seen) != 4 {
+		t.Fatal("expected fallback to all backends, got", seen)
+	}
+	if n := lb.Stats().NoHealthy; n != 0 {
+		t.Fatal("fallback was counted as no healthy backend", n, "times")
+	}
+
+	// Full request through the proxy.
+	before := proxy.Status().Backends[0].Selected
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Backend-Group", "us")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if proxy.Status().Backends[0].Selected != before+1 {
+		t.Fatal("expected us request to be sent to backend 0")
+	}
+}
+
+// Test that the sticky cookie sends clients back to the same backend,
+// and that another backend is used if it becomes unhealthy.
+func TestProxySticky(t *testing.T) {
+	inv := newMockInventory(t, 4)
+	httpmock.RegisterResponder("GET", httpmock.MockResponse)
+
+	conf := *defaultConfig
+	conf.LoadBalancing.Type = "roundrobin"
+	conf.LoadBalancing.StickyCookie = "DOPROXY_BE"
+	conf.LoadBalancing.StickyTTL = Duration(time.Hour)
+	lb, err := NewLoadBalancer(conf.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxyConfig(conf, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	// get returns the sticky cookie set by the response, if any.
+	get := func(cookie string) *http.Cookie {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "DOPROXY_BE", Value: cookie})
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		for _, c := range res.Cookies() {
+			if c.Name == "DOPROXY_BE" {
+				return c
+			}
+		}
+		return nil
+	}
+
+	c := get("")
+	if c == nil {
+		t.Fatal("no sticky cookie was set")
+	}
+	if c.MaxAge != 3600 || !c.HttpOnly {
+		t.Fatalf("unexpected cookie %v", c)
+	}
+	id := c.Value
+	var stuck *mockBackend
+	for _, be := range inv.backends {
+		if be.ID() == id {
+			stuck = be.(*mockBackend)
+		}
+	}
+	if stuck == nil {
+		t.Fatalf("cookie %q does not match a backend", id)
+	}
+	selected := func() int64 {
+		stuck.Stats.mu.RLock()
+		defer stuck.Stats.mu.RUnlock()
+		return stuck.Stats.Selected
+	}
+	before := selected()
+	for i := 0; i < 8; i++ {
+		if c := get(id); c != nil {
+			t.Fatal("cookie was set again:", c)
+		}
+	}
+	if selected() != before+8 {
+		t.Fatalf("expected 8 requests to %s, got %d", id, selected()-before)
+	}
+
+	// Unknown backends are replaced.
+	c = get("unknown")
+	if c == nil || c.Value == "unknown" {
+		t.Fatal("expected new cookie for unknown backend, got", c)
+	}
+	if n := lb.Stats().NoHealthy; n != 0 {
+		t.Fatal("unknown backend was counted as no healthy backend", n, "times")
+	}
+
+	// Unhealthy backends are replaced.
+	stuck.backend.Close() // Close the monitor, so it doesn't interfere.
+	stuck.Stats.mu.Lock()
+	stuck.setHealthy(false)
+	stuck.Stats.mu.Unlock()
+	c = get(id)
+	if c == nil || c.Value == id {
+		t.Fatal("expected new cookie for unhealthy backend, got", c)
+	}
+	before = selected()
+	get(id)
+	if selected() != before {
+		t.Fatal("request was sent to unhealthy backend")
+	}
+}
+
+// Test that a panic while serving a request returns 500,
+// and that the proxy keeps serving requests.
+func TestProxyPanic(t *testing.T) {
+	inv := newMockInventory(t, 1)
+	httpmock.RegisterResponder("GET", httpmock.MockResponse)
+	httpmock.RegisterResponder("PATCH", func(req *http.Request) (*http.Response, error) {
+		panic("backend transport failed")
+	})
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(NewReverseProxyConfig(*defaultConfig, lb))
+	defer ts.Close()
+
+	req, err := http.NewRequest("PATCH", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatal("expected 500 after panic, got", res.StatusCode)
+	}
+
+	res, err = http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("expected 200 after panic, got", res.StatusCode)
+	}
+}
+
+// Test that 304 Not Modified responses are forwarded without a body.
+func TestProxyNotModified(t *testing.T) {
+	inv := newMockInventory(t, 3)
+	var conditional = make(chan bool, 1)
+	responder := func(req *http.Request) (*http.Response, error) {
+		conditional <- req.Header.Get("If-None-Match") == `"abc"` && req.Header.Get("If-Modified-Since") == "Wed, 21 Oct 2015 07:28:00 GMT"
+		res, err := httpmock.MockResponse(req)
+		res.StatusCode = http.StatusNotModified
+		res.Header.Del("Content-Type")
+		res.Header.Set("ETag", `"abc"`)
+		res.Header.Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+		res.Header.Set("Cache-Control", "max-age=60")
+		return res, err
+	}
+	httpmock.RegisterResponder("GET", responder)
+
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxyConfig(*defaultConfig, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", `"abc"`)
+	req.Header.Set("If-Modified-Since", "Wed, 21 Oct 2015 07:28:00 GMT")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !<-conditional {
+		t.Fatal("conditional headers were not forwarded to backend")
+	}
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatal("Unexpected status code", res.StatusCode)
+	}
+	if len(body) != 0 {
+		t.Fatalf("expected no body, got %q", body)
+	}
+	expect := map[string]string{
+		"ETag":          `"abc"`,
+		"Last-Modified": "Wed, 21 Oct 2015 07:28:00 GMT",
+		"Cache-Control": "max-age=60",
+		"Content-Type":  "",
+	}
+	for k, v := range expect {
+		if got := res.Header.Get(k); got != v {
+			t.Fatalf("header %s: expected %q, got %q", k, v, got)
+		}
+	}
+}
+
+// Test that chunked request bodies are sent chunked to the backend.
+func TestProxyChunkedBody(t *testing.T) {
+	body := strings.Repeat("chunked upload ", 1000)
+	type result struct {
+		te   []string
+		body string
+		err  error
+	}
+	got := make(chan result, 1)
+	backendSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		got <- result{te: r.TransferEncoding, body: string(b), err: err}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backendSrv.Close()
+	u, err := url.Parse(backendSrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := &mockBackend{backend: newBackend(defaultConfig.Backend, u.Host, "")}
+	defer be.Close()
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, NewInventory([]Backend{be}, defaultConfig.Backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(NewReverseProxyConfig(*defaultConfig, lb))
+	defer ts.Close()
+
+	// Hide the length of the body, so it is sent chunked.
+	req, err := http.NewRequest("POST", ts.URL, ioutil.NopCloser(strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = -1
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected status code", res.StatusCode)
+	}
+	r := <-got
+	if r.err != nil {
+		t.Fatal("backend error reading body:", r.err)
+	}
+	if !isChunked(r.te) {
+		t.Fatalf("expected chunked transfer encoding at backend, got %v", r.te)
+	}
+	if r.body != body {
+		t.Fatalf("backend received %d bytes, expected %d", len(r.body), len(body))
+	}
+}
+
+// Test that compressed responses pass through untouched
+// when 'pass-compression' is set.
+func TestProxyPassCompression(t *testing.T) {
+	const body = "compressed response"
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(body))
+	zw.Close()
+	// The backend always compresses.
+	backendSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gz.Bytes())
+	}))
+	defer backendSrv.Close()
+	u, err := url.Parse(backendSrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client doesn't ask for compression or decompress.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(pass bool) (string, []byte) {
+		conf := *defaultConfig
+		conf.Backend.PassCompression = pass
+		be := &mockBackend{backend: newBackend(conf.Backend, u.Host, "")}
+		defer be.Close()
+		lb, err := NewLoadBalancer(conf.LoadBalancing, NewInventory([]Backend{be}, conf.Backend))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(NewReverseProxyConfig(conf, lb))
+		defer ts.Close()
+		res, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Header.Get("Content-Encoding"), b
+	}
+
+	// By default the response is decompressed by the proxy.
+	ce, b := get(false)
+	if ce != "" || string(b) != body {
+		t.Fatalf("expected decompressed response, got %q %q", ce, b)
+	}
+
+	ce, b = get(true)
+	if ce != "gzip" || !bytes.Equal(b, gz.Bytes()) {
+		t.Fatalf("expected gzip response to pass through, got %q %q", ce, b)
+	}
+}
+
+// Test that Retry-After is sent when no backend is available.
+func TestProxyRetryAfter(t *testing.T) {
+	inv := newMockInventory(t, 2)
+	for _, be := range inv.backends {
+		mark := be.(*mockBackend)
+		mark.backend.Close() // Close the monitor, so it doesn't interfere.
+		mark.Stats.mu.Lock()
+		mark.setHealthy(false)
+		mark.Stats.mu.Unlock()
+	}
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := *defaultConfig
+	proxy := NewReverseProxyConfig(conf, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	tests := []struct {
+		enable bool
+		boot   Duration
+		expect string
+	}{
+		{enable: false, expect: "5"},
+		{enable: true, boot: 0, expect: "60"},
+		{enable: true, boot: Duration(90*time.Second + time.Millisecond), expect: "91"},
+	}
+	for i, test := range tests {
+		conf.Provision.Enable = test.enable
+		conf.Provision.BootTime = test.boot
+		proxy.SetConfig(conf)
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatal("test", i, "unexpected status code", res.StatusCode)
+		}
+		if got := res.Header.Get("Retry-After"); got != test.expect {
+			t.Fatalf("test %d: expected Retry-After %q, got %q", i, test.expect, got)
+		}
+	}
+}
+
+// Test that errors are returned as JSON to clients preferring it.
+func TestProxyJSONErrors(t *testing.T) {
+	inv := newMockInventory(t, 1)
+	for _, be := range inv.backends {
+		mark := be.(*mockBackend)
+		mark.backend.Close() // Close the monitor, so it doesn't interfere.
+		mark.Stats.mu.Lock()
+		mark.setHealthy(false)
+		mark.Stats.mu.Unlock()
+	}
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := *defaultConfig
+	conf.JSONErrors = true
+	proxy := NewReverseProxyConfig(conf, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	tests := []struct {
+		accept string
+		json   bool
+	}{
+		{accept: "", json: false},
+		{accept: "text/html", json: false},
+		{accept: "application/json", json: true},
+		{accept: "application/problem+json", json: true},
+		{accept: "text/html;q=0.9, application/json", json: true},
+		{accept: "text/html, application/json;q=0.5", json: false},
+		{accept: "application/json;q=0", json: false},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatal("test", i, "unexpected status code", res.StatusCode)
+		}
+		ct := res.Header.Get("Content-Type")
+		if !test.json {
+			if ct == "application/json" {
+				t.Fatal("test", i, "got JSON content type")
+			}
+			if string(body) != "No healthy backend available :(" {
+				t.Fatalf("test %d: unexpected body %q", i, string(body))
+			}
+			continue
+		}
+		if ct != "application/json" {
+			t.Fatalf("test %d: expected JSON content type, got %q", i, ct)
+		}
+		var got struct {
+			Error string `json:"error"`
+			Code  int    `json:"code"`
+		}
+		err = json.Unmarshal(body, &got)
+		if err != nil {
+			t.Fatal("test", i, err)
+		}
+		if got.Code != http.StatusServiceUnavailable || got.Error != "No healthy backend available :(" {
+			t.Fatalf("test %d: unexpected response %+v", i, got)
+		}
+	}
+
+	// Disabled should always return text.
+	conf.JSONErrors = false
+	proxy.SetConfig(conf)
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct == "application/json" {
+		t.Fatal("got JSON content type with json-errors disabled")
+	}
+}
+
+// Test that concurrent requests from a single client are limited.
+func TestProxyMaxClientRequests(t *testing.T) {
+	entered := make(chan struct{}, 10)
+	release := make(chan struct{})
+	backendSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backendSrv.Close()
+	u, err := url.Parse(backendSrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := &mockBackend{backend: newBackend(defaultConfig.Backend, u.Host, "")}
+	defer be.Close()
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, NewInventory([]Backend{be}, defaultConfig.Backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := *defaultConfig
+	conf.MaxClientRequests = 2
+	proxy := NewReverseProxyConfig(conf, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	get := func() (int, error) {
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	// Fill up the allowed requests.
+	var wg sync.WaitGroup
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, err := get()
+			if err != nil {
+				t.Error(err)
+			}
+			codes <- code
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-entered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("request did not reach backend")
+		}
+	}
+
+	code, err := get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusTooManyRequests {
+		t.Fatal("expected status 429, got", code)
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Fatal("expected status 200, got", code)
+		}
+	}
+
+	// All requests are done, so we should be allowed again.
+	code, err = get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatal("expected status 200, got", code)
+	}
+	proxy.clients.mu.Lock()
+	n := len(proxy.clients.inflight)
+	proxy.clients.mu.Unlock()
+	if n != 0 {
+		t.Fatal("expected no clients in flight, got", n)
+	}
+}
+
+// Test that concurrent requests to all backends are limited.
+func TestProxyMaxBackendRequests(t *testing.T) {
+	entered := make(chan struct{}, 10)
+	release := make(chan struct{})
+	var bes []Backend
+	for i := 0; i < 2; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entered <- struct{}{}
+			<-release
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer srv.Close()
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		be := &mockBackend{backend: newBackend(defaultConfig.Backend, u.Host, ""), n: i}
+		defer be.Close()
+		bes = append(bes, be)
+	}
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, NewInventory(bes, defaultConfig.Backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := *defaultConfig
+	conf.MaxBackendRequests = 2
+	proxy := NewReverseProxyConfig(conf, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	get := func() (int, error) {
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	// Fill up the allowed requests, one on each backend.
+	var wg sync.WaitGroup
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, err := get()
+			if err != nil {
+				t.Error(err)
+			}
+			codes <- code
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-entered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("request did not reach backend")
+		}
+	}
+
+	// The limit applies to all backends together.
+	code, err := get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusServiceUnavailable {
+		t.Fatal("expected status 503, got", code)
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Fatal("expected status 200, got", code)
+		}
+	}
+
+	// All requests are done, so we should be allowed again.
+	code, err = get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatal("expected status 200, got", code)
+	}
+	if n := atomic.LoadInt64(&proxy.inflight); n != 0 {
+		t.Fatal("expected no requests in flight, got", n)
+	}
+}
+
+// Test that unchanged backends are kept when the inventory is reloaded.
+func TestProxyReloadKeepsBackends(t *testing.T) {
+	const before = `
+[[droplet]]
+id = 1
+name = "unchanged"
+server-host = "127.0.0.1:1"
+
+[[droplet]]
+id = 2
+name = "removed"
+server-host = "127.0.0.1:2"
+`
+	const after = `
+[[droplet]]
+id = 1
+name = "unchanged"
+server-host = "127.0.0.1:1"
+
+[[droplet]]
+id = 3
+name = "added"
+server-host = "127.0.0.1:3"
+`
+	inv, err := parseInventory([]byte(before), defaultConfig.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxyConfig(*defaultConfig, lb)
+
+	kept, _ := inv.BackendID("1")
+	removed, _ := inv.BackendID("2")
+	keptStats := kept.(*DropletBackend).backend
+	keptStats.Stats.mu.Lock()
+	keptStats.Stats.Selected = 42
+	keptStats.Stats.mu.Unlock()
+
+	inv2, err := parseInventory([]byte(after), defaultConfig.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, _ := inv2.BackendID("1")
+	lb2, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inUse := lb2.Backends()
+	proxy.SetBackends(lb2)
+	defer lb2.Close()
+	if inUse[0] != replaced {
+		t.Fatal("slice in use was modified when reusing backends")
+	}
+
+	got, ok := inv2.BackendID("1")
+	if !ok {
+		t.Fatal("backend 1 not found after reload")
+	}
+	if got != kept {
+		t.Fatal("unchanged backend was not kept")
+	}
+	if got.(*DropletBackend).closeMonitor == nil {
+		t.Fatal("kept backend was closed")
+	}
+	got.(*DropletBackend).Stats.mu.RLock()
+	selected := got.(*DropletBackend).Stats.Selected
+	got.(*DropletBackend).Stats.mu.RUnlock()
+	if selected != 42 {
+		t.Fatal("expected stats to persist, got selected", selected)
+	}
+	if replaced.(*DropletBackend).closeMonitor != nil {
+		t.Fatal("replaced backend was not closed")
+	}
+	if removed.(*DropletBackend).closeMonitor != nil {
+		t.Fatal("removed backend was not closed")
+	}
+	added, ok := inv2.BackendID("3")
+	if !ok {
+		t.Fatal("backend 3 not found after reload")
+	}
+	if added.(*DropletBackend).closeMonitor == nil {
+		t.Fatal("added backend is not running")
+	}
+	if _, ok := inv2.BackendID("2"); ok {
+		t.Fatal("removed backend still in inventory")
+	}
+
+	// A changed backend should be replaced.
+	inv3, err := parseInventory([]byte(strings.Replace(after, `"unchanged"`, `"changed"`, 1)), defaultConfig.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb3, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetBackends(lb3)
+	defer lb3.Close()
+	got, _ = inv3.BackendID("1")
+	if got == kept {
+		t.Fatal("changed backend was kept")
+	}
+	if kept.(*DropletBackend).closeMonitor != nil {
+		t.Fatal("changed backend was not closed")
+	}
+}
+
+// Test that redirects and cookies pointing at the backend are rewritten.
+func TestProxyRewriteLocation(t *testing.T) {
+	var backendHost string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostname, _, _ := net.SplitHostPort(backendHost)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Domain: hostname, Path: "/"})
+		http.SetCookie(w, &http.Cookie{Name: "other", Value: "2", Domain: "example.org"})
+		switch r.URL.Path {
+		case "/internal":
+			http.Redirect(w, r, "http://"+backendHost+"/login?next=1", http.StatusFound)
+		case "/external":
+			http.Redirect(w, r, "http://example.org/login", http.StatusFound)
+		case "/relative":
+			http.Redirect(w, r, "/login", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+	backendHost = srv.Listener.Addr().String()
+
+	bec := defaultConfig.Backend
+	bec.DisableHealth = true
+	be := &mockBackend{backend: newBackend(bec, backendHost, "")}
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, NewInventory([]Backend{be}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	conf := *defaultConfig
+	conf.RewriteLocation = true
+	conf.RewriteCookieDomain = true
+	proxy := NewReverseProxyConfig(conf, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	tests := map[string]string{
+		"/internal": "http://proxy.example.com:8000/login?next=1",
+		"/external": "http://example.org/login",
+		"/relative": "/login",
+	}
+	for path, expect := range tests {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "proxy.example.com:8000"
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusFound {
+			t.Fatalf("%s: unexpected status %d", path, res.StatusCode)
+		}
+		if got := res.Header.Get("Location"); got != expect {
+			t.Errorf("%s: expected location %q, got %q", path, expect, got)
+		}
+		domains := map[string]string{}
+		for _, c := range res.Cookies() {
+			domains[c.Name] = c.Domain
+		}
+		if domains["session"] != "proxy.example.com" {
+			t.Errorf("%s: expected session cookie domain to be rewritten, got %q", path, domains["session"])
+		}
+		if domains["other"] != "example.org" {
+			t.Errorf("%s: other cookie domain was changed to %q", path, domains["other"])
+		}
+	}
+}
+
+// Test that basic authentication is required when enabled.
+func TestProxyBasicAuth(t *testing.T) {
+	inv := newMockInventory(t, 1)
+	var auth = make(chan string, 10)
+	httpmock.RegisterResponder("GET", func(req *http.Request) (*http.Response, error) {
+		auth <- req.Header.Get("Authorization")
+		return httpmock.MockResponse(req)
+	})
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	conf := *defaultConfig
+	conf.BasicAuth = BasicAuthConfig{
+		Enable: true,
+		Realm:  "internal",
+		Users: []string{
+			// sha256("password")
+			"admin:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8",
+			// sha256("secret")
+			"other:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b",
+			// bcrypt("secret")
+			"crypt:$2a$04$d22H13wbOzeaZbHE5ipNC.CysyS1m7s/VopkFTEPwxGilCNeFF5fO",
+		},
+	}
+	if err := conf.BasicAuth.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxyConfig(conf, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	tests := []struct {
+		user, pass string
+		set        bool
+		ok         bool
+	}{
+		{set: false, ok: false},
+		{user: "admin", pass: "password", set: true, ok: true},
+		{user: "other", pass: "secret", set: true, ok: true},
+		{user: "crypt", pass: "secret", set: true, ok: true},
+		{user: "crypt", pass: "password", set: true, ok: false},
+		{user: "admin", pass: "secret", set: true, ok: false},
+		{user: "nobody", pass: "password", set: true, ok: false},
+		{user: "admin", pass: "", set: true, ok: false},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.set {
+			req.SetBasicAuth(test.user, test.pass)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if !test.ok {
+			if res.StatusCode != http.StatusUnauthorized {
+				t.Errorf("test %d: expected status 401, got %d", i, res.StatusCode)
+			}
+			if got := res.Header.Get("WWW-Authenticate"); got != `Basic realm="internal"` {
+				t.Errorf("test %d: unexpected WWW-Authenticate %q", i, got)
+			}
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("test %d: expected status 200, got %d", i, res.StatusCode)
+			continue
+		}
+		if got := <-auth; got != "" {
+			t.Errorf("test %d: credentials were sent to the backend: %q", i, got)
+		}
+	}
+	select {
+	case <-auth:
+		t.Error("unauthorized request reached the backend")
+	default:
+	}
+}
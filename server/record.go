@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecordConfig contains settings for recording a sample
+// of proxied requests, so they can be replayed later.
+type RecordConfig struct {
+	File       string  `toml:"file"`        // Requests are appended to this file. Empty disables recording.
+	SampleRate float64 `toml:"sample-rate"` // Fraction of requests that are recorded. 0 records all.
+}
+
+// Validate record configuration.
+func (c RecordConfig) Validate() error {
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("record: 'sample-rate' must be between 0 and 1, was %g", c.SampleRate)
+	}
+	return nil
+}
+
+// RecordedRequest is a single recorded request.
+// Bodies are not recorded, only their size and SHA-256 hash.
+type RecordedRequest struct {
+	Time     time.Time   `json:"time"`
+	Method   string      `json:"method"`
+	Host     string      `json:"host"`
+	URL      string      `json:"url"` // Path and query.
+	Header   http.Header `json:"header"`
+	BodySize int64       `json:"body_size"`
+	BodyHash string      `json:"body_sha256,omitempty"`
+}
+
+// recordRedact contains the headers that are
+// replaced with "REDACTED" when recorded.
+var recordRedact = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// recorder writes recorded requests to a file,
+// one JSON object per line.
+type recorder struct {
+	mu   sync.Mutex
+	f    *os.File
+	rate float64
+	log  *serverLog
+}
+
+// newRecorder will open the configured file for recording requests.
+// If the file is empty, recording is disabled and nil is returned.
+// Errors writing the file are logged to log.
+func newRecorder(c RecordConfig, log *serverLog) (*recorder, error) {
+	if c.File == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("record: %v", err)
+	}
+	return &recorder{f: f, rate: c.SampleRate, log: log}, nil
+}
+
+// Close will close the file of the recorder.
+// Requests that are done after this are not recorded.
+func (rec *recorder) Close() {
+	rec.mu.Lock()
+	rec.f.Close()
+	rec.mu.Unlock()
+}
+
+// setRecorder will start recording requests with rec.
+// If rec is nil, no requests are recorded.
+// The previous recorder is closed.
+func (h *ReverseProxy) setRecorder(rec *recorder) {
+	h.mu.Lock()
+	old := h.rec
+	h.rec = rec
+	h.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// getRecorder returns the current recorder.
+// If recording is disabled, nil is returned.
+func (h *ReverseProxy) getRecorder() *recorder {
+	h.mu.RLock()
+	rec := h.rec
+	h.mu.RUnlock()
+	return rec
+}
+
+// start will begin recording the request, if it is sampled.
+// The request body is hashed while it is read.
+// The returned function writes the entry and must be called
+// when the request is done. If the request isn't sampled, nil is returned.
+func (rec *recorder) start(r *http.Request) func() {
+	if rec.rate > 0 && rand.Float64() >= rec.rate {
+		return nil
+	}
+	e := RecordedRequest{
+		Time:   time.Now().UTC(),
+		Method: r.Method,
+		Host:   r.Host,
+		URL:    r.URL.RequestURI(),
+		Header: r.Header.Clone(),
+	}
+	for _, k := range recordRedact {
+		if _, ok := e.Header[k]; ok {
+			e.Header.Set(k, redacted)
+		}
+	}
+	var body *hashReader
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &hashReader{ReadCloser: r.Body, h: sha256.New()}
+		r.Body = body
+	}
+	return func() {
+		if body != nil && body.n > 0 {
+			e.BodySize = body.n
+			e.BodyHash = hex.EncodeToString(body.h.Sum(nil))
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			rec.log.Errorf("Recording request: %v", err)
+			return
+		}
+		rec.mu.Lock()
+		_, err = rec.f.Write(append(b, '\n'))
+		rec.mu.Unlock()
+		if err != nil {
+			rec.log.Errorf("Recording request: %v", err)
+		}
+	}
+}
+
+// hashReader hashes and counts everything read from the body.
+type hashReader struct {
+	io.ReadCloser
+	h hash.Hash
+	n int64
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.ReadCloser.Read(p)
+	h.h.Write(p[:n])
+	h.n += int64(n)
+	return n, err
+}
+
+// ReplayStats contains the results of a replay.
+type ReplayStats struct {
+	Requests int            // Requests sent.
+	Errors   int            // Requests that could not be sent.
+	NoBody   int            // Requests that had a body, which wasn't recorded.
+	Status   map[int]int    // Number of responses with each status code.
+	Backends map[string]int // Number of requests sent to each backend host.
+}
+
+// Replay will send the requests recorded in the file to backends
+// selected by the load balancer. Requests are sent one at a time.
+// Bodies are not recorded, so requests are sent without a body.
+// Headers that were redacted when recorded are not sent.
+func Replay(file string, lb LoadBalancer) (*ReplayStats, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	log := balancerLog(lb)
+	st := &ReplayStats{Status: make(map[int]int), Backends: make(map[string]int)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var e RecordedRequest
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return st, fmt.Errorf("%s line %d: %v", file, line, err)
+		}
+		be := lb.Backend()
+		if be == nil {
+			return st, fmt.Errorf("no healthy backend available")
+		}
+		req, err := http.NewRequest(e.Method, backendScheme(be)+"://"+be.Host()+e.URL, nil)
+		if err != nil {
+			return st, fmt.Errorf("%s line %d: %v", file, line, err)
+		}
+		for k, vv := range e.Header {
+			if len(vv) == 1 && vv[0] == redacted {
+				continue
+			}
+			req.Header[k] = vv
+		}
+		req.Host = e.Host
+		if e.BodySize > 0 {
+			st.NoBody++
+		}
+		st.Requests++
+		st.Backends[be.Host()]++
+		resp, err := be.Transport().RoundTrip(req)
+		if err != nil {
+			log.Warnf("Replaying %s %s to %s: %v", e.Method, e.URL, be.Host(), err)
+			st.Errors++
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		st.Status[resp.StatusCode]++
+	}
+	return st, scanner.Err()
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test that requests are recorded and can be replayed.
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doproxy-test-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "requests.log")
+	rec, err := newRecorder(RecordConfig{File: file}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	primary, closePrimary := newPool(t, "primary")
+	defer closePrimary()
+	proxy := NewReverseProxyConfig(valid_config, primary)
+	proxy.setRecorder(rec)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	req, err := http.NewRequest("POST", ts.URL+"/submit?id=1", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Test", "value")
+	for _, req := range []*http.Request{req, mustRequest(t, "GET", ts.URL+"/page")} {
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	// Stop recording, so the file is complete.
+	proxy.setRecorder(nil)
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []RecordedRequest
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e RecordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e)
+	}
+	f.Close()
+	if len(got) != 2 {
+		t.Fatal("expected 2 recorded requests, got", len(got))
+	}
+	sum := sha256.Sum256([]byte("payload"))
+	post := got[0]
+	if post.Method != "POST" || post.URL != "/submit?id=1" || post.BodySize != 7 || post.BodyHash != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected recorded request %+v", post)
+	}
+	if post.Header.Get("Authorization") != redacted || post.Header.Get("X-Test") != "value" {
+		t.Fatalf("unexpected recorded headers %v", post.Header)
+	}
+	if got[1].Method != "GET" || got[1].URL != "/page" || got[1].BodyHash != "" {
+		t.Fatalf("unexpected recorded request %+v", got[1])
+	}
+
+	// Replay the requests to another backend.
+	type replayed struct {
+		method, uri, auth, test, body string
+	}
+	reqs := make(chan replayed, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		reqs <- replayed{r.Method, r.URL.RequestURI(), r.Header.Get("Authorization"), r.Header.Get("X-Test"), string(b)}
+		if r.Method == "POST" {
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	be := &mockBackend{backend: newBackend(bec, u.Host, "")}
+	lb, err := NewLoadBalancer(valid_config.LoadBalancing, NewInventory([]Backend{be}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+
+	st, err := Replay(file, lb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Requests != 2 || st.Errors != 0 || st.NoBody != 1 {
+		t.Fatalf("unexpected replay stats %+v", st)
+	}
+	if st.Status[http.StatusCreated] != 1 || st.Status[http.StatusOK] != 1 || st.Backends[u.Host] != 2 {
+		t.Fatalf("unexpected replay stats %+v", st)
+	}
+	close(reqs)
+	var all []replayed
+	for r := range reqs {
+		all = append(all, r)
+	}
+	expect := []replayed{{"POST", "/submit?id=1", "", "value", ""}, {"GET", "/page", "", "", ""}}
+	for i := range expect {
+		if all[i] != expect[i] {
+			t.Fatalf("replayed request %d: expected %+v, got %+v", i, expect[i], all[i])
+		}
+	}
+}
+
+// Test that requests are replayed with TLS to HTTPS backends.
+func TestReplayHTTPS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doproxy-test-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "requests.log")
+	err = ioutil.WriteFile(file, []byte(`{"method":"GET","url":"/page","host":"example.com"}`+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secure := make(chan bool, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secure <- r.TLS != nil
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	be := &mockBackend{backend: newBackend(bec, u.Host, "")}
+	be.https = true
+	be.rt.rt = srv.Client().Transport
+	lb, err := NewLoadBalancer(valid_config.LoadBalancing, NewInventory([]Backend{be}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+
+	st, err := Replay(file, lb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Requests != 1 || st.Errors != 0 || st.Status[http.StatusOK] != 1 {
+		t.Fatalf("unexpected replay stats %+v", st)
+	}
+	if !<-secure {
+		t.Fatal("request was not sent with TLS")
+	}
+}
+
+// mustRequest returns a new request without a body.
+func mustRequest(t *testing.T, method, url string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
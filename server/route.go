@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RouteConfig sends requests where the path starts with
+// a prefix to a separate pool of backends.
+type RouteConfig struct {
+	PathPrefix    string `toml:"path-prefix"`
+	InventoryFile string `toml:"inventory-file"` // Inventory file or http(s) URL with the backends of the pool.
+	Protocol      string `toml:"protocol"`       // Protocol used for requests to the pool. Empty uses 'protocol' in [backend].
+}
+
+// Validate the route configuration.
+// Will return the first error found.
+func (r RouteConfig) Validate() error {
+	if !strings.HasPrefix(r.PathPrefix, "/") {
+		return fmt.Errorf("route: 'path-prefix' = '%s' must start with '/'", r.PathPrefix)
+	}
+	if r.InventoryFile == "" {
+		return fmt.Errorf("route %q: no 'inventory-file' specified", r.PathPrefix)
+	}
+	if err := validProtocol(r.Protocol); err != nil {
+		return fmt.Errorf("route %q: %v", r.PathPrefix, err)
+	}
+	return nil
+}
+
+// MethodPoolConfig sends read and write requests
+// to separate pools of backends.
+type MethodPoolConfig struct {
+	ReadInventory  string `toml:"read-inventory-file"`  // Backends for GET, HEAD and OPTIONS requests.
+	WriteInventory string `toml:"write-inventory-file"` // Backends for all other requests.
+}
+
+// readMethods are the methods sent to the read pool.
+var readMethods = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true}
+
+// route is a pool of backends used for requests with a path prefix.
+// If class is "read" or "write", only requests with methods of that
+// class use the route, and the route is skipped while it has no backends.
+type route struct {
+	prefix   string
+	class    string
+	balancer LoadBalancer
+}
+
+// matches returns true if the route should be used for the request.
+func (r route) matches(path, method string) bool {
+	if !strings.HasPrefix(path, r.prefix) {
+		return false
+	}
+	switch r.class {
+	case "":
+		return true
+	case "read":
+		if !readMethods[method] {
+			return false
+		}
+	case "write":
+		if readMethods[method] {
+			return false
+		}
+	}
+	return len(r.balancer.Backends()) > 0
+}
+
+// loadRoutes will read the inventories of the routes and method pools
+// in the configuration and create a load balancer for each.
+func (s *Server) loadRoutes(c Config) ([]route, error) {
+	type pool struct {
+		route
+		name, file string
+		protocol   string
+	}
+	var pools []pool
+	for _, rc := range c.Routes {
+		pools = append(pools, pool{route{prefix: rc.PathPrefix}, fmt.Sprintf("route %q", rc.PathPrefix), rc.InventoryFile, rc.Protocol})
+	}
+	// Method pools are used for all paths not matching a route.
+	if c.MethodPools.ReadInventory != "" {
+		pools = append(pools, pool{route{prefix: "/", class: "read"}, "read pool", c.MethodPools.ReadInventory, ""})
+	}
+	if c.MethodPools.WriteInventory != "" {
+		pools = append(pools, pool{route{prefix: "/", class: "write"}, "write pool", c.MethodPools.WriteInventory, ""})
+	}
+
+	routes := make([]route, 0, len(pools))
+	for _, p := range pools {
+		bec := c.Backend
+		if p.protocol != "" {
+			bec.Protocol = p.protocol
+		}
+		inv, err := s.readInventory(p.file, bec)
+		if err == nil && len(inv.IDs()) == 0 {
+			s.log.Warnf("Inventory %q of %s has no backends.", p.file, p.name)
+		}
+		if err == nil {
+			p.balancer, err = NewLoadBalancer(c.LoadBalancing, inv)
+			if err != nil {
+				inv.Close()
+			}
+		}
+		if err != nil {
+			for _, r := range routes {
+				r.balancer.Close()
+			}
+			return nil, fmt.Errorf("%s: %v", p.name, err)
+		}
+		routes = append(routes, p.route)
+	}
+	return routes, nil
+}
+
+// setRoutes will replace the path prefix routes.
+// The load balancers of the previous routes are closed.
+func (h *ReverseProxy) setRoutes(routes []route) {
+	// Sort by prefix length, so the longest match is found first.
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+	h.mu.Lock()
+	old := h.routes
+	h.routes = routes
+	h.mu.Unlock()
+	for _, r := range old {
+		r.balancer.Close()
+	}
+}
+
+// routeBalancer returns the load balancer of the route with the
+// longest prefix matching the request. If no route matches, nil is returned.
+// h.mu must be held.
+func (h *ReverseProxy) routeBalancer(path, method string) LoadBalancer {
+	for _, r := range h.routes {
+		if r.matches(path, method) {
+			return r.balancer
+		}
+	}
+	return nil
+}
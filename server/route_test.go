@@ -0,0 +1,185 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// newPool returns a load balancer with a single backend
+// that responds with the name of the pool.
+func newPool(t *testing.T, name string) (LoadBalancer, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	be := &mockBackend{backend: newBackend(bec, u.Host, "")}
+	lb, err := NewLoadBalancer(valid_config.LoadBalancing, NewInventory([]Backend{be}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb, srv.Close
+}
+
+// Test that requests are routed to the pool with the longest matching prefix.
+func TestProxyRoutes(t *testing.T) {
+	def, closeDef := newPool(t, "default")
+	defer closeDef()
+	api, closeAPI := newPool(t, "api")
+	defer closeAPI()
+	apiV2, closeAPIV2 := newPool(t, "api-v2")
+	defer closeAPIV2()
+	static, closeStatic := newPool(t, "static")
+	defer closeStatic()
+
+	proxy := NewReverseProxyConfig(valid_config, def)
+	proxy.setRoutes([]route{
+		{prefix: "/api/", balancer: api},
+		{prefix: "/static/", balancer: static},
+		{prefix: "/api/v2/", balancer: apiV2},
+	})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	tests := map[string]string{
+		"/":              "default",
+		"/api":           "default",
+		"/apis/":         "default",
+		"/api/":          "api",
+		"/api/users":     "api",
+		"/api/v2/users":  "api-v2",
+		"/static/a.css":  "static",
+		"/other/static/": "default",
+	}
+	for path, expect := range tests {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != expect {
+			t.Errorf("%s: expected pool %q, got %q", path, expect, string(body))
+		}
+	}
+
+	// Removing the routes should send everything to the default pool.
+	proxy.setRoutes(nil)
+	res, err := http.Get(ts.URL + "/api/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "default" {
+		t.Errorf("expected default pool after removing routes, got %q", string(body))
+	}
+}
+
+// Test that the inventories of routes are loaded.
+func TestServerLoadRoutes(t *testing.T) {
+	s := &Server{Config: valid_config}
+	s.Config.Routes = []RouteConfig{{PathPrefix: "/api/", InventoryFile: "testdata/validinventory.toml"}}
+	routes, err := s.loadRoutes(s.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].prefix != "/api/" {
+		t.Fatalf("unexpected routes %+v", routes)
+	}
+	if n := len(routes[0].balancer.Backends()); n != 3 {
+		t.Fatal("expected 3 backends, got", n)
+	}
+	routes[0].balancer.Close()
+
+	s.Config.Routes = append(s.Config.Routes, RouteConfig{PathPrefix: "/static/", InventoryFile: "testdata/nonexistent.toml"})
+	_, err = s.loadRoutes(s.Config)
+	if err == nil {
+		t.Fatal("expected error with missing inventory")
+	}
+}
+
+// Test that read and write requests are sent to their pools.
+func TestProxyMethodPools(t *testing.T) {
+	def, closeDef := newPool(t, "default")
+	defer closeDef()
+	read, closeRead := newPool(t, "read")
+	defer closeRead()
+	write, closeWrite := newPool(t, "write")
+	defer closeWrite()
+	api, closeAPI := newPool(t, "api")
+	defer closeAPI()
+
+	proxy := NewReverseProxyConfig(valid_config, def)
+	proxy.setRoutes([]route{
+		{prefix: "/", class: "read", balancer: read},
+		{prefix: "/", class: "write", balancer: write},
+		{prefix: "/api/", balancer: api},
+	})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	do := func(method, path string) string {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	tests := []struct {
+		method, path, expect string
+	}{
+		{"GET", "/", "read"},
+		{"OPTIONS", "/x", "read"},
+		{"POST", "/x", "write"},
+		{"PUT", "/x", "write"},
+		{"DELETE", "/x", "write"},
+		{"POST", "/api/x", "api"},
+		{"GET", "/api/x", "api"},
+	}
+	for _, test := range tests {
+		if got := do(test.method, test.path); got != test.expect {
+			t.Errorf("%s %s: expected pool %q, got %q", test.method, test.path, test.expect, got)
+		}
+	}
+
+	// An empty pool falls back to the default pool.
+	empty, err := NewLoadBalancer(valid_config.LoadBalancing, NewInventory([]Backend{}, valid_config.Backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read2, closeRead2 := newPool(t, "read")
+	defer closeRead2()
+	proxy.setRoutes([]route{
+		{prefix: "/", class: "read", balancer: read2},
+		{prefix: "/", class: "write", balancer: empty},
+	})
+	if got := do("POST", "/x"); got != "default" {
+		t.Errorf("expected empty write pool to use default pool, got %q", got)
+	}
+	if got := do("GET", "/x"); got != "read" {
+		t.Errorf("expected read pool, got %q", got)
+	}
+}
@@ -1,11 +1,17 @@
 package server
 
 import (
-	"github.com/klauspost/shutdown"
-	"gopkg.in/fsnotify.v1"
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"path/filepath"
 	"sync"
+	"time"
+
+	"github.com/klauspost/shutdown"
+	"gopkg.in/fsnotify.v1"
 )
 
 // Server contains the main server configuration
@@ -14,10 +20,25 @@ import (
 // to run multiple servers at once with different
 // configurations.
 type Server struct {
-	Config     Config
-	mu         sync.RWMutex
-	handler    *ReverseProxy
-	exitMonInv chan chan struct{} // Channel to indicate that inventory monitoring must stop.
+	Config        Config
+	configFile    string // File the configuration was read from.
+	mu            sync.RWMutex
+	handler       *ReverseProxy
+	events        *Events            // Health transitions of all backends.
+	exitMonInv    chan chan struct{} // Channel to indicate that inventory monitoring must stop.
+	monDone       chan struct{}      // Closed when inventory monitoring has stopped.
+	prov          *provisioner       // Provisioner, if enabled.
+	stopUnhealthy chan struct{}      // Closed to stop removing unhealthy backends.
+	servers       []*http.Server     // Frontend servers, stopped by drain.
+	log           *serverLog         // Log of the server, passed to the proxy, load balancers and backends.
+	metrics       *serverMetrics     // 'statsd' client of the server, passed to the proxy and backends.
+	tracer        *serverTracer      // Span exporter of the server, passed to the proxy.
+	healthLimits  *healthLimiter     // 'health-check-concurrency' limit of the server, passed to the backends.
+
+	// Content of the inventory file last saved by the server,
+	// so the watcher doesn't reload it. Protected by savedMu.
+	savedInv []byte
+	savedMu  sync.Mutex
 }
 
 // NewServer will read the supplied config file,
@@ -26,7 +47,15 @@ type Server struct {
 // configuration file and reload settings if changes
 // are detected.
 func NewServer(config string) (*Server, error) {
-	s := &Server{handler: NewReverseProxy()}
+	s := &Server{
+		handler:      NewReverseProxy(),
+		events:       NewEvents(),
+		configFile:   config,
+		log:          newServerLog(),
+		metrics:      &serverMetrics{},
+		tracer:       &serverTracer{},
+		healthLimits: &healthLimiter{},
+	}
 	err := s.ReadConfig(config, true)
 	if err != nil {
 		return nil, err
@@ -34,64 +63,115 @@ func NewServer(config string) (*Server, error) {
 
 	// Add config file watcher/reloader.
 	if s.Config.WatchConfig {
-		watcher, err := fsnotify.NewWatcher()
+		err = s.watchConfig(config)
 		if err != nil {
 			return nil, err
 		}
-		err = watcher.Add(config)
-		if err != nil {
-			return nil, err
+	}
+	return s, nil
+}
+
+// withServer returns the backend configuration with the log, metrics,
+// span exporter and health check limit of the server, so the proxy,
+// load balancers and backends using the configuration share them
+// with the rest of the server.
+func (s *Server) withServer(bec BackendConfig) BackendConfig {
+	bec.log = s.log
+	bec.metrics = s.metrics
+	bec.tracer = s.tracer
+	bec.healthLimits = s.healthLimits
+	return bec
+}
+
+// watchConfig will reload the configuration when the file changes.
+// Editors may replace the file by deleting or renaming it.
+// When that happens the directory is watched until the file
+// is back, and the file is watched again.
+func (s *Server) watchConfig(config string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	err = watcher.Add(config)
+	if err != nil {
+		return err
+	}
+	s.log.Infof("Watching %s", config)
+	dir := filepath.Dir(config)
+
+	// reattach will watch the file again if it exists,
+	// and stop watching the directory.
+	reattach := func() bool {
+		if watcher.Add(config) != nil {
+			return false
 		}
-		log.Println("Watching", config)
-		// We want the watcher to exit in the first stage.
-		go func() {
-			// Get a first stage shutdown notification
-			exit := shutdown.First()
-			for {
-				select {
-				// Event on config file.
-				case event := <-watcher.Events:
-					switch event.Op {
-					// Editor may do rename -> write -> delete, so we should not follow
-					// the old file
-					case fsnotify.Rename:
-						watcher.Remove(event.Name)
-						watcher.Add(config)
-					case fsnotify.Remove:
+		watcher.Remove(dir)
+		return true
+	}
+
+	// We want the watcher to exit in the first stage.
+	go func() {
+		// Get a first stage shutdown notification
+		exit := shutdown.First()
+		for {
+			select {
+			// Event on config file.
+			case event := <-watcher.Events:
+				if filepath.Clean(event.Name) != filepath.Clean(config) {
+					// Another file in the directory.
+					continue
+				}
+				switch {
+				// The old file is gone. Watch the directory,
+				// so we notice when the file is created again.
+				case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+					watcher.Remove(config)
+					if err := watcher.Add(dir); err != nil {
+						s.log.Errorf("Watching %s: %v", dir, err)
+					}
+					// The file may have been created before we watched the directory.
+					if !reattach() {
 						continue
 					}
-					log.Println("Reloading configuration")
-					err := s.ReadConfig(event.Name, false)
-					if err != nil {
-						log.Println("Error reloading configuration:", err)
-						log.Println("Configuration NOT applied")
-					} else {
-						log.Println("Configuration applied")
+				case event.Op&fsnotify.Create != 0:
+					if !reattach() {
+						continue
 					}
-
-					// Server is shutting down
-				case n := <-exit:
-					watcher.Remove(config)
-					close(n)
-					return
 				}
+				s.log.Infof("Reloading configuration")
+				err := s.ReadConfig(config, false)
+				if err != nil {
+					s.log.Errorf("Reloading configuration: %v. Configuration NOT applied", err)
+				} else {
+					s.log.Infof("Configuration applied")
+				}
+
+				// Server is shutting down
+			case n := <-exit:
+				watcher.Close()
+				close(n)
+				return
 			}
-		}()
-	}
-	return s, nil
+		}
+	}()
+	return nil
 }
 
 // MonitorInventory will monitor the inventory file
 // and reload the inventory if changes are detected.
+// If the inventory is a URL it will be polled for changes.
 // The monitor can be shut down by sending a channel on
 // (Server).exitMonInv. The monitor will exit and close
 // the supplied channel.
 func (s *Server) MonitorInventory() error {
+	file := s.Config.InventoryFile
+	if isURL(file) {
+		return s.pollInventory(file)
+	}
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
-	file := s.Config.InventoryFile
 	err = watcher.Add(file)
 	if err != nil {
 		return err
@@ -99,11 +179,16 @@ func (s *Server) MonitorInventory() error {
 
 	// Create channel to stop monitoring
 	stop := make(chan chan struct{})
+	done := make(chan struct{})
+	s.mu.Lock()
 	s.exitMonInv = stop
+	s.monDone = done
+	s.mu.Unlock()
 
-	log.Println("Watching", file)
+	s.log.Infof("Watching %s", file)
 	// We want the watcher to exit in the first stage.
 	go func() {
+		defer close(done)
 		// Get a first stage shutdown notification
 		exit := shutdown.First()
 		for {
@@ -119,43 +204,111 @@ func (s *Server) MonitorInventory() error {
 				case fsnotify.Remove:
 					continue
 				}
-				log.Println("Reloading inventory")
+				if s.savedBySelf(event.Name) {
+					s.log.Debugf("Inventory was saved by the server, not reloading")
+					continue
+				}
+				s.log.Infof("Reloading inventory")
 				s.mu.RLock()
-				bec := s.Config.Backend
+				conf := s.Config
 				s.mu.RUnlock()
 
-				inv, err := ReadInventory(event.Name, bec)
+				inv, err := s.readInventory(event.Name, conf.Backend)
 				if err != nil {
-					log.Println("Error reloading inventory:", err)
-					log.Println("New inventory NOT applied")
-					continue
+					s.log.Errorf("Reloading inventory: %v. New inventory NOT applied", err)
+					if !conf.InventoryRollback {
+						continue
+					}
+					inv, err = s.recoverInventory(file, conf)
+					if err != nil {
+						s.log.Errorf("Recovering inventory: %v", err)
+						continue
+					}
 				}
+				inv.SetSnapshots(conf.InventorySnapshots)
+				s.applyInventory(inv)
+			// Server is shutting down
+			case n := <-exit:
+				s.log.Debugf("Monitor exiting")
+				watcher.Remove(file)
+				close(n)
+				return
+				// Monitor must stop
+			case n := <-stop:
+				exit.Cancel()
+				watcher.Remove(file)
+				close(n)
+				s.log.Infof("No longer watching %s", file)
+				return
+			}
+		}
+	}()
+	return nil
+}
 
-				// Update the load balancer
-				s.mu.RLock()
-				lb, err := NewLoadBalancer(s.Config.LoadBalancing, inv)
+// pollInventory will poll an inventory URL and
+// reload the inventory if the content changes.
+// The poller can be stopped the same way as MonitorInventory.
+func (s *Server) pollInventory(url string) error {
+	every := time.Duration(s.Config.InventoryPoll)
+	if every <= 0 {
+		every = defaultInventoryPoll
+	}
+	src := newInventorySource(url)
+	last, err := src.Read()
+	if err != nil {
+		s.log.Errorf("Reading inventory: %v", err)
+	}
+
+	// Create channel to stop monitoring
+	stop := make(chan chan struct{})
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.exitMonInv = stop
+	s.monDone = done
+	s.mu.Unlock()
+
+	s.log.Infof("Polling %s every %v", url, every)
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		// Get a first stage shutdown notification
+		exit := shutdown.First()
+		for {
+			select {
+			case <-ticker.C:
+				b, err := src.Read()
 				if err != nil {
-					log.Println(err)
-					log.Println("New inventory NOT applied")
-					s.mu.RUnlock()
+					s.log.Errorf("Polling inventory: %v", err)
+					continue
+				}
+				if bytes.Equal(b, last) {
 					continue
 				}
-				s.handler.SetBackends(lb)
+				s.log.Infof("Reloading inventory")
+				s.mu.RLock()
+				bec := s.Config.Backend
 				s.mu.RUnlock()
 
-				log.Println("New inventory applied")
+				inv, err := parseInventory(b, bec)
+				if err != nil {
+					s.log.Errorf("Reloading inventory: %v. New inventory NOT applied", err)
+					continue
+				}
+				last = b
+				inv.SetEvents(s.events)
+				s.applyInventory(inv)
 			// Server is shutting down
 			case n := <-exit:
-				log.Println("Monitor exiting")
-				watcher.Remove(file)
+				s.log.Debugf("Monitor exiting")
 				close(n)
 				return
 				// Monitor must stop
 			case n := <-stop:
 				exit.Cancel()
-				watcher.Remove(file)
 				close(n)
-				log.Println("No longer watching", file)
+				s.log.Infof("No longer polling %s", url)
 				return
 			}
 		}
@@ -163,10 +316,176 @@ func (s *Server) MonitorInventory() error {
 	return nil
 }
 
+// applyInventory will create a new load balancer with
+// the inventory and start using it.
+func (s *Server) applyInventory(inv *Inventory) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	lb, err := NewLoadBalancer(s.Config.LoadBalancing, inv)
+	if err != nil {
+		s.log.Errorf("%v. New inventory NOT applied", err)
+		return
+	}
+	s.handler.SetBackends(lb)
+	s.log.Infof("New inventory applied")
+}
+
+// saveInventory will save the inventory of the current load balancer
+// to the inventory file, if it is a file.
+// The saved content is recorded, so the watcher doesn't reload it.
+func (s *Server) saveInventory() error {
+	s.mu.RLock()
+	file := s.Config.InventoryFile
+	s.mu.RUnlock()
+	if isURL(file) {
+		return nil
+	}
+	s.handler.mu.RLock()
+	lb, ok := s.handler.balancer.(inventoried)
+	s.handler.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	s.savedMu.Lock()
+	defer s.savedMu.Unlock()
+	err := lb.inventory().SaveDroplets(file)
+	if err != nil {
+		return err
+	}
+	s.savedInv, err = ioutil.ReadFile(file)
+	return err
+}
+
+// savedBySelf returns true if the file contains the
+// inventory last saved by the server.
+// If the server is saving the inventory, it waits for it to finish.
+func (s *Server) savedBySelf(file string) bool {
+	s.savedMu.Lock()
+	defer s.savedMu.Unlock()
+	if s.savedInv == nil {
+		return false
+	}
+	b, err := ioutil.ReadFile(file)
+	return err == nil && bytes.Equal(b, s.savedInv)
+}
+
+// readInventory will read an inventory file and make the backends
+// publish health transitions to the server events.
+func (s *Server) readInventory(file string, bec BackendConfig) (*Inventory, error) {
+	inv, err := ReadInventory(file, bec)
+	if err != nil {
+		return nil, err
+	}
+	inv.SetEvents(s.events)
+	return inv, nil
+}
+
+// recoverInventory will restore the newest snapshot of the inventory
+// file that can be read, if 'inventory-rollback' is enabled.
+// The unreadable inventory is kept as "<file>.corrupt".
+func (s *Server) recoverInventory(file string, conf Config) (*Inventory, error) {
+	if !conf.InventoryRollback || isURL(file) {
+		return nil, fmt.Errorf("rollback disabled")
+	}
+	for n := 1; n <= conf.InventorySnapshots; n++ {
+		snap := snapshotFile(file, n)
+		inv, err := s.readInventory(snap, conf.Backend)
+		if err != nil {
+			s.log.Debugf("Inventory snapshot %s not usable: %v", snap, err)
+			continue
+		}
+		b, err := ioutil.ReadFile(snap)
+		if err == nil {
+			if corrupt, err := ioutil.ReadFile(file); err == nil {
+				ioutil.WriteFile(file+".corrupt", corrupt, 0644)
+			}
+			err = ioutil.WriteFile(file, b, 0644)
+		}
+		if err != nil {
+			inv.Close()
+			return nil, fmt.Errorf("restoring %s: %v", snap, err)
+		}
+		inv.SetSnapshots(conf.InventorySnapshots)
+		s.log.Warnf("Inventory %s restored from snapshot %s. The unreadable inventory was saved as %s.corrupt", file, snap, file)
+		return inv, nil
+	}
+	return nil, fmt.Errorf("no usable snapshot of %s found", file)
+}
+
+// Stop will stop monitoring the inventory and
+// unhealthy backends, and stop the provisioner.
+// It is safe to call Stop more than once.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	stop, done, prov, unhealthy := s.exitMonInv, s.monDone, s.prov, s.stopUnhealthy
+	s.exitMonInv, s.monDone, s.prov, s.stopUnhealthy = nil, nil, nil, nil
+	s.mu.Unlock()
+
+	if unhealthy != nil {
+		close(unhealthy)
+	}
+
+	if stop != nil {
+		c := make(chan struct{})
+		select {
+		case stop <- c:
+			<-c
+			<-done
+		case <-done:
+			// Monitor has already exited.
+		}
+	}
+	if prov != nil {
+		prov.Close()
+	}
+}
+
+// httpServer returns the frontend server for the listener and handler.
+func (s *Server) httpServer(l ListenerConfig, h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:        h,
+		Addr:           l.Bind,
+		MaxHeaderBytes: s.Config.MaxHeaderBytes,
+	}
+}
+
+// startInventory will read the inventory the server is started with.
+// If the inventory has no backends and 'require-backends' is set,
+// an error is returned.
+func (s *Server) startInventory() (*Inventory, error) {
+	inv, err := s.readInventory(s.Config.InventoryFile, s.Config.Backend)
+	if err != nil && s.Config.InventoryRollback {
+		s.log.Errorf("Reading inventory: %v", err)
+		inv, err = s.recoverInventory(s.Config.InventoryFile, s.Config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	inv.SetSnapshots(s.Config.InventorySnapshots)
+	if len(inv.IDs()) > 0 {
+		return inv, nil
+	}
+	if s.Config.RequireBackends {
+		inv.Close()
+		return nil, fmt.Errorf("inventory %q has no backends and 'require-backends' is set", s.Config.InventoryFile)
+	}
+	s.log.Warnf("Inventory %q has no backends. All requests will fail until backends are added.", s.Config.InventoryFile)
+	return inv, nil
+}
+
 // Run the server.
 func (s *Server) Run() {
+	if s.Config.LogConfig {
+		b, err := s.effectiveConfig()
+		if err != nil {
+			s.log.Errorf("Encoding configuration: %v", err)
+		} else {
+			s.log.Infof("Effective configuration:\n%s", b)
+		}
+	}
+
 	// Read inventory
-	inv, err := ReadInventory(s.Config.InventoryFile, s.Config.Backend)
+	inv, err := s.startInventory()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -182,22 +501,66 @@ func (s *Server) Run() {
 		log.Fatal(err)
 	}
 	s.handler = NewReverseProxyConfig(s.Config, lb)
+	routes, err := s.loadRoutes(s.Config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.handler.setRoutes(routes)
+	shadow, err := s.loadShadow(s.Config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.handler.setShadow(shadow)
+	rec, err := newRecorder(s.Config.Record, s.log)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.handler.setRecorder(rec)
 
 	// Start monitoring inventory.
 	s.MonitorInventory()
 
-	mux := http.NewServeMux()
-	mux.Handle("/", s.handler)
+	// Apply 'unhealthy-action' to backends failing health checks.
+	s.monitorUnhealthy()
 
-	srv := &http.Server{Handler: mux, Addr: s.Config.Bind}
-	if s.Config.Https {
-		err := srv.ListenAndServeTLS(s.Config.CertFile, s.Config.KeyFile)
+	if s.Config.Provision.Enable {
+		s.prov, err = newProvisioner(s.Config.Provision, lb)
 		if err != nil {
-			log.Fatalf("Starting HTTPS frontend failed: %v", err)
-		}
-	} else {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Fatalf("Starting frontend failed: %v", err)
+			log.Fatal(err)
 		}
+		s.prov.save = s.saveInventory
+	}
+
+	// Stop monitoring and provisioning when shutting down.
+	shutdown.FirstFunc(func(interface{}) {
+		s.Stop()
+	}, nil)
+
+	// Let running requests finish before exiting.
+	shutdown.SetTimeoutN(shutdown.Stage1, s.Config.shutdownTimeout()+time.Second)
+	shutdown.FirstFunc(func(interface{}) {
+		s.drain()
+	}, nil)
+
+	err = s.listen(s.mux())
+	if shutdown.Started() {
+		// Listeners were stopped by drain.
+		shutdown.Wait()
+		return
 	}
+	if err != nil {
+		log.Fatalf("Starting frontend failed: %v", err)
+	}
+}
+
+// mux returns the handler for the frontend, with
+// the proxy and the admin endpoints.
+func (s *Server) mux() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", s.handler)
+	mux.Handle("/_doproxy/events", s.requireAdmin(s.events))
+	mux.Handle("/_doproxy/stats", s.requireAdmin(http.HandlerFunc(s.handler.ServeStats)))
+	mux.HandleFunc("/_doproxy/reload-config", s.ServeReloadConfig)
+	mux.HandleFunc("/_doproxy/config", s.ServeConfig)
+	return mux
 }
@@ -0,0 +1,418 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that Stop ends inventory monitoring and closes the provisioner.
+func TestServerStop(t *testing.T) {
+	tmp := filepath.Join(os.TempDir(), "doproxy-test-stop-inventory.toml")
+	err := cp(tmp, "testdata/validinventory.toml")
+	if err != nil {
+		t.Fatal("error copying inventory:", err)
+	}
+	defer os.Remove(tmp)
+
+	s, err := NewServer("testdata/validconfig.toml")
+	if err != nil {
+		t.Fatal("error loading config:", err)
+	}
+	s.Config.InventoryFile = tmp
+	err = s.MonitorInventory()
+	if err != nil {
+		t.Fatal("error monitoring inventory:", err)
+	}
+	s.prov, err = newProvisioner(s.Config.Provision, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prov := s.prov
+	done := s.monDone
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatal("monitor goroutine did not exit")
+	}
+	if err := prov.Add(); err != errProvisionerClosed {
+		t.Fatal("expected provisioner to be closed, got", err)
+	}
+
+	// Stopping again should be fine.
+	s.Stop()
+}
+
+// Test that requests with headers above the maximum size are rejected.
+func TestServerMaxHeaderBytes(t *testing.T) {
+	s := &Server{Config: Config{MaxHeaderBytes: 1 << 10}}
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = s.httpServer(ListenerConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.Start()
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Small", "value")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("expected status 200, got", res.StatusCode)
+	}
+
+	// Go allows some slack above the limit, so exceed it well.
+	req.Header.Set("X-Large", strings.Repeat("a", 64<<10))
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestHeaderFieldsTooLarge && res.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected status 431 or 400, got", res.StatusCode)
+	}
+}
+
+// Test that drain lets running requests finish within 'shutdown-timeout',
+// and closes connections still running after it.
+func TestServerDrain(t *testing.T) {
+	for _, test := range []struct {
+		timeout time.Duration
+		clean   bool
+	}{
+		{timeout: 5 * time.Second, clean: true},
+		{timeout: 50 * time.Millisecond, clean: false},
+	} {
+		s := &Server{Config: Config{ShutdownTimeout: Duration(test.timeout)}}
+		started := make(chan struct{})
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(300 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.serve(ListenerConfig{}, h, ln)
+
+		errc := make(chan error, 1)
+		go func() {
+			res, err := http.Get("http://" + ln.Addr().String())
+			if err == nil {
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					err = fmt.Errorf("expected status 200, got %d", res.StatusCode)
+				}
+			}
+			errc <- err
+		}()
+		<-started
+
+		start := time.Now()
+		if clean := s.drain(); clean != test.clean {
+			t.Fatalf("timeout %v: expected clean drain %t, got %t", test.timeout, test.clean, clean)
+		}
+		if test.clean {
+			if err := <-errc; err != nil {
+				t.Fatal("expected request to finish, got", err)
+			}
+		} else {
+			if time.Since(start) > 250*time.Millisecond {
+				t.Fatal("drain waited past the timeout:", time.Since(start))
+			}
+			if err := <-errc; err == nil {
+				t.Fatal("expected request to fail when connections are closed")
+			}
+		}
+
+		// New connections are refused.
+		if _, err := http.Get("http://" + ln.Addr().String()); err == nil {
+			t.Fatal("expected requests to be refused after drain")
+		}
+	}
+}
+
+// Test that startup fails with an empty inventory if backends are required.
+func TestServerRequireBackends(t *testing.T) {
+	s, err := NewServer("testdata/validconfig.toml")
+	if err != nil {
+		t.Fatal("error loading config:", err)
+	}
+	s.Config.InventoryFile = "testdata/emptyinventory.toml"
+	inv, err := s.startInventory()
+	if err != nil {
+		t.Fatal("empty inventory should be allowed, got", err)
+	}
+	inv.Close()
+
+	s.Config.RequireBackends = true
+	_, err = s.startInventory()
+	if err == nil {
+		t.Fatal("expected error with empty inventory")
+	}
+
+	s.Config.InventoryFile = "testdata/validinventory.toml"
+	inv, err = s.startInventory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.Close()
+}
+
+// Test that an unreadable inventory is replaced by
+// the newest good snapshot, at startup and on reload.
+func TestServerInventoryRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doproxy-test-rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "inventory.toml")
+
+	s, err := NewServer("testdata/validconfig.toml")
+	if err != nil {
+		t.Fatal("error loading config:", err)
+	}
+	s.Config.InventoryFile = file
+	s.Config.Backend.DisableHealth = true
+	s.Config.InventorySnapshots = 2
+	s.Config.InventoryRollback = true
+
+	// Save the inventory, so a snapshot is taken.
+	inv, err := ReadInventory("testdata/validinventory.toml", s.Config.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.SetSnapshots(s.Config.InventorySnapshots)
+	if err := inv.SaveDroplets(file); err != nil {
+		t.Fatal(err)
+	}
+	inv.Close()
+
+	corrupt := []byte("[[droplet]\nid = ")
+	if err := ioutil.WriteFile(file, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	inv, err = s.startInventory()
+	if err != nil {
+		t.Fatal("expected startup to recover from snapshot, got", err)
+	}
+	if len(inv.IDs()) != 3 {
+		t.Fatal("expected 3 backends from snapshot, got", inv.IDs())
+	}
+	if b, err := ioutil.ReadFile(file + ".corrupt"); err != nil || string(b) != string(corrupt) {
+		t.Fatalf("corrupt inventory not kept: %q, %v", b, err)
+	}
+	inv.Close()
+
+	// Start with no backends, so the recovered inventory can be seen.
+	lb, err := NewLoadBalancer(s.Config.LoadBalancing, NewInventory(nil, s.Config.Backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.handler = NewReverseProxyConfig(s.Config, lb)
+	if err := s.MonitorInventory(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// Corrupt the file while it is monitored.
+	os.Remove(file + ".corrupt")
+	if err := ioutil.WriteFile(file, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.handler.Status().Backends) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("snapshot was not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	restored, err := ReadInventory(file, s.Config.Backend)
+	if err != nil {
+		t.Fatal("inventory file was not restored:", err)
+	}
+	restored.Close()
+	if _, err := os.Stat(file + ".corrupt"); err != nil {
+		t.Fatal("corrupt inventory not kept:", err)
+	}
+}
+
+// Test that the inventory file is saved after provisioning,
+// and that the watcher doesn't reload the saved file.
+func TestServerSaveInventoryAfterProvisioning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doproxy-test-provision-save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "inventory.toml")
+	b, err := ioutil.ReadFile("testdata/validinventory.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer("testdata/validconfig.toml")
+	if err != nil {
+		t.Fatal("error loading config:", err)
+	}
+	s.Config.InventoryFile = file
+	s.Config.Backend.DisableHealth = true
+	inv, err := s.readInventory(file, s.Config.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLoadBalancer(s.Config.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.handler = NewReverseProxyConfig(s.Config, lb)
+	if err := s.MonitorInventory(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	current := func() *Inventory {
+		s.handler.mu.RLock()
+		defer s.handler.mu.RUnlock()
+		return s.handler.balancer.(inventoried).inventory()
+	}
+
+	// Simulate a provisioned backend.
+	d := Droplet{ID: 99, Name: "provisioned", ServerHost: "192.168.0.99:8080"}
+	if err := inv.AddBackend(NewDropletBackend(d, s.Config.Backend)); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newProvisioner(ProvisionConfig{}, lb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.save = s.saveInventory
+	if err := p.Add(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ReadInventory(file, s.Config.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved.Close()
+	if _, ok := saved.BackendID("99"); !ok {
+		t.Fatal("provisioned backend was not saved, got", saved.IDs())
+	}
+
+	// The file saved by the server must not be reloaded.
+	time.Sleep(300 * time.Millisecond)
+	if current() != inv {
+		t.Fatal("inventory saved by the server was reloaded")
+	}
+
+	// Changes by others are still reloaded.
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for current() == inv {
+		if time.Now().After(deadline) {
+			t.Fatal("changed inventory was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test that the configuration is reloaded after the file
+// has been deleted and created again.
+func TestServerWatchConfigRecreated(t *testing.T) {
+	orig, err := ioutil.ReadFile("testdata/validconfig.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "doproxy-test-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "doproxy.toml")
+	conf := strings.Replace(string(orig), "watch-config = false", "watch-config = true", 1)
+	write := func(forwarded bool) {
+		c := conf
+		if !forwarded {
+			c = strings.Replace(c, "add-x-forwarded-for = true", "add-x-forwarded-for = false", 1)
+		}
+		if err := ioutil.WriteFile(file, []byte(c), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(true)
+
+	s, err := NewServer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForwarded := func(want bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			s.mu.RLock()
+			got := s.Config.AddForwarded
+			s.mu.RUnlock()
+			if got == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("configuration with add-x-forwarded-for = %t was not applied", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Delete and create the file, like some editors do.
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	write(false)
+	waitForwarded(false)
+
+	// The new file is watched.
+	write(true)
+	waitForwarded(true)
+
+	// Replace the file by renaming another file over it.
+	tmp := filepath.Join(dir, "doproxy.toml.tmp")
+	c := strings.Replace(conf, "add-x-forwarded-for = true", "add-x-forwarded-for = false", 1)
+	if err := ioutil.WriteFile(tmp, []byte(c), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatal(err)
+	}
+	waitForwarded(false)
+	write(true)
+	waitForwarded(true)
+}
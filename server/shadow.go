@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ShadowConfig mirrors a copy of proxied requests to a separate
+// pool of backends. The responses of the shadow pool are discarded.
+type ShadowConfig struct {
+	InventoryFile string  `toml:"inventory-file"` // Inventory file or http(s) URL with the shadow backends. Empty disables mirroring.
+	SampleRate    float64 `toml:"sample-rate"`    // Fraction of requests that are mirrored. 0 mirrors all.
+}
+
+// Validate shadow configuration.
+func (c ShadowConfig) Validate() error {
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("shadow: 'sample-rate' must be between 0 and 1, was %g", c.SampleRate)
+	}
+	return nil
+}
+
+const (
+	// shadowMaxBody is the largest request body that is mirrored.
+	// Requests with larger or chunked bodies are not mirrored.
+	shadowMaxBody = 1 << 20
+
+	// shadowMaxInflight is the maximum number of mirrored
+	// requests in flight. Above this, requests are not mirrored.
+	shadowMaxInflight = 100
+
+	// shadowTimeout is the maximum time for a mirrored request.
+	shadowTimeout = 30 * time.Second
+)
+
+// loadShadow will read the shadow inventory and create a load balancer for it.
+// If mirroring is disabled, nil is returned.
+func (s *Server) loadShadow(c Config) (LoadBalancer, error) {
+	if c.Shadow.InventoryFile == "" {
+		return nil, nil
+	}
+	inv, err := s.readInventory(c.Shadow.InventoryFile, c.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("shadow: %v", err)
+	}
+	if len(inv.IDs()) == 0 {
+		s.log.Warnf("Shadow inventory %q has no backends.", c.Shadow.InventoryFile)
+	}
+	lb, err := NewLoadBalancer(c.LoadBalancing, inv)
+	if err != nil {
+		inv.Close()
+		return nil, fmt.Errorf("shadow: %v", err)
+	}
+	return lb, nil
+}
+
+// setShadow will replace the shadow load balancer.
+// If lb is nil, mirroring is disabled.
+// The previous load balancer is closed.
+func (h *ReverseProxy) setShadow(lb LoadBalancer) {
+	h.mu.Lock()
+	old := h.shadow
+	h.shadow = lb
+	h.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// mirror will send a copy of the request to a shadow backend,
+// if the request is sampled. The request body is buffered,
+// so mirror must be called before the request is sent.
+// The copy is sent in the background and the response is discarded.
+func (h *ReverseProxy) mirror(r *http.Request, conf ShadowConfig) {
+	h.mu.RLock()
+	lb, log := h.shadow, h.conf.Backend.log
+	h.mu.RUnlock()
+	if lb == nil {
+		return
+	}
+	if conf.SampleRate > 0 && rand.Float64() >= conf.SampleRate {
+		return
+	}
+	if r.ContentLength < 0 || r.ContentLength > shadowMaxBody {
+		return
+	}
+	var body []byte
+	if r.ContentLength > 0 {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			log.Warnf("Reading request body for shadow request: %v", err)
+			return
+		}
+	}
+	// The primary pool is unaffected, so this is not
+	// counted or logged as a failure of the load balancer.
+	be := tryBackend(lb, nil)
+	if be == nil {
+		atomic.AddInt64(&h.shadowMissed, 1)
+		log.Debugf("No healthy shadow backend, request to %s not mirrored", r.URL.Path)
+		return
+	}
+	if atomic.AddInt64(&h.shadowInflight, 1) > shadowMaxInflight {
+		atomic.AddInt64(&h.shadowInflight, -1)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	sr := r.Clone(ctx)
+	sr.URL.Scheme = backendScheme(be)
+	sr.URL.Host = be.Host()
+	sr.Body = http.NoBody
+	if len(body) > 0 {
+		sr.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	go func() {
+		defer atomic.AddInt64(&h.shadowInflight, -1)
+		defer cancel()
+		resp, err := be.Transport().RoundTrip(sr)
+		if err != nil {
+			log.Debugf("Shadow request to %s failed: %v", be.Host(), err)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test that requests are mirrored to the shadow pool,
+// and that the client only sees the primary response.
+func TestProxyShadow(t *testing.T) {
+	primary, closePrimary := newPool(t, "primary")
+	defer closePrimary()
+
+	type mirrored struct {
+		method, path, body string
+	}
+	got := make(chan mirrored, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got <- mirrored{r.Method, r.URL.Path, string(b)}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("shadow"))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	be := &mockBackend{backend: newBackend(bec, u.Host, "")}
+	shadow, err := NewLoadBalancer(valid_config.LoadBalancing, NewInventory([]Backend{be}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewReverseProxyConfig(valid_config, primary)
+	proxy.setShadow(shadow)
+	defer proxy.setShadow(nil)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	for _, method := range []string{"GET", "POST"} {
+		body := ""
+		if method == "POST" {
+			body = "payload"
+		}
+		req, err := http.NewRequest(method, ts.URL+"/mirror", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || string(b) != "primary" {
+			t.Fatalf("%s: expected primary response, got %d %q", method, res.StatusCode, b)
+		}
+		select {
+		case m := <-got:
+			want := mirrored{method, "/mirror", body}
+			if m != want {
+				t.Fatalf("expected mirrored request %+v, got %+v", want, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal(method, "request was not mirrored")
+		}
+	}
+
+	// Requests that are not sampled are not mirrored.
+	conf := valid_config
+	conf.Shadow.SampleRate = 1e-9
+	proxy.SetConfig(conf)
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case m := <-got:
+		t.Fatal("unexpected mirrored request", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Requests rejected by 'max-backend-requests' are not mirrored.
+	conf = valid_config
+	conf.MaxBackendRequests = 1
+	proxy.SetConfig(conf)
+	atomic.AddInt64(&proxy.inflight, 1)
+	res, err = http.Get(ts.URL)
+	atomic.AddInt64(&proxy.inflight, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("expected request to be rejected, got", res.Status)
+	}
+	select {
+	case m := <-got:
+		t.Fatal("rejected request was mirrored", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Test that requests are mirrored with TLS to HTTPS shadow backends, and
+// that no healthy shadow backend is counted apart from the primary pool.
+func TestProxyShadowHTTPSAndUnhealthy(t *testing.T) {
+	primary, closePrimary := newPool(t, "primary")
+	defer closePrimary()
+
+	secure := make(chan bool, 10)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secure <- r.TLS != nil
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	be := &mockBackend{backend: newBackend(bec, u.Host, "")}
+	be.https = true
+	be.rt.rt = srv.Client().Transport
+	shadow, err := NewLoadBalancer(valid_config.LoadBalancing, NewInventory([]Backend{be}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewReverseProxyConfig(valid_config, primary)
+	proxy.setShadow(shadow)
+	defer proxy.setShadow(nil)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case ok := <-secure:
+		if !ok {
+			t.Fatal("request was not mirrored with TLS")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+
+	// Without a healthy shadow backend the request is only counted as missed.
+	be.Stats.mu.Lock()
+	be.setHealthy(false)
+	be.Stats.mu.Unlock()
+	res, err = http.Get(ts.URL + "/mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("expected primary response, got", res.Status)
+	}
+	st := proxy.Status()
+	if st.ShadowMissed != 1 {
+		t.Fatal("expected 1 missed shadow request, got", st.ShadowMissed)
+	}
+	if st.NoHealthy != 0 {
+		t.Fatal("expected no failures of the primary pool, got", st.NoHealthy)
+	}
+	if n := shadow.Stats().NoHealthy; n != 0 {
+		t.Fatal("expected the shadow pool not to count a failure, got", n)
+	}
+}
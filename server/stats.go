@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// BackendStatus contains the current status of a single backend.
+type BackendStatus struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	Host        string        `json:"host"`
+	Healthy     bool          `json:"healthy"`
+	Degraded    bool          `json:"degraded,omitempty"` // Latency is above 'degraded-latency'.
+	Latency     time.Duration `json:"latency"`
+	FailureRate float64       `json:"failure_rate"`
+	Connections int           `json:"connections"`
+	Selected    int64         `json:"selected"`
+	Retries     int64         `json:"retries"`            // Failed requests to the backend that were retried.
+	Draining    bool          `json:"draining,omitempty"` // Receives no new requests. Open connections are in 'connections'.
+}
+
+// Status contains the current status of the proxy
+// and all its backends.
+type Status struct {
+	LBStats
+	Retries   int64           `json:"retries"`   // Requests that were retried.
+	Failovers int64           `json:"failovers"` // Retries sent to another backend than the one that failed.
+	Backends  []BackendStatus `json:"backends"`
+
+	// Requests not mirrored, since no shadow backend was healthy.
+	ShadowMissed int64 `json:"shadow_missed,omitempty"`
+}
+
+// Status returns the current status of the proxy backends.
+func (h *ReverseProxy) Status() Status {
+	h.mu.RLock()
+	lb := h.balancer
+	h.mu.RUnlock()
+	if lb == nil {
+		return Status{}
+	}
+	st := Status{
+		LBStats:   lb.Stats(),
+		Retries:   atomic.LoadInt64(&h.retries),
+		Failovers: atomic.LoadInt64(&h.failovers),
+
+		ShadowMissed: atomic.LoadInt64(&h.shadowMissed),
+	}
+	for _, be := range lb.Backends() {
+		st.Backends = append(st.Backends, backendStatus(be))
+	}
+	for _, be := range h.drainingBackends() {
+		bs := backendStatus(be)
+		bs.Draining = true
+		st.Backends = append(st.Backends, bs)
+	}
+	return st
+}
+
+// backendStatus returns the current status of a backend.
+func backendStatus(be Backend) BackendStatus {
+	bes := be.Statistics()
+	return BackendStatus{
+		ID:          be.ID(),
+		Name:        be.Name(),
+		Host:        be.Host(),
+		Healthy:     bes.Healthy,
+		Degraded:    bes.Degraded,
+		Latency:     time.Duration(bes.Latency.Value()),
+		FailureRate: bes.FailureRate.Value(),
+		Connections: be.Connections(),
+		Selected:    bes.Selected,
+		Retries:     bes.Retries,
+		Draining:    bes.Draining,
+	}
+}
+
+// ServeStats will write the current status of the proxy as JSON.
+func (h *ReverseProxy) ServeStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(h.Status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// recordRetry counts that a request that failed on the backend from
+// is retried on the backend to. If they differ, it is counted as a failover.
+func (h *ReverseProxy) recordRetry(from, to Backend) {
+	atomic.AddInt64(&h.retries, 1)
+	if from.ID() != to.ID() || from.Host() != to.Host() {
+		atomic.AddInt64(&h.failovers, 1)
+	}
+	if r, ok := from.(interface {
+		retried()
+	}); ok {
+		r.retried()
+	}
+}
+
+// FetchStatus will fetch the status from the stats
+// endpoint of a running server, using the admin token.
+// The request is sent with tr. If tr is nil, the default
+// transport is used.
+func FetchStatus(url, token string, tr http.RoundTripper) (*Status, error) {
+	resp, err := adminGet(url, token, tr)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response from server: %s", resp.Status)
+	}
+	var st Status
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// adminGet will request an admin endpoint of a running server
+// with the admin token.
+func adminGet(url, token string, tr http.RoundTripper) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := http.Client{Transport: tr, Timeout: 10 * time.Second}
+	return client.Do(req)
+}
+
+// WriteTable will write the status as a human readable table.
+func (s Status) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tNAME\tHOST\tHEALTHY\tDRAINING\tLATENCY\tFAILURES\tCONNECTIONS\tSELECTED\tRETRIES\n")
+	for _, be := range s.Backends {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%t\t%s\t%.1f%%\t%d\t%d\t%d\n", be.ID, be.Name, be.Host, be.Healthy, be.Draining, be.Latency, be.FailureRate*100, be.Connections, be.Selected, be.Retries)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "\n%d healthy, %d unhealthy, %d connections, average latency %s, %d retries, %d failovers\n", s.HealtyBackends, s.UnhealtyBackends, s.Connections, s.AvgLatency, s.Retries, s.Failovers)
+	return err
+}
+
+// drainPollInterval is how often WaitDrained polls the server.
+const drainPollInterval = 250 * time.Millisecond
+
+// WaitDrained will poll the stats endpoint of a running server,
+// until the backend with the ID has no active connections
+// or the timeout expires.
+// Backends that are not known by the server have no connections.
+// The requests are sent with tr, as with FetchStatus.
+func WaitDrained(url, token, id string, timeout time.Duration, tr http.RoundTripper) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		st, err := FetchStatus(url, token, tr)
+		if err != nil {
+			return err
+		}
+		n := st.connections(id)
+		if n == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("backend %s still has %d connections after %s", id, n, timeout)
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// connections returns the number of connections
+// to backends with the supplied ID.
+func (s Status) connections(id string) int {
+	n := 0
+	for _, be := range s.Backends {
+		if be.ID == id {
+			n += be.Connections
+		}
+	}
+	return n
+}
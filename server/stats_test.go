@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/doproxy/server/httpmock"
+)
+
+// Test that stats are fetched and formatted as a table.
+func TestFetchStatusTable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"healthy_backends":1,"unhealthy_backends":1,"avg_latency":15000000,"connections":3,"retries":5,"failovers":1,
+"backends":[{"id":"1","name":"web-1","host":"10.0.0.1:8080","healthy":true,"latency":15000000,"failure_rate":0.25,"connections":3,"selected":40,"retries":5},
+{"id":"22","name":"web-22","host":"10.0.0.22:8080","healthy":false,"latency":0,"failure_rate":0,"connections":0,"selected":2}]}`))
+	}))
+	defer ts.Close()
+
+	st, err := FetchStatus(ts.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = st.WriteTable(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `ID  NAME    HOST            HEALTHY  DRAINING  LATENCY  FAILURES  CONNECTIONS  SELECTED  RETRIES
+1   web-1   10.0.0.1:8080   true     false     15ms     25.0%     3            40        5
+22  web-22  10.0.0.22:8080  false    false     0s       0.0%      0            2         0
+
+1 healthy, 1 unhealthy, 3 connections, average latency 15ms, 5 retries, 1 failovers
+`
+	if buf.String() != expect {
+		t.Fatalf("unexpected output:\n%s\nExpected:\n%s", buf.String(), expect)
+	}
+
+	nf := httptest.NewServer(http.NotFoundHandler())
+	defer nf.Close()
+	_, err = FetchStatus(nf.URL, "", nil)
+	if err == nil {
+		t.Fatal("expected error from missing endpoint")
+	}
+}
+
+// Test that removed backends with connections are reported
+// until their connections are drained.
+func TestWaitDrained(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	httpmock.RegisterResponder("GET", func(req *http.Request) (*http.Response, error) {
+		started <- struct{}{}
+		<-release
+		return httpmock.MockResponse(req)
+	})
+	lb, err := NewLoadBalancer(LBConfig{Type: "roundrobin"}, newMockInventory(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxyConfig(*defaultConfig, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	stats := httptest.NewServer(http.HandlerFunc(proxy.ServeStats))
+	defer stats.Close()
+
+	// Start a request to the first backend.
+	done := make(chan error, 1)
+	go func() {
+		res, err := http.Get(ts.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+
+	// Remove the first backend.
+	newLB, err := NewLoadBalancer(LBConfig{Type: "roundrobin"}, NewInventory([]Backend{newMockBackend(t, 1)}, BackendConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetBackends(newLB)
+	st := proxy.Status()
+	if len(st.Backends) != 2 || !st.Backends[1].Draining || st.Backends[1].ID != "id0" {
+		t.Fatalf("expected id0 to be draining, got %+v", st.Backends)
+	}
+
+	err = WaitDrained(stats.URL, "", "id0", 100*time.Millisecond, nil)
+	if err == nil {
+		t.Fatal("expected timeout while request is running")
+	}
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		close(release)
+	}()
+	start := time.Now()
+	err = WaitDrained(stats.URL, "", "id0", 5*time.Second, nil)
+	if err != nil {
+		t.Fatal("backend was not drained:", err)
+	}
+	if time.Since(start) < 400*time.Millisecond {
+		t.Fatal("backend reported drained while request was running")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if st := proxy.Status(); len(st.Backends) != 1 {
+		t.Fatalf("expected drained backend to be removed, got %+v", st.Backends)
+	}
+
+	// Unknown backends have nothing to drain.
+	err = WaitDrained(stats.URL, "", "unknown", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that retries on another backend are counted as failovers.
+func TestRecordRetry(t *testing.T) {
+	inv := newMockInventory(t, 2)
+	defer inv.Close()
+	lb, err := NewLoadBalancer(valid_config.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxyConfig(valid_config, lb)
+	a, b := inv.backends[0], inv.backends[1]
+	proxy.recordRetry(a, a)
+	proxy.recordRetry(a, b)
+	proxy.recordRetry(b, a)
+
+	st := proxy.Status()
+	if st.Retries != 3 || st.Failovers != 2 {
+		t.Fatalf("expected 3 retries and 2 failovers, got %d and %d", st.Retries, st.Failovers)
+	}
+	// Retries are counted on the backend that failed.
+	for i, want := range []int64{2, 1} {
+		if got := st.Backends[i].Retries; got != want {
+			t.Fatalf("backend %d: expected %d retries, got %d", i, want, got)
+		}
+	}
+}
+
+// Test that draining backends receive no new requests,
+// and are reported as draining while healthy.
+func TestStatusDrainingBackend(t *testing.T) {
+	inv := newMockInventory(t, 2)
+	lb, err := NewLoadBalancer(LBConfig{Type: "roundrobin"}, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	proxy := NewReverseProxyConfig(*defaultConfig, lb)
+
+	be := inv.backends[0].(*mockBackend)
+	atomic.StoreInt64(&be.rt.running, 2)
+	be.setDraining(true)
+	for i := 0; i < 10; i++ {
+		if n := lb.Backend().(*mockBackend).n; n != 1 {
+			t.Fatal("expected draining backend to be skipped, got", n)
+		}
+	}
+
+	st := proxy.Status()
+	bs := st.Backends[0]
+	if !bs.Draining || !bs.Healthy || bs.Connections != 2 {
+		t.Fatalf("expected healthy draining backend with 2 connections, got %+v", bs)
+	}
+	if st.Backends[1].Draining {
+		t.Fatal("expected only the first backend to be draining")
+	}
+	if st.HealtyBackends != 2 {
+		t.Fatal("draining backends should still be healthy, got", st.HealtyBackends)
+	}
+
+	// When all backends are draining none is returned.
+	inv.backends[1].(*mockBackend).setDraining(true)
+	if got := lb.Backend(); got != nil {
+		t.Fatal("expected no backend, got", got.ID())
+	}
+	be.setDraining(false)
+	if n := lb.Backend().(*mockBackend).n; n != 0 {
+		t.Fatal("expected backend 0 after draining stopped, got", n)
+	}
+}
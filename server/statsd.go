@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsdConfig contains settings for sending metrics to statsd.
+type StatsdConfig struct {
+	Address    string  `toml:"address"`     // UDP address of the statsd server. Empty disables metrics.
+	Prefix     string  `toml:"prefix"`      // Prefix added to all metric names.
+	SampleRate float64 `toml:"sample-rate"` // Fraction of requests that are sent. 0 sends all.
+}
+
+// Validate statsd configuration.
+func (c StatsdConfig) Validate() error {
+	if c.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return fmt.Errorf("statsd: invalid 'address' = '%s': %v", c.Address, err)
+		}
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("statsd: 'sample-rate' must be between 0 and 1, was %g", c.SampleRate)
+	}
+	return nil
+}
+
+// statsd sends metrics to a statsd server.
+// Metrics are sent as UDP packets, so lost
+// packets and errors are ignored.
+type statsd struct {
+	conn   net.Conn
+	prefix string
+	rate   float64
+}
+
+// serverMetrics is the statsd client of a server.
+// It is passed to the proxy and backends of the server
+// with the backend configuration.
+// If no address is configured, client is nil.
+// A nil *serverMetrics sends no metrics.
+type serverMetrics struct {
+	mu     sync.RWMutex
+	client *statsd
+}
+
+// set will start sending metrics to the configured address.
+// If the address is empty, no metrics are sent.
+// The previous client is closed.
+func (m *serverMetrics) set(c StatsdConfig) error {
+	var client *statsd
+	if c.Address != "" {
+		conn, err := net.Dial("udp", c.Address)
+		if err != nil {
+			return fmt.Errorf("statsd: %v", err)
+		}
+		client = &statsd{conn: conn, prefix: c.Prefix, rate: c.SampleRate}
+		if client.rate == 0 {
+			client.rate = 1
+		}
+	}
+	m.mu.Lock()
+	old := m.client
+	m.client = client
+	m.mu.Unlock()
+	if old != nil {
+		old.conn.Close()
+	}
+	return nil
+}
+
+// get returns the current statsd client.
+// If metrics are disabled, nil is returned.
+func (m *serverMetrics) get() *statsd {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	c := m.client
+	m.mu.RUnlock()
+	return c
+}
+
+// send will send a single metric.
+// If rate is below 1, the metric is only sent with
+// that probability, and the rate is added to the metric.
+func (s *statsd) send(name, value, typ string, rate float64) {
+	line := s.prefix + name + ":" + value + "|" + typ
+	if rate < 1 {
+		if rand.Float64() >= rate {
+			return
+		}
+		line += fmt.Sprintf("|@%g", rate)
+	}
+	s.conn.Write([]byte(line))
+}
+
+// timing sends a sampled duration in milliseconds.
+func (s *statsd) timing(name string, d time.Duration) {
+	s.send(name, fmt.Sprintf("%g", float64(d)/float64(time.Millisecond)), "ms", s.rate)
+}
+
+// count sends a sampled counter increment.
+func (s *statsd) count(name string, n int) {
+	s.send(name, fmt.Sprint(n), "c", s.rate)
+}
+
+// gauge sends the current value of a gauge.
+// Gauges are never sampled.
+func (s *statsd) gauge(name string, v float64) {
+	s.send(name, fmt.Sprintf("%g", v), "g", 1)
+}
+
+// request sends the duration and status of a proxied request.
+func (s *statsd) request(start time.Time, status int) {
+	s.timing("request.duration", time.Since(start))
+	s.count(fmt.Sprintf("request.status.%d", status), 1)
+}
+
+// backend sends the current state of a backend.
+func (s *statsd) backend(host string, conns int, latency time.Duration, healthy, draining bool) {
+	name := "backend." + metricName(host) + "."
+	s.gauge(name+"connections", float64(conns))
+	s.gauge(name+"latency", float64(latency)/float64(time.Millisecond))
+	s.gauge(name+"healthy", boolGauge(healthy))
+	s.gauge(name+"draining", boolGauge(draining))
+}
+
+// boolGauge returns the gauge value of a boolean.
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// metricName replaces characters that have a
+// special meaning in statsd metric names.
+var metricName = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_").Replace
+
+// statusWriter records the status code written to the client.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush will flush the underlying writer, if it supports it.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack the underlying connection. The status is
+// recorded as "101 Switching Protocols".
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("cannot hijack writer")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
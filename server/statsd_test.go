@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/doproxy/server/httpmock"
+)
+
+// listenStatsd starts a UDP listener and returns a channel
+// with the metric lines received.
+func listenStatsd(t *testing.T) (string, <-chan string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				close(lines)
+				return
+			}
+			select {
+			case lines <- string(buf[:n]):
+			default:
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), lines, func() { conn.Close() }
+}
+
+// expectLines will wait for all the expected lines.
+// Other lines are ignored, since backends of other tests
+// may still be sending.
+func expectLines(t *testing.T, lines <-chan string, expect ...string) {
+	missing := make(map[string]bool, len(expect))
+	for _, e := range expect {
+		missing[e] = true
+	}
+	timeout := time.After(5 * time.Second)
+	for len(missing) > 0 {
+		select {
+		case l := <-lines:
+			delete(missing, l)
+		case <-timeout:
+			t.Fatalf("did not receive metrics %v", missing)
+		}
+	}
+}
+
+// Test that requests and backend state are sent to statsd.
+func TestStatsd(t *testing.T) {
+	addr, lines, closeFn := listenStatsd(t)
+	defer closeFn()
+	m := &serverMetrics{}
+	err := m.set(StatsdConfig{Address: addr, Prefix: "test."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.set(StatsdConfig{})
+
+	inv := newMockInventory(t, 1)
+	httpmock.RegisterResponder("GET", httpmock.MockResponse)
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	conf := *defaultConfig
+	conf.Backend.metrics = m
+	proxy := NewReverseProxyConfig(conf, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/somepath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	var duration string
+	timeout := time.After(5 * time.Second)
+	for duration == "" {
+		select {
+		case l := <-lines:
+			if strings.HasPrefix(l, "test.request.duration:") {
+				duration = l
+			}
+		case <-timeout:
+			t.Fatal("did not receive request duration")
+		}
+	}
+	if !strings.HasSuffix(duration, "|ms") {
+		t.Errorf("expected timing, got %q", duration)
+	}
+	expectLines(t, lines, "test.request.status.200:1|c")
+
+	// Backend gauges are sent by the monitor.
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	bec.metrics = m
+	b := newBackend(bec, "10.0.0.1:8080", "")
+	defer b.Close()
+	b.update(time.Second)
+	expectLines(t, lines,
+		"test.backend.10_0_0_1_8080.connections:0|g",
+		"test.backend.10_0_0_1_8080.latency:0|g",
+		"test.backend.10_0_0_1_8080.healthy:1|g",
+		"test.backend.10_0_0_1_8080.draining:0|g",
+	)
+}
+
+// Test that sampled metrics carry the sample rate.
+func TestStatsdSampleRate(t *testing.T) {
+	addr, lines, closeFn := listenStatsd(t)
+	defer closeFn()
+	var m serverMetrics
+	err := m.set(StatsdConfig{Address: addr, Prefix: "rate.", SampleRate: 0.999999})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.set(StatsdConfig{})
+
+	c := m.get()
+	c.count("hits", 1)
+	c.gauge("level", 2)
+	expectLines(t, lines, "rate.hits:1|c|@0.999999", "rate.level:2|g")
+}
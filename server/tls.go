@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// clientAuthTypes maps 'tls-client-auth' values to
+// the client certificate policy.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                   tls.NoClientCert,
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+// TLSConfig returns the TLS configuration for the frontend.
+// The server certificate is not loaded.
+func (c Config) TLSConfig() (*tls.Config, error) {
+	auth, ok := clientAuthTypes[c.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown 'tls-client-auth' = '%s'", c.ClientAuth)
+	}
+	tc := &tls.Config{ClientAuth: auth}
+	if c.ClientCAFile != "" {
+		pool, err := loadCertPool(c.ClientCAFile, "tls-client-ca-file")
+		if err != nil {
+			return nil, err
+		}
+		tc.ClientCAs = pool
+	}
+	if c.CertDir != "" {
+		certs, err := loadCertDir(c.CertDir)
+		if err != nil {
+			return nil, err
+		}
+		tc.GetCertificate = certs.GetCertificate
+	}
+	return tc, nil
+}
+
+// HealthTLSConfig returns the TLS configuration used
+// for health checks. If no settings are changed, nil is returned.
+func (c BackendConfig) HealthTLSConfig() (*tls.Config, error) {
+	if !c.HealthInsecure && c.HealthCAFile == "" {
+		return nil, nil
+	}
+	tc := &tls.Config{InsecureSkipVerify: c.HealthInsecure}
+	if c.HealthCAFile != "" {
+		pool, err := loadCertPool(c.HealthCAFile, "health-check-ca-file")
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	return tc, nil
+}
+
+// loadCertPool will load the PEM encoded certificates in file.
+// The setting is used in the error if no certificates are found.
+func loadCertPool(file, setting string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in '%s' = '%s'", setting, file)
+	}
+	return pool, nil
+}
+
+// certStore contains certificates indexed by the
+// host names they are valid for.
+type certStore map[string]*tls.Certificate
+
+// loadCertDir will load all certificates in a directory.
+// Each certificate "name.crt" must have a matching key in "name.key".
+// Certificates are indexed by their DNS names, or their
+// common name if they have none.
+func loadCertDir(dir string) (certStore, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	certs := make(certStore)
+	for _, certFile := range files {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate %s: %v", certFile, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate %s: %v", certFile, err)
+		}
+		cert.Leaf = leaf
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			certs[strings.ToLower(name)] = &cert
+		}
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in 'tls-cert-dir' = '%s'", dir)
+	}
+	return certs, nil
+}
+
+// GetCertificate returns the certificate matching the server name
+// requested by the client. A wildcard certificate is used if there
+// is no exact match. If no certificate matches, nil is returned and
+// the default certificate is used.
+func (c certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert, ok := c[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := c["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return nil, nil
+}
+
+// isDir returns an error if the path is not a directory.
+func isDir(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/doproxy/server/httpmock"
+)
+
+// newTestCert will create a certificate signed by parent.
+// If parent is nil, a self-signed CA is created.
+func newTestCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	signer, signKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer = parent.Leaf
+		signKey = parent.PrivateKey.(*ecdsa.PrivateKey)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// Test that client certificates are required and verified.
+func TestProxyClientCert(t *testing.T) {
+	ca := newTestCert(t, "test ca", nil)
+	client := newTestCert(t, "test client", &ca)
+	other := newTestCert(t, "other client", nil)
+
+	caFile := filepath.Join(os.TempDir(), "doproxy-test-client-ca.pem")
+	err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile)
+
+	var subject = make(chan string, 1)
+	responder := func(req *http.Request) (*http.Response, error) {
+		subject <- req.Header.Get("X-Client-Subject")
+		return httpmock.MockResponse(req)
+	}
+	httpmock.RegisterResponder("GET", responder)
+
+	inv := newMockInventory(t, 3)
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := *defaultConfig
+	conf.ClientCAFile = caFile
+	conf.ClientAuth = "require-and-verify"
+	conf.ClientCertHdr = "X-Client-Subject"
+	err = conf.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc, err := conf.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(NewReverseProxyConfig(conf, lb))
+	ts.TLS = tc
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(cert *tls.Certificate) (*http.Response, error) {
+		tr := ts.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			tr.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Client-Subject", "spoofed")
+		return (&http.Client{Transport: tr}).Do(req)
+	}
+
+	res, err := get(&client)
+	if err != nil {
+		t.Fatal("request with valid client certificate failed:", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected status code", res.StatusCode)
+	}
+	if got := <-subject; got != "CN=test client" {
+		t.Fatalf("expected client subject %q, got %q", "CN=test client", got)
+	}
+
+	_, err = get(nil)
+	if err == nil {
+		t.Fatal("request without client certificate was accepted")
+	}
+	_, err = get(&other)
+	if err == nil {
+		t.Fatal("request with untrusted client certificate was accepted")
+	}
+}
+
+// writeTestCert will write the certificate and key as PEM files.
+func writeTestCert(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that certificates in 'tls-cert-dir' are selected by SNI.
+func TestServerCertDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doproxy-test-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, newTestCert(t, "a.example.com", nil), filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"))
+	writeTestCert(t, newTestCert(t, "*.b.example.com", nil), filepath.Join(dir, "b.crt"), filepath.Join(dir, "b.key"))
+	certFile, keyFile := filepath.Join(dir, "default.pem"), filepath.Join(dir, "default-key.pem")
+	writeTestCert(t, newTestCert(t, "default", nil), certFile, keyFile)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := ListenerConfig{Bind: ln.Addr().String(), Https: true, CertFile: certFile, KeyFile: keyFile}
+	s := &Server{Config: Config{Listener: []ListenerConfig{l}, CertDir: dir}}
+	go s.serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), ln)
+
+	tests := []struct {
+		name   string
+		expect string
+	}{
+		{name: "a.example.com", expect: "a.example.com"},
+		{name: "A.Example.COM", expect: "a.example.com"},
+		{name: "www.b.example.com", expect: "*.b.example.com"},
+		{name: "b.example.com", expect: "default"},
+		{name: "c.example.com", expect: "default"},
+		{name: "", expect: "default"},
+	}
+	for _, test := range tests {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: test.name, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+		if got != test.expect {
+			t.Errorf("%q: expected certificate %q, got %q", test.name, test.expect, got)
+		}
+	}
+}
+
+// Test that health checks can use self-signed certificates,
+// if verification is disabled or the CA is supplied.
+func TestHealthCheckTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "doproxy-test-health-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		insecure bool
+		caFile   string
+		healthy  bool
+	}{
+		{healthy: false},
+		{insecure: true, healthy: true},
+		{caFile: caFile, healthy: true},
+	}
+	for i, test := range tests {
+		bec := valid_config.Backend
+		bec.DisableHealth = true
+		bec.HealthInsecure = test.insecure
+		bec.HealthCAFile = test.caFile
+		if err := bec.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		b := newBackend(bec, ts.Listener.Addr().String(), ts.URL)
+		if got := b.checkHealth(); got != test.healthy {
+			t.Errorf("test %d: expected healthy %v, got %v", i, test.healthy, got)
+		}
+		// Requests to the backend are not affected.
+		if tc := b.rt.rt.(*http.Transport).TLSClientConfig; tc != nil {
+			t.Errorf("test %d: health check TLS settings used for requests: %+v", i, tc)
+		}
+		b.Close()
+	}
+
+	// A file without certificates is rejected.
+	bec := valid_config.Backend
+	bec.HealthCAFile = filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(bec.HealthCAFile, nil, 0600)
+	if err := bec.Validate(); err == nil {
+		t.Fatal("expected error on CA file without certificates")
+	}
+}
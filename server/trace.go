@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TracingConfig contains settings for sending
+// OpenTelemetry traces of proxied requests.
+type TracingConfig struct {
+	Endpoint    string `toml:"endpoint"`     // OTLP/HTTP traces endpoint. Empty disables tracing.
+	ServiceName string `toml:"service-name"` // Service name of the spans. Default is "doproxy".
+}
+
+// Validate tracing configuration.
+func (c TracingConfig) Validate() error {
+	if c.Endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("tracing: 'endpoint' = '%s' must be a http(s) URL", c.Endpoint)
+	}
+	return nil
+}
+
+// Span is a single proxied request.
+type Span struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte // Zero if the request had no valid 'traceparent'.
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{} // Values are strings or ints.
+	Error      bool
+}
+
+// SpanExporter receives finished spans.
+// ExportSpan must not block.
+type SpanExporter interface {
+	ExportSpan(s *Span)
+}
+
+// serverTracer is the exporter of spans of a server.
+// It is passed to the proxy of the server with the
+// backend configuration.
+// If tracing is disabled, exporter is nil.
+// A nil *serverTracer exports no spans.
+type serverTracer struct {
+	mu       sync.RWMutex
+	exporter SpanExporter
+}
+
+// set will start exporting spans to the configured endpoint.
+// If the endpoint is empty, tracing is disabled.
+// Errors sending spans are logged to log.
+func (t *serverTracer) set(c TracingConfig, log *serverLog) {
+	var e SpanExporter
+	if c.Endpoint != "" {
+		e = newOTLPExporter(c, log)
+	}
+	t.setExporter(e)
+}
+
+// setExporter will send spans to e.
+// If e is nil, tracing is disabled.
+// The previous exporter is closed, if it can be.
+func (t *serverTracer) setExporter(e SpanExporter) {
+	t.mu.Lock()
+	old := t.exporter
+	t.exporter = e
+	t.mu.Unlock()
+	if c, ok := old.(interface {
+		Close()
+	}); ok {
+		c.Close()
+	}
+}
+
+// get returns the current exporter or nil.
+func (t *serverTracer) get() SpanExporter {
+	if t == nil {
+		return nil
+	}
+	t.mu.RLock()
+	e := t.exporter
+	t.mu.RUnlock()
+	return e
+}
+
+// startSpan starts a span for the request.
+// If the request has a valid 'traceparent' header, the span
+// continues that trace. The header is replaced, so the backend
+// will see the new span as parent.
+func startSpan(r *http.Request) *Span {
+	s := &Span{
+		Name:  "proxy " + r.Method,
+		Start: time.Now(),
+		Attributes: map[string]interface{}{
+			"http.method": r.Method,
+			"http.target": r.URL.Path,
+			"http.host":   r.Host,
+		},
+	}
+	if tid, pid, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.TraceID, s.ParentID = tid, pid
+	} else {
+		rand.Read(s.TraceID[:])
+	}
+	rand.Read(s.SpanID[:])
+	r.Header.Set("traceparent", s.traceparent())
+	return s
+}
+
+// traceparent returns the W3C trace context header of the span.
+func (s *Span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.TraceID[:]) + "-" + hex.EncodeToString(s.SpanID[:]) + "-01"
+}
+
+// parseTraceparent parses a W3C 'traceparent' header.
+// Invalid headers and all zero IDs are rejected.
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false
+	}
+	if traceID == ([16]byte{}) || parentID == ([8]byte{}) {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, true
+}
+
+// finish will set the status and send the span to the exporter.
+func (s *Span) finish(e SpanExporter, status int) {
+	s.End = time.Now()
+	s.Attributes["http.status_code"] = status
+	s.Error = status >= 500
+	e.ExportSpan(s)
+}
+
+// otlpExporter sends spans to an OTLP/HTTP endpoint as JSON.
+// Spans are sent in batches. If the queue is full, spans are dropped.
+type otlpExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	queue    chan *Span
+	done     chan struct{}
+	once     sync.Once
+	log      *serverLog // Errors sending spans are logged here.
+}
+
+const (
+	otlpQueueSize = 1000
+	otlpBatchSize = 100
+	otlpInterval  = time.Second
+)
+
+func newOTLPExporter(c TracingConfig, log *serverLog) *otlpExporter {
+	e := &otlpExporter{
+		endpoint: c.Endpoint,
+		service:  c.ServiceName,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, otlpQueueSize),
+		done:     make(chan struct{}),
+		log:      log,
+	}
+	if e.service == "" {
+		e.service = "doproxy"
+	}
+	go e.run()
+	return e
+}
+
+// ExportSpan queues the span for sending.
+func (e *otlpExporter) ExportSpan(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+// Close will send queued spans and stop the exporter.
+func (e *otlpExporter) Close() {
+	e.once.Do(func() { close(e.done) })
+}
+
+// run sends batches until the exporter is closed.
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(otlpInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.done:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			e.send(batch)
+			return
+		}
+		e.send(batch)
+		batch = nil
+	}
+}
+
+// send will post the spans to the endpoint.
+func (e *otlpExporter) send(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+	b, err := json.Marshal(otlpRequest(e.service, spans))
+	if err != nil {
+		e.log.Errorf("Encoding traces: %v", err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		e.log.Warnf("Sending traces to %s: %v", e.endpoint, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		e.log.Warnf("Sending traces to %s: status %s", e.endpoint, resp.Status)
+	}
+}
+
+// otlpRequest returns the spans in the OTLP JSON encoding.
+func otlpRequest(service string, spans []*Span) interface{} {
+	type obj = map[string]interface{}
+	attrs := func(m map[string]interface{}) []obj {
+		res := make([]obj, 0, len(m))
+		for k, v := range m {
+			switch v := v.(type) {
+			case int:
+				res = append(res, obj{"key": k, "value": obj{"intValue": strconv.Itoa(v)}})
+			default:
+				res = append(res, obj{"key": k, "value": obj{"stringValue": fmt.Sprint(v)}})
+			}
+		}
+		return res
+	}
+	out := make([]obj, 0, len(spans))
+	for _, s := range spans {
+		span := obj{
+			"traceId":           hex.EncodeToString(s.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.SpanID[:]),
+			"name":              s.Name,
+			"kind":              2, // Server
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        attrs(s.Attributes),
+		}
+		if s.ParentID != ([8]byte{}) {
+			span["parentSpanId"] = hex.EncodeToString(s.ParentID[:])
+		}
+		if s.Error {
+			span["status"] = obj{"code": 2}
+		}
+		out = append(out, span)
+	}
+	return obj{"resourceSpans": []obj{{
+		"resource":   obj{"attributes": attrs(map[string]interface{}{"service.name": service})},
+		"scopeSpans": []obj{{"scope": obj{"name": "doproxy"}, "spans": out}},
+	}}}
+}
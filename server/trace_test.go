@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/doproxy/server/httpmock"
+)
+
+// memoryExporter keeps exported spans in memory.
+type memoryExporter chan *Span
+
+func (m memoryExporter) ExportSpan(s *Span) { m <- s }
+
+// Test that proxied requests are traced.
+func TestProxyTracing(t *testing.T) {
+	spans := make(memoryExporter, 10)
+	var tracer serverTracer
+	tracer.setExporter(spans)
+
+	inv := newMockInventory(t, 1)
+	sent := make(chan string, 1)
+	httpmock.RegisterResponder("GET", func(req *http.Request) (*http.Response, error) {
+		sent <- req.Header.Get("traceparent")
+		return httpmock.MockResponse(req)
+	})
+	lb, err := NewLoadBalancer(defaultConfig.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	conf := *defaultConfig
+	conf.Backend.tracer = &tracer
+	ts := httptest.NewServer(NewReverseProxyConfig(conf, lb))
+	defer ts.Close()
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, err := http.NewRequest("GET", ts.URL+"/somepath", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", parent)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	var s *Span
+	select {
+	case s = <-spans:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no span was exported")
+	}
+	if got := hex.EncodeToString(s.TraceID[:]); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Error("trace was not continued, got trace id", got)
+	}
+	if got := hex.EncodeToString(s.ParentID[:]); got != "00f067aa0ba902b7" {
+		t.Error("unexpected parent id", got)
+	}
+	if got := <-sent; got != s.traceparent() {
+		t.Errorf("backend got traceparent %q, expected %q", got, s.traceparent())
+	}
+	expect := map[string]interface{}{
+		"http.method":      "GET",
+		"http.target":      "/somepath",
+		"http.status_code": 200,
+		"backend.id":       "id0",
+		"backend.host":     "",
+	}
+	for k, v := range expect {
+		if s.Attributes[k] != v {
+			t.Errorf("attribute %q: expected %v, got %v", k, v, s.Attributes[k])
+		}
+	}
+	if s.End.Before(s.Start) {
+		t.Error("span ended before it started")
+	}
+
+	// Without a valid parent, a new trace is started.
+	req.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	<-sent
+	s = <-spans
+	if s.TraceID == ([16]byte{}) || s.ParentID != ([8]byte{}) {
+		t.Errorf("expected new trace without parent, got %x/%x", s.TraceID, s.ParentID)
+	}
+}
+
+// Test that spans are sent to an OTLP endpoint.
+func TestOTLPExporter(t *testing.T) {
+	got := make(chan []byte, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got <- b
+	}))
+	defer ts.Close()
+
+	e := newOTLPExporter(TracingConfig{Endpoint: ts.URL, ServiceName: "test"}, nil)
+	s := &Span{Name: "proxy GET", Start: time.Now(), Attributes: map[string]interface{}{"http.method": "GET"}}
+	s.TraceID[0], s.SpanID[0] = 1, 2
+	s.finish(e, 502)
+	e.Close()
+
+	var b []byte
+	select {
+	case b = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no traces were sent")
+	}
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID    string `json:"traceId"`
+					SpanID     string `json:"spanId"`
+					Name       string `json:"name"`
+					Attributes []struct {
+						Key   string
+						Value map[string]string
+					}
+					Status struct {
+						Code int
+					}
+				}
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		t.Fatal(err)
+	}
+	span := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if !strings.HasPrefix(span.TraceID, "01") || !strings.HasPrefix(span.SpanID, "02") || span.Name != "proxy GET" {
+		t.Errorf("unexpected span %+v", span)
+	}
+	if span.Status.Code != 2 {
+		t.Error("expected error status, got", span.Status.Code)
+	}
+	attrs := map[string]map[string]string{}
+	for _, a := range span.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	if attrs["http.status_code"]["intValue"] != "502" || attrs["http.method"]["stringValue"] != "GET" {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"time"
+
+	"github.com/klauspost/shutdown"
+)
+
+// destroyDroplet destroys a droplet. Replaceable for tests.
+var destroyDroplet = func(conf Config, d Droplet) error {
+	return d.Delete(conf)
+}
+
+// monitorUnhealthy will apply 'unhealthy-action' to backends
+// every health check interval, until the server is stopped.
+func (s *Server) monitorUnhealthy() {
+	stop := make(chan struct{})
+	s.mu.Lock()
+	s.stopUnhealthy = stop
+	s.mu.Unlock()
+
+	go func() {
+		exit := shutdown.First()
+		ticker := time.NewTicker(healthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.removeUnhealthy()
+			case n := <-exit:
+				close(n)
+				return
+			case <-stop:
+				exit.Cancel()
+				return
+			}
+		}
+	}()
+}
+
+// removeUnhealthy will remove unhealthy backends that have failed
+// 'unhealthy-remove-after' consecutive health checks from the inventory,
+// and destroy the droplets if 'unhealthy-action' is "destroy".
+// If backends are removed and the inventory is a file, it is saved.
+// The IDs of the removed backends are returned.
+func (s *Server) removeUnhealthy() []string {
+	s.mu.RLock()
+	conf := s.Config
+	s.mu.RUnlock()
+	action := conf.Provision.UnhealthyAction
+	after := conf.Provision.UnhealthyRemoveAfter
+	if (action != "remove" && action != "destroy") || after <= unhealthyFailures {
+		return nil
+	}
+
+	s.handler.mu.RLock()
+	lb, ok := s.handler.balancer.(inventoried)
+	s.handler.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	inv := lb.inventory()
+	backends := inv.list()
+
+	var removed []string
+	for _, be := range backends {
+		f, ok := be.(interface {
+			failures() int
+		})
+		if !ok || be.Healthy() || f.failures() < after {
+			continue
+		}
+		id := be.ID()
+		s.log.Warnf("%s: %d consecutive health checks failed. Removing backend %q.", be.Host(), f.failures(), id)
+		if err := inv.Remove(id); err != nil {
+			s.log.Errorf("Removing unhealthy backend: %v", err)
+			continue
+		}
+		removed = append(removed, id)
+		if action != "destroy" {
+			continue
+		}
+		d, ok := be.(*DropletBackend)
+		if !ok {
+			continue
+		}
+		if err := destroyDroplet(conf, d.Droplet); err != nil {
+			s.log.Errorf("Destroying unhealthy droplet %d: %v", d.Droplet.ID, err)
+			continue
+		}
+		s.log.Infof("Droplet %d %q destroyed", d.Droplet.ID, d.Droplet.Name)
+	}
+	if len(removed) > 0 {
+		if err := s.saveInventory(); err != nil {
+			s.log.Errorf("Saving inventory after removing unhealthy backends: %v", err)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Test that backends failing too many health checks are
+// handled according to 'unhealthy-action'.
+func TestRemoveUnhealthy(t *testing.T) {
+	const inventory = `
+[[droplet]]
+id = 1
+name = "failing"
+server-host = "127.0.0.1:1"
+
+[[droplet]]
+id = 2
+name = "healthy"
+server-host = "127.0.0.1:2"
+`
+	var destroyed []int
+	defer func(f func(Config, Droplet) error) { destroyDroplet = f }(destroyDroplet)
+	destroyDroplet = func(conf Config, d Droplet) error {
+		destroyed = append(destroyed, d.ID)
+		return nil
+	}
+
+	dir, err := ioutil.TempDir("", "doproxy-test-unhealthy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, action := range []string{"keep", "remove", "destroy"} {
+		destroyed = nil
+		file := filepath.Join(dir, action+".toml")
+		if err := ioutil.WriteFile(file, []byte(inventory), 0600); err != nil {
+			t.Fatal(err)
+		}
+		conf := valid_config
+		conf.InventoryFile = file
+		conf.Backend.DisableHealth = true
+		conf.Provision.UnhealthyRemoveAfter = 10
+		conf.Provision.UnhealthyAction = action
+		inv, err := ReadInventory(file, conf.Backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lb, err := NewLoadBalancer(conf.LoadBalancing, inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{Config: conf, handler: NewReverseProxyConfig(conf, lb)}
+
+		failing, _ := inv.BackendID("1")
+		fb := failing.(*DropletBackend)
+		st := &fb.Stats
+		st.mu.Lock()
+		st.healthFailures = 9
+		fb.setHealthy(false)
+		st.mu.Unlock()
+
+		// Below the threshold nothing is removed.
+		if removed := s.removeUnhealthy(); len(removed) != 0 {
+			t.Fatalf("%s: removed %v before reaching 'unhealthy-remove-after'", action, removed)
+		}
+
+		// Healthy backends are never removed.
+		healthy, _ := inv.BackendID("2")
+		hst := &healthy.(*DropletBackend).Stats
+		hst.mu.Lock()
+		hst.healthFailures = 10
+		hst.mu.Unlock()
+
+		st.mu.Lock()
+		st.healthFailures = 10
+		st.mu.Unlock()
+		removed := s.removeUnhealthy()
+
+		saved, err := ReadInventory(file, conf.Backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch action {
+		case "keep":
+			if len(removed) != 0 || len(inv.IDs()) != 2 || len(saved.IDs()) != 2 {
+				t.Errorf("keep: backend was removed")
+			}
+		default:
+			if !reflect.DeepEqual(removed, []string{"1"}) {
+				t.Errorf("%s: expected backend 1 to be removed, got %v", action, removed)
+			}
+			if ids := inv.IDs(); !reflect.DeepEqual(ids, []string{"2"}) {
+				t.Errorf("%s: unexpected inventory %v", action, ids)
+			}
+			if ids := saved.IDs(); !reflect.DeepEqual(ids, []string{"2"}) {
+				t.Errorf("%s: unexpected saved inventory %v", action, ids)
+			}
+		}
+		expect := []int(nil)
+		if action == "destroy" {
+			expect = []int{1}
+		}
+		if !reflect.DeepEqual(destroyed, expect) {
+			t.Errorf("%s: expected destroyed droplets %v, got %v", action, expect, destroyed)
+		}
+		saved.Close()
+		lb.Close()
+	}
+}
+
+// Test that nothing is removed without 'unhealthy-remove-after',
+// even if provisioning is disabled.
+func TestRemoveUnhealthyThreshold(t *testing.T) {
+	conf := valid_config
+	conf.Provision.Enable = false
+	conf.Provision.UnhealthyAction = "remove"
+	if err := conf.Validate(); err == nil {
+		t.Fatal("expected 'unhealthy-remove-after' to be required")
+	}
+	inv := newMockInventory(t, 2)
+	defer inv.Close()
+	lb, err := NewLoadBalancer(conf.LoadBalancing, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: conf, handler: NewReverseProxyConfig(conf, lb)}
+	if removed := s.removeUnhealthy(); len(removed) != 0 {
+		t.Fatal("removed backends without a threshold:", removed)
+	}
+	if n := len(inv.IDs()); n != 2 {
+		t.Fatal("expected 2 backends, got", n)
+	}
+}
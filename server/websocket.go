@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// errWSTooLarge is returned when a websocket connection
+// has transferred more than the configured maximum.
+var errWSTooLarge = fmt.Errorf("websocket connection exceeded maximum size")
+
+// wsDial connects to a websocket backend. Replaceable for tests.
+var wsDial = net.DialTimeout
+
+// dialWebSocket connects to the backend.
+// Failed attempts are retried up to 'dial-attempts' times.
+// The wait between attempts starts at 'dial-backoff' and is doubled
+// after every attempt. If ctx is cancelled, the last error is returned.
+// Before every new attempt next is called with the backend that failed
+// and returns the backend to try next.
+// The backend that was used last is returned.
+func dialWebSocket(ctx context.Context, conf WebSocketConfig, log *serverLog, be Backend, next func(failed Backend) Backend) (net.Conn, Backend, error) {
+	wait := time.Duration(conf.DialBackoff)
+	if wait <= 0 {
+		wait = 100 * time.Millisecond
+	}
+	for i := 1; ; i++ {
+		c, err := dialBackend(be)
+		if err == nil || i >= conf.DialAttempts {
+			return c, be, err
+		}
+		log.Debugf("Websocket connection to %s failed (attempt %d): %v", be.Host(), i, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, be, err
+		}
+		be = next(be)
+		wait *= 2
+	}
+}
+
+// dialBackend connects to the backend for requests that
+// don't use its transport. Backends that don't know how
+// to connect are connected without TLS and timeout.
+func dialBackend(be Backend) (net.Conn, error) {
+	if d, ok := be.(interface {
+		dial() (net.Conn, error)
+	}); ok {
+		return d.dial()
+	}
+	return wsDial("tcp", be.Host(), 0)
+}
+
+// wsLimits enforces the idle timeout and size limit
+// of a proxied websocket connection.
+type wsLimits struct {
+	conf  WebSocketConfig
+	conns []net.Conn
+}
+
+// newWSLimits returns limits for the connections.
+// If an idle timeout is configured, the initial deadline is set.
+func newWSLimits(conf WebSocketConfig, conns ...net.Conn) *wsLimits {
+	w := &wsLimits{conf: conf, conns: conns}
+	w.touch()
+	return w
+}
+
+// touch will extend the read deadline of all connections,
+// since there has been activity.
+func (w *wsLimits) touch() {
+	if w.conf.IdleTimeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(time.Duration(w.conf.IdleTimeout))
+	for _, c := range w.conns {
+		c.SetReadDeadline(deadline)
+	}
+}
+
+// reader returns a reader for the connection that
+// enforces the limits.
+func (w *wsLimits) reader(c net.Conn) *wsReader {
+	return &wsReader{limits: w, conn: c, remain: w.conf.MaxBytes}
+}
+
+// wsReader reads from a websocket connection.
+// Activity in either direction keeps both directions alive.
+type wsReader struct {
+	limits *wsLimits
+	conn   net.Conn
+	remain int64 // Bytes remaining, if MaxBytes is set.
+}
+
+func (r *wsReader) Read(p []byte) (int, error) {
+	if r.limits.conf.MaxBytes > 0 {
+		if r.remain <= 0 {
+			return 0, errWSTooLarge
+		}
+		if int64(len(p)) > r.remain {
+			p = p[:r.remain]
+		}
+	}
+	n, err := r.conn.Read(p)
+	if n > 0 {
+		r.remain -= int64(n)
+		r.limits.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWSBackend starts a backend that accepts websocket upgrades
+// and echoes everything it receives.
+func newWSBackend(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				_, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				fmt.Fprint(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+				io.Copy(c, br)
+			}(c)
+		}
+	}()
+	return ln
+}
+
+// dialWS will connect to the proxy and upgrade to websocket.
+func dialWS(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(c, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("unexpected status code", res.StatusCode)
+	}
+	return c, br
+}
+
+// Test that idle websocket connections are closed and
+// that connections exceeding the maximum size are closed.
+func TestProxyWebSocketLimits(t *testing.T) {
+	ln := newWSBackend(t)
+	defer ln.Close()
+
+	conf := valid_config
+	conf.WebSocket = WebSocketConfig{IdleTimeout: Duration(300 * time.Millisecond), MaxBytes: 100}
+	bec := conf.Backend
+	bec.DisableHealth = true
+	be := &mockBackend{backend: newBackend(bec, ln.Addr().String(), "")}
+	lb, err := NewLoadBalancer(conf.LoadBalancing, NewInventory([]Backend{be}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	ts := httptest.NewServer(NewReverseProxyConfig(conf, lb))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	// Traffic keeps the connection alive.
+	c, br := dialWS(t, addr)
+	defer c.Close()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(c, "ping\n")
+		line, err := br.ReadString('\n')
+		if err != nil || line != "ping\n" {
+			t.Fatalf("unexpected echo %q: %v", line, err)
+		}
+	}
+	// An idle connection is closed.
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	waitClosed(t, br)
+	if d := time.Since(start); d < 800*time.Millisecond {
+		t.Fatal("connection closed after", d, "while it was active")
+	}
+
+	// Sending more than the maximum closes the connection.
+	c2, br2 := dialWS(t, addr)
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(c2, strings.Repeat("x", 200))
+	got := waitClosed(t, br2)
+	if len(got) > 100 {
+		t.Fatal("received", len(got), "bytes, expected at most 100")
+	}
+}
+
+// waitClosed reads until the connection is closed and returns what was read.
+// A reset connection is also closed, but timing out is an error.
+func waitClosed(t *testing.T, r io.Reader) []byte {
+	b, err := ioutil.ReadAll(r)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("expected connection to be closed by proxy, got", err)
+	}
+	return b
+}
+
+// Test that websocket upgrades can use a separate load balancer type.
+func TestProxyWebSocketBalancer(t *testing.T) {
+	conf := valid_config
+	conf.LoadBalancing.Type = "roundrobin"
+	conf.LoadBalancing.WebSocketType = "leastconn"
+	bec := conf.Backend
+	bec.DisableHealth = true
+	var bes []*mockBackend
+	for i := 0; i < 2; i++ {
+		ln := newWSBackend(t)
+		defer ln.Close()
+		bes = append(bes, &mockBackend{backend: newBackend(bec, ln.Addr().String(), ""), n: i})
+	}
+	lb, err := NewLoadBalancer(conf.LoadBalancing, NewInventory([]Backend{bes[0], bes[1]}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	ts := httptest.NewServer(NewReverseProxyConfig(conf, lb))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	// Make the first backend busy.
+	const busy = 5
+	atomic.StoreInt64(&bes[0].rt.running, busy)
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, _ := dialWS(t, addr)
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	if n := bes[1].Connections(); n != len(conns) {
+		t.Fatalf("expected %d websockets on the least loaded backend, got %d", len(conns), n)
+	}
+	if n := bes[0].Connections(); n != busy {
+		t.Fatalf("expected no websockets on the busy backend, got %d", n-busy)
+	}
+
+	// Closed websockets should no longer be counted.
+	for _, c := range conns {
+		c.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for bes[1].Connections() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("websocket connections were not released, got", bes[1].Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test that websocket upgrades above 'max-connections' are rejected.
+func TestProxyWebSocketMaxConns(t *testing.T) {
+	ln := newWSBackend(t)
+	defer ln.Close()
+
+	conf := valid_config
+	conf.WebSocket = WebSocketConfig{MaxConns: 2}
+	bec := conf.Backend
+	bec.DisableHealth = true
+	be := &mockBackend{backend: newBackend(bec, ln.Addr().String(), "")}
+	lb, err := NewLoadBalancer(conf.LoadBalancing, NewInventory([]Backend{be}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	ts := httptest.NewServer(NewReverseProxyConfig(conf, lb))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	// upgrade returns the status of an upgrade request.
+	upgrade := func() (int, net.Conn) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(c, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, c
+	}
+
+	c1, _ := dialWS(t, addr)
+	c2, _ := dialWS(t, addr)
+	defer c2.Close()
+	code, c3 := upgrade()
+	c3.Close()
+	if code != http.StatusServiceUnavailable {
+		t.Fatal("expected upgrade above the limit to return 503, got", code)
+	}
+
+	// Closing a connection makes room for a new one.
+	c1.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, c := upgrade()
+		if code == http.StatusSwitchingProtocols {
+			c.Close()
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("upgrade still rejected after closing a connection, got", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test that failed websocket dials are retried.
+func TestProxyWebSocketDialRetry(t *testing.T) {
+	ln := newWSBackend(t)
+	defer ln.Close()
+
+	// Refuse the first connection attempt.
+	var dials int32
+	defer func(d func(network, address string, timeout time.Duration) (net.Conn, error)) { wsDial = d }(wsDial)
+	wsDial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+
+	conf := valid_config
+	conf.WebSocket = WebSocketConfig{DialAttempts: 2, DialBackoff: Duration(time.Millisecond)}
+	bec := conf.Backend
+	bec.DisableHealth = true
+	be := &mockBackend{backend: newBackend(bec, ln.Addr().String(), "")}
+	lb, err := NewLoadBalancer(conf.LoadBalancing, NewInventory([]Backend{be}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	proxy := NewReverseProxyConfig(conf, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	c, br := dialWS(t, addr)
+	defer c.Close()
+	fmt.Fprint(c, "hello\n")
+	line, err := br.ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("expected echo, got %q, %v", line, err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatal("expected 2 dials, got", n)
+	}
+	// The retry is counted on the backend. It is not a failover.
+	st := proxy.Status()
+	if st.Retries != 1 || st.Failovers != 0 || st.Backends[0].Retries != 1 {
+		t.Fatalf("expected 1 retry and no failovers, got %d retries, %d failovers, %d on backend", st.Retries, st.Failovers, st.Backends[0].Retries)
+	}
+
+	// Without retries the upgrade fails.
+	atomic.StoreInt32(&dials, 0)
+	conf.WebSocket.DialAttempts = 1
+	proxy.SetConfig(conf)
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	fmt.Fprint(c2, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(c2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("expected 503, got", res.StatusCode)
+	}
+}
+
+// Test that websockets to HTTPS backends are sent with TLS.
+func TestProxyWebSocketTLS(t *testing.T) {
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		fmt.Fprint(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(c, brw)
+	}))
+	defer secure.Close()
+	u, err := url.Parse(secure.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	d := Droplet{ID: 1, PrivateIP: u.Hostname(), ServerHost: u.Host, Scheme: "https"}
+	be, err := newInventoryBackend(d, bec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Trust the certificate of the test server.
+	tr := be.(*DropletBackend).rt.rt.(*http.Transport)
+	tr.TLSClientConfig = secure.Client().Transport.(*http.Transport).TLSClientConfig
+	lb, err := NewLoadBalancer(valid_config.LoadBalancing, NewInventory([]Backend{be}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	ts := httptest.NewServer(NewReverseProxyConfig(valid_config, lb))
+	defer ts.Close()
+
+	c, br := dialWS(t, strings.TrimPrefix(ts.URL, "http://"))
+	defer c.Close()
+	fmt.Fprint(c, "hello\n")
+	line, err := br.ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("expected echo, got %q, %v", line, err)
+	}
+}
+
+// Test that websockets are connected with the dial timeout of the droplet.
+func TestWebSocketDialTimeout(t *testing.T) {
+	ln := newWSBackend(t)
+	defer ln.Close()
+	var got time.Duration
+	defer func(d func(network, address string, timeout time.Duration) (net.Conn, error)) { wsDial = d }(wsDial)
+	wsDial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		got = timeout
+		return net.DialTimeout(network, address, timeout)
+	}
+
+	bec := valid_config.Backend
+	bec.DisableHealth = true
+	bec.DialTimeout = Duration(2 * time.Second)
+	for _, d := range []Droplet{
+		{ID: 1, ServerHost: ln.Addr().String()},
+		{ID: 2, ServerHost: ln.Addr().String(), DialTimeout: Duration(5 * time.Second)},
+	} {
+		be := NewDropletBackend(d, bec)
+		c, err := dialBackend(be)
+		be.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		want := time.Duration(bec.DialTimeout)
+		if d.DialTimeout > 0 {
+			want = time.Duration(d.DialTimeout)
+		}
+		if got != want {
+			t.Errorf("droplet %d: expected dial timeout %v, got %v", d.ID, want, got)
+		}
+	}
+}
+
+// Test that failed websocket dials are retried on another backend.
+func TestProxyWebSocketDialFailover(t *testing.T) {
+	ln := newWSBackend(t)
+	defer ln.Close()
+	// Nothing listens on the address of the failing backend.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	conf := valid_config
+	conf.WebSocket = WebSocketConfig{DialAttempts: 3, DialBackoff: Duration(time.Millisecond)}
+	conf.LoadBalancing.StickyCookie = "DOPROXY_BE"
+	bec := conf.Backend
+	bec.DisableHealth = true
+	failing := &mockBackend{backend: newBackend(bec, closed.Addr().String(), ""), n: 0}
+	working := &mockBackend{backend: newBackend(bec, ln.Addr().String(), ""), n: 1}
+	lb, err := NewLoadBalancer(conf.LoadBalancing, NewInventory([]Backend{failing, working}, bec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	proxy := NewReverseProxyConfig(conf, lb)
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nCookie: DOPROXY_BE=%s\r\n\r\n", failing.ID())
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("unexpected status code", res.StatusCode)
+	}
+	fmt.Fprint(c, "hello\n")
+	line, err := br.ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("expected echo, got %q, %v", line, err)
+	}
+	st := proxy.Status()
+	if st.Retries != 1 || st.Failovers != 1 {
+		t.Fatalf("expected 1 retry on another backend, got %d retries, %d failovers", st.Retries, st.Failovers)
+	}
+}